@@ -118,9 +118,16 @@ func main() {
 	// Orchestrator routes
 	r.PathPrefix("/orchestrator").HandlerFunc(gateway.proxyOrchestrator)
 	r.Path("/refunds").Methods("POST").HandlerFunc(gateway.createRefundAlias)
+	r.Path("/transactions").HandlerFunc(gateway.proxyOrchestrator)
 	r.Path("/stats/transactions").HandlerFunc(gateway.proxyOrchestrator)
 	r.Path("/stats/processors").HandlerFunc(gateway.proxyOrchestrator)
 	r.Path("/admin/stats").HandlerFunc(gateway.proxyOrchestrator)
+	r.PathPrefix("/webhooks").HandlerFunc(gateway.proxyOrchestrator)
+	r.Path("/events").HandlerFunc(gateway.proxyOrchestrator)
+	r.PathPrefix("/disputes").HandlerFunc(gateway.proxyOrchestrator)
+	r.PathPrefix("/reconciliation").HandlerFunc(gateway.proxyOrchestrator)
+	r.PathPrefix("/audit").HandlerFunc(gateway.proxyOrchestrator)
+	r.PathPrefix("/payment-methods").HandlerFunc(gateway.proxyOrchestrator)
 	r.PathPrefix("/ws").HandlerFunc(gateway.proxyWebsocket)
 
 	// BPAS routes
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/fees"
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+// costCandidate is a processor a cost_optimized rule may pick
+type costCandidate struct {
+	Processor   string
+	Estimate    fees.Estimate
+	SuccessRate *float64 // Nil when the orchestrator sent no rate
+}
+
+// loadFeeSchedules reads processor pricing used by cost-optimized routing.
+// Fixed fees in another currency are converted at mid-market rates.
+func (b *BPASService) loadFeeSchedules() {
+	rates := fx.NewService(0)
+	if err := rates.LoadFile(filepath.Join(b.configPath, "fx-rates.yaml")); err != nil {
+		log.Printf("Warning: %v, fixed fees can only be estimated in their own currency", err)
+	}
+
+	table, err := fees.LoadFile(filepath.Join(b.configPath, "fee-schedules.yaml"), rates.ConvertMid)
+	if err != nil {
+		log.Printf("Warning: %v, cost-optimized rules will not match", err)
+		table = nil
+	}
+
+	b.mu.Lock()
+	b.fees = table
+	b.mu.Unlock()
+
+	if table != nil {
+		log.Printf("Loaded fee schedules for %d processors", len(table.Schedules()))
+	}
+}
+
+// feePayment describes the request for fee estimation
+func feePayment(req *EvaluationRequest) (fees.Payment, error) {
+	amount, err := money.Resolve(req.AmountMinor, req.Amount, req.Currency)
+	if err != nil {
+		return fees.Payment{}, err
+	}
+	return fees.Payment{Amount: amount, CardBrand: req.CardBrand, CardCountry: req.CardCountry}, nil
+}
+
+// effectiveBps is the fee as a share of the amount, in basis points
+func effectiveBps(e fees.Estimate, amount money.Money) float64 {
+	if amount.Amount <= 0 {
+		return float64(e.BasisPoints)
+	}
+	return float64(e.Fee.Amount) * 10000 / float64(amount.Amount)
+}
+
+// estimateAll estimates the fee on every configured processor with a
+// schedule, in processor priority order. Callers hold b.mu.
+func (b *BPASService) estimateAll(req *EvaluationRequest) (map[string]fees.Estimate, fees.Payment) {
+	estimates := make(map[string]fees.Estimate)
+	payment, err := feePayment(req)
+	if err != nil || b.fees == nil {
+		return estimates, payment
+	}
+
+	for _, p := range b.processors {
+		estimate, err := b.fees.Estimate(p.Name, payment)
+		if err != nil {
+			log.Printf("Cannot estimate %s fee for %s: %v", p.Name, payment.Amount, err)
+			continue
+		}
+		estimates[p.Name] = estimate
+	}
+	return estimates, payment
+}
+
+// rankByCost returns the processors a cost_optimized rule may pick,
+// cheapest first. A processor qualifies if it has a fee schedule, its
+// approval rate meets the rule's threshold and its fee is within the rule's
+// cap; condition_value.processors restricts the candidates. When the rule
+// sets a threshold, a processor the orchestrator sent no rate for has not
+// shown it meets it and is left out. Ties keep processor priority order.
+// Callers hold b.mu.
+func (b *BPASService) rankByCost(req *EvaluationRequest, rule *RoutingRule) []costCandidate {
+	allowed := make(map[string]bool)
+	if list, ok := rule.ConditionValue["processors"].([]interface{}); ok {
+		for _, p := range list {
+			if name, ok := p.(string); ok {
+				allowed[name] = true
+			}
+		}
+	}
+
+	estimates, payment := b.estimateAll(req)
+	candidates := []costCandidate{}
+	for _, p := range b.processors {
+		if len(allowed) > 0 && !allowed[p.Name] {
+			continue
+		}
+		estimate, ok := estimates[p.Name]
+		if !ok {
+			continue
+		}
+		if rule.FeeBasisPoints > 0 && effectiveBps(estimate, payment.Amount) > float64(rule.FeeBasisPoints) {
+			continue
+		}
+
+		candidate := costCandidate{Processor: p.Name, Estimate: estimate}
+		rate, measured := req.ProcessorSuccessRates[p.Name]
+		if rule.SuccessRateThreshold > 0 && (!measured || rate < rule.SuccessRateThreshold) {
+			continue
+		}
+		if measured {
+			candidate.SuccessRate = &rate
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Estimate.Fee.Amount < candidates[j].Estimate.Fee.Amount
+	})
+	return candidates
+}
+
+// withinFeeCap reports whether a processor's fee for the request is at or
+// below capBps. An unknown fee never is. Callers hold b.mu.
+func (b *BPASService) withinFeeCap(req *EvaluationRequest, processorName string, capBps int) bool {
+	estimates, payment := b.estimateAll(req)
+	estimate, ok := estimates[processorName]
+	return ok && effectiveBps(estimate, payment.Amount) <= float64(capBps)
+}
+
+// getCostAlternatives orders the fallback processors for a cost_optimized
+// rule: other qualifying processors cheapest first, then the rest in
+// priority order
+func (b *BPASService) getCostAlternatives(req *EvaluationRequest, rule *RoutingRule, selectedProcessor string) []Alternative {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	alternatives := []Alternative{}
+	ranked := make(map[string]bool)
+	for _, c := range b.rankByCost(req, rule) {
+		ranked[c.Processor] = true
+		if c.Processor == selectedProcessor {
+			continue
+		}
+		alternatives = append(alternatives, Alternative{
+			Processor: c.Processor,
+			Weight:    1,
+			Reason:    fmt.Sprintf("Expected fee %s", c.Estimate.Fee),
+		})
+	}
+
+	for _, p := range b.processors {
+		if p.Name == selectedProcessor || ranked[p.Name] {
+			continue
+		}
+		alternatives = append(alternatives, Alternative{
+			Processor: p.Name,
+			Weight:    p.Weight,
+			Reason:    "Does not meet the rule's cost or success rate requirements",
+		})
+	}
+	return alternatives
+}
+
+// expectedFees returns the fee estimate for each processor in chain that has a schedule
+func (b *BPASService) expectedFees(req *EvaluationRequest, chain []string) []fees.Estimate {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	estimates, _ := b.estimateAll(req)
+	expected := []fees.Estimate{}
+	for _, name := range chain {
+		if estimate, ok := estimates[name]; ok {
+			expected = append(expected, estimate)
+		}
+	}
+	return expected
+}
+
+// getFeeSchedules returns the loaded fee schedules
+func (b *BPASService) getFeeSchedules(w http.ResponseWriter, r *http.Request) {
+	b.mu.RLock()
+	table := b.fees
+	b.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if table == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "No fee schedules loaded",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"merchant_country": table.MerchantCountry(),
+		"schedules":        table.Schedules(),
+		"timestamp":        time.Now(),
+	})
+}
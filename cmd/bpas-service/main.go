@@ -11,16 +11,22 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"gopkg.in/yaml.v2"
+
+	"github.com/AnuragDani/subscription-platform/internal/fees"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
 )
 
 type BPASService struct {
 	mu           sync.RWMutex
 	rules        []RoutingRule
+	processors   []*processor.ProcessorConfig
+	fees         *fees.Table // Nil when no fee schedules are loaded
 	configPath   string
 	lastModified time.Time
 	stats        BPASStats
@@ -46,6 +52,11 @@ type RoutingRule struct {
 	Description     string                 `yaml:"description,omitempty" json:"description,omitempty"`
 	CreatedAt       time.Time              `yaml:"created_at,omitempty" json:"created_at,omitempty"`
 	UpdatedAt       time.Time              `yaml:"updated_at,omitempty" json:"updated_at,omitempty"`
+
+	// Minimum approval rate, in percent, a processor needs to be picked by a cost_optimized rule
+	SuccessRateThreshold float64 `yaml:"success_rate_threshold,omitempty" json:"success_rate_threshold,omitempty"`
+	// Highest effective fee the rule accepts; processors costing more are skipped. Zero means no cap.
+	FeeBasisPoints int `yaml:"fee_basis_points,omitempty" json:"fee_basis_points,omitempty"`
 }
 
 type RoutingConfig struct {
@@ -62,6 +73,15 @@ type EvaluationRequest struct {
 	UserTier    string  `json:"user_tier,omitempty"`
 	UserID      string  `json:"user_id,omitempty"`
 	ClientID    string  `json:"client_id,omitempty"`
+
+	// Used to estimate processor fees
+	AmountMinor int64  `json:"amount_minor,omitempty"` // Derived from Amount when zero
+	CardBrand   string `json:"card_brand,omitempty"`
+	CardCountry string `json:"card_country,omitempty"`
+
+	// Recent approval rate of each processor in percent, as measured by the
+	// orchestrator. Processors without a rate are assumed to meet thresholds.
+	ProcessorSuccessRates map[string]float64 `json:"processor_success_rates,omitempty"`
 }
 
 type EvaluationResponse struct {
@@ -71,8 +91,16 @@ type EvaluationResponse struct {
 	RulePriority    int           `json:"rule_priority"`
 	Confidence      float64       `json:"confidence"`
 	Alternatives    []Alternative `json:"alternatives,omitempty"`
+	FallbackChain   []string      `json:"fallback_chain"`
 	EvaluationTime  float64       `json:"evaluation_time_ms"`
 	ErrorMessage    string        `json:"error_message,omitempty"`
+
+	// Expected fee on each processor in the fallback chain that has a schedule
+	ExpectedFees []fees.Estimate `json:"expected_fees,omitempty"`
+
+	// Set when a three_ds rule requires strong customer authentication
+	ThreeDSRequired bool   `json:"three_ds_required,omitempty"`
+	ThreeDSRule     string `json:"three_ds_rule,omitempty"`
 }
 
 type Alternative struct {
@@ -106,6 +134,9 @@ func NewBPASService(configPath string) *BPASService {
 }
 
 func (b *BPASService) loadConfig() error {
+	b.loadProcessors()
+	b.loadFeeSchedules()
+
 	configFile := filepath.Join(b.configPath, "routing-rules.yaml")
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -134,6 +165,24 @@ func (b *BPASService) loadConfig() error {
 	return nil
 }
 
+// loadProcessors reads the acquirers used to build fallback chains
+func (b *BPASService) loadProcessors() {
+	processors, err := processor.LoadProcessorConfigs(filepath.Join(b.configPath, "processors.yaml"))
+	if err != nil {
+		log.Printf("Warning: %v, using default processors", err)
+		processors = []*processor.ProcessorConfig{
+			{Name: "processor_a", Priority: 1, Weight: 0.7, Description: "Primary processor with faster response time"},
+			{Name: "processor_b", Priority: 2, Weight: 0.3, Description: "Secondary processor with multi-currency support"},
+		}
+	}
+
+	b.mu.Lock()
+	b.processors = processors
+	b.mu.Unlock()
+
+	log.Printf("Loaded %d processors for fallback chains", len(processors))
+}
+
 func (b *BPASService) loadDefaultConfig() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -213,6 +262,7 @@ func (b *BPASService) evaluateRouting(w http.ResponseWriter, r *http.Request) {
 	if req.Currency == "" {
 		req.Currency = "USD" // Default currency
 	}
+	req.Currency = strings.ToUpper(req.Currency)
 
 	b.mu.Lock()
 	b.stats.TotalEvaluations++
@@ -220,12 +270,16 @@ func (b *BPASService) evaluateRouting(w http.ResponseWriter, r *http.Request) {
 
 	// Evaluate routing rules
 	processor, rule, confidence := b.evaluateRules(&req)
+	threeDSRule := b.threeDSRule(&req)
 
 	// Record statistics
 	b.mu.Lock()
 	if rule != nil {
 		b.stats.RuleHits[rule.Name]++
 	}
+	if threeDSRule != nil {
+		b.stats.RuleHits[threeDSRule.Name]++
+	}
 	b.stats.ProcessorDistribution[processor]++
 
 	// Update average evaluation time
@@ -250,8 +304,22 @@ func (b *BPASService) evaluateRouting(w http.ResponseWriter, r *http.Request) {
 		response.RulePriority = rule.Priority
 	}
 
-	// Add alternatives for transparency
-	response.Alternatives = b.getAlternatives(&req, processor)
+	// Add alternatives, in the order the orchestrator should fall back through them
+	if rule != nil && rule.ConditionType == "cost_optimized" {
+		response.Alternatives = b.getCostAlternatives(&req, rule, processor)
+	} else {
+		response.Alternatives = b.getAlternatives(&req, processor)
+	}
+	response.FallbackChain = []string{processor}
+	for _, alt := range response.Alternatives {
+		response.FallbackChain = append(response.FallbackChain, alt.Processor)
+	}
+	response.ExpectedFees = b.expectedFees(&req, response.FallbackChain)
+
+	if threeDSRule != nil {
+		response.ThreeDSRequired = true
+		response.ThreeDSRule = threeDSRule.Name
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -268,6 +336,19 @@ func (b *BPASService) evaluateRules(req *EvaluationRequest) (string, *RoutingRul
 		}
 
 		if b.matchesRule(req, &rule) {
+			// Cost-optimized rules pick the cheapest processor that qualifies
+			if rule.ConditionType == "cost_optimized" {
+				if ranked := b.rankByCost(req, &rule); len(ranked) > 0 {
+					return ranked[0].Processor, &rule, b.calculateConfidence(&rule, req)
+				}
+				continue // No processor qualifies
+			}
+
+			// Rules with a fee cap don't route to a processor costing more
+			if rule.FeeBasisPoints > 0 && !b.withinFeeCap(req, rule.TargetProcessor, rule.FeeBasisPoints) {
+				continue
+			}
+
 			// For percentage-based rules, apply the percentage check
 			if rule.ConditionType == "percentage" {
 				if rand.Intn(100) < rule.Percentage {
@@ -300,6 +381,10 @@ func (b *BPASService) matchesRule(req *EvaluationRequest, rule *RoutingRule) boo
 		return true // Always matches, but percentage is applied in evaluateRules
 	case "client_id":
 		return b.matchesClientID(req, rule)
+	case "cost_optimized":
+		return true // Always matches; the processor is picked in evaluateRules
+	case "three_ds":
+		return false // Requires authentication rather than routing; see threeDSRule
 	default:
 		return false
 	}
@@ -400,27 +485,26 @@ func (b *BPASService) calculateConfidence(rule *RoutingRule, req *EvaluationRequ
 		confidence = 0.7
 	} else if rule.ConditionType == "percentage" {
 		confidence = 0.6
+	} else if rule.ConditionType == "cost_optimized" {
+		confidence = 0.8
 	}
 
 	return confidence
 }
 
 func (b *BPASService) getAlternatives(req *EvaluationRequest, selectedProcessor string) []Alternative {
-	alternatives := []Alternative{}
-
-	if selectedProcessor != "processor_a" {
-		alternatives = append(alternatives, Alternative{
-			Processor: "processor_a",
-			Weight:    0.7,
-			Reason:    "Primary processor with faster response time",
-		})
-	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	if selectedProcessor != "processor_b" {
+	alternatives := []Alternative{}
+	for _, p := range b.processors {
+		if p.Name == selectedProcessor {
+			continue
+		}
 		alternatives = append(alternatives, Alternative{
-			Processor: "processor_b",
-			Weight:    0.3,
-			Reason:    "Secondary processor with multi-currency support",
+			Processor: p.Name,
+			Weight:    p.Weight,
+			Reason:    p.Description,
 		})
 	}
 
@@ -551,7 +635,7 @@ func (b *BPASService) health(w http.ResponseWriter, r *http.Request) {
 		"version":            "1.0.0",
 		"rules_loaded":       rulesCount,
 		"last_config_reload": lastReload,
-		"capabilities":       []string{"dynamic_routing", "rule_evaluation", "config_reload", "percentage_splits"},
+		"capabilities":       []string{"dynamic_routing", "rule_evaluation", "config_reload", "percentage_splits", "cost_optimized_routing", "three_ds_rules"},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -612,6 +696,7 @@ func main() {
 	r.HandleFunc("/bpas/rules", service.getRules).Methods("GET")
 	r.HandleFunc("/bpas/rules/{name}", service.updateRule).Methods("PUT")
 	r.HandleFunc("/bpas/reload", service.reloadConfig).Methods("POST")
+	r.HandleFunc("/bpas/fees", service.getFeeSchedules).Methods("GET")
 
 	// Testing endpoints
 	r.HandleFunc("/bpas/test", service.testRule).Methods("GET")
@@ -641,6 +726,7 @@ func main() {
 	log.Println("   PUT /bpas/rules/{name}")
 	log.Println("   POST /bpas/reload")
 	log.Println("   GET /bpas/test?amount=1000&currency=EUR")
+	log.Println("   GET /bpas/fees")
 
 	log.Fatal(http.ListenAndServe(":8003", r))
 }
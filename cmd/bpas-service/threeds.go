@@ -0,0 +1,44 @@
+package main
+
+import "strings"
+
+// threeDSRule returns the first active three_ds rule matching the payment,
+// or nil when no rule requires 3-D Secure. A three_ds rule's condition_value
+// may set currencies, card_countries and an amount with an operator; every
+// condition it sets must match.
+func (b *BPASService) threeDSRule(req *EvaluationRequest) *RoutingRule {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for i := range b.rules {
+		rule := b.rules[i]
+		if !rule.IsActive || rule.ConditionType != "three_ds" {
+			continue
+		}
+		if _, ok := rule.ConditionValue["currencies"]; ok && !b.matchesCurrency(req, &rule) {
+			continue
+		}
+		if _, ok := rule.ConditionValue["amount"]; ok && !b.matchesAmountThreshold(req, &rule) {
+			continue
+		}
+		if _, ok := rule.ConditionValue["card_countries"]; ok && !matchesCardCountry(req, &rule) {
+			continue
+		}
+		return &rule
+	}
+	return nil
+}
+
+func matchesCardCountry(req *EvaluationRequest, rule *RoutingRule) bool {
+	countries, ok := rule.ConditionValue["card_countries"].([]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, country := range countries {
+		if countryStr, ok := country.(string); ok && strings.EqualFold(countryStr, req.CardCountry) {
+			return true
+		}
+	}
+	return false
+}
@@ -8,15 +8,26 @@ import (
 
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
+
+	"github.com/AnuragDani/subscription-platform/internal/vault"
 )
 
+// querier is satisfied by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // DB wraps the database connection
 type DB struct {
-	conn *sql.DB
+	conn   *sql.DB
+	q      querier      // conn, or the transaction inside InTx
+	tokens *vault.Vault // Encrypts payment method tokens
 }
 
 // NewDB creates a new database connection
-func NewDB(connectionString string) (*DB, error) {
+func NewDB(connectionString string, tokenVault *vault.Vault) (*DB, error) {
 	conn, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, err
@@ -31,7 +42,22 @@ func NewDB(connectionString string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, q: conn, tokens: tokenVault}, nil
+}
+
+// InTx runs fn against a DB whose queries share one transaction, committing
+// only if fn succeeds
+func (db *DB) InTx(ctx context.Context, fn func(tx *DB) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&DB{conn: db.conn, q: tx, tokens: db.tokens}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Close closes the database connection
@@ -47,7 +73,7 @@ func (db *DB) Ping() error {
 // GetSubscriptionsDue retrieves subscriptions due for billing
 func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscription, error) {
 	query := `
-		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount, currency,
+		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount_minor, currency,
 			   billing_cycle, current_period_start, current_period_end,
 			   next_billing_date, cancel_at_period_end, canceled_at,
 			   trial_start, trial_end, created_at, updated_at
@@ -58,7 +84,7 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 		ORDER BY next_billing_date ASC
 		LIMIT $1`
 
-	rows, err := db.conn.QueryContext(ctx, query, limit)
+	rows, err := db.q.QueryContext(ctx, query, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get due subscriptions: %w", err)
 	}
@@ -68,10 +94,9 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 	for rows.Next() {
 		var s Subscription
 		var paymentMethodID string
-		var amount float64
 
 		err := rows.Scan(
-			&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &amount, &s.Currency,
+			&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &s.Amount, &s.Currency,
 			&s.BillingCycle, &s.CurrentPeriodStart, &s.CurrentPeriodEnd,
 			&s.NextBillingDate, &s.CancelAtPeriodEnd, &s.CanceledAt,
 			&s.TrialStart, &s.TrialEnd, &s.CreatedAt, &s.UpdatedAt,
@@ -83,8 +108,6 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 		if paymentMethodID != "" {
 			s.PaymentMethodID = paymentMethodID
 		}
-
-		s.Amount = int64(amount * 100)
 		subscriptions = append(subscriptions, s)
 	}
 
@@ -107,7 +130,7 @@ func (db *DB) CreateJob(ctx context.Context, subscriptionID, jobType string, sch
 		INSERT INTO scheduler_jobs (id, subscription_id, type, status, attempt, scheduled_at, created_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	_, err := db.conn.ExecContext(ctx, query,
+	_, err := db.q.ExecContext(ctx, query,
 		job.ID, job.SubscriptionID, job.Type, job.Status, job.Attempt, job.ScheduledAt, job.CreatedAt,
 	)
 
@@ -139,7 +162,7 @@ func (db *DB) UpdateJobStatus(ctx context.Context, jobID string, status string,
 		args = []interface{}{status, now, jobID}
 	}
 
-	_, err := db.conn.ExecContext(ctx, query, args...)
+	_, err := db.q.ExecContext(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("failed to update job status: %w", err)
 	}
@@ -157,7 +180,7 @@ func (db *DB) GetJob(ctx context.Context, id string) (*Job, error) {
 		FROM scheduler_jobs WHERE id = $1`
 
 	var job Job
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
+	err := db.q.QueryRowContext(ctx, query, id).Scan(
 		&job.ID, &job.SubscriptionID, &job.Type, &job.Status, &job.Attempt,
 		&job.TransactionID, &job.ProcessorUsed, &job.ErrorCode, &job.ErrorMessage,
 		&job.ScheduledAt, &job.StartedAt, &job.CompletedAt, &job.CreatedAt,
@@ -184,7 +207,7 @@ func (db *DB) ListJobs(ctx context.Context, limit int) ([]Job, error) {
 		ORDER BY created_at DESC
 		LIMIT $1`
 
-	rows, err := db.conn.QueryContext(ctx, query, limit)
+	rows, err := db.q.QueryContext(ctx, query, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list jobs: %w", err)
 	}
@@ -210,7 +233,7 @@ func (db *DB) ListJobs(ctx context.Context, limit int) ([]Job, error) {
 // GetJobCount returns the total number of jobs
 func (db *DB) GetJobCount(ctx context.Context) (int, error) {
 	var count int
-	err := db.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM scheduler_jobs").Scan(&count)
+	err := db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM scheduler_jobs").Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("failed to count jobs: %w", err)
 	}
@@ -243,7 +266,7 @@ func (db *DB) EnsureJobsTableExists(ctx context.Context) error {
 		CREATE INDEX IF NOT EXISTS idx_scheduler_jobs_scheduled_at ON scheduler_jobs(scheduled_at);
 	`
 
-	_, err := db.conn.ExecContext(ctx, query)
+	_, err := db.q.ExecContext(ctx, query)
 	if err != nil {
 		return fmt.Errorf("failed to create scheduler_jobs table: %w", err)
 	}
@@ -1,28 +1,31 @@
 package main
 
 import (
+	"context"
+
 	"github.com/AnuragDani/subscription-platform/internal/events"
 )
 
-// EventPublisher wraps the events publisher for scheduler-specific events
+// EventPublisher records scheduler events in the outbox. Pass the
+// transaction that updates the job or retry so the event commits with it.
 type EventPublisher struct {
-	publisher *events.Publisher
+	outbox *events.Outbox
 }
 
 // NewEventPublisher creates a new event publisher
-func NewEventPublisher(orchestratorURL string) *EventPublisher {
+func NewEventPublisher() *EventPublisher {
 	return &EventPublisher{
-		publisher: events.NewPublisher(orchestratorURL),
+		outbox: events.NewOutbox("mit-scheduler"),
 	}
 }
 
 // EmitJobStarted emits a job started event
-func (e *EventPublisher) EmitJobStarted(job *Job) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitJobStarted(ctx context.Context, ex events.Execer, job *Job) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
-	e.publisher.PublishJobStarted(events.SchedulerEventData{
+	return e.outbox.Write(ctx, ex, events.TypeScheduler, events.SchedulerJobStarted, events.SchedulerEventData{
 		JobID:          job.ID,
 		SubscriptionID: job.SubscriptionID,
 		Type:           job.Type,
@@ -32,9 +35,9 @@ func (e *EventPublisher) EmitJobStarted(job *Job) {
 }
 
 // EmitJobCompleted emits a job completed event
-func (e *EventPublisher) EmitJobCompleted(job *Job, success bool) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitJobCompleted(ctx context.Context, ex events.Execer, job *Job, success bool) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
 	status := "completed"
@@ -42,7 +45,7 @@ func (e *EventPublisher) EmitJobCompleted(job *Job, success bool) {
 		status = "failed"
 	}
 
-	e.publisher.PublishJobCompleted(events.SchedulerEventData{
+	return e.outbox.Write(ctx, ex, events.TypeScheduler, events.SchedulerJobCompleted, events.SchedulerEventData{
 		JobID:          job.ID,
 		SubscriptionID: job.SubscriptionID,
 		Type:           job.Type,
@@ -56,9 +59,9 @@ func (e *EventPublisher) EmitJobCompleted(job *Job, success bool) {
 }
 
 // EmitRetryScheduled emits a retry scheduled event
-func (e *EventPublisher) EmitRetryScheduled(entry *RetryEntry) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitRetryScheduled(ctx context.Context, ex events.Execer, entry *RetryEntry) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
 	nextRetry := ""
@@ -66,7 +69,7 @@ func (e *EventPublisher) EmitRetryScheduled(entry *RetryEntry) {
 		nextRetry = entry.NextRetryAt.Format("2006-01-02T15:04:05Z")
 	}
 
-	e.publisher.PublishRetryScheduled(events.SchedulerEventData{
+	return e.outbox.Write(ctx, ex, events.TypeScheduler, events.SchedulerRetryScheduled, events.SchedulerEventData{
 		JobID:          entry.ID,
 		SubscriptionID: entry.SubscriptionID,
 		Type:           "retry",
@@ -80,12 +83,12 @@ func (e *EventPublisher) EmitRetryScheduled(entry *RetryEntry) {
 }
 
 // EmitRetryFailed emits a retry failed event
-func (e *EventPublisher) EmitRetryFailed(entry *RetryEntry) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitRetryFailed(ctx context.Context, ex events.Execer, entry *RetryEntry) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
-	e.publisher.PublishRetryFailed(events.SchedulerEventData{
+	return e.outbox.Write(ctx, ex, events.TypeScheduler, events.SchedulerRetryFailed, events.SchedulerEventData{
 		JobID:          entry.ID,
 		SubscriptionID: entry.SubscriptionID,
 		Type:           "retry",
@@ -98,12 +101,12 @@ func (e *EventPublisher) EmitRetryFailed(entry *RetryEntry) {
 }
 
 // EmitRetrySucceeded emits a retry succeeded event
-func (e *EventPublisher) EmitRetrySucceeded(entry *RetryEntry) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitRetrySucceeded(ctx context.Context, ex events.Execer, entry *RetryEntry) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
-	e.publisher.PublishRetrySucceeded(events.SchedulerEventData{
+	return e.outbox.Write(ctx, ex, events.TypeScheduler, events.SchedulerRetrySucceeded, events.SchedulerEventData{
 		JobID:          entry.ID,
 		SubscriptionID: entry.SubscriptionID,
 		Type:           "retry",
@@ -114,3 +117,36 @@ func (e *EventPublisher) EmitRetrySucceeded(entry *RetryEntry) {
 		ProcessorUsed:  entry.ProcessorUsed,
 	})
 }
+
+// EmitPaymentMethodRefreshed emits a payment method refreshed event
+func (e *EventPublisher) EmitPaymentMethodRefreshed(ctx context.Context, ex events.Execer, pm *ExpiringPaymentMethod, expMonth, expYear int) error {
+	if e == nil || e.outbox == nil {
+		return nil
+	}
+
+	return e.outbox.Write(ctx, ex, events.TypePaymentMethod, events.PaymentMethodRefreshed, events.PaymentMethodEventData{
+		PaymentMethodID: pm.ID,
+		UserID:          pm.UserID,
+		SubscriptionID:  pm.SubscriptionID,
+		LastFour:        pm.LastFour,
+		ExpMonth:        expMonth,
+		ExpYear:         expYear,
+	})
+}
+
+// EmitPaymentMethodUpdateRequired emits an event asking for customer outreach
+func (e *EventPublisher) EmitPaymentMethodUpdateRequired(ctx context.Context, ex events.Execer, pm *ExpiringPaymentMethod, reason string) error {
+	if e == nil || e.outbox == nil {
+		return nil
+	}
+
+	return e.outbox.Write(ctx, ex, events.TypePaymentMethod, events.PaymentMethodUpdateRequired, events.PaymentMethodEventData{
+		PaymentMethodID: pm.ID,
+		UserID:          pm.UserID,
+		SubscriptionID:  pm.SubscriptionID,
+		LastFour:        pm.LastFour,
+		ExpMonth:        pm.ExpMonth,
+		ExpYear:         pm.ExpYear,
+		Reason:          reason,
+	})
+}
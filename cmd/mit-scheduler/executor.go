@@ -9,15 +9,17 @@ import (
 // Executor handles the execution of billing jobs
 type Executor struct {
 	db                 *DB
+	events             *EventPublisher
 	subscriptionClient *SubscriptionServiceClient
 	retryPolicy        *RetryPolicy
 	logger             *log.Logger
 }
 
 // NewExecutor creates a new executor instance
-func NewExecutor(db *DB, subscriptionServiceURL string, logger *log.Logger) *Executor {
+func NewExecutor(db *DB, events *EventPublisher, subscriptionServiceURL string, logger *log.Logger) *Executor {
 	return &Executor{
 		db:                 db,
+		events:             events,
 		subscriptionClient: NewSubscriptionServiceClient(subscriptionServiceURL),
 		retryPolicy:        DefaultRetryPolicy(),
 		logger:             logger,
@@ -62,7 +64,13 @@ func (e *Executor) ExecuteCharge(ctx context.Context, job *Job, sub *Subscriptio
 // ProcessJob processes a single job
 func (e *Executor) ProcessJob(ctx context.Context, job *Job, sub *Subscription) error {
 	// Mark job as running
-	if err := e.db.UpdateJobStatus(ctx, job.ID, JobStatusRunning, nil); err != nil {
+	err := e.db.InTx(ctx, func(tx *DB) error {
+		if err := tx.UpdateJobStatus(ctx, job.ID, JobStatusRunning, nil); err != nil {
+			return err
+		}
+		return e.events.EmitJobStarted(ctx, tx.q, job)
+	})
+	if err != nil {
 		e.logger.Printf("Error marking job as running: %v", err)
 	}
 
@@ -79,7 +87,13 @@ func (e *Executor) ProcessJob(ctx context.Context, job *Job, sub *Subscription)
 		// On failure, create a retry entry
 		declineType := ClassifyError(result.ErrorCode)
 		if declineType == DeclineTypeSoft {
-			_, err := e.db.CreateRetryEntry(ctx, sub.ID, result.ErrorCode, result.ErrorMessage, declineType, e.retryPolicy)
+			err := e.db.InTx(ctx, func(tx *DB) error {
+				entry, err := tx.CreateRetryEntry(ctx, sub.ID, result.ErrorCode, result.ErrorMessage, declineType, e.retryPolicy)
+				if err != nil {
+					return err
+				}
+				return e.events.EmitRetryScheduled(ctx, tx.q, entry)
+			})
 			if err != nil {
 				e.logger.Printf("Error creating retry entry for subscription %s: %v", sub.ID, err)
 			} else {
@@ -92,7 +106,18 @@ func (e *Executor) ProcessJob(ctx context.Context, job *Job, sub *Subscription)
 		}
 	}
 
-	if err := e.db.UpdateJobStatus(ctx, job.ID, status, result); err != nil {
+	job.TransactionID = result.TransactionID
+	job.ProcessorUsed = result.ProcessorUsed
+	job.ErrorCode = result.ErrorCode
+	job.ErrorMessage = result.ErrorMessage
+
+	err = e.db.InTx(ctx, func(tx *DB) error {
+		if err := tx.UpdateJobStatus(ctx, job.ID, status, result); err != nil {
+			return err
+		}
+		return e.events.EmitJobCompleted(ctx, tx.q, job, result.Success)
+	})
+	if err != nil {
 		e.logger.Printf("Error updating job status: %v", err)
 		return err
 	}
@@ -119,7 +144,9 @@ func (e *Executor) ProcessRetry(ctx context.Context, entry *RetryEntry) (*Charge
 			ErrorCode:    "SUBSCRIPTION_ERROR",
 			ErrorMessage: err.Error(),
 		}
-		e.db.UpdateRetryAfterAttempt(ctx, entry.ID, false, result, e.retryPolicy)
+		if err := e.recordRetryAttempt(ctx, entry.ID, result); err != nil {
+			e.logger.Printf("Error updating retry after attempt: %v", err)
+		}
 		return result, err
 	}
 
@@ -132,7 +159,9 @@ func (e *Executor) ProcessRetry(ctx context.Context, entry *RetryEntry) (*Charge
 			ErrorCode:    "CHARGE_ERROR",
 			ErrorMessage: err.Error(),
 		}
-		e.db.UpdateRetryAfterAttempt(ctx, entry.ID, false, result, e.retryPolicy)
+		if err := e.recordRetryAttempt(ctx, entry.ID, result); err != nil {
+			e.logger.Printf("Error updating retry after attempt: %v", err)
+		}
 		return result, nil
 	}
 
@@ -145,7 +174,7 @@ func (e *Executor) ProcessRetry(ctx context.Context, entry *RetryEntry) (*Charge
 	}
 
 	// Update retry entry
-	if err := e.db.UpdateRetryAfterAttempt(ctx, entry.ID, result.Success, result, e.retryPolicy); err != nil {
+	if err := e.recordRetryAttempt(ctx, entry.ID, result); err != nil {
 		e.logger.Printf("Error updating retry after attempt: %v", err)
 	}
 
@@ -163,6 +192,30 @@ func (e *Executor) ProcessRetry(ctx context.Context, entry *RetryEntry) (*Charge
 	return result, nil
 }
 
+// recordRetryAttempt updates a retry entry after an attempt and records the
+// outcome event in the same transaction
+func (e *Executor) recordRetryAttempt(ctx context.Context, id string, result *ChargeResult) error {
+	return e.db.InTx(ctx, func(tx *DB) error {
+		if err := tx.UpdateRetryAfterAttempt(ctx, id, result.Success, result, e.retryPolicy); err != nil {
+			return err
+		}
+		entry, err := tx.GetRetryEntry(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		switch entry.Status {
+		case RetryStatusSucceeded:
+			return e.events.EmitRetrySucceeded(ctx, tx.q, entry)
+		case RetryStatusPending:
+			return e.events.EmitRetryScheduled(ctx, tx.q, entry)
+		default:
+			// Hard decline or out of attempts
+			return e.events.EmitRetryFailed(ctx, tx.q, entry)
+		}
+	})
+}
+
 // ExecuteRetryBatch processes a batch of due retries
 func (e *Executor) ExecuteRetryBatch(ctx context.Context, entries []RetryEntry) *BatchResult {
 	start := time.Now()
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -11,14 +13,16 @@ import (
 // Handler handles HTTP requests for the scheduler
 type Handler struct {
 	scheduler *Scheduler
+	refresher *TokenRefresher
 	db        *DB
 	logger    *log.Logger
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(scheduler *Scheduler, db *DB, logger *log.Logger) *Handler {
+func NewHandler(scheduler *Scheduler, refresher *TokenRefresher, db *DB, logger *log.Logger) *Handler {
 	return &Handler{
 		scheduler: scheduler,
+		refresher: refresher,
 		db:        db,
 		logger:    logger,
 	}
@@ -239,6 +243,23 @@ func (h *Handler) GetRetryStats(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, stats)
 }
 
+// GetTokenRefreshStatus handles GET /scheduler/token-refresh
+func (h *Handler) GetTokenRefreshStatus(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"last_result": h.refresher.LastResult(),
+	})
+}
+
+// TriggerTokenRefresh handles POST /scheduler/token-refresh/trigger
+func (h *Handler) TriggerTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	h.logger.Println("Manual token refresh requested")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+
+	respondJSON(w, http.StatusOK, h.refresher.Run(ctx))
+}
+
 // Helper functions
 
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
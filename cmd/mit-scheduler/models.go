@@ -11,7 +11,7 @@ type Subscription struct {
 	PlanID            string     `json:"plan_id"`
 	PaymentMethodID   string     `json:"payment_method_id"`
 	Status            string     `json:"status"`
-	Amount            int64      `json:"amount"` // in cents
+	Amount            int64      `json:"amount"` // in minor units of Currency
 	Currency          string     `json:"currency"`
 	BillingCycle      string     `json:"billing_cycle"`
 	CurrentPeriodStart *time.Time `json:"current_period_start,omitempty"`
@@ -79,6 +79,7 @@ func ClassifyError(errorCode string) DeclineType {
 		"invalid_amount":          true,
 		"do_not_honor":            true,
 		"account_closed":          true,
+		"token_deleted":           true, // The card network retired the card's token
 		"insufficient_permission": true,
 	}
 
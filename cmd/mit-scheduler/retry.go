@@ -65,7 +65,7 @@ func (db *DB) EnsureRetryTableExists(ctx context.Context) error {
 		CREATE INDEX IF NOT EXISTS idx_retry_queue_subscription ON retry_queue(subscription_id);
 	`
 
-	_, err := db.conn.ExecContext(ctx, query)
+	_, err := db.q.ExecContext(ctx, query)
 	if err != nil {
 		return fmt.Errorf("failed to create retry_queue table: %w", err)
 	}
@@ -101,7 +101,7 @@ func (db *DB) CreateRetryEntry(ctx context.Context, subscriptionID, errorCode, e
 			updated_at = NOW()
 		RETURNING id`
 
-	err := db.conn.QueryRowContext(ctx, query,
+	err := db.q.QueryRowContext(ctx, query,
 		entry.ID, entry.SubscriptionID, entry.Attempt, entry.MaxAttempts, entry.Status,
 		entry.LastErrorCode, entry.LastErrorMessage, entry.DeclineType,
 		entry.NextRetryAt, entry.CreatedAt, entry.UpdatedAt,
@@ -130,7 +130,7 @@ func (db *DB) GetRetryEntry(ctx context.Context, id string) (*RetryEntry, error)
 		FROM retry_queue WHERE id = $1`
 
 	var entry RetryEntry
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
+	err := db.q.QueryRowContext(ctx, query, id).Scan(
 		&entry.ID, &entry.SubscriptionID, &entry.Attempt, &entry.MaxAttempts, &entry.Status,
 		&entry.LastErrorCode, &entry.LastErrorMessage, &entry.DeclineType,
 		&entry.NextRetryAt, &entry.LastAttemptAt,
@@ -162,7 +162,7 @@ func (db *DB) GetActiveRetryForSubscription(ctx context.Context, subscriptionID
 		LIMIT 1`
 
 	var entry RetryEntry
-	err := db.conn.QueryRowContext(ctx, query, subscriptionID).Scan(
+	err := db.q.QueryRowContext(ctx, query, subscriptionID).Scan(
 		&entry.ID, &entry.SubscriptionID, &entry.Attempt, &entry.MaxAttempts, &entry.Status,
 		&entry.LastErrorCode, &entry.LastErrorMessage, &entry.DeclineType,
 		&entry.NextRetryAt, &entry.LastAttemptAt,
@@ -193,7 +193,7 @@ func (db *DB) GetDueRetries(ctx context.Context, limit int) ([]RetryEntry, error
 		ORDER BY next_retry_at ASC
 		LIMIT $1`
 
-	rows, err := db.conn.QueryContext(ctx, query, limit)
+	rows, err := db.q.QueryContext(ctx, query, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get due retries: %w", err)
 	}
@@ -241,7 +241,7 @@ func (db *DB) ListRetries(ctx context.Context, status string, limit int) ([]Retr
 	query += fmt.Sprintf(" LIMIT $%d", argNum)
 	args = append(args, limit)
 
-	rows, err := db.conn.QueryContext(ctx, query, args...)
+	rows, err := db.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list retries: %w", err)
 	}
@@ -282,7 +282,7 @@ func (db *DB) UpdateRetryStatus(ctx context.Context, id string, status string) e
 		args = []any{status, now, id}
 	}
 
-	_, err := db.conn.ExecContext(ctx, query, args...)
+	_, err := db.q.ExecContext(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("failed to update retry status: %w", err)
 	}
@@ -305,7 +305,7 @@ func (db *DB) UpdateRetryAfterAttempt(ctx context.Context, id string, success bo
 				status = $1, last_attempt_at = $2, transaction_id = $3,
 				processor_used = $4, updated_at = $5, resolved_at = $6
 			WHERE id = $7`
-		_, err = db.conn.ExecContext(ctx, query,
+		_, err = db.q.ExecContext(ctx, query,
 			RetryStatusSucceeded, now, result.TransactionID,
 			result.ProcessorUsed, now, now, id,
 		)
@@ -320,7 +320,7 @@ func (db *DB) UpdateRetryAfterAttempt(ctx context.Context, id string, success bo
 					last_error_code = $4, last_error_message = $5,
 					updated_at = $6, resolved_at = $7
 				WHERE id = $8`
-			_, err = db.conn.ExecContext(ctx, query,
+			_, err = db.q.ExecContext(ctx, query,
 				RetryStatusExhausted, newAttempt, now,
 				result.ErrorCode, result.ErrorMessage,
 				now, now, id,
@@ -338,7 +338,7 @@ func (db *DB) UpdateRetryAfterAttempt(ctx context.Context, id string, success bo
 						last_error_code = $4, last_error_message = $5,
 						decline_type = $6, updated_at = $7, resolved_at = $8
 					WHERE id = $9`
-				_, err = db.conn.ExecContext(ctx, query,
+				_, err = db.q.ExecContext(ctx, query,
 					RetryStatusFailed, newAttempt, now,
 					result.ErrorCode, result.ErrorMessage,
 					string(declineType), now, now, id,
@@ -351,7 +351,7 @@ func (db *DB) UpdateRetryAfterAttempt(ctx context.Context, id string, success bo
 						last_error_code = $4, last_error_message = $5,
 						decline_type = $6, next_retry_at = $7, updated_at = $8
 					WHERE id = $9`
-				_, err = db.conn.ExecContext(ctx, query,
+				_, err = db.q.ExecContext(ctx, query,
 					RetryStatusPending, newAttempt, now,
 					result.ErrorCode, result.ErrorMessage,
 					string(declineType), nextRetry, now, id,
@@ -386,7 +386,7 @@ func (db *DB) GetRetryStats(ctx context.Context) (*RetryStats, error) {
 		FROM retry_queue`
 
 	var stats RetryStats
-	err := db.conn.QueryRowContext(ctx, query).Scan(
+	err := db.q.QueryRowContext(ctx, query).Scan(
 		&stats.TotalPending, &stats.TotalProcessing, &stats.TotalSucceeded,
 		&stats.TotalFailed, &stats.TotalCanceled, &stats.TotalExhausted,
 		&stats.AvgAttempts,
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+)
+
+// ExpiringPaymentMethod is a card that lapses before the next billing date
+// of a subscription that charges it
+type ExpiringPaymentMethod struct {
+	ID              string    `json:"id"`
+	UserID          string    `json:"user_id"`
+	TokenType       string    `json:"token_type"`
+	NetworkToken    string    `json:"-"`
+	LastFour        string    `json:"last_four"`
+	ExpMonth        int       `json:"exp_month"`
+	ExpYear         int       `json:"exp_year"`
+	UpdateRequired  bool      `json:"update_required"` // Already flagged for customer outreach
+	SubscriptionID  string    `json:"subscription_id"`
+	NextBillingDate time.Time `json:"next_billing_date"`
+}
+
+// cardExpiry returns when a card stops working: cards are valid through
+// the last day of their expiry month
+func cardExpiry(month, year int) time.Time {
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+}
+
+// TokenRefreshConfig holds token refresh job configuration
+type TokenRefreshConfig struct {
+	Interval   time.Duration // How often the job runs
+	RetryAfter time.Duration // How long before a card that couldn't be refreshed is tried again
+	BatchSize  int
+	Enabled    bool
+}
+
+// DefaultTokenRefreshConfig returns the default token refresh configuration
+func DefaultTokenRefreshConfig() *TokenRefreshConfig {
+	return &TokenRefreshConfig{
+		Interval:   24 * time.Hour,
+		RetryAfter: 7 * 24 * time.Hour,
+		BatchSize:  100,
+		Enabled:    true,
+	}
+}
+
+// TokenRefreshResult summarizes one run of the token refresh job
+type TokenRefreshResult struct {
+	Checked        int           `json:"checked"`
+	Refreshed      int           `json:"refreshed"`
+	UpdateRequired int           `json:"update_required"` // Flagged for customer outreach
+	Errors         int           `json:"errors"`          // Left for the next run
+	Duration       time.Duration `json:"duration"`
+	RanAt          time.Time     `json:"ran_at"`
+}
+
+// TokenRefresher keeps cards on subscriptions from lapsing. Before a card
+// expires it asks the network token service for the card's current expiry
+// and stores the update; cards that can't be refreshed are flagged so the
+// customer can be asked for a new one.
+type TokenRefresher struct {
+	db         *DB
+	tokens     *tokens.TokenManager
+	events     *EventPublisher
+	config     *TokenRefreshConfig
+	logger     *log.Logger
+	stopCh     chan struct{}
+	wg         sync.WaitGroup
+	runMu      sync.Mutex // Serializes runs
+	mu         sync.RWMutex
+	lastResult *TokenRefreshResult
+}
+
+// NewTokenRefresher creates a new token refresh job
+func NewTokenRefresher(db *DB, tokenManager *tokens.TokenManager, events *EventPublisher, config *TokenRefreshConfig, logger *log.Logger) *TokenRefresher {
+	return &TokenRefresher{
+		db:     db,
+		tokens: tokenManager,
+		events: events,
+		config: config,
+		logger: logger,
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Start runs the job every config.Interval in the background
+func (t *TokenRefresher) Start() {
+	if !t.config.Enabled {
+		t.logger.Println("Token refresh job disabled")
+		return
+	}
+
+	t.logger.Printf("Starting token refresh job every %v, batch size: %d", t.config.Interval, t.config.BatchSize)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(t.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.stopCh:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				t.Run(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+// Stop waits for a run in progress to finish
+func (t *TokenRefresher) Stop() {
+	close(t.stopCh)
+	t.wg.Wait()
+}
+
+// LastResult returns the result of the last run, if any
+func (t *TokenRefresher) LastResult() *TokenRefreshResult {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lastResult
+}
+
+// Run refreshes one batch of cards expiring before their next billing date
+func (t *TokenRefresher) Run(ctx context.Context) *TokenRefreshResult {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+
+	result := &TokenRefreshResult{RanAt: time.Now()}
+	methods, err := t.db.GetExpiringPaymentMethods(ctx, time.Now().Add(-t.config.RetryAfter), t.config.BatchSize)
+	if err != nil {
+		t.logger.Printf("Error getting expiring payment methods: %v", err)
+		result.Errors++
+		return result
+	}
+
+	for i := range methods {
+		pm := &methods[i]
+		result.Checked++
+
+		refreshed, err := t.refresh(ctx, pm)
+		switch {
+		case err != nil:
+			t.logger.Printf("Could not refresh payment method %s, retrying next run: %v", pm.ID, err)
+			result.Errors++
+		case refreshed:
+			result.Refreshed++
+		default:
+			result.UpdateRequired++
+		}
+	}
+
+	result.Duration = time.Since(result.RanAt)
+	t.mu.Lock()
+	t.lastResult = result
+	t.mu.Unlock()
+
+	t.logger.Printf("Token refresh completed: checked=%d, refreshed=%d, update_required=%d, errors=%d",
+		result.Checked, result.Refreshed, result.UpdateRequired, result.Errors)
+	return result
+}
+
+// refresh asks the account updater for a card's current expiry. It reports
+// whether the card will still work on its next billing date; an error means
+// the account updater couldn't be reached and the card should be tried again.
+func (t *TokenRefresher) refresh(ctx context.Context, pm *ExpiringPaymentMethod) (bool, error) {
+	// Only network tokens are kept up to date by the card networks
+	if pm.TokenType != "network" || pm.NetworkToken == "" {
+		return false, t.flagForUpdate(ctx, pm, "NO_NETWORK_TOKEN")
+	}
+
+	resp, err := t.tokens.RefreshToken(ctx, pm.NetworkToken, 0, 0)
+	var tokenErr *tokens.TokenError
+	switch {
+	case resp != nil && !resp.Success && errors.As(err, &tokenErr) && tokenErr.Refused():
+		return false, t.flagForUpdate(ctx, pm, tokenErr.Code)
+	case err != nil:
+		return false, err
+	case resp.ExpMonth == 0 || resp.ExpYear == 0:
+		return false, fmt.Errorf("account updater returned no expiry")
+	}
+
+	// The issuer may not have reissued the card yet
+	expiry := &tokens.NetworkToken{ExpiresAt: cardExpiry(resp.ExpMonth, resp.ExpYear)}
+	if t.tokens.IsTokenExpiringSoon(expiry, time.Until(pm.NextBillingDate)) {
+		return false, t.flagForUpdate(ctx, pm, "NO_UPDATE_AVAILABLE")
+	}
+
+	networkToken := pm.NetworkToken
+	if resp.NewNetworkToken != "" {
+		networkToken = resp.NewNetworkToken
+	}
+
+	err = t.db.InTx(ctx, func(tx *DB) error {
+		if err := tx.MarkPaymentMethodRefreshed(ctx, pm.ID, networkToken, resp.ExpMonth, resp.ExpYear); err != nil {
+			return err
+		}
+		return t.events.EmitPaymentMethodRefreshed(ctx, tx.q, pm, resp.ExpMonth, resp.ExpYear)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	t.logger.Printf("Refreshed payment method %s (%s): expiry %02d/%d -> %02d/%d",
+		pm.ID, pm.LastFour, pm.ExpMonth, pm.ExpYear, resp.ExpMonth, resp.ExpYear)
+	return true, nil
+}
+
+// flagForUpdate marks a card for customer outreach. The event is only sent
+// the first time a card is flagged.
+func (t *TokenRefresher) flagForUpdate(ctx context.Context, pm *ExpiringPaymentMethod, reason string) error {
+	err := t.db.InTx(ctx, func(tx *DB) error {
+		if err := tx.FlagPaymentMethodForUpdate(ctx, pm.ID, reason); err != nil {
+			return err
+		}
+		if pm.UpdateRequired {
+			return nil
+		}
+		return t.events.EmitPaymentMethodUpdateRequired(ctx, tx.q, pm, reason)
+	})
+	if err == nil {
+		t.logger.Printf("Payment method %s (%s) expires before %s and needs a customer update: %s",
+			pm.ID, pm.LastFour, pm.NextBillingDate.Format("2006-01-02"), reason)
+	}
+	return err
+}
+
+// GetExpiringPaymentMethods retrieves cards that expire before the next
+// billing date of a subscription that charges them, skipping cards tried
+// since attemptedBefore
+func (db *DB) GetExpiringPaymentMethods(ctx context.Context, attemptedBefore time.Time, limit int) ([]ExpiringPaymentMethod, error) {
+	query := `
+		SELECT DISTINCT ON (pm.id)
+			pm.id, pm.user_id, pm.token_type, COALESCE(pm.network_token, ''), COALESCE(pm.last_four, ''),
+			pm.exp_month, pm.exp_year, pm.update_required_at IS NOT NULL,
+			s.id, s.next_billing_date, pm.token_key_version, pm.wrapped_data_key
+		FROM payment_methods pm
+		JOIN subscriptions s ON s.payment_method_id = pm.id
+		WHERE s.status IN ('active', 'trialing', 'past_due')
+		  AND s.next_billing_date IS NOT NULL
+		  AND pm.detached_at IS NULL
+		  AND pm.exp_month IS NOT NULL AND pm.exp_year IS NOT NULL
+		  AND make_date(pm.exp_year, pm.exp_month, 1) + INTERVAL '1 month' <= s.next_billing_date
+		  AND (pm.refresh_attempted_at IS NULL OR pm.refresh_attempted_at < $1)
+		ORDER BY pm.id, s.next_billing_date
+		LIMIT $2`
+
+	rows, err := db.q.QueryContext(ctx, query, attemptedBefore, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expiring payment methods: %w", err)
+	}
+	defer rows.Close()
+
+	var methods []ExpiringPaymentMethod
+	for rows.Next() {
+		var pm ExpiringPaymentMethod
+		var keyVersion sql.NullInt64
+		var wrappedKey []byte
+		err := rows.Scan(
+			&pm.ID, &pm.UserID, &pm.TokenType, &pm.NetworkToken, &pm.LastFour,
+			&pm.ExpMonth, &pm.ExpYear, &pm.UpdateRequired,
+			&pm.SubscriptionID, &pm.NextBillingDate, &keyVersion, &wrappedKey,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payment method: %w", err)
+		}
+		if keyVersion.Valid {
+			envelope, err := db.tokens.OpenEnvelope(int(keyVersion.Int64), wrappedKey)
+			if err != nil {
+				return nil, fmt.Errorf("payment method %s: %w", pm.ID, err)
+			}
+			if pm.NetworkToken, err = envelope.Decrypt("network_token", pm.NetworkToken); err != nil {
+				return nil, fmt.Errorf("payment method %s: %w", pm.ID, err)
+			}
+		}
+		methods = append(methods, pm)
+	}
+
+	return methods, rows.Err()
+}
+
+// MarkPaymentMethodRefreshed stores a card's updated expiry and token and
+// clears any outreach flag. The token is encrypted with the row's data key,
+// read under a row lock so a concurrent re-encryption can't replace it.
+func (db *DB) MarkPaymentMethodRefreshed(ctx context.Context, id, networkToken string, expMonth, expYear int) error {
+	var keyVersion sql.NullInt64
+	var wrappedKey []byte
+	err := db.q.QueryRowContext(ctx,
+		`SELECT token_key_version, wrapped_data_key FROM payment_methods WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&keyVersion, &wrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to lock payment method: %w", err)
+	}
+
+	stored, tokenHash := networkToken, ""
+	if keyVersion.Valid {
+		envelope, err := db.tokens.OpenEnvelope(int(keyVersion.Int64), wrappedKey)
+		if err != nil {
+			return err
+		}
+		if stored, err = envelope.Encrypt("network_token", networkToken); err != nil {
+			return err
+		}
+		tokenHash = db.tokens.Index(networkToken)
+	}
+
+	query := `
+		UPDATE payment_methods
+		SET network_token = $2, exp_month = $3, exp_year = $4,
+			network_token_hash = NULLIF($5, ''),
+			refreshed_at = NOW(), refresh_attempted_at = NOW(),
+			update_required_at = NULL, update_required_reason = NULL
+		WHERE id = $1`
+
+	_, err = db.q.ExecContext(ctx, query, id, stored, expMonth, expYear, tokenHash)
+	if err != nil {
+		return fmt.Errorf("failed to update payment method: %w", err)
+	}
+	return nil
+}
+
+// FlagPaymentMethodForUpdate records that a card couldn't be refreshed and
+// the customer must provide a new one
+func (db *DB) FlagPaymentMethodForUpdate(ctx context.Context, id, reason string) error {
+	query := `
+		UPDATE payment_methods
+		SET refresh_attempted_at = NOW(),
+			update_required_at = COALESCE(update_required_at, NOW()),
+			update_required_reason = $2
+		WHERE id = $1`
+
+	_, err := db.q.ExecContext(ctx, query, id, reason)
+	if err != nil {
+		return fmt.Errorf("failed to flag payment method: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Network token cryptograms are 24 bytes: the token's 4-byte use counter,
+// the 4-byte Unix time it was issued, then a MAC over the token, amount,
+// currency, merchant, counter and issue time. The mock network token
+// service and processors share the MAC key.
+const cryptogramMACSize = 16
+
+// cryptogramTTL is how long after issue a cryptogram is accepted;
+// cryptogramSkew allows for the network token service's clock running ahead
+const (
+	cryptogramTTL  = 15 * time.Minute
+	cryptogramSkew = time.Minute
+)
+
+func cryptogramKey() []byte {
+	if key := os.Getenv("CRYPTOGRAM_KEY"); key != "" {
+		return []byte(key)
+	}
+	return []byte("demo-cryptogram-key")
+}
+
+func merchantID() string {
+	if id := os.Getenv("MERCHANT_ID"); id != "" {
+		return id
+	}
+	return "merchant_demo"
+}
+
+func cryptogramMAC(key []byte, networkToken string, amount int64, currency, merchantID string, counter, issuedAt uint32) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s|%d|%s|%s|%d|%d", networkToken, amount, currency, merchantID, counter, issuedAt)
+	return mac.Sum(nil)[:cryptogramMACSize]
+}
+
+// cryptogramDecline returns why the network would refuse a network token
+// charge's cryptogram, or "" if it is acceptable. Each cryptogram is good
+// for one charge of the amount it was issued for, within cryptogramTTL of
+// being issued. MITs may be sent with the token alone.
+func (p *ProcessorA) cryptogramDecline(req *ChargeRequest) string {
+	if req.NetworkToken == "" {
+		return ""
+	}
+	if req.TokenCryptogram == "" {
+		if req.StoredCredential != nil && req.StoredCredential.Initiator == "merchant" {
+			return ""
+		}
+		return "Network token charges must carry a cryptogram"
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(req.TokenCryptogram)
+	if err != nil || len(raw) != 8+cryptogramMACSize {
+		return "Cryptogram is malformed"
+	}
+	counter := binary.BigEndian.Uint32(raw[:4])
+	issuedAt := binary.BigEndian.Uint32(raw[4:8])
+	expected := cryptogramMAC(cryptogramKey(), req.NetworkToken, req.Amount, req.Currency, p.merchantID, counter, issuedAt)
+	if !hmac.Equal(raw[8:], expected) {
+		return "Cryptogram does not match the charge"
+	}
+
+	now := time.Now()
+	issued := time.Unix(int64(issuedAt), 0)
+	expires := issued.Add(cryptogramTTL)
+	if issued.After(now.Add(cryptogramSkew)) || !now.Before(expires) {
+		return "Cryptogram has expired"
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweepCryptograms(now)
+	if _, used := p.cryptograms[req.TokenCryptogram]; used {
+		return "Cryptogram has already been used"
+	}
+	p.cryptograms[req.TokenCryptogram] = expires
+	return ""
+}
+
+// sweepCryptograms forgets used cryptograms that have expired, since they
+// would be refused anyway. It runs at most once a minute. Callers hold p.mu.
+func (p *ProcessorA) sweepCryptograms(now time.Time) {
+	if now.Sub(p.cryptogramsSwept) < time.Minute {
+		return
+	}
+	p.cryptogramsSwept = now
+	for cryptogram, expires := range p.cryptograms {
+		if !now.Before(expires) {
+			delete(p.cryptograms, cryptogram)
+		}
+	}
+}
@@ -17,11 +17,26 @@ import (
 )
 
 type ProcessorA struct {
-	mu           sync.RWMutex
-	isHealthy    bool
-	failureRate  float64
-	responseTime time.Duration
-	stats        ProcessorStats
+	mu               sync.RWMutex
+	isHealthy        bool
+	failureRate      float64
+	responseTime     time.Duration
+	stats            ProcessorStats
+	authorizations   map[string]*Authorization
+	authorizeKeys    map[string]*AuthorizeResponse // Authorization outcomes by idempotency key
+	captureKeys      map[string]*CaptureResponse   // Capture outcomes by idempotency key
+	authHoldDuration time.Duration
+	charges          map[string]*ChargeResponse // Charge outcomes by idempotency key
+	refunds          map[string]*RefundResponse // Refund outcomes by idempotency key
+	payments         map[string]*Payment        // Settled payments by transaction ID, for disputes
+	disputes         map[string]*Dispute
+	settlements      []SettlementEntry     // Settled payments and refunds, in processing order
+	orchestratorURL  string                // Where dispute and 3DS notifications are sent
+	challenges       map[string]*Challenge // 3DS challenges by ID
+	publicURL        string                // Base of challenge redirect URLs
+	cryptograms      map[string]time.Time  // Network token cryptograms already used, until they expire
+	cryptogramsSwept time.Time             // When expired cryptograms were last dropped
+	merchantID       string                // Merchant the cryptograms must be issued for
 }
 
 type ProcessorStats struct {
@@ -34,12 +49,16 @@ type ProcessorStats struct {
 }
 
 type ChargeRequest struct {
-	Amount         int    `json:"amount"`
-	Currency       string `json:"currency"`
-	Token          string `json:"token"`
-	IdempotencyKey string `json:"idempotency_key"`
-	NetworkToken   string `json:"network_token,omitempty"`
-	ProcessorToken string `json:"processor_token,omitempty"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	Token           string `json:"token"`
+	IdempotencyKey  string `json:"idempotency_key"`
+	NetworkToken    string `json:"network_token,omitempty"`
+	ProcessorToken  string `json:"processor_token,omitempty"`
+	TokenCryptogram string `json:"token_cryptogram,omitempty"` // Required for network token CITs
+
+	StoredCredential *StoredCredential `json:"stored_credential,omitempty"`
+	ThreeDS          *ThreeDSRequest   `json:"three_ds,omitempty"`
 }
 
 type ChargeResponse struct {
@@ -50,11 +69,18 @@ type ChargeResponse struct {
 	ErrorMessage  string `json:"error_message,omitempty"`
 	ProcessorUsed string `json:"processor_used"`
 	TokenType     string `json:"token_type,omitempty"`
+
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+
+	// requires_action while the cardholder completes a 3DS challenge
+	Status  string            `json:"status,omitempty"`
+	ThreeDS *ThreeDSChallenge `json:"three_ds,omitempty"`
 }
 
 type RefundRequest struct {
 	OriginalTransactionID string `json:"original_transaction_id"`
-	Amount                int    `json:"amount"`
+	Amount                int64  `json:"amount"`
+	Currency              string `json:"currency"`
 	Reason                string `json:"reason"`
 	IdempotencyKey        string `json:"idempotency_key"`
 }
@@ -90,6 +116,19 @@ func NewProcessorA() *ProcessorA {
 		stats: ProcessorStats{
 			AvgResponseTime: 250,
 		},
+		authorizations:   make(map[string]*Authorization),
+		authorizeKeys:    make(map[string]*AuthorizeResponse),
+		captureKeys:      make(map[string]*CaptureResponse),
+		charges:          make(map[string]*ChargeResponse),
+		refunds:          make(map[string]*RefundResponse),
+		payments:         make(map[string]*Payment),
+		disputes:         make(map[string]*Dispute),
+		orchestratorURL:  orchestratorURL(),
+		challenges:       make(map[string]*Challenge),
+		publicURL:        publicURL(),
+		cryptograms:      make(map[string]time.Time),
+		merchantID:       merchantID(),
+		authHoldDuration: 7 * 24 * time.Hour, // Typical card hold window
 	}
 }
 
@@ -116,6 +155,54 @@ func (p *ProcessorA) charge(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// Replay the outcome of a charge already made with this key
+	if recorded := p.recordedCharge(req.IdempotencyKey); recorded != nil {
+		switch {
+		case recorded.Status == "requires_action":
+			w.WriteHeader(http.StatusAccepted)
+		case !recorded.Success:
+			w.WriteHeader(http.StatusPaymentRequired)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
+	// The network refuses charges on file that don't follow stored credential rules
+	if message := storedCredentialDecline(req.StoredCredential); message != "" {
+		p.mu.Lock()
+		p.stats.FailedCharges++
+		p.mu.Unlock()
+
+		response := ChargeResponse{
+			Success:       false,
+			ErrorCode:     "STORED_CREDENTIAL_INVALID",
+			ErrorMessage:  message,
+			ProcessorUsed: "processor_a",
+		}
+		p.recordCharge(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The network checks the cryptogram binds the token to this charge
+	if message := p.cryptogramDecline(&req); message != "" {
+		p.mu.Lock()
+		p.stats.FailedCharges++
+		p.mu.Unlock()
+
+		response := ChargeResponse{
+			Success:       false,
+			ErrorCode:     "CRYPTOGRAM_INVALID",
+			ErrorMessage:  message,
+			ProcessorUsed: "processor_a",
+		}
+		p.recordCharge(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Check if processor is healthy
 	p.mu.RLock()
 	healthy := p.isHealthy
@@ -138,6 +225,18 @@ func (p *ProcessorA) charge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send the cardholder to authenticate when SCA applies and no exemption is granted
+	if needsChallenge(&req) {
+		tokenType := "processor_specific"
+		if req.NetworkToken != "" {
+			tokenType = "network"
+		}
+		response := p.startChallenge(req, tokenType)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Simulate random failures based on failure rate
 	if rand.Float64() < failRate {
 		p.mu.Lock()
@@ -165,6 +264,11 @@ func (p *ProcessorA) charge(w http.ResponseWriter, r *http.Request) {
 			ProcessorUsed: "processor_a",
 		}
 
+		// Only issuer declines are final; other errors can be retried with the same key
+		if errorType.status == http.StatusPaymentRequired {
+			p.recordCharge(req.IdempotencyKey, response)
+		}
+
 		w.WriteHeader(errorType.status)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -189,8 +293,14 @@ func (p *ProcessorA) charge(w http.ResponseWriter, r *http.Request) {
 		AuthCode:      fmt.Sprintf("auth_%d", rand.Intn(999999)),
 		ProcessorUsed: "processor_a",
 		TokenType:     tokenType,
+
+		NetworkTransactionID: newNetworkTransactionID(),
 	}
 
+	p.recordCharge(req.IdempotencyKey, response)
+	p.recordPayment(response.TransactionID, req.Amount, req.Currency)
+	p.recordSettlement(newSettlementEntry(response.TransactionID, "", SettlementCharge, req.Amount, req.Currency))
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
@@ -222,6 +332,15 @@ func (p *ProcessorA) refund(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Replay the outcome of a refund already made with this key
+	if recorded := p.recordedRefund(req.IdempotencyKey); recorded != nil {
+		if !recorded.Success {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
 	// Simulate processing time
 	time.Sleep(100 * time.Millisecond)
 
@@ -236,6 +355,8 @@ func (p *ProcessorA) refund(w http.ResponseWriter, r *http.Request) {
 			ErrorCode:    "REFUND_FAILED",
 			ErrorMessage: "Refund could not be processed",
 		}
+		p.recordRefund(req.IdempotencyKey, response)
+
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -246,6 +367,9 @@ func (p *ProcessorA) refund(w http.ResponseWriter, r *http.Request) {
 		RefundID: fmt.Sprintf("ref_a_%s", uuid.New().String()[:8]),
 	}
 
+	p.recordRefund(req.IdempotencyKey, response)
+	p.recordRefundSettlement(response.RefundID, req.OriginalTransactionID, req.Amount, req.Currency)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
@@ -384,12 +508,37 @@ func main() {
 	// Core payment endpoints
 	r.HandleFunc("/charge", processor.charge).Methods("POST")
 	r.HandleFunc("/refund", processor.refund).Methods("POST")
+	r.HandleFunc("/charges/{idempotency_key}", processor.getCharge).Methods("GET")
+	r.HandleFunc("/refunds/{idempotency_key}", processor.findRefund).Methods("GET")
 	r.HandleFunc("/tokenize", processor.tokenize).Methods("POST")
+	r.HandleFunc("/verify", processor.verify).Methods("POST") // Zero-amount card verification
+
+	// Two-step payment endpoints
+	r.HandleFunc("/authorize", processor.authorize).Methods("POST")
+	r.HandleFunc("/capture", processor.capture).Methods("POST")
+	r.HandleFunc("/void", processor.void).Methods("POST")
+	r.HandleFunc("/captures/{idempotency_key}", processor.findCapture).Methods("GET")
+	r.HandleFunc("/authorizations", processor.findAuthorization).Queries("idempotency_key", "{idempotency_key}").Methods("GET")
+	r.HandleFunc("/authorizations/{id}", processor.getAuthorization).Methods("GET")
+
+	// Settlement reports
+	r.HandleFunc("/settlements/{date}", processor.getSettlementReport).Methods("GET")
+
+	// Dispute endpoints
+	r.HandleFunc("/disputes/{id}", processor.getDispute).Methods("GET")
+	r.HandleFunc("/disputes/{id}/evidence", processor.submitDisputeEvidence).Methods("POST")
 
 	// Admin endpoints for testing
 	r.HandleFunc("/admin/set-failure-rate", processor.setFailureRate).Methods("POST")
 	r.HandleFunc("/admin/toggle-status", processor.toggleStatus).Methods("POST")
+	r.HandleFunc("/admin/set-auth-expiry", processor.setAuthExpiry).Methods("POST")
 	r.HandleFunc("/admin/stats", processor.getStats).Methods("GET")
+	r.HandleFunc("/admin/disputes", processor.createDispute).Methods("POST")
+	r.HandleFunc("/admin/disputes/{id}/resolve", processor.resolveDispute).Methods("POST")
+
+	// 3-D Secure challenges, standing in for the issuer's authentication page
+	r.HandleFunc("/3ds/challenges/{id}", processor.getChallenge).Methods("GET")
+	r.HandleFunc("/3ds/challenges/{id}/complete", processor.completeChallenge).Methods("POST")
 
 	// Health check
 	r.HandleFunc("/health", processor.health).Methods("GET")
@@ -402,7 +551,15 @@ func main() {
 	log.Println("Admin endpoints:")
 	log.Println("   POST /admin/set-failure-rate?rate=50")
 	log.Println("   POST /admin/toggle-status")
+	log.Println("   POST /admin/set-auth-expiry?seconds=60")
 	log.Println("   GET /admin/stats")
+	log.Println("   GET /settlements/{YYYY-MM-DD}")
+	log.Println("   POST /admin/disputes")
+	log.Println("   POST /admin/disputes/{id}/resolve?outcome=lost")
+	log.Println("   POST /3ds/challenges/{id}/complete?result=authenticated")
+
+	go processor.expireDisputesLoop(time.Minute)
+	go processor.expireChallengesLoop(time.Minute)
 
 	log.Fatal(http.ListenAndServe(":8101", r))
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Settlement entry types
+const (
+	SettlementCharge  = "charge"
+	SettlementCapture = "capture"
+	SettlementRefund  = "refund"
+)
+
+// Processor A pricing: 2.9% plus 30 minor units per payment. Refunds carry no
+// fee and the original fee is not returned.
+const (
+	feeRateBps = 290
+	feeFixed   = 30
+)
+
+// settlementColumns is the header row of the daily settlement file
+var settlementColumns = []string{
+	"settlement_date", "transaction_id", "original_transaction_id", "type", "status",
+	"amount", "currency", "fee", "net", "processed_at",
+}
+
+// SettlementEntry is a money movement reported in the daily settlement file
+type SettlementEntry struct {
+	TransactionID         string
+	OriginalTransactionID string // Set on refunds
+	Type                  string
+	Amount                int64
+	Currency              string
+	Fee                   int64
+	ProcessedAt           time.Time
+}
+
+// Net is what the merchant is paid for the entry; negative for refunds
+func (e *SettlementEntry) Net() int64 {
+	if e.Type == SettlementRefund {
+		return -e.Amount
+	}
+	return e.Amount - e.Fee
+}
+
+func newSettlementEntry(transactionID, originalTransactionID, entryType string, amount int64, currency string) SettlementEntry {
+	entry := SettlementEntry{
+		TransactionID:         transactionID,
+		OriginalTransactionID: originalTransactionID,
+		Type:                  entryType,
+		Amount:                amount,
+		Currency:              currency,
+		ProcessedAt:           time.Now().UTC(),
+	}
+	if entryType != SettlementRefund {
+		entry.Fee = (amount*feeRateBps+5000)/10000 + feeFixed
+	}
+	return entry
+}
+
+// recordSettlement adds a settled payment or refund to the day's file
+func (p *ProcessorA) recordSettlement(entry SettlementEntry) {
+	p.mu.Lock()
+	p.settlements = append(p.settlements, entry)
+	p.mu.Unlock()
+}
+
+// recordRefundSettlement settles a refund in the currency of the payment it returns
+func (p *ProcessorA) recordRefundSettlement(refundID, originalTransactionID string, amount int64, currency string) {
+	p.mu.Lock()
+	if payment, exists := p.payments[originalTransactionID]; exists {
+		currency = payment.Currency
+	}
+	p.settlements = append(p.settlements, newSettlementEntry(refundID, originalTransactionID, SettlementRefund, amount, currency))
+	p.mu.Unlock()
+}
+
+// getSettlementReport serves the settlement file for a UTC day
+// (GET /settlements/2026-10-15) as CSV
+func (p *ProcessorA) getSettlementReport(w http.ResponseWriter, r *http.Request) {
+	date := mux.Vars(r)["date"]
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if !day.Before(time.Now().UTC()) {
+		http.Error(w, "Settlement day has not started", http.StatusNotFound)
+		return
+	}
+
+	p.mu.RLock()
+	var entries []SettlementEntry
+	for _, entry := range p.settlements {
+		if !entry.ProcessedAt.Before(day) && entry.ProcessedAt.Before(day.AddDate(0, 0, 1)) {
+			entries = append(entries, entry)
+		}
+	}
+	p.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=processor_a_settlement_%s.csv", date))
+
+	out := csv.NewWriter(w)
+	out.Write(settlementColumns)
+	for _, entry := range entries {
+		out.Write([]string{
+			date,
+			entry.TransactionID,
+			entry.OriginalTransactionID,
+			entry.Type,
+			"settled",
+			strconv.FormatInt(entry.Amount, 10),
+			entry.Currency,
+			strconv.FormatInt(entry.Fee, 10),
+			strconv.FormatInt(entry.Net(), 10),
+			entry.ProcessedAt.Format(time.RFC3339),
+		})
+	}
+	out.Flush()
+}
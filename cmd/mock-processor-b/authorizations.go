@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Authorization states
+const (
+	AuthStatusAuthorized        = "authorized"
+	AuthStatusPartiallyCaptured = "partially_captured"
+	AuthStatusCaptured          = "captured"
+	AuthStatusVoided            = "voided"
+	AuthStatusExpired           = "expired"
+)
+
+// Authorization is a hold placed on a card that can later be captured or voided
+type Authorization struct {
+	ID             string    `json:"authorization_id"`
+	Amount         int64     `json:"amount"`
+	CapturedAmount int64     `json:"captured_amount"`
+	Currency       string    `json:"currency"`
+	Status         string    `json:"status"`
+	AuthCode       string    `json:"auth_code"`
+	Captures       []string  `json:"captures"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+type AuthorizeResponse struct {
+	Success         bool      `json:"success"`
+	AuthorizationID string    `json:"authorization_id,omitempty"`
+	AuthCode        string    `json:"auth_code,omitempty"`
+	Amount          int64     `json:"amount,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitempty"`
+	ErrorCode       string    `json:"error_code,omitempty"`
+	ErrorMessage    string    `json:"error_message,omitempty"`
+	ProcessorUsed   string    `json:"processor_used"`
+}
+
+type CaptureRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	Amount          int64  `json:"amount"`
+	FinalCapture    bool   `json:"final_capture"`
+	IdempotencyKey  string `json:"idempotency_key"`
+}
+
+type CaptureResponse struct {
+	Success         bool   `json:"success"`
+	TransactionID   string `json:"transaction_id,omitempty"`
+	AuthorizationID string `json:"authorization_id"`
+	CapturedAmount  int64  `json:"captured_amount"`
+	RemainingAmount int64  `json:"remaining_amount"`
+	Status          string `json:"status,omitempty"`
+	ErrorCode       string `json:"error_code,omitempty"`
+	ErrorMessage    string `json:"error_message,omitempty"`
+}
+
+type VoidRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	Reason          string `json:"reason"`
+	IdempotencyKey  string `json:"idempotency_key"`
+}
+
+type VoidResponse struct {
+	Success         bool   `json:"success"`
+	AuthorizationID string `json:"authorization_id"`
+	ReleasedAmount  int64  `json:"released_amount"`
+	Status          string `json:"status,omitempty"`
+	ErrorCode       string `json:"error_code,omitempty"`
+	ErrorMessage    string `json:"error_message,omitempty"`
+}
+
+func (p *ProcessorB) authorize(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.stats.TotalRequests++
+	p.mu.Unlock()
+
+	// Simulate processing time
+	time.Sleep(p.responseTime)
+
+	var req ChargeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate required fields
+	if req.Amount <= 0 || req.Currency == "" || (req.Token == "" && req.NetworkToken == "" && req.ProcessorToken == "") {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Replay the outcome of an authorization already made with this key
+	if recorded := p.recordedAuthorization(req.IdempotencyKey); recorded != nil {
+		if !recorded.Success {
+			w.WriteHeader(http.StatusPaymentRequired)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
+	p.mu.RLock()
+	supported := false
+	for _, currency := range p.stats.CurrenciesSupported {
+		if currency == req.Currency {
+			supported = true
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	if !supported {
+		response := AuthorizeResponse{
+			Success:       false,
+			ErrorCode:     "CURRENCY_NOT_SUPPORTED",
+			ErrorMessage:  fmt.Sprintf("Currency %s not supported", req.Currency),
+			ProcessorUsed: "processor_b",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	p.mu.RLock()
+	healthy := p.isHealthy
+	failRate := p.failureRate
+	holdDuration := p.authHoldDuration
+	p.mu.RUnlock()
+
+	if !healthy {
+		response := AuthorizeResponse{
+			Success:       false,
+			ErrorCode:     "PROCESSOR_UNAVAILABLE",
+			ErrorMessage:  "Payment processor temporarily unavailable",
+			ProcessorUsed: "processor_b",
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The network checks holds the same way as charges
+	if code, message := p.authorizationRefusal(&req); code != "" {
+		response := AuthorizeResponse{
+			Success:       false,
+			ErrorCode:     code,
+			ErrorMessage:  message,
+			ProcessorUsed: "processor_b",
+		}
+		p.recordAuthorization(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Simulate declines based on failure rate
+	if rand.Float64() < failRate {
+		errors := []struct {
+			code    string
+			message string
+		}{
+			{"CARD_DECLINED", "Payment declined by issuing bank"},
+			{"INSUFFICIENT_FUNDS", "Insufficient funds on card"},
+		}
+
+		errorType := errors[rand.Intn(len(errors))]
+		response := AuthorizeResponse{
+			Success:       false,
+			ErrorCode:     errorType.code,
+			ErrorMessage:  errorType.message,
+			ProcessorUsed: "processor_b",
+		}
+		p.recordAuthorization(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	now := time.Now()
+	auth := &Authorization{
+		ID:        fmt.Sprintf("ath_b_%s", uuid.New().String()[:8]),
+		Amount:    req.Amount,
+		Currency:  req.Currency,
+		Status:    AuthStatusAuthorized,
+		AuthCode:  fmt.Sprintf("auth_%d", rand.Intn(999999)),
+		CreatedAt: now,
+		ExpiresAt: now.Add(holdDuration),
+	}
+
+	p.mu.Lock()
+	p.authorizations[auth.ID] = auth
+	p.mu.Unlock()
+
+	response := AuthorizeResponse{
+		Success:         true,
+		AuthorizationID: auth.ID,
+		AuthCode:        auth.AuthCode,
+		Amount:          auth.Amount,
+		ExpiresAt:       auth.ExpiresAt,
+		ProcessorUsed:   "processor_b",
+	}
+	p.recordAuthorization(req.IdempotencyKey, response)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// authorizationRefusal returns the code and reason the network would refuse
+// a hold with, or "" if it may be placed. Holds have no challenge flow, so
+// one that needs 3-D Secure is soft declined for the merchant to charge instead.
+func (p *ProcessorB) authorizationRefusal(req *ChargeRequest) (string, string) {
+	if message := storedCredentialDecline(req.StoredCredential); message != "" {
+		return "STORED_CREDENTIAL_INVALID", message
+	}
+	if message := p.cryptogramDecline(req); message != "" {
+		return "CRYPTOGRAM_INVALID", message
+	}
+	if needsChallenge(req) {
+		return "AUTHENTICATION_REQUIRED", "Strong customer authentication is required for this authorization"
+	}
+	return "", ""
+}
+
+func (p *ProcessorB) capture(w http.ResponseWriter, r *http.Request) {
+	var req CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.AuthorizationID == "" || req.Amount <= 0 {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Simulate processing time
+	time.Sleep(100 * time.Millisecond)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Replay the outcome of a capture already made with this key
+	if recorded, exists := p.captureKeys[req.IdempotencyKey]; exists && req.IdempotencyKey != "" {
+		if !recorded.Success {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
+	auth, status, errResp := p.lookupOpenAuthorization(req.AuthorizationID)
+	if errResp != nil {
+		response := CaptureResponse{
+			AuthorizationID: req.AuthorizationID,
+			ErrorCode:       errResp.code,
+			ErrorMessage:    errResp.message,
+		}
+		p.recordCapture(req.IdempotencyKey, response)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	remaining := auth.Amount - auth.CapturedAmount
+	if req.Amount > remaining {
+		response := CaptureResponse{
+			AuthorizationID: auth.ID,
+			CapturedAmount:  auth.CapturedAmount,
+			RemainingAmount: remaining,
+			Status:          auth.Status,
+			ErrorCode:       "AMOUNT_EXCEEDS_AUTHORIZATION",
+			ErrorMessage:    fmt.Sprintf("Capture of %d exceeds remaining authorized amount %d", req.Amount, remaining),
+		}
+		p.recordCapture(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	captureID := fmt.Sprintf("txn_b_%s", uuid.New().String()[:8])
+	auth.CapturedAmount += req.Amount
+	auth.Captures = append(auth.Captures, captureID)
+	p.payments[captureID] = &Payment{TransactionID: captureID, Amount: req.Amount, Currency: auth.Currency}
+	p.settlements = append(p.settlements, newSettlementEntry(captureID, "", SettlementCapture, req.Amount, auth.Currency))
+	if auth.CapturedAmount == auth.Amount || req.FinalCapture {
+		auth.Status = AuthStatusCaptured
+	} else {
+		auth.Status = AuthStatusPartiallyCaptured
+	}
+
+	p.stats.SuccessfulCharges++
+
+	remaining = auth.Amount - auth.CapturedAmount
+	if auth.Status == AuthStatusCaptured {
+		// A final capture releases whatever is left of the hold
+		remaining = 0
+	}
+
+	response := CaptureResponse{
+		Success:         true,
+		TransactionID:   captureID,
+		AuthorizationID: auth.ID,
+		CapturedAmount:  auth.CapturedAmount,
+		RemainingAmount: remaining,
+		Status:          auth.Status,
+	}
+	p.recordCapture(req.IdempotencyKey, response)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (p *ProcessorB) void(w http.ResponseWriter, r *http.Request) {
+	var req VoidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.AuthorizationID == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	auth, status, errResp := p.lookupOpenAuthorization(req.AuthorizationID)
+	if errResp != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(VoidResponse{
+			AuthorizationID: req.AuthorizationID,
+			ErrorCode:       errResp.code,
+			ErrorMessage:    errResp.message,
+		})
+		return
+	}
+
+	released := auth.Amount - auth.CapturedAmount
+	auth.Status = AuthStatusVoided
+
+	json.NewEncoder(w).Encode(VoidResponse{
+		Success:         true,
+		AuthorizationID: auth.ID,
+		ReleasedAmount:  released,
+		Status:          auth.Status,
+	})
+}
+
+func (p *ProcessorB) getAuthorization(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	p.mu.Lock()
+	auth, exists := p.authorizations[id]
+	if exists {
+		p.expireIfDue(auth)
+	}
+	var snapshot Authorization
+	if exists {
+		snapshot = *auth
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error_code":    "AUTHORIZATION_NOT_FOUND",
+			"error_message": "Authorization not found on this processor",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// recordedAuthorization returns the outcome of an earlier authorization with the same idempotency key
+func (p *ProcessorB) recordedAuthorization(idempotencyKey string) *AuthorizeResponse {
+	if idempotencyKey == "" {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if recorded, exists := p.authorizeKeys[idempotencyKey]; exists {
+		response := *recorded
+		return &response
+	}
+	return nil
+}
+
+// recordAuthorization keeps an authorization outcome so a retry doesn't place a second hold
+func (p *ProcessorB) recordAuthorization(idempotencyKey string, response AuthorizeResponse) {
+	if idempotencyKey == "" {
+		return
+	}
+
+	p.mu.Lock()
+	p.authorizeKeys[idempotencyKey] = &response
+	p.mu.Unlock()
+}
+
+// findAuthorization looks up an authorization by the idempotency key it was sent with
+func (p *ProcessorB) findAuthorization(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["idempotency_key"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	recorded := p.recordedAuthorization(key)
+	if recorded == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error_code":    "AUTHORIZATION_NOT_FOUND",
+			"error_message": "No authorization with this idempotency key",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(recorded)
+}
+
+// recordCapture keeps a capture outcome so a retry doesn't capture twice. The
+// caller holds p.mu.
+func (p *ProcessorB) recordCapture(idempotencyKey string, response CaptureResponse) {
+	if idempotencyKey != "" {
+		p.captureKeys[idempotencyKey] = &response
+	}
+}
+
+// findCapture looks up a capture by the idempotency key it was sent with
+func (p *ProcessorB) findCapture(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["idempotency_key"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	p.mu.RLock()
+	recorded, exists := p.captureKeys[key]
+	p.mu.RUnlock()
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error_code":    "CAPTURE_NOT_FOUND",
+			"error_message": "No capture with this idempotency key",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(recorded)
+}
+
+// setAuthExpiry changes how long new holds last, for testing expiry
+func (p *ProcessorB) setAuthExpiry(w http.ResponseWriter, r *http.Request) {
+	secondsStr := r.URL.Query().Get("seconds")
+	seconds, err := strconv.Atoi(secondsStr)
+	if err != nil || seconds <= 0 {
+		http.Error(w, "Invalid seconds parameter", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	p.authHoldDuration = time.Duration(seconds) * time.Second
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":            "Authorization hold duration updated",
+		"hold_duration_secs": seconds,
+	})
+}
+
+type authError struct {
+	code    string
+	message string
+}
+
+// lookupOpenAuthorization returns an authorization that can still be
+// captured or voided. Must be called with p.mu held.
+func (p *ProcessorB) lookupOpenAuthorization(id string) (*Authorization, int, *authError) {
+	auth, exists := p.authorizations[id]
+	if !exists {
+		return nil, http.StatusNotFound, &authError{"AUTHORIZATION_NOT_FOUND", "Authorization not found on this processor"}
+	}
+
+	p.expireIfDue(auth)
+
+	switch auth.Status {
+	case AuthStatusAuthorized, AuthStatusPartiallyCaptured:
+		return auth, http.StatusOK, nil
+	case AuthStatusExpired:
+		return nil, http.StatusGone, &authError{"AUTHORIZATION_EXPIRED", "Authorization hold has expired"}
+	default:
+		return nil, http.StatusConflict, &authError{"AUTHORIZATION_CLOSED", fmt.Sprintf("Authorization is already %s", auth.Status)}
+	}
+}
+
+// expireIfDue moves an open authorization past its hold window to expired
+func (p *ProcessorB) expireIfDue(auth *Authorization) {
+	if (auth.Status == AuthStatusAuthorized || auth.Status == AuthStatusPartiallyCaptured) && time.Now().After(auth.ExpiresAt) {
+		auth.Status = AuthStatusExpired
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// recordedCharge returns the outcome of an earlier charge with the same idempotency key
+func (p *ProcessorB) recordedCharge(idempotencyKey string) *ChargeResponse {
+	if idempotencyKey == "" {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if recorded, exists := p.charges[idempotencyKey]; exists {
+		response := *recorded
+		return &response
+	}
+	return nil
+}
+
+// recordCharge keeps a charge outcome so retries and lookups see the same result
+func (p *ProcessorB) recordCharge(idempotencyKey string, response ChargeResponse) {
+	if idempotencyKey == "" {
+		return
+	}
+
+	p.mu.Lock()
+	p.charges[idempotencyKey] = &response
+	p.mu.Unlock()
+}
+
+// getCharge looks up a charge by the idempotency key it was sent with
+func (p *ProcessorB) getCharge(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["idempotency_key"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	recorded := p.recordedCharge(key)
+	if recorded == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error_code":    "CHARGE_NOT_FOUND",
+			"error_message": "No charge with this idempotency key",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(recorded)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// StoredCredential flags a charge made with card details kept on file
+type StoredCredential struct {
+	Initiator            string `json:"initiator"` // customer or merchant
+	Sequence             string `json:"sequence"`  // initial or subsequent
+	Reason               string `json:"reason"`    // recurring or unscheduled
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+}
+
+// newNetworkTransactionID simulates the ID the card network assigns a
+// charge: 15 digits, the last a Luhn check digit. Both mock processors use
+// the same format since the ID comes from the network, not the acquirer.
+func newNetworkTransactionID() string {
+	digits := make([]byte, 14)
+	for i := range digits {
+		digits[i] = byte('0' + rand.Intn(10))
+	}
+	return fmt.Sprintf("%s%d", digits, luhnCheckDigit(digits))
+}
+
+func validNetworkTransactionID(id string) bool {
+	if len(id) != 15 {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return int(id[14]-'0') == luhnCheckDigit([]byte(id[:14]))
+}
+
+func luhnCheckDigit(digits []byte) int {
+	sum := 0
+	double := true
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// storedCredentialDecline returns why the network would refuse a charge
+// on file, or "" if it is acceptable. MITs must be subsequent to an initial
+// CIT and reference its network transaction ID.
+func storedCredentialDecline(sc *StoredCredential) string {
+	if sc == nil || sc.Initiator != "merchant" {
+		return ""
+	}
+	if sc.Sequence != "subsequent" {
+		return "Merchant-initiated charges must be subsequent to a customer-initiated charge"
+	}
+	if !validNetworkTransactionID(sc.NetworkTransactionID) {
+		return "Merchant-initiated charge is missing a valid network transaction ID reference"
+	}
+	return ""
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Dispute states
+const (
+	DisputeNeedsResponse = "needs_response"
+	DisputeUnderReview   = "under_review"
+	DisputeWon           = "won"
+	DisputeLost          = "lost"
+)
+
+// disputeReasons are the card network reason codes the mock raises
+var disputeReasons = map[string]string{
+	"10.4":   "Other fraud - card absent environment",
+	"12.6.1": "Duplicate processing",
+	"13.1":   "Merchandise or services not received",
+	"13.2":   "Cancelled recurring transaction",
+	"13.3":   "Not as described or defective",
+}
+
+// Payment is a settled charge or capture that can be disputed
+type Payment struct {
+	TransactionID string
+	Amount        int64
+	Currency      string
+}
+
+// Dispute is a chargeback raised by the cardholder's bank against a payment
+type Dispute struct {
+	ID            string          `json:"dispute_id"`
+	TransactionID string          `json:"transaction_id"`
+	Amount        int64           `json:"amount"`
+	Currency      string          `json:"currency"`
+	ReasonCode    string          `json:"reason_code"`
+	Reason        string          `json:"reason"`
+	Status        string          `json:"status"`
+	EvidenceDueBy time.Time       `json:"evidence_due_by"`
+	Evidence      json.RawMessage `json:"evidence,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+type CreateDisputeRequest struct {
+	TransactionID string `json:"transaction_id"`
+	Amount        int64  `json:"amount"`        // Defaults to the full payment
+	ReasonCode    string `json:"reason_code"`   // Picked at random when empty
+	EvidenceDays  int    `json:"evidence_days"` // Defaults to 7
+}
+
+type DisputeEvidenceRequest struct {
+	DisputeID string          `json:"dispute_id"`
+	Evidence  json.RawMessage `json:"evidence"`
+}
+
+type DisputeEvidenceResponse struct {
+	Success      bool   `json:"success"`
+	DisputeID    string `json:"dispute_id"`
+	Status       string `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// recordPayment remembers a successful payment so it can be disputed later
+func (p *ProcessorB) recordPayment(transactionID string, amount int64, currency string) {
+	p.mu.Lock()
+	p.payments[transactionID] = &Payment{TransactionID: transactionID, Amount: amount, Currency: currency}
+	p.mu.Unlock()
+}
+
+// createDispute raises a dispute against an earlier payment (admin endpoint)
+func (p *ProcessorB) createDispute(w http.ResponseWriter, r *http.Request) {
+	var req CreateDisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	payment, exists := p.payments[req.TransactionID]
+	if !exists {
+		p.mu.Unlock()
+		http.Error(w, "Transaction not found on this processor", http.StatusNotFound)
+		return
+	}
+
+	if req.Amount == 0 {
+		req.Amount = payment.Amount
+	}
+	if req.Amount < 0 || req.Amount > payment.Amount {
+		p.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Dispute amount must be between 1 and %d", payment.Amount), http.StatusBadRequest)
+		return
+	}
+	if req.ReasonCode == "" {
+		codes := make([]string, 0, len(disputeReasons))
+		for code := range disputeReasons {
+			codes = append(codes, code)
+		}
+		req.ReasonCode = codes[rand.Intn(len(codes))]
+	}
+	reason, known := disputeReasons[req.ReasonCode]
+	if !known {
+		p.mu.Unlock()
+		http.Error(w, "Unknown reason code", http.StatusBadRequest)
+		return
+	}
+	if req.EvidenceDays <= 0 {
+		req.EvidenceDays = 7
+	}
+
+	now := time.Now().UTC()
+	dispute := &Dispute{
+		ID:            fmt.Sprintf("dp_b_%s", uuid.New().String()[:8]),
+		TransactionID: payment.TransactionID,
+		Amount:        req.Amount,
+		Currency:      payment.Currency,
+		ReasonCode:    req.ReasonCode,
+		Reason:        reason,
+		Status:        DisputeNeedsResponse,
+		EvidenceDueBy: now.Add(time.Duration(req.EvidenceDays) * 24 * time.Hour),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	p.disputes[dispute.ID] = dispute
+	snapshot := *dispute
+	p.mu.Unlock()
+
+	log.Printf("Dispute %s raised against %s: %s", dispute.ID, dispute.TransactionID, reason)
+	go p.notifyDispute(snapshot)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// submitDisputeEvidence contests a dispute; the bank then reviews it
+func (p *ProcessorB) submitDisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req DisputeEvidenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Evidence) == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dispute, exists := p.disputes[id]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(DisputeEvidenceResponse{
+			DisputeID:    id,
+			ErrorCode:    "DISPUTE_NOT_FOUND",
+			ErrorMessage: "Dispute not found on this processor",
+		})
+		return
+	}
+	p.expireDisputeIfDue(dispute)
+	if dispute.Status != DisputeNeedsResponse {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(DisputeEvidenceResponse{
+			DisputeID:    id,
+			Status:       dispute.Status,
+			ErrorCode:    "DISPUTE_NOT_OPEN",
+			ErrorMessage: fmt.Sprintf("Dispute is %s and no longer accepts evidence", dispute.Status),
+		})
+		return
+	}
+
+	dispute.Evidence = req.Evidence
+	dispute.Status = DisputeUnderReview
+	dispute.UpdatedAt = time.Now().UTC()
+
+	json.NewEncoder(w).Encode(DisputeEvidenceResponse{
+		Success:   true,
+		DisputeID: id,
+		Status:    dispute.Status,
+	})
+}
+
+// getDispute returns a dispute's current state
+func (p *ProcessorB) getDispute(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	dispute, exists := p.disputes[mux.Vars(r)["id"]]
+	var snapshot Dispute
+	if exists {
+		p.expireDisputeIfDue(dispute)
+		snapshot = *dispute
+	}
+	p.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// resolveDispute records the bank's decision on a dispute under review
+// (admin endpoint, ?outcome=won or lost)
+func (p *ProcessorB) resolveDispute(w http.ResponseWriter, r *http.Request) {
+	outcome := r.URL.Query().Get("outcome")
+	if outcome != DisputeWon && outcome != DisputeLost {
+		http.Error(w, "outcome must be won or lost", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	dispute, exists := p.disputes[mux.Vars(r)["id"]]
+	if !exists {
+		p.mu.Unlock()
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+	// Without evidence the merchant can only lose
+	if dispute.Status != DisputeUnderReview && !(dispute.Status == DisputeNeedsResponse && outcome == DisputeLost) {
+		p.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Dispute is %s and cannot be resolved as %s", dispute.Status, outcome), http.StatusConflict)
+		return
+	}
+	dispute.Status = outcome
+	dispute.UpdatedAt = time.Now().UTC()
+	snapshot := *dispute
+	p.mu.Unlock()
+
+	log.Printf("Dispute %s %s", snapshot.ID, outcome)
+	go p.notifyDispute(snapshot)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// expireDisputeIfDue loses a dispute whose evidence deadline passed without
+// a response. Callers hold p.mu.
+func (p *ProcessorB) expireDisputeIfDue(dispute *Dispute) {
+	if dispute.Status != DisputeNeedsResponse || time.Now().Before(dispute.EvidenceDueBy) {
+		return
+	}
+	dispute.Status = DisputeLost
+	dispute.UpdatedAt = time.Now().UTC()
+	go p.notifyDispute(*dispute)
+}
+
+// expireDisputesLoop loses overdue disputes even if nobody looks at them
+func (p *ProcessorB) expireDisputesLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		for _, dispute := range p.disputes {
+			p.expireDisputeIfDue(dispute)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// notifyDispute sends the dispute's state to the orchestrator, retrying with
+// backoff for a while as a real processor's webhook would
+func (p *ProcessorB) notifyDispute(dispute Dispute) {
+	body, err := json.Marshal(dispute)
+	if err != nil {
+		log.Printf("Failed to encode dispute %s: %v", dispute.ID, err)
+		return
+	}
+
+	url := p.orchestratorURL + "/processors/processor_b/disputes"
+	client := &http.Client{Timeout: 5 * time.Second}
+	delay := time.Second
+	for attempt := 1; attempt <= 6; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Dispute %s notification attempt %d failed: %v", dispute.ID, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Printf("Gave up notifying the orchestrator of dispute %s (%s)", dispute.ID, dispute.Status)
+}
+
+func orchestratorURL() string {
+	if url := os.Getenv("ORCHESTRATOR_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8001"
+}
@@ -17,11 +17,26 @@ import (
 )
 
 type ProcessorB struct {
-	mu           sync.RWMutex
-	isHealthy    bool
-	failureRate  float64
-	responseTime time.Duration
-	stats        ProcessorStats
+	mu               sync.RWMutex
+	isHealthy        bool
+	failureRate      float64
+	responseTime     time.Duration
+	stats            ProcessorStats
+	authorizations   map[string]*Authorization
+	authorizeKeys    map[string]*AuthorizeResponse // Authorization outcomes by idempotency key
+	captureKeys      map[string]*CaptureResponse   // Capture outcomes by idempotency key
+	authHoldDuration time.Duration
+	charges          map[string]*ChargeResponse // Charge outcomes by idempotency key
+	refunds          map[string]*RefundResponse // Refund outcomes by idempotency key
+	payments         map[string]*Payment        // Settled payments by transaction ID, for disputes
+	disputes         map[string]*Dispute
+	settlements      []SettlementEntry     // Settled payments and refunds, in processing order
+	orchestratorURL  string                // Where dispute and 3DS notifications are sent
+	challenges       map[string]*Challenge // 3DS challenges by ID
+	publicURL        string                // Base of challenge redirect URLs
+	cryptograms      map[string]time.Time  // Network token cryptograms already used, until they expire
+	cryptogramsSwept time.Time             // When expired cryptograms were last dropped
+	merchantID       string                // Merchant the cryptograms must be issued for
 }
 
 type ProcessorStats struct {
@@ -36,13 +51,17 @@ type ProcessorStats struct {
 }
 
 type ChargeRequest struct {
-	Amount         int    `json:"amount"`
-	Currency       string `json:"currency"`
-	Token          string `json:"token"`
-	IdempotencyKey string `json:"idempotency_key"`
-	NetworkToken   string `json:"network_token,omitempty"`
-	ProcessorToken string `json:"processor_token,omitempty"`
-	Marketplace    string `json:"marketplace,omitempty"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	Token           string `json:"token"`
+	IdempotencyKey  string `json:"idempotency_key"`
+	NetworkToken    string `json:"network_token,omitempty"`
+	ProcessorToken  string `json:"processor_token,omitempty"`
+	TokenCryptogram string `json:"token_cryptogram,omitempty"` // Required for network token CITs
+	Marketplace     string `json:"marketplace,omitempty"`
+
+	StoredCredential *StoredCredential `json:"stored_credential,omitempty"`
+	ThreeDS          *ThreeDSRequest   `json:"three_ds,omitempty"`
 }
 
 type ChargeResponse struct {
@@ -54,12 +73,18 @@ type ChargeResponse struct {
 	ProcessorUsed   string `json:"processor_used"`
 	TokenType       string `json:"token_type,omitempty"`
 	ExchangeRate    string `json:"exchange_rate,omitempty"`
-	ProcessedAmount int    `json:"processed_amount,omitempty"`
+	ProcessedAmount int64  `json:"processed_amount,omitempty"`
+
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+
+	// requires_action while the cardholder completes a 3DS challenge
+	Status  string            `json:"status,omitempty"`
+	ThreeDS *ThreeDSChallenge `json:"three_ds,omitempty"`
 }
 
 type RefundRequest struct {
 	OriginalTransactionID string `json:"original_transaction_id"`
-	Amount                int    `json:"amount"`
+	Amount                int64  `json:"amount"`
 	Currency              string `json:"currency"`
 	Reason                string `json:"reason"`
 	IdempotencyKey        string `json:"idempotency_key"`
@@ -100,6 +125,19 @@ func NewProcessorB() *ProcessorB {
 			AvgResponseTime:     300,
 			CurrenciesSupported: []string{"USD", "EUR", "GBP", "JPY", "AUD", "CAD", "CHF", "SEK", "NOK", "DKK"},
 		},
+		authorizations:   make(map[string]*Authorization),
+		authorizeKeys:    make(map[string]*AuthorizeResponse),
+		captureKeys:      make(map[string]*CaptureResponse),
+		charges:          make(map[string]*ChargeResponse),
+		refunds:          make(map[string]*RefundResponse),
+		payments:         make(map[string]*Payment),
+		disputes:         make(map[string]*Dispute),
+		orchestratorURL:  orchestratorURL(),
+		challenges:       make(map[string]*Challenge),
+		publicURL:        publicURL(),
+		cryptograms:      make(map[string]time.Time),
+		merchantID:       merchantID(),
+		authHoldDuration: 7 * 24 * time.Hour, // Typical card hold window
 	}
 }
 
@@ -126,6 +164,54 @@ func (p *ProcessorB) charge(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	// Replay the outcome of a charge already made with this key
+	if recorded := p.recordedCharge(req.IdempotencyKey); recorded != nil {
+		switch {
+		case recorded.Status == "requires_action":
+			w.WriteHeader(http.StatusAccepted)
+		case !recorded.Success:
+			w.WriteHeader(http.StatusPaymentRequired)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
+	// The network refuses charges on file that don't follow stored credential rules
+	if message := storedCredentialDecline(req.StoredCredential); message != "" {
+		p.mu.Lock()
+		p.stats.FailedCharges++
+		p.mu.Unlock()
+
+		response := ChargeResponse{
+			Success:       false,
+			ErrorCode:     "STORED_CREDENTIAL_INVALID",
+			ErrorMessage:  message,
+			ProcessorUsed: "processor_b",
+		}
+		p.recordCharge(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// The network checks the cryptogram binds the token to this charge
+	if message := p.cryptogramDecline(&req); message != "" {
+		p.mu.Lock()
+		p.stats.FailedCharges++
+		p.mu.Unlock()
+
+		response := ChargeResponse{
+			Success:       false,
+			ErrorCode:     "CRYPTOGRAM_INVALID",
+			ErrorMessage:  message,
+			ProcessorUsed: "processor_b",
+		}
+		p.recordCharge(req.IdempotencyKey, response)
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Check currency support - Processor B supports more currencies
 	supportedCurrencies := map[string]bool{
 		"USD": true, "EUR": true, "GBP": true, "JPY": true,
@@ -167,6 +253,18 @@ func (p *ProcessorB) charge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send the cardholder to authenticate when SCA applies and no exemption is granted
+	if needsChallenge(&req) {
+		tokenType := "processor_specific"
+		if req.NetworkToken != "" {
+			tokenType = "network"
+		}
+		response := p.startChallenge(req, tokenType)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	// Simulate random failures based on failure rate (lower than A)
 	if rand.Float64() < failRate {
 		p.mu.Lock()
@@ -194,6 +292,11 @@ func (p *ProcessorB) charge(w http.ResponseWriter, r *http.Request) {
 			ProcessorUsed: "processor_b",
 		}
 
+		// Only issuer declines are final; other errors can be retried with the same key
+		if errorType.status == http.StatusPaymentRequired {
+			p.recordCharge(req.IdempotencyKey, response)
+		}
+
 		w.WriteHeader(errorType.status)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -228,7 +331,7 @@ func (p *ProcessorB) charge(w http.ResponseWriter, r *http.Request) {
 		}
 		if rate, exists := rates[req.Currency]; exists {
 			exchangeRate = fmt.Sprintf("1 USD = %.4f %s", rate, req.Currency)
-			processedAmount = int(float64(req.Amount) * rate)
+			processedAmount = int64(float64(req.Amount) * rate)
 		}
 	}
 
@@ -240,8 +343,14 @@ func (p *ProcessorB) charge(w http.ResponseWriter, r *http.Request) {
 		TokenType:       tokenType,
 		ExchangeRate:    exchangeRate,
 		ProcessedAmount: processedAmount,
+
+		NetworkTransactionID: newNetworkTransactionID(),
 	}
 
+	p.recordCharge(req.IdempotencyKey, response)
+	p.recordPayment(response.TransactionID, req.Amount, req.Currency)
+	p.recordSettlement(newSettlementEntry(response.TransactionID, "", SettlementCharge, req.Amount, req.Currency))
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
@@ -273,6 +382,15 @@ func (p *ProcessorB) refund(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Replay the outcome of a refund already made with this key
+	if recorded := p.recordedRefund(req.IdempotencyKey); recorded != nil {
+		if !recorded.Success {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(recorded)
+		return
+	}
+
 	// Simulate processing time
 	time.Sleep(150 * time.Millisecond)
 
@@ -287,6 +405,8 @@ func (p *ProcessorB) refund(w http.ResponseWriter, r *http.Request) {
 			ErrorCode:    "REFUND_FAILED",
 			ErrorMessage: "Refund could not be processed",
 		}
+		p.recordRefund(req.IdempotencyKey, response)
+
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		json.NewEncoder(w).Encode(response)
 		return
@@ -298,6 +418,9 @@ func (p *ProcessorB) refund(w http.ResponseWriter, r *http.Request) {
 		ProcessedCurrency: req.Currency,
 	}
 
+	p.recordRefund(req.IdempotencyKey, response)
+	p.recordRefundSettlement(response.RefundID, req.OriginalTransactionID, req.Amount, req.Currency)
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
@@ -468,13 +591,38 @@ func main() {
 	// Core payment endpoints
 	r.HandleFunc("/charge", processor.charge).Methods("POST")
 	r.HandleFunc("/refund", processor.refund).Methods("POST")
+	r.HandleFunc("/charges/{idempotency_key}", processor.getCharge).Methods("GET")
+	r.HandleFunc("/refunds/{idempotency_key}", processor.findRefund).Methods("GET")
 	r.HandleFunc("/tokenize", processor.tokenize).Methods("POST")
+	r.HandleFunc("/verify", processor.verify).Methods("POST") // Zero-amount card verification
+
+	// Two-step payment endpoints
+	r.HandleFunc("/authorize", processor.authorize).Methods("POST")
+	r.HandleFunc("/capture", processor.capture).Methods("POST")
+	r.HandleFunc("/void", processor.void).Methods("POST")
+	r.HandleFunc("/captures/{idempotency_key}", processor.findCapture).Methods("GET")
+	r.HandleFunc("/authorizations", processor.findAuthorization).Queries("idempotency_key", "{idempotency_key}").Methods("GET")
+	r.HandleFunc("/authorizations/{id}", processor.getAuthorization).Methods("GET")
+
+	// Settlement reports
+	r.HandleFunc("/settlements/{date}", processor.getSettlementReport).Methods("GET")
+
+	// Dispute endpoints
+	r.HandleFunc("/disputes/{id}", processor.getDispute).Methods("GET")
+	r.HandleFunc("/disputes/{id}/evidence", processor.submitDisputeEvidence).Methods("POST")
 
 	// Admin endpoints for testing
 	r.HandleFunc("/admin/set-failure-rate", processor.setFailureRate).Methods("POST")
 	r.HandleFunc("/admin/set-latency", processor.setLatency).Methods("POST")
 	r.HandleFunc("/admin/toggle-status", processor.toggleStatus).Methods("POST")
+	r.HandleFunc("/admin/set-auth-expiry", processor.setAuthExpiry).Methods("POST")
 	r.HandleFunc("/admin/stats", processor.getStats).Methods("GET")
+	r.HandleFunc("/admin/disputes", processor.createDispute).Methods("POST")
+	r.HandleFunc("/admin/disputes/{id}/resolve", processor.resolveDispute).Methods("POST")
+
+	// 3-D Secure challenges, standing in for the issuer's authentication page
+	r.HandleFunc("/3ds/challenges/{id}", processor.getChallenge).Methods("GET")
+	r.HandleFunc("/3ds/challenges/{id}/complete", processor.completeChallenge).Methods("POST")
 
 	// Health check
 	r.HandleFunc("/health", processor.health).Methods("GET")
@@ -489,7 +637,15 @@ func main() {
 	log.Println("   POST /admin/set-failure-rate?rate=20")
 	log.Println("   POST /admin/set-latency?ms=1000")
 	log.Println("   POST /admin/toggle-status")
+	log.Println("   POST /admin/set-auth-expiry?seconds=60")
 	log.Println("   GET /admin/stats")
+	log.Println("   GET /settlements/{YYYY-MM-DD}")
+	log.Println("   POST /admin/disputes")
+	log.Println("   POST /admin/disputes/{id}/resolve?outcome=lost")
+	log.Println("   POST /3ds/challenges/{id}/complete?result=authenticated")
+
+	go processor.expireDisputesLoop(time.Minute)
+	go processor.expireChallengesLoop(time.Minute)
 
 	log.Fatal(http.ListenAndServe(":8102", r))
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// recordedRefund returns the outcome of an earlier refund with the same idempotency key
+func (p *ProcessorB) recordedRefund(idempotencyKey string) *RefundResponse {
+	if idempotencyKey == "" {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if recorded, exists := p.refunds[idempotencyKey]; exists {
+		response := *recorded
+		return &response
+	}
+	return nil
+}
+
+// recordRefund keeps a refund outcome so a retried refund isn't paid out twice
+func (p *ProcessorB) recordRefund(idempotencyKey string, response RefundResponse) {
+	if idempotencyKey == "" {
+		return
+	}
+
+	p.mu.Lock()
+	p.refunds[idempotencyKey] = &response
+	p.mu.Unlock()
+}
+
+// findRefund looks up a refund by the idempotency key it was sent with
+func (p *ProcessorB) findRefund(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["idempotency_key"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	recorded := p.recordedRefund(key)
+	if recorded == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error_code":    "REFUND_NOT_FOUND",
+			"error_message": "No refund with this idempotency key",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(recorded)
+}
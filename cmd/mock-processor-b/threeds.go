@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Challenge states
+const (
+	ChallengePending       = "pending"
+	ChallengeAuthenticated = "authenticated"
+	ChallengeFailed        = "failed"
+	ChallengeExpired       = "expired"
+)
+
+// Issuer limits for exemptions, in minor units of any currency
+const (
+	lowValueLimit = 3000  // EUR 30
+	traLimit      = 50000 // EUR 500, the highest TRA band
+)
+
+// challengeLifetime is how long the cardholder has to authenticate
+const challengeLifetime = 15 * time.Minute
+
+// ThreeDSRequest asks for strong customer authentication
+type ThreeDSRequest struct {
+	Required  bool   `json:"required,omitempty"`
+	Exemption string `json:"exemption,omitempty"` // low_value, mit or tra
+}
+
+// ThreeDSChallenge is where the cardholder is sent to authenticate
+type ThreeDSChallenge struct {
+	ID          string    `json:"id"`
+	RedirectURL string    `json:"redirect_url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Challenge is a 3-D Secure challenge and the charge waiting on it
+type Challenge struct {
+	ThreeDSChallenge
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	TokenType      string `json:"token_type"`
+}
+
+// exemptionGranted reports whether the issuer accepts the exemption requested
+func exemptionGranted(req *ChargeRequest) bool {
+	switch req.ThreeDS.Exemption {
+	case "low_value":
+		return req.Amount <= lowValueLimit
+	case "tra":
+		return req.Amount <= traLimit
+	case "mit":
+		return req.StoredCredential != nil && req.StoredCredential.Initiator == "merchant"
+	}
+	return false
+}
+
+// needsChallenge reports whether the cardholder must authenticate the charge
+func needsChallenge(req *ChargeRequest) bool {
+	return req.ThreeDS != nil && req.ThreeDS.Required && !exemptionGranted(req)
+}
+
+// startChallenge opens a challenge for a charge. Until it is completed the
+// charge is recorded as requiring action.
+func (p *ProcessorB) startChallenge(req ChargeRequest, tokenType string) ChargeResponse {
+	challenge := &Challenge{
+		ThreeDSChallenge: ThreeDSChallenge{
+			ID:        "3ds_b_" + uuid.New().String()[:8],
+			ExpiresAt: time.Now().UTC().Add(challengeLifetime),
+		},
+		Status:         ChallengePending,
+		IdempotencyKey: req.IdempotencyKey,
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		TokenType:      tokenType,
+	}
+	challenge.RedirectURL = p.publicURL + "/3ds/challenges/" + challenge.ID
+
+	p.mu.Lock()
+	p.challenges[challenge.ID] = challenge
+	p.mu.Unlock()
+
+	threeDS := challenge.ThreeDSChallenge
+	response := ChargeResponse{
+		Success:       false,
+		Status:        "requires_action",
+		ThreeDS:       &threeDS,
+		ProcessorUsed: "processor_b",
+		TokenType:     tokenType,
+	}
+	p.recordCharge(req.IdempotencyKey, response)
+
+	log.Printf("3DS challenge %s opened for %d %s", challenge.ID, req.Amount, req.Currency)
+	return response
+}
+
+// finishChallenge settles the charge behind a challenge that is no longer pending
+func (p *ProcessorB) finishChallenge(challenge Challenge) ChargeResponse {
+	response := ChargeResponse{
+		Success:       false,
+		ProcessorUsed: "processor_b",
+		TokenType:     challenge.TokenType,
+	}
+
+	switch challenge.Status {
+	case ChallengeAuthenticated:
+		response.Success = true
+		response.TransactionID = fmt.Sprintf("txn_b_%s", uuid.New().String()[:8])
+		response.AuthCode = fmt.Sprintf("auth_%d", rand.Intn(999999))
+		response.NetworkTransactionID = newNetworkTransactionID()
+
+		p.mu.Lock()
+		p.stats.SuccessfulCharges++
+		p.mu.Unlock()
+		p.recordPayment(response.TransactionID, challenge.Amount, challenge.Currency)
+		p.recordSettlement(newSettlementEntry(response.TransactionID, "", SettlementCharge, challenge.Amount, challenge.Currency))
+	case ChallengeExpired:
+		response.ErrorCode = "AUTHENTICATION_EXPIRED"
+		response.ErrorMessage = "Cardholder did not complete authentication in time"
+	default:
+		response.ErrorCode = "AUTHENTICATION_FAILED"
+		response.ErrorMessage = "Cardholder failed authentication"
+	}
+
+	if !response.Success {
+		p.mu.Lock()
+		p.stats.FailedCharges++
+		p.mu.Unlock()
+	}
+
+	p.recordCharge(challenge.IdempotencyKey, response)
+	return response
+}
+
+// getChallenge stands in for the page the cardholder is redirected to
+func (p *ProcessorB) getChallenge(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	challenge, exists := p.challenges[mux.Vars(r)["id"]]
+	var snapshot Challenge
+	if exists {
+		snapshot = *challenge
+	}
+	p.mu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Challenge not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// completeChallenge simulates the cardholder finishing the challenge
+// (POST /3ds/challenges/{id}/complete?result=authenticated|failed)
+func (p *ProcessorB) completeChallenge(w http.ResponseWriter, r *http.Request) {
+	result := r.URL.Query().Get("result")
+	if result == "" {
+		result = ChallengeAuthenticated
+	}
+	if result != ChallengeAuthenticated && result != ChallengeFailed {
+		http.Error(w, "result must be authenticated or failed", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	challenge, exists := p.challenges[mux.Vars(r)["id"]]
+	if !exists {
+		p.mu.Unlock()
+		http.Error(w, "Challenge not found", http.StatusNotFound)
+		return
+	}
+	if challenge.Status != ChallengePending {
+		p.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Challenge is already %s", challenge.Status), http.StatusConflict)
+		return
+	}
+	expired := time.Now().After(challenge.ExpiresAt)
+	if expired {
+		challenge.Status = ChallengeExpired
+	} else {
+		challenge.Status = result
+	}
+	snapshot := *challenge
+	p.mu.Unlock()
+
+	response := p.finishChallenge(snapshot)
+	go p.notifyChallenge(snapshot)
+
+	w.Header().Set("Content-Type", "application/json")
+	if expired {
+		w.WriteHeader(http.StatusGone)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge": snapshot,
+		"charge":    response,
+	})
+}
+
+// expireChallengesLoop fails charges whose cardholder never authenticated
+func (p *ProcessorB) expireChallengesLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []Challenge
+		p.mu.Lock()
+		for _, challenge := range p.challenges {
+			if challenge.Status == ChallengePending && time.Now().After(challenge.ExpiresAt) {
+				challenge.Status = ChallengeExpired
+				expired = append(expired, *challenge)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, challenge := range expired {
+			p.finishChallenge(challenge)
+			go p.notifyChallenge(challenge)
+		}
+	}
+}
+
+// notifyChallenge tells the orchestrator a challenge is over so it can read
+// back the charge outcome, retrying with backoff like notifyDispute
+func (p *ProcessorB) notifyChallenge(challenge Challenge) {
+	body, err := json.Marshal(map[string]string{
+		"challenge_id":    challenge.ID,
+		"idempotency_key": challenge.IdempotencyKey,
+		"status":          challenge.Status,
+	})
+	if err != nil {
+		log.Printf("Failed to encode challenge %s: %v", challenge.ID, err)
+		return
+	}
+
+	url := p.orchestratorURL + "/processors/processor_b/3ds"
+	client := &http.Client{Timeout: 5 * time.Second}
+	delay := time.Second
+	for attempt := 1; attempt <= 6; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("3DS challenge %s notification attempt %d failed: %v", challenge.ID, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Printf("Gave up notifying the orchestrator of challenge %s (%s)", challenge.ID, challenge.Status)
+}
+
+// publicURL is the address cardholders reach this processor at
+func publicURL() string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8102"
+}
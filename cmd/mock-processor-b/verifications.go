@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VerifyRequest checks a card can be charged without charging it
+type VerifyRequest struct {
+	Currency       string `json:"currency"`
+	IdempotencyKey string `json:"idempotency_key"`
+	NetworkToken   string `json:"network_token,omitempty"`
+	ProcessorToken string `json:"processor_token,omitempty"`
+}
+
+type VerifyResponse struct {
+	Success        bool   `json:"success"`
+	VerificationID string `json:"verification_id,omitempty"`
+	ErrorCode      string `json:"error_code,omitempty"`
+	ErrorMessage   string `json:"error_message,omitempty"`
+	ProcessorUsed  string `json:"processor_used"`
+}
+
+// verify runs a zero-amount authorization: the issuer checks the card is
+// open and valid, and nothing is held or settled
+func (p *ProcessorB) verify(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.stats.TotalRequests++
+	p.mu.Unlock()
+
+	// Simulate processing time
+	time.Sleep(p.responseTime)
+
+	var req VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Currency == "" || (req.NetworkToken == "" && req.ProcessorToken == "") {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	p.mu.RLock()
+	healthy := p.isHealthy
+	failRate := p.failureRate
+	p.mu.RUnlock()
+
+	if !healthy {
+		response := VerifyResponse{
+			Success:       false,
+			ErrorCode:     "PROCESSOR_UNAVAILABLE",
+			ErrorMessage:  "Payment processor temporarily unavailable",
+			ProcessorUsed: "processor_b",
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Simulate issuers refusing the card
+	if rand.Float64() < failRate {
+		errors := []struct {
+			code    string
+			message string
+		}{
+			{"CARD_DECLINED", "Card verification declined by issuing bank"},
+			{"CARD_EXPIRED", "Card has expired"},
+		}
+
+		errorType := errors[rand.Intn(len(errors))]
+		response := VerifyResponse{
+			Success:       false,
+			ErrorCode:     errorType.code,
+			ErrorMessage:  errorType.message,
+			ProcessorUsed: "processor_b",
+		}
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := VerifyResponse{
+		Success:        true,
+		VerificationID: fmt.Sprintf("ver_b_%s", uuid.New().String()[:8]),
+		ProcessorUsed:  "processor_b",
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Account updater outcomes, as a share of lookups
+const (
+	accountClosedRate = 0.05 // The issuer closed the account
+	noUpdateRate      = 0.15 // The issuer doesn't take part in account updates
+)
+
+// accountUpdate answers a refresh without an expiry the way a network
+// account updater would: a card close to expiry has been reissued with a
+// new expiry three years out, other cards keep theirs.
+func (nts *NetworkTokenService) accountUpdate(ctx context.Context, w http.ResponseWriter, token *NetworkToken) {
+	switch r := rand.Float64(); {
+	case r < accountClosedRate:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(RefreshTokenResponse{
+			Success:      false,
+			ErrorCode:    "ACCOUNT_CLOSED",
+			ErrorMessage: "The issuer reports the card account is closed",
+		})
+		return
+	case r < accountClosedRate+noUpdateRate:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(RefreshTokenResponse{
+			Success:      false,
+			ErrorCode:    "NO_UPDATE_AVAILABLE",
+			ErrorMessage: "The issuer has no updated details for the card",
+		})
+		return
+	}
+
+	token, err := nts.store.Update(ctx, token.NetworkToken, func(t *NetworkToken) error {
+		if time.Now().AddDate(0, 3, 0).After(t.ExpiresAt) {
+			t.ExpiryYear = time.Now().Year() + 3
+			t.ExpiresAt = time.Date(t.ExpiryYear, time.Month(t.ExpiryMonth), 1, 0, 0, 0, 0, time.UTC)
+			log.Printf("Account updater reissued %s until %02d/%d", t.LastFour, t.ExpiryMonth, t.ExpiryYear)
+		}
+		return nil
+	})
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(RefreshTokenResponse{
+		Success:         true,
+		NewNetworkToken: token.NetworkToken,
+		ExpiresAt:       token.ExpiresAt.Format(time.RFC3339),
+		ExpMonth:        token.ExpiryMonth,
+		ExpYear:         token.ExpiryYear,
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Cryptograms are 24 bytes: the token's 4-byte use counter, the 4-byte Unix
+// time it was issued, then a MAC over the token, amount, currency, merchant,
+// counter and issue time. Processors share the MAC key to validate them and
+// accept a cryptogram for a limited time after it was issued.
+const cryptogramMACSize = 16
+
+type CryptogramRequest struct {
+	NetworkToken string `json:"network_token"`
+	Amount       int64  `json:"amount"` // In minor units of Currency
+	Currency     string `json:"currency"`
+	MerchantID   string `json:"merchant_id"`
+}
+
+type CryptogramResponse struct {
+	Success      bool   `json:"success"`
+	Cryptogram   string `json:"cryptogram,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+func cryptogramKey() []byte {
+	if key := os.Getenv("CRYPTOGRAM_KEY"); key != "" {
+		return []byte(key)
+	}
+	return []byte("demo-cryptogram-key")
+}
+
+func cryptogramMAC(key []byte, networkToken string, amount int64, currency, merchantID string, counter, issuedAt uint32) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s|%d|%s|%s|%d|%d", networkToken, amount, currency, merchantID, counter, issuedAt)
+	return mac.Sum(nil)[:cryptogramMACSize]
+}
+
+// issueCryptogram binds a network token to one charge. Every cryptogram
+// carries a new value of the token's use counter, so none can be reused.
+func (nts *NetworkTokenService) issueCryptogram(w http.ResponseWriter, r *http.Request) {
+	var req CryptogramRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if req.NetworkToken == "" || req.Amount < 0 || req.Currency == "" || req.MerchantID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(CryptogramResponse{
+			ErrorCode:    "INVALID_REQUEST",
+			ErrorMessage: "network_token, amount, currency and merchant_id are required",
+		})
+		return
+	}
+
+	// The counter is stored before the cryptogram goes out, so a value is
+	// never handed out twice, even across replicas
+	token, err := nts.store.Update(r.Context(), req.NetworkToken, func(t *NetworkToken) error {
+		switch {
+		case t.TokenType != "network":
+			return refuse(http.StatusUnprocessableEntity, "TOKEN_NOT_ELIGIBLE", "Only network tokens have cryptograms")
+		case t.Status != TokenStatusActive:
+			code, message := t.lifecycleError()
+			return refuse(http.StatusUnprocessableEntity, code, message)
+		case time.Now().After(t.ExpiresAt.AddDate(0, 1, 0)):
+			return refuse(http.StatusUnprocessableEntity, "TOKEN_EXPIRED", "Network token has expired")
+		}
+		t.UseCounter++
+		return nil
+	})
+	var refusal *tokenRefusal
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(CryptogramResponse{ErrorCode: "TOKEN_NOT_FOUND", ErrorMessage: "Network token not found"})
+		return
+	case errors.As(err, &refusal):
+		w.WriteHeader(refusal.status)
+		json.NewEncoder(w).Encode(CryptogramResponse{ErrorCode: refusal.code, ErrorMessage: refusal.message})
+		return
+	case err != nil:
+		nts.storeError(w, err)
+		return
+	}
+
+	issuedAt := uint32(time.Now().Unix())
+	raw := make([]byte, 8, 8+cryptogramMACSize)
+	binary.BigEndian.PutUint32(raw, token.UseCounter)
+	binary.BigEndian.PutUint32(raw[4:], issuedAt)
+	raw = append(raw, cryptogramMAC(cryptogramKey(), req.NetworkToken, req.Amount, req.Currency, req.MerchantID, token.UseCounter, issuedAt)...)
+	json.NewEncoder(w).Encode(CryptogramResponse{Success: true, Cryptogram: base64.StdEncoding.EncodeToString(raw)})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// seedDemoTokens registers the network tokens of the demo payment methods
+// in migrations/002_seed_demo_data.sql, so they can be looked up and refreshed.
+// Tokens already in the store are left as they are.
+func (nts *NetworkTokenService) seedDemoTokens() {
+	ctx := context.Background()
+
+	demo := []struct {
+		token, lastFour, brand string
+		expMonth, expYear      int
+	}{
+		{"ntk_demo_1234567890abcdef", "4242", "visa", 12, 2025},
+		{"ntk_demo_9876543210fedcba", "9999", "mastercard", 3, 2027},
+		{"ntk_demo_1111222233334444", "0123", "visa", 9, 2028},
+	}
+
+	for _, d := range demo {
+		if _, err := nts.store.Get(ctx, d.token); !errors.Is(err, ErrTokenNotFound) {
+			continue
+		}
+		err := nts.store.Create(ctx, &NetworkToken{
+			ID:               uuid.New().String(),
+			NetworkToken:     d.token,
+			TokenType:        "network",
+			LastFour:         d.lastFour,
+			Brand:            d.brand,
+			ExpiryMonth:      d.expMonth,
+			ExpiryYear:       d.expYear,
+			IsPortable:       true,
+			CreatedAt:        time.Now(),
+			ExpiresAt:        time.Date(d.expYear, time.Month(d.expMonth), 1, 0, 0, 0, 0, time.UTC),
+			SupportedMarkets: []string{"US", "EU", "UK", "JP", "AU", "CA"},
+			Status:           TokenStatusActive,
+		})
+		if err != nil {
+			log.Printf("Failed to seed demo token %s: %v", d.token, err)
+		}
+	}
+}
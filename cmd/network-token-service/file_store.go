@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileStatsFlushInterval is how often counters changed since the last write
+// are saved. Up to that much counting is lost if the service is killed.
+const fileStatsFlushInterval = 5 * time.Second
+
+// FileTokenStore keeps tokens in a single JSON file, rewritten on every
+// token change. Counters are only kept in memory between writes, so
+// counting a request doesn't rewrite the file. It suits one instance;
+// replicas need the Postgres store.
+type FileTokenStore struct {
+	mu         sync.Mutex
+	path       string
+	sealer     *sealer
+	data       fileStoreData
+	statsDirty bool // Counters changed since the file was last written
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type fileStoreData struct {
+	Tokens map[string]*fileStoreEntry `json:"tokens"` // Keyed by token index
+	Stats  map[string]int64           `json:"stats"`
+}
+
+type fileStoreEntry struct {
+	ProcessorA  string `json:"processor_a,omitempty"`
+	ProcessorB  string `json:"processor_b,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Record      []byte `json:"record"` // Sealed storedToken
+}
+
+// NewFileTokenStore opens the store at path, creating it if it doesn't
+// exist, and starts saving counters in the background until Close
+func NewFileTokenStore(path string, sealer *sealer) (*FileTokenStore, error) {
+	s := &FileTokenStore{
+		path:   path,
+		sealer: sealer,
+		data: fileStoreData{
+			Tokens: make(map[string]*fileStoreEntry),
+			Stats:  make(map[string]int64),
+		},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	raw, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to read token store: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &s.data); err != nil {
+			return nil, fmt.Errorf("failed to parse token store: %w", err)
+		}
+		if s.data.Tokens == nil {
+			s.data.Tokens = make(map[string]*fileStoreEntry)
+		}
+		if s.data.Stats == nil {
+			s.data.Stats = make(map[string]int64)
+		}
+	}
+
+	go s.flushStatsLoop(fileStatsFlushInterval)
+	return s, nil
+}
+
+// flushStatsLoop saves changed counters every interval until Close
+func (s *FileTokenStore) flushStatsLoop(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.flushStats(); err != nil {
+				log.Printf("Failed to save token service stats: %v", err)
+			}
+		}
+	}
+}
+
+// flushStats writes the file if counters changed since it was last written
+func (s *FileTokenStore) flushStats() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.statsDirty {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store to a temporary file and renames it into place, so
+// a crash never leaves a partial file
+func (s *FileTokenStore) save() error {
+	raw, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write token store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.statsDirty = false
+	return nil
+}
+
+func (s *FileTokenStore) put(t *NetworkToken) error {
+	record, err := s.sealer.seal(t)
+	if err != nil {
+		return err
+	}
+	idx := s.sealer.indexes(t)
+	s.data.Tokens[idx.Token] = &fileStoreEntry{
+		ProcessorA:  idx.ProcessorA,
+		ProcessorB:  idx.ProcessorB,
+		Fingerprint: idx.Fingerprint,
+		Record:      record,
+	}
+	return s.save()
+}
+
+func (s *FileTokenStore) Create(ctx context.Context, t *NetworkToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.Tokens[s.sealer.index(t.NetworkToken)]; exists {
+		return fmt.Errorf("network token %s already exists", t.NetworkToken)
+	}
+	return s.put(t)
+}
+
+func (s *FileTokenStore) Get(ctx context.Context, networkToken string) (*NetworkToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(networkToken)
+}
+
+func (s *FileTokenStore) get(networkToken string) (*NetworkToken, error) {
+	idx := s.sealer.index(networkToken)
+	entry, exists := s.data.Tokens[idx]
+	if !exists {
+		return nil, ErrTokenNotFound
+	}
+	return s.sealer.open(idx, entry.Record)
+}
+
+func (s *FileTokenStore) GetByProcessorToken(ctx context.Context, processorToken string) (*NetworkToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.sealer.index(processorToken)
+	for tokenIdx, entry := range s.data.Tokens {
+		if idx != "" && (entry.ProcessorA == idx || entry.ProcessorB == idx) {
+			return s.sealer.open(tokenIdx, entry.Record)
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+func (s *FileTokenStore) ListByFingerprint(ctx context.Context, fingerprint string) ([]*NetworkToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []*NetworkToken{}
+	for tokenIdx, entry := range s.data.Tokens {
+		if fingerprint == "" || entry.Fingerprint != fingerprint {
+			continue
+		}
+		t, err := s.sealer.open(tokenIdx, entry.Record)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func (s *FileTokenStore) Update(ctx context.Context, networkToken string, fn func(t *NetworkToken) error) (*NetworkToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.get(networkToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+	return t, s.put(t)
+}
+
+func (s *FileTokenStore) Fingerprint(cardNumber string) string {
+	return s.sealer.cardFingerprint(cardNumber)
+}
+
+func (s *FileTokenStore) IncrementStat(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Stats[name]++
+	s.statsDirty = true
+	return nil
+}
+
+func (s *FileTokenStore) Stats(ctx context.Context) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]int64, len(s.data.Stats))
+	for name, value := range s.data.Stats {
+		stats[name] = value
+	}
+	return stats, nil
+}
+
+func (s *FileTokenStore) ResetStats(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.Stats = make(map[string]int64)
+	return s.save()
+}
+
+// Close stops the background saving and writes any counters not yet saved
+func (s *FileTokenStore) Close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.flushStats()
+}
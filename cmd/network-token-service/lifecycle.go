@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Token states
+const (
+	TokenStatusActive    = "active"
+	TokenStatusSuspended = "suspended" // Temporarily unusable, e.g. the card was reported lost
+	TokenStatusDeleted   = "deleted"   // Permanently unusable, e.g. the account was closed
+)
+
+// Lifecycle events sent to the orchestrator
+const (
+	TokenEventSuspended  = "suspended"
+	TokenEventResumed    = "resumed"
+	TokenEventDeleted    = "deleted"
+	TokenEventPANUpdated = "pan_updated"
+)
+
+type TokenLifecycleRequest struct {
+	Reason string `json:"reason,omitempty"` // e.g. lost_card, stolen_card, account_closed
+}
+
+type PANUpdateRequest struct {
+	LastFour string `json:"last_four"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+}
+
+type TokenLifecycleResponse struct {
+	Success      bool   `json:"success"`
+	NetworkToken string `json:"network_token,omitempty"`
+	Status       string `json:"status,omitempty"`
+	LastFour     string `json:"last_four,omitempty"`
+	ExpMonth     int    `json:"exp_month,omitempty"`
+	ExpYear      int    `json:"exp_year,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// TokenNotification is posted to the orchestrator when a token changes. It
+// carries the token's whole state, so whichever notification happened last
+// wins regardless of the order they arrive in.
+type TokenNotification struct {
+	EventID      string    `json:"event_id"`
+	NetworkToken string    `json:"network_token"`
+	Event        string    `json:"event"`
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason,omitempty"`
+	LastFour     string    `json:"last_four"`
+	ExpMonth     int       `json:"exp_month"`
+	ExpYear      int       `json:"exp_year"`
+	OccurredAt   time.Time `json:"occurred_at"`
+}
+
+// lifecycleError reports why a token can't be used, if it can't
+func (t *NetworkToken) lifecycleError() (code, message string) {
+	switch t.Status {
+	case TokenStatusSuspended:
+		return "TOKEN_SUSPENDED", "Network token is suspended"
+	case TokenStatusDeleted:
+		return "TOKEN_DELETED", "Network token has been deleted"
+	}
+	return "", ""
+}
+
+// tokenRefusal is returned from a store update to refuse the change
+type tokenRefusal struct {
+	status        int
+	code, message string
+}
+
+func (e *tokenRefusal) Error() string {
+	return e.message
+}
+
+func refuse(status int, code, message string) error {
+	return &tokenRefusal{status: status, code: code, message: message}
+}
+
+// suspendToken stops a token from being used until it is resumed
+func (nts *NetworkTokenService) suspendToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenLifecycleRequest
+	if !decodeOptional(w, r, &req) {
+		return
+	}
+
+	nts.changeToken(w, r, TokenEventSuspended, func(t *NetworkToken) error {
+		if t.Status != TokenStatusActive {
+			return refuse(http.StatusConflict, "INVALID_TOKEN_STATE", "Only active tokens can be suspended")
+		}
+		t.Status = TokenStatusSuspended
+		t.StatusReason = req.Reason
+		return nil
+	})
+}
+
+// resumeToken makes a suspended token usable again
+func (nts *NetworkTokenService) resumeToken(w http.ResponseWriter, r *http.Request) {
+	nts.changeToken(w, r, TokenEventResumed, func(t *NetworkToken) error {
+		if t.Status != TokenStatusSuspended {
+			return refuse(http.StatusConflict, "INVALID_TOKEN_STATE", "Only suspended tokens can be resumed")
+		}
+		t.Status = TokenStatusActive
+		t.StatusReason = ""
+		return nil
+	})
+}
+
+// deleteToken retires a token for good. It stays known so later uses are
+// refused as deleted rather than unknown.
+func (nts *NetworkTokenService) deleteToken(w http.ResponseWriter, r *http.Request) {
+	var req TokenLifecycleRequest
+	if !decodeOptional(w, r, &req) {
+		return
+	}
+
+	nts.changeToken(w, r, TokenEventDeleted, func(t *NetworkToken) error {
+		if t.Status == TokenStatusDeleted {
+			return refuse(http.StatusConflict, "INVALID_TOKEN_STATE", "Network token is already deleted")
+		}
+		t.Status = TokenStatusDeleted
+		t.StatusReason = req.Reason
+		return nil
+	})
+}
+
+// updateTokenPAN moves a token onto a reissued card. The token value stays
+// the same, so merchants keep charging it without asking the customer.
+func (nts *NetworkTokenService) updateTokenPAN(w http.ResponseWriter, r *http.Request) {
+	var req PANUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validLastFour(req.LastFour) || req.ExpMonth < 1 || req.ExpMonth > 12 || req.ExpYear < time.Now().Year() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(TokenLifecycleResponse{
+			ErrorCode:    "INVALID_REQUEST",
+			ErrorMessage: "last_four must be 4 digits and exp_month/exp_year a current expiry",
+		})
+		return
+	}
+
+	nts.changeToken(w, r, TokenEventPANUpdated, func(t *NetworkToken) error {
+		if t.Status == TokenStatusDeleted {
+			return refuse(http.StatusUnprocessableEntity, "TOKEN_DELETED", "Network token has been deleted")
+		}
+		t.LastFour = req.LastFour
+		t.ExpiryMonth = req.ExpMonth
+		t.ExpiryYear = req.ExpYear
+		t.ExpiresAt = time.Date(req.ExpYear, time.Month(req.ExpMonth), 1, 0, 0, 0, 0, time.UTC)
+		return nil
+	})
+}
+
+// changeToken applies a lifecycle change to the token in the URL and, when
+// apply accepts it, notifies the orchestrator
+func (nts *NetworkTokenService) changeToken(w http.ResponseWriter, r *http.Request, event string, apply func(t *NetworkToken) error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, err := nts.store.Update(r.Context(), mux.Vars(r)["token"], func(t *NetworkToken) error {
+		if t.TokenType != "network" {
+			return refuse(http.StatusUnprocessableEntity, "TOKEN_NOT_ELIGIBLE", "Only network tokens have a lifecycle")
+		}
+		return apply(t)
+	})
+	var refusal *tokenRefusal
+	if errors.Is(err, ErrTokenNotFound) {
+		refusal = &tokenRefusal{status: http.StatusNotFound, code: "TOKEN_NOT_FOUND", message: "Network token not found"}
+	} else if err != nil && !errors.As(err, &refusal) {
+		nts.storeError(w, err)
+		return
+	}
+	if refusal != nil {
+		w.WriteHeader(refusal.status)
+		json.NewEncoder(w).Encode(TokenLifecycleResponse{ErrorCode: refusal.code, ErrorMessage: refusal.message})
+		return
+	}
+
+	notification := TokenNotification{
+		EventID:      uuid.New().String(),
+		NetworkToken: token.NetworkToken,
+		Event:        event,
+		Status:       token.Status,
+		Reason:       token.StatusReason,
+		LastFour:     token.LastFour,
+		ExpMonth:     token.ExpiryMonth,
+		ExpYear:      token.ExpiryYear,
+		OccurredAt:   time.Now().UTC(),
+	}
+
+	log.Printf("Network token %s (%s) %s", notification.NetworkToken, notification.LastFour, event)
+	go nts.notify(notification)
+
+	json.NewEncoder(w).Encode(TokenLifecycleResponse{
+		Success:      true,
+		NetworkToken: notification.NetworkToken,
+		Status:       notification.Status,
+		LastFour:     notification.LastFour,
+		ExpMonth:     notification.ExpMonth,
+		ExpYear:      notification.ExpYear,
+	})
+}
+
+// notify sends a lifecycle notification to the orchestrator, retrying with
+// backoff for a while as the card networks would
+func (nts *NetworkTokenService) notify(n TokenNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Failed to encode token notification %s: %v", n.EventID, err)
+		return
+	}
+
+	url := nts.orchestratorURL + "/network-tokens/notifications"
+	client := &http.Client{Timeout: 5 * time.Second}
+	delay := time.Second
+	for attempt := 1; attempt <= 6; attempt++ {
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		log.Printf("Token notification %s attempt %d failed: %v", n.EventID, attempt, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Printf("Gave up notifying the orchestrator that %s was %s", n.NetworkToken, n.Event)
+}
+
+// decodeOptional reads a request body that may be left out
+func decodeOptional(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func validLastFour(s string) bool {
+	if len(s) != 4 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func orchestratorURL() string {
+	if url := os.Getenv("ORCHESTRATOR_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8001"
+}
@@ -2,7 +2,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -18,11 +20,12 @@ import (
 type NetworkTokenService struct {
 	mu            sync.RWMutex
 	successRate   float64
-	networkTokens map[string]*NetworkToken
-	stats         NetworkTokenStats
+	store         TokenStore // Tokens and stats, shared by every replica with the Postgres store
 	processorAURL string
 	processorBURL string
-	isHealthy     bool
+	// Where token lifecycle notifications are sent
+	orchestratorURL string
+	isHealthy       bool
 }
 
 type NetworkTokenStats struct {
@@ -32,6 +35,8 @@ type NetworkTokenStats struct {
 	NetworkTokenRate     float64 `json:"network_token_rate"`
 	RefreshRequests      int     `json:"refresh_requests"`
 	ValidationRequests   int     `json:"validation_requests"`
+	UpgradeRequests      int     `json:"upgrade_requests"`
+	TokensUpgraded       int     `json:"tokens_upgraded"` // Dual-vault cards that later got a network token
 }
 
 type NetworkToken struct {
@@ -48,6 +53,12 @@ type NetworkToken struct {
 	CreatedAt        time.Time `json:"created_at"`
 	ExpiresAt        time.Time `json:"expires_at"`
 	SupportedMarkets []string  `json:"supported_markets"`
+	Status           string    `json:"status"`                // active, suspended or deleted
+	Fingerprint      string    `json:"fingerprint,omitempty"` // Same for every token of a card
+	CardNumber       string    `json:"-"`                     // Only kept encrypted in the store
+	UseCounter       uint32    `json:"-"`                     // Cryptograms issued so far
+	StatusReason     string    `json:"-"`                     // Why the token was last suspended or deleted
+	UpgradedTo       string    `json:"-"`                     // Network token a dual-vault card was upgraded to
 }
 
 type CreateTokenRequest struct {
@@ -99,6 +110,8 @@ type RefreshTokenResponse struct {
 	Success         bool   `json:"success"`
 	NewNetworkToken string `json:"new_network_token,omitempty"`
 	ExpiresAt       string `json:"expires_at,omitempty"`
+	ExpMonth        int    `json:"exp_month,omitempty"`
+	ExpYear         int    `json:"exp_year,omitempty"`
 	ErrorCode       string `json:"error_code,omitempty"`
 	ErrorMessage    string `json:"error_message,omitempty"`
 }
@@ -114,25 +127,27 @@ type TokenInfoResponse struct {
 	CreatedAt        time.Time `json:"created_at"`
 	ExpiresAt        time.Time `json:"expires_at"`
 	SupportedMarkets []string  `json:"supported_markets"`
+	Status           string    `json:"status"`
+	StatusReason     string    `json:"status_reason,omitempty"`
+	Fingerprint      string    `json:"fingerprint,omitempty"`
 }
 
-func NewNetworkTokenService() *NetworkTokenService {
-	return &NetworkTokenService{
-		successRate:   0.95, // 95% success rate for network tokens
-		networkTokens: make(map[string]*NetworkToken),
-		stats: NetworkTokenStats{
-			NetworkTokenRate: 95.0,
-		},
-		processorAURL: "http://mock-processor-a:8101",
-		processorBURL: "http://mock-processor-b:8102",
-		isHealthy:     true,
+func NewNetworkTokenService(store TokenStore) *NetworkTokenService {
+	nts := &NetworkTokenService{
+		successRate:     0.95, // 95% success rate for network tokens
+		store:           store,
+		processorAURL:   "http://mock-processor-a:8101",
+		processorBURL:   "http://mock-processor-b:8102",
+		orchestratorURL: orchestratorURL(),
+		isHealthy:       true,
 	}
+	nts.seedDemoTokens()
+	return nts
 }
 
 func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Request) {
-	nts.mu.Lock()
-	nts.stats.TotalRequests++
-	nts.mu.Unlock()
+	ctx := r.Context()
+	nts.countStat(ctx, statTotalRequests)
 
 	var req CreateTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -160,6 +175,7 @@ func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Reque
 	// Extract card information
 	lastFour := req.CardNumber[len(req.CardNumber)-4:]
 	brand := nts.getCardBrand(req.CardNumber)
+	fingerprint := nts.store.Fingerprint(req.CardNumber)
 
 	// Determine if network token creation succeeds (95% rate)
 	nts.mu.RLock()
@@ -180,13 +196,16 @@ func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Reque
 			CreatedAt:        time.Now(),
 			ExpiresAt:        time.Date(req.ExpYear, time.Month(req.ExpMonth), 1, 0, 0, 0, 0, time.UTC),
 			SupportedMarkets: []string{"US", "EU", "UK", "JP", "AU", "CA"},
+			Status:           TokenStatusActive,
+			Fingerprint:      fingerprint,
+			CardNumber:       req.CardNumber,
 		}
 
-		nts.mu.Lock()
-		nts.networkTokens[networkToken.NetworkToken] = networkToken
-		nts.stats.NetworkTokensCreated++
-		nts.stats.NetworkTokenRate = float64(nts.stats.NetworkTokensCreated) / float64(nts.stats.TotalRequests) * 100
-		nts.mu.Unlock()
+		if err := nts.store.Create(ctx, networkToken); err != nil {
+			nts.storeError(w, err)
+			return
+		}
+		nts.countStat(ctx, statNetworkTokensCreated)
 
 		response := CreateTokenResponse{
 			Success:      true,
@@ -200,11 +219,6 @@ func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Dual vault fallback path (5%)
-	nts.mu.Lock()
-	nts.stats.DualVaultFallbacks++
-	nts.stats.NetworkTokenRate = float64(nts.stats.NetworkTokensCreated) / float64(nts.stats.TotalRequests) * 100
-	nts.mu.Unlock()
-
 	// Create processor-specific tokens for dual vault
 	processorAToken := fmt.Sprintf("tok_a_%s_%s", lastFour, uuid.New().String()[:8])
 	processorBToken := fmt.Sprintf("tok_b_%s_%s", lastFour, uuid.New().String()[:8])
@@ -224,18 +238,19 @@ func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Reque
 		CreatedAt:        time.Now(),
 		ExpiresAt:        time.Date(req.ExpYear, time.Month(req.ExpMonth), 1, 0, 0, 0, 0, time.UTC),
 		SupportedMarkets: []string{"US", "EU", "UK", "JP", "AU", "CA"},
+		Status:           TokenStatusActive,
+		Fingerprint:      fingerprint,
+		CardNumber:       req.CardNumber,
 	}
 
-	nts.networkTokens[dualVaultToken.NetworkToken] = dualVaultToken
+	if err := nts.store.Create(ctx, dualVaultToken); err != nil {
+		nts.storeError(w, err)
+		return
+	}
+	nts.countStat(ctx, statDualVaultFallbacks)
 
 	// Determine reason for network token failure
-	reasons := []string{
-		"card_not_supported",
-		"issuer_not_participating",
-		"geographic_restriction",
-		"card_type_unsupported",
-	}
-	reason := reasons[rand.Intn(len(reasons))]
+	reason := fallbackReasons[rand.Intn(len(fallbackReasons))]
 
 	response := CreateTokenResponse{
 		Success:    true, // Still successful, just using dual vault
@@ -254,9 +269,7 @@ func (nts *NetworkTokenService) createToken(w http.ResponseWriter, r *http.Reque
 }
 
 func (nts *NetworkTokenService) validateToken(w http.ResponseWriter, r *http.Request) {
-	nts.mu.Lock()
-	nts.stats.ValidationRequests++
-	nts.mu.Unlock()
+	nts.countStat(r.Context(), statValidationRequests)
 
 	var req ValidateTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -266,11 +279,13 @@ func (nts *NetworkTokenService) validateToken(w http.ResponseWriter, r *http.Req
 
 	w.Header().Set("Content-Type", "application/json")
 
-	nts.mu.RLock()
-	token, exists := nts.networkTokens[req.NetworkToken]
-	nts.mu.RUnlock()
+	token, err := nts.store.Get(r.Context(), req.NetworkToken)
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		nts.storeError(w, err)
+		return
+	}
 
-	if !exists {
+	if token == nil {
 		response := ValidateTokenResponse{
 			Valid:        false,
 			ErrorCode:    "TOKEN_NOT_FOUND",
@@ -281,6 +296,17 @@ func (nts *NetworkTokenService) validateToken(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Suspended and deleted tokens can't be used
+	if code, message := token.lifecycleError(); code != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ValidateTokenResponse{
+			Valid:        false,
+			ErrorCode:    code,
+			ErrorMessage: message,
+		})
+		return
+	}
+
 	// Check if token is expired
 	if time.Now().After(token.ExpiresAt) {
 		response := ValidateTokenResponse{
@@ -310,9 +336,8 @@ func (nts *NetworkTokenService) validateToken(w http.ResponseWriter, r *http.Req
 }
 
 func (nts *NetworkTokenService) refreshToken(w http.ResponseWriter, r *http.Request) {
-	nts.mu.Lock()
-	nts.stats.RefreshRequests++
-	nts.mu.Unlock()
+	ctx := r.Context()
+	nts.countStat(ctx, statRefreshRequests)
 
 	var req RefreshTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -322,11 +347,13 @@ func (nts *NetworkTokenService) refreshToken(w http.ResponseWriter, r *http.Requ
 
 	w.Header().Set("Content-Type", "application/json")
 
-	nts.mu.RLock()
-	token, exists := nts.networkTokens[req.NetworkToken]
-	nts.mu.RUnlock()
+	token, err := nts.store.Get(ctx, req.NetworkToken)
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		nts.storeError(w, err)
+		return
+	}
 
-	if !exists {
+	if token == nil {
 		response := RefreshTokenResponse{
 			Success:      false,
 			ErrorCode:    "TOKEN_NOT_FOUND",
@@ -337,19 +364,42 @@ func (nts *NetworkTokenService) refreshToken(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if code, message := token.lifecycleError(); code != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(RefreshTokenResponse{
+			Success:      false,
+			ErrorCode:    code,
+			ErrorMessage: message,
+		})
+		return
+	}
+
+	// Without a new expiry, ask the issuer for the card's current one
+	if req.ExpMonth == 0 && req.ExpYear == 0 {
+		nts.accountUpdate(ctx, w, token)
+		return
+	}
+
 	// Update token expiry
 	newExpiresAt := time.Date(req.ExpYear, time.Month(req.ExpMonth), 1, 0, 0, 0, 0, time.UTC)
 
-	nts.mu.Lock()
-	token.ExpiryMonth = req.ExpMonth
-	token.ExpiryYear = req.ExpYear
-	token.ExpiresAt = newExpiresAt
-	nts.mu.Unlock()
+	token, err = nts.store.Update(ctx, req.NetworkToken, func(t *NetworkToken) error {
+		t.ExpiryMonth = req.ExpMonth
+		t.ExpiryYear = req.ExpYear
+		t.ExpiresAt = newExpiresAt
+		return nil
+	})
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
 
 	response := RefreshTokenResponse{
 		Success:         true,
 		NewNetworkToken: token.NetworkToken, // In practice, this might be a new token
 		ExpiresAt:       newExpiresAt.Format(time.RFC3339),
+		ExpMonth:        req.ExpMonth,
+		ExpYear:         req.ExpYear,
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -361,16 +411,21 @@ func (nts *NetworkTokenService) getTokenInfo(w http.ResponseWriter, r *http.Requ
 
 	w.Header().Set("Content-Type", "application/json")
 
-	nts.mu.RLock()
-	token, exists := nts.networkTokens[networkToken]
-	nts.mu.RUnlock()
-
-	if !exists {
+	token, err := nts.store.Get(r.Context(), networkToken)
+	if errors.Is(err, ErrTokenNotFound) {
 		http.Error(w, "Token not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokenInfo(token))
+}
 
-	response := TokenInfoResponse{
+func tokenInfo(token *NetworkToken) TokenInfoResponse {
+	return TokenInfoResponse{
 		NetworkToken:     token.NetworkToken,
 		TokenType:        token.TokenType,
 		IsPortable:       token.IsPortable,
@@ -381,15 +436,76 @@ func (nts *NetworkTokenService) getTokenInfo(w http.ResponseWriter, r *http.Requ
 		CreatedAt:        token.CreatedAt,
 		ExpiresAt:        token.ExpiresAt,
 		SupportedMarkets: token.SupportedMarkets,
+		Status:           token.Status,
+		StatusReason:     token.StatusReason,
+		Fingerprint:      token.Fingerprint,
 	}
+}
 
-	json.NewEncoder(w).Encode(response)
+// lookupTokens finds tokens by the processor token of a dual-vault card or
+// by card fingerprint (GET /network-tokens/lookup?processor_token=|fingerprint=)
+func (nts *NetworkTokenService) lookupTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	processorToken := r.URL.Query().Get("processor_token")
+	fingerprint := r.URL.Query().Get("fingerprint")
+
+	var found []*NetworkToken
+	var err error
+	switch {
+	case processorToken != "":
+		var token *NetworkToken
+		if token, err = nts.store.GetByProcessorToken(ctx, processorToken); err == nil {
+			found = append(found, token)
+		} else if errors.Is(err, ErrTokenNotFound) {
+			err = nil
+		}
+	case fingerprint != "":
+		found, err = nts.store.ListByFingerprint(ctx, fingerprint)
+	default:
+		http.Error(w, "processor_token or fingerprint is required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	tokens := make([]TokenInfoResponse, 0, len(found))
+	for _, token := range found {
+		tokens = append(tokens, tokenInfo(token))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tokens": tokens,
+		"count":  len(tokens),
+	})
 }
 
+// getStats reports the counters kept in the store, so they survive restarts
+// and add up across replicas
 func (nts *NetworkTokenService) getStats(w http.ResponseWriter, r *http.Request) {
-	nts.mu.RLock()
-	stats := nts.stats
-	nts.mu.RUnlock()
+	counters, err := nts.store.Stats(r.Context())
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	stats := NetworkTokenStats{
+		TotalRequests:        int(counters[statTotalRequests]),
+		NetworkTokensCreated: int(counters[statNetworkTokensCreated]),
+		DualVaultFallbacks:   int(counters[statDualVaultFallbacks]),
+		RefreshRequests:      int(counters[statRefreshRequests]),
+		ValidationRequests:   int(counters[statValidationRequests]),
+		UpgradeRequests:      int(counters[statUpgradeRequests]),
+		TokensUpgraded:       int(counters[statTokensUpgraded]),
+	}
+	if stats.TotalRequests > 0 {
+		stats.NetworkTokenRate = float64(stats.NetworkTokensCreated) / float64(stats.TotalRequests) * 100
+	} else {
+		nts.mu.RLock()
+		stats.NetworkTokenRate = nts.successRate * 100
+		nts.mu.RUnlock()
+	}
 
 	response := map[string]interface{}{
 		"service_name": "network_token_service",
@@ -457,11 +573,10 @@ func (nts *NetworkTokenService) setSuccessRate(w http.ResponseWriter, r *http.Re
 }
 
 func (nts *NetworkTokenService) resetStats(w http.ResponseWriter, r *http.Request) {
-	nts.mu.Lock()
-	nts.stats = NetworkTokenStats{
-		NetworkTokenRate: nts.successRate * 100,
+	if err := nts.store.ResetStats(r.Context()); err != nil {
+		nts.storeError(w, err)
+		return
 	}
-	nts.mu.Unlock()
 
 	response := map[string]interface{}{
 		"message": "Statistics reset successfully",
@@ -472,6 +587,19 @@ func (nts *NetworkTokenService) resetStats(w http.ResponseWriter, r *http.Reques
 }
 
 // Helper functions
+
+// countStat bumps a counter; a failure is logged rather than failing the request
+func (nts *NetworkTokenService) countStat(ctx context.Context, name string) {
+	if err := nts.store.IncrementStat(ctx, name); err != nil {
+		log.Printf("Failed to count %s: %v", name, err)
+	}
+}
+
+func (nts *NetworkTokenService) storeError(w http.ResponseWriter, err error) {
+	log.Printf("Token store error: %v", err)
+	http.Error(w, "Token store unavailable", http.StatusInternalServerError)
+}
+
 func (nts *NetworkTokenService) getCardBrand(cardNumber string) string {
 	// Simple card brand detection
 	if strings.HasPrefix(cardNumber, "4") {
@@ -487,15 +615,30 @@ func (nts *NetworkTokenService) getCardBrand(cardNumber string) string {
 }
 
 func main() {
-	service := NewNetworkTokenService()
+	store, err := NewTokenStore()
+	if err != nil {
+		log.Fatalf("Failed to open token store: %v", err)
+	}
+	defer store.Close()
+
+	service := NewNetworkTokenService(store)
 	r := mux.NewRouter()
 
 	// Core network token endpoints
 	r.HandleFunc("/network-tokens/create", service.createToken).Methods("POST")
 	r.HandleFunc("/network-tokens/validate", service.validateToken).Methods("POST")
 	r.HandleFunc("/network-tokens/refresh", service.refreshToken).Methods("POST")
+	r.HandleFunc("/network-tokens/cryptogram", service.issueCryptogram).Methods("POST")
+	r.HandleFunc("/network-tokens/upgrade", service.upgradeToken).Methods("POST")
+	r.HandleFunc("/network-tokens/lookup", service.lookupTokens).Methods("GET")
 	r.HandleFunc("/network-tokens/{token}", service.getTokenInfo).Methods("GET")
 
+	// Token lifecycle, as reported by the card networks
+	r.HandleFunc("/network-tokens/{token}/suspend", service.suspendToken).Methods("POST")
+	r.HandleFunc("/network-tokens/{token}/resume", service.resumeToken).Methods("POST")
+	r.HandleFunc("/network-tokens/{token}/pan-update", service.updateTokenPAN).Methods("POST")
+	r.HandleFunc("/network-tokens/{token}", service.deleteToken).Methods("DELETE")
+
 	// Debug endpoint to list all routes
 	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -503,7 +646,14 @@ func main() {
 		w.Write([]byte("POST /network-tokens/create\n"))
 		w.Write([]byte("POST /network-tokens/validate\n"))
 		w.Write([]byte("POST /network-tokens/refresh\n"))
+		w.Write([]byte("POST /network-tokens/cryptogram\n"))
+		w.Write([]byte("POST /network-tokens/upgrade\n"))
+		w.Write([]byte("GET /network-tokens/lookup?processor_token=|fingerprint=\n"))
 		w.Write([]byte("GET /network-tokens/{token}\n"))
+		w.Write([]byte("POST /network-tokens/{token}/suspend\n"))
+		w.Write([]byte("POST /network-tokens/{token}/resume\n"))
+		w.Write([]byte("POST /network-tokens/{token}/pan-update\n"))
+		w.Write([]byte("DELETE /network-tokens/{token}\n"))
 		w.Write([]byte("GET /health\n"))
 		w.Write([]byte("GET /admin/stats\n"))
 	})
@@ -529,7 +679,14 @@ func main() {
 	log.Println("   POST /network-tokens/create")
 	log.Println("   POST /network-tokens/validate")
 	log.Println("   POST /network-tokens/refresh")
+	log.Println("   POST /network-tokens/upgrade")
+	log.Println("   GET /network-tokens/lookup?processor_token=|fingerprint=")
 	log.Println("   GET /network-tokens/{token}")
+	log.Println("🔄 Lifecycle endpoints (notify the orchestrator):")
+	log.Println("   POST /network-tokens/{token}/suspend")
+	log.Println("   POST /network-tokens/{token}/resume")
+	log.Println("   POST /network-tokens/{token}/pan-update")
+	log.Println("   DELETE /network-tokens/{token}")
 
 	log.Fatal(http.ListenAndServe(":8103", r))
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+// PostgresTokenStore keeps tokens in the network_token_vault table, shared
+// by every replica of the service
+type PostgresTokenStore struct {
+	db     *sql.DB
+	sealer *sealer
+}
+
+// NewPostgresTokenStore connects to the database holding the vault tables
+// (migrations/025_network_token_vault.sql)
+func NewPostgresTokenStore(connectionString string, sealer *sealer) (*PostgresTokenStore, error) {
+	if connectionString == "" {
+		return nil, fmt.Errorf("DATABASE_URL is required for the postgres token store")
+	}
+	db, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to token store: %w", err)
+	}
+	return &PostgresTokenStore{db: db, sealer: sealer}, nil
+}
+
+func (s *PostgresTokenStore) Create(ctx context.Context, t *NetworkToken) error {
+	record, err := s.sealer.seal(t)
+	if err != nil {
+		return err
+	}
+	idx := s.sealer.indexes(t)
+
+	query := `
+		INSERT INTO network_token_vault (token_index, processor_a_index, processor_b_index, fingerprint, record)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5)`
+
+	if _, err := s.db.ExecContext(ctx, query, idx.Token, idx.ProcessorA, idx.ProcessorB, idx.Fingerprint, record); err != nil {
+		return fmt.Errorf("failed to store network token: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresTokenStore) Get(ctx context.Context, networkToken string) (*NetworkToken, error) {
+	return s.getOne(ctx, s.db, `SELECT token_index, record FROM network_token_vault WHERE token_index = $1`,
+		s.sealer.index(networkToken))
+}
+
+func (s *PostgresTokenStore) GetByProcessorToken(ctx context.Context, processorToken string) (*NetworkToken, error) {
+	return s.getOne(ctx, s.db, `
+		SELECT token_index, record FROM network_token_vault
+		WHERE processor_a_index = $1 OR processor_b_index = $1
+		LIMIT 1`, s.sealer.index(processorToken))
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *PostgresTokenStore) getOne(ctx context.Context, q queryRower, query string, arg string) (*NetworkToken, error) {
+	var tokenIdx string
+	var record []byte
+	err := q.QueryRowContext(ctx, query, arg).Scan(&tokenIdx, &record)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load network token: %w", err)
+	}
+	return s.sealer.open(tokenIdx, record)
+}
+
+func (s *PostgresTokenStore) ListByFingerprint(ctx context.Context, fingerprint string) ([]*NetworkToken, error) {
+	query := `
+		SELECT token_index, record FROM network_token_vault
+		WHERE fingerprint = $1
+		ORDER BY created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*NetworkToken{}
+	for rows.Next() {
+		var tokenIdx string
+		var record []byte
+		if err := rows.Scan(&tokenIdx, &record); err != nil {
+			return nil, err
+		}
+		t, err := s.sealer.open(tokenIdx, record)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresTokenStore) Update(ctx context.Context, networkToken string, fn func(t *NetworkToken) error) (*NetworkToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t, err := s.getOne(ctx, tx, `SELECT token_index, record FROM network_token_vault WHERE token_index = $1 FOR UPDATE`,
+		s.sealer.index(networkToken))
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(t); err != nil {
+		return nil, err
+	}
+
+	record, err := s.sealer.seal(t)
+	if err != nil {
+		return nil, err
+	}
+	idx := s.sealer.indexes(t)
+
+	query := `
+		UPDATE network_token_vault
+		SET processor_a_index = NULLIF($2, ''), processor_b_index = NULLIF($3, ''),
+			fingerprint = NULLIF($4, ''), record = $5, updated_at = NOW()
+		WHERE token_index = $1`
+
+	if _, err := tx.ExecContext(ctx, query, idx.Token, idx.ProcessorA, idx.ProcessorB, idx.Fingerprint, record); err != nil {
+		return nil, fmt.Errorf("failed to update network token: %w", err)
+	}
+	return t, tx.Commit()
+}
+
+func (s *PostgresTokenStore) Fingerprint(cardNumber string) string {
+	return s.sealer.cardFingerprint(cardNumber)
+}
+
+func (s *PostgresTokenStore) IncrementStat(ctx context.Context, name string) error {
+	query := `
+		INSERT INTO network_token_stats (name, value) VALUES ($1, 1)
+		ON CONFLICT (name) DO UPDATE SET value = network_token_stats.value + 1`
+
+	_, err := s.db.ExecContext(ctx, query, name)
+	return err
+}
+
+func (s *PostgresTokenStore) Stats(ctx context.Context) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, value FROM network_token_stats`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		stats[name] = value
+	}
+	return stats, rows.Err()
+}
+
+func (s *PostgresTokenStore) ResetStats(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE network_token_stats SET value = 0`)
+	return err
+}
+
+func (s *PostgresTokenStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ErrTokenNotFound is returned by a TokenStore for an unknown token
+var ErrTokenNotFound = errors.New("network token not found")
+
+// Stat counters kept by a TokenStore
+const (
+	statTotalRequests        = "total_requests"
+	statNetworkTokensCreated = "network_tokens_created"
+	statDualVaultFallbacks   = "dual_vault_fallbacks"
+	statRefreshRequests      = "refresh_requests"
+	statValidationRequests   = "validation_requests"
+	statUpgradeRequests      = "upgrade_requests"
+	statTokensUpgraded       = "tokens_upgraded"
+)
+
+// TokenStore persists network tokens and the service's counters. Token
+// records are encrypted at rest; tokens, processor tokens and card
+// fingerprints are only stored as keyed hashes for lookups.
+type TokenStore interface {
+	// Create stores a new token
+	Create(ctx context.Context, token *NetworkToken) error
+	// Get returns the token with the given network token value
+	Get(ctx context.Context, networkToken string) (*NetworkToken, error)
+	// GetByProcessorToken returns the dual-vault token holding a processor token
+	GetByProcessorToken(ctx context.Context, processorToken string) (*NetworkToken, error)
+	// ListByFingerprint returns every token issued for a card
+	ListByFingerprint(ctx context.Context, fingerprint string) ([]*NetworkToken, error)
+	// Update applies fn to a token and stores the result. Updates of one
+	// token are serialized; if fn fails nothing is stored and its error is
+	// returned.
+	Update(ctx context.Context, networkToken string, fn func(t *NetworkToken) error) (*NetworkToken, error)
+	// Fingerprint identifies a card across tokens without revealing its number
+	Fingerprint(cardNumber string) string
+
+	// IncrementStat adds one to a counter
+	IncrementStat(ctx context.Context, name string) error
+	// Stats returns every counter
+	Stats(ctx context.Context) (map[string]int64, error)
+	// ResetStats zeroes every counter
+	ResetStats(ctx context.Context) error
+
+	Close() error
+}
+
+// NewTokenStore opens the store selected by TOKEN_STORE: "postgres" uses
+// DATABASE_URL, "file" (the default) TOKEN_STORE_PATH
+func NewTokenStore() (TokenStore, error) {
+	key, err := storeKey()
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newSealer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind := os.Getenv("TOKEN_STORE"); kind {
+	case "postgres":
+		return NewPostgresTokenStore(os.Getenv("DATABASE_URL"), sealer)
+	case "", "file":
+		path := os.Getenv("TOKEN_STORE_PATH")
+		if path == "" {
+			path = "data/network-tokens.json"
+		}
+		return NewFileTokenStore(path, sealer)
+	default:
+		return nil, fmt.Errorf("unknown TOKEN_STORE %q", kind)
+	}
+}
+
+// storeKey returns TOKEN_STORE_KEY. The published demo key is only used
+// when TOKEN_STORE_KEY_DEMO=1 asks for it.
+func storeKey() ([]byte, error) {
+	if key := os.Getenv("TOKEN_STORE_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	if os.Getenv("TOKEN_STORE_KEY_DEMO") == "1" {
+		log.Println("⚠️  TOKEN_STORE_KEY_DEMO set, using the demo key")
+		return []byte("demo-token-store-key"), nil
+	}
+	return nil, errors.New("TOKEN_STORE_KEY is required (set TOKEN_STORE_KEY_DEMO=1 to use the demo key)")
+}
+
+// storedToken is what is encrypted for each token, including the fields
+// never sent to clients
+type storedToken struct {
+	NetworkToken
+	CardNumber   string `json:"card_number,omitempty"`
+	UseCounter   uint32 `json:"use_counter"`
+	StatusReason string `json:"status_reason,omitempty"`
+	UpgradedTo   string `json:"upgraded_to,omitempty"`
+}
+
+// tokenIndexes are the keyed hashes a token is looked up by
+type tokenIndexes struct {
+	Token       string
+	ProcessorA  string
+	ProcessorB  string
+	Fingerprint string
+}
+
+// sealer encrypts token records with AES-256-GCM and derives lookup hashes.
+// Both keys are derived from one master key.
+type sealer struct {
+	aead     cipher.AEAD
+	indexKey []byte
+}
+
+func newSealer(masterKey []byte) (*sealer, error) {
+	block, err := aes.NewCipher(deriveKey(masterKey, "record"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, indexKey: deriveKey(masterKey, "index")}, nil
+}
+
+func deriveKey(masterKey []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, masterKey)
+	mac.Write([]byte("network-token-store|" + purpose))
+	return mac.Sum(nil)
+}
+
+// index hashes a lookup value; empty values have no index
+func (s *sealer) index(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *sealer) indexes(t *NetworkToken) tokenIndexes {
+	return tokenIndexes{
+		Token:       s.index(t.NetworkToken),
+		ProcessorA:  s.index(t.ProcessorAToken),
+		ProcessorB:  s.index(t.ProcessorBToken),
+		Fingerprint: t.Fingerprint,
+	}
+}
+
+// seal encrypts a token, binding the ciphertext to its token index so a
+// record can't be moved to another row
+func (s *sealer) seal(t *NetworkToken) ([]byte, error) {
+	plaintext, err := json.Marshal(storedToken{
+		NetworkToken: *t,
+		CardNumber:   t.CardNumber,
+		UseCounter:   t.UseCounter,
+		StatusReason: t.StatusReason,
+		UpgradedTo:   t.UpgradedTo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(s.index(t.NetworkToken))), nil
+}
+
+func (s *sealer) open(tokenIndex string, sealed []byte) (*NetworkToken, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("sealed token record too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(tokenIndex))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token record: %w", err)
+	}
+
+	var stored storedToken
+	if err := json.Unmarshal(plaintext, &stored); err != nil {
+		return nil, err
+	}
+	t := stored.NetworkToken
+	t.CardNumber = stored.CardNumber
+	t.UseCounter = stored.UseCounter
+	t.StatusReason = stored.StatusReason
+	t.UpgradedTo = stored.UpgradedTo
+	return &t, nil
+}
+
+// cardFingerprint identifies a card across tokens without revealing its number
+func (s *sealer) cardFingerprint(cardNumber string) string {
+	return s.index("card|" + cardNumber)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// statStoreTest is a counter only these tests use
+const statStoreTest = "store_test_requests"
+
+func testSealer(t *testing.T) *sealer {
+	t.Helper()
+	s, err := newSealer([]byte("test-token-store-key"))
+	if err != nil {
+		t.Fatalf("newSealer: %v", err)
+	}
+	return s
+}
+
+// testTokens returns a network token and a dual-vault token for the same
+// card. suffix keeps token values apart between runs against one database.
+func testTokens(s *sealer, suffix string) (*NetworkToken, *NetworkToken) {
+	created := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	fingerprint := s.cardFingerprint("4111111111111111" + suffix)
+
+	network := &NetworkToken{
+		ID:               "nt_1" + suffix,
+		NetworkToken:     "ntk_4111abcd1111" + suffix,
+		TokenType:        "network",
+		LastFour:         "1111",
+		Brand:            "visa",
+		ExpiryMonth:      12,
+		ExpiryYear:       2029,
+		IsPortable:       true,
+		CreatedAt:        created,
+		ExpiresAt:        created.AddDate(3, 0, 0),
+		SupportedMarkets: []string{"US", "EU"},
+		Status:           TokenStatusActive,
+		Fingerprint:      fingerprint,
+		CardNumber:       "4111111111111111",
+		UseCounter:       3,
+	}
+	dualVault := &NetworkToken{
+		ID:               "nt_2" + suffix,
+		NetworkToken:     "dv_4111abcd1111" + suffix,
+		TokenType:        "dual_vault",
+		LastFour:         "1111",
+		Brand:            "visa",
+		ExpiryMonth:      12,
+		ExpiryYear:       2029,
+		ProcessorAToken:  "tok_a_12345678" + suffix,
+		ProcessorBToken:  "tok_b_87654321" + suffix,
+		CreatedAt:        created,
+		ExpiresAt:        created.AddDate(3, 0, 0),
+		SupportedMarkets: []string{"US"},
+		Status:           TokenStatusSuspended,
+		StatusReason:     "card reported lost",
+		Fingerprint:      fingerprint,
+		CardNumber:       "4111111111111111",
+	}
+	return network, dualVault
+}
+
+func checkToken(t *testing.T, what string, got *NetworkToken, err error, want *NetworkToken) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %+v, want %+v", what, got, want)
+	}
+}
+
+// testStoreRoundTrip stores tokens in a fresh store, reads them back by
+// every lookup, then checks reopen sees the same tokens and counters
+func testStoreRoundTrip(t *testing.T, store TokenStore, reopen func() TokenStore, suffix string) {
+	ctx := context.Background()
+	network, dualVault := testTokens(testSealer(t), suffix)
+
+	for _, token := range []*NetworkToken{network, dualVault} {
+		if err := store.Create(ctx, token); err != nil {
+			t.Fatalf("Create(%s): %v", token.NetworkToken, err)
+		}
+	}
+	if err := store.Create(ctx, network); err == nil {
+		t.Error("Create stored the same network token twice")
+	}
+
+	got, err := store.Get(ctx, network.NetworkToken)
+	checkToken(t, "Get", got, err, network)
+	got, err = store.GetByProcessorToken(ctx, dualVault.ProcessorBToken)
+	checkToken(t, "GetByProcessorToken", got, err, dualVault)
+
+	listed, err := store.ListByFingerprint(ctx, network.Fingerprint)
+	if err != nil {
+		t.Fatalf("ListByFingerprint: %v", err)
+	}
+	var values []string
+	for _, token := range listed {
+		values = append(values, token.NetworkToken)
+	}
+	sort.Strings(values)
+	if want := []string{dualVault.NetworkToken, network.NetworkToken}; !reflect.DeepEqual(values, want) {
+		t.Errorf("ListByFingerprint = %v, want %v", values, want)
+	}
+
+	if _, err := store.Get(ctx, "ntk_unknown"+suffix); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get of an unknown token error = %v, want ErrTokenNotFound", err)
+	}
+	if _, err := store.GetByProcessorToken(ctx, ""); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("GetByProcessorToken of an empty token error = %v, want ErrTokenNotFound", err)
+	}
+
+	updated, err := store.Update(ctx, network.NetworkToken, func(token *NetworkToken) error {
+		token.UseCounter++
+		return nil
+	})
+	if err != nil || updated.UseCounter != 4 {
+		t.Fatalf("Update = %+v, %v, want use counter 4", updated, err)
+	}
+	refused := errors.New("refused")
+	if _, err := store.Update(ctx, network.NetworkToken, func(token *NetworkToken) error {
+		token.UseCounter = 99
+		return refused
+	}); !errors.Is(err, refused) {
+		t.Errorf("Update error = %v, want the callback's", err)
+	}
+
+	before, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.IncrementStat(ctx, statStoreTest); err != nil {
+			t.Fatalf("IncrementStat: %v", err)
+		}
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	store = reopen()
+	defer store.Close()
+
+	network.UseCounter = 4
+	got, err = store.Get(ctx, network.NetworkToken)
+	checkToken(t, "Get after reopening", got, err, network)
+	got, err = store.GetByProcessorToken(ctx, dualVault.ProcessorAToken)
+	checkToken(t, "GetByProcessorToken after reopening", got, err, dualVault)
+
+	after, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats after reopening: %v", err)
+	}
+	if after[statStoreTest]-before[statStoreTest] != 2 {
+		t.Errorf("%s went from %d to %d after reopening, want 2 more",
+			statStoreTest, before[statStoreTest], after[statStoreTest])
+	}
+}
+
+func TestFileTokenStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network-tokens.json")
+	open := func() TokenStore {
+		store, err := NewFileTokenStore(path, testSealer(t))
+		if err != nil {
+			t.Fatalf("NewFileTokenStore: %v", err)
+		}
+		return store
+	}
+	testStoreRoundTrip(t, open(), open, "")
+}
+
+func TestFileTokenStoreCountsWithoutRewriting(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "network-tokens.json")
+	store, err := NewFileTokenStore(path, testSealer(t))
+	if err != nil {
+		t.Fatalf("NewFileTokenStore: %v", err)
+	}
+	network, _ := testTokens(testSealer(t), "")
+	if err := store.Create(ctx, network); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := store.IncrementStat(ctx, statTotalRequests); err != nil {
+			t.Fatalf("IncrementStat: %v", err)
+		}
+	}
+	if current, _ := os.ReadFile(path); !bytes.Equal(current, saved) {
+		t.Error("IncrementStat rewrote the token file")
+	}
+
+	if err := store.flushStats(); err != nil {
+		t.Fatalf("flushStats: %v", err)
+	}
+	reopened, err := NewFileTokenStore(path, testSealer(t))
+	if err != nil {
+		t.Fatalf("NewFileTokenStore: %v", err)
+	}
+	defer reopened.Close()
+	if stats, _ := reopened.Stats(ctx); stats[statTotalRequests] != 100 {
+		t.Errorf("%s = %d after flushing, want 100", statTotalRequests, stats[statTotalRequests])
+	}
+	store.Close()
+}
+
+func TestPostgresTokenStoreRoundTrip(t *testing.T) {
+	url := os.Getenv("TOKEN_STORE_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TOKEN_STORE_TEST_DATABASE_URL not set")
+	}
+
+	open := func() TokenStore {
+		store, err := NewPostgresTokenStore(url, testSealer(t))
+		if err != nil {
+			t.Fatalf("NewPostgresTokenStore: %v", err)
+		}
+		return store
+	}
+
+	suffix := fmt.Sprintf("_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		store := open().(*PostgresTokenStore)
+		defer store.Close()
+		network, dualVault := testTokens(store.sealer, suffix)
+		for _, token := range []*NetworkToken{network, dualVault} {
+			store.db.Exec(`DELETE FROM network_token_vault WHERE token_index = $1`, store.sealer.index(token.NetworkToken))
+		}
+		store.db.Exec(`DELETE FROM network_token_stats WHERE name = $1`, statStoreTest)
+	})
+
+	testStoreRoundTrip(t, open(), open, suffix)
+}
+
+func TestStoreKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		demo    string
+		want    string
+		wantErr bool
+	}{
+		{"configured key", "secret-store-key", "", "secret-store-key", false},
+		{"configured key wins over the demo flag", "secret-store-key", "1", "secret-store-key", false},
+		{"demo key asked for", "", "1", "demo-token-store-key", false},
+		{"no key", "", "", "", true},
+		{"demo flag not set to 1", "", "true", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TOKEN_STORE_KEY", tt.key)
+			t.Setenv("TOKEN_STORE_KEY_DEMO", tt.demo)
+
+			key, err := storeKey()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("storeKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(key) != tt.want {
+				t.Errorf("storeKey() = %q, want %q", key, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Why a card couldn't get a network token and fell back to the dual vault
+var fallbackReasons = []string{
+	"card_not_supported",
+	"issuer_not_participating",
+	"geographic_restriction",
+	"card_type_unsupported",
+}
+
+// Share of retries that find the issuer now provisions network tokens
+const upgradeSuccessRate = 0.3
+
+// UpgradeTokenRequest names a dual-vault card by one of its processor tokens,
+// so callers never handle the card number
+type UpgradeTokenRequest struct {
+	ProcessorToken string `json:"processor_token"`
+}
+
+type UpgradeTokenResponse struct {
+	Success      bool          `json:"success"`
+	NetworkToken *NetworkToken `json:"network_token,omitempty"`
+	ErrorCode    string        `json:"error_code,omitempty"`
+	ErrorMessage string        `json:"error_message,omitempty"`
+}
+
+// upgradeToken retries network tokenization for a card that fell back to
+// the dual vault, using the card number kept in the store. The dual-vault
+// token stays valid. Asking again after a success returns the same token.
+func (nts *NetworkTokenService) upgradeToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	nts.countStat(ctx, statUpgradeRequests)
+
+	var req UpgradeTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	fail := func(status int, code, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(UpgradeTokenResponse{ErrorCode: code, ErrorMessage: message})
+	}
+
+	if req.ProcessorToken == "" {
+		fail(http.StatusBadRequest, "INVALID_REQUEST", "processor_token is required")
+		return
+	}
+
+	dual, err := nts.store.GetByProcessorToken(ctx, req.ProcessorToken)
+	if errors.Is(err, ErrTokenNotFound) {
+		fail(http.StatusNotFound, "TOKEN_NOT_FOUND", "No dual-vault card holds this processor token")
+		return
+	}
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	if dual.UpgradedTo != "" {
+		nts.respondUpgraded(w, r, dual.UpgradedTo)
+		return
+	}
+	if code, message := dual.lifecycleError(); code != "" {
+		fail(http.StatusUnprocessableEntity, code, message)
+		return
+	}
+	if dual.CardNumber == "" {
+		fail(http.StatusUnprocessableEntity, "CARD_DETAILS_UNAVAILABLE", "The card number of this token isn't stored")
+		return
+	}
+
+	// Simulate processing time
+	time.Sleep(200 * time.Millisecond)
+
+	if rand.Float64() >= upgradeSuccessRate {
+		reason := fallbackReasons[rand.Intn(len(fallbackReasons))]
+		fail(http.StatusUnprocessableEntity, strings.ToUpper(reason), "The card still can't be network tokenized")
+		return
+	}
+
+	networkToken := &NetworkToken{
+		ID:               uuid.New().String(),
+		NetworkToken:     fmt.Sprintf("ntk_%s_%s_%s", dual.Brand, dual.LastFour, uuid.New().String()[:8]),
+		TokenType:        "network",
+		LastFour:         dual.LastFour,
+		Brand:            dual.Brand,
+		ExpiryMonth:      dual.ExpiryMonth,
+		ExpiryYear:       dual.ExpiryYear,
+		IsPortable:       true,
+		CreatedAt:        time.Now(),
+		ExpiresAt:        dual.ExpiresAt,
+		SupportedMarkets: dual.SupportedMarkets,
+		Status:           TokenStatusActive,
+		Fingerprint:      dual.Fingerprint,
+		CardNumber:       dual.CardNumber,
+	}
+	if err := nts.store.Create(ctx, networkToken); err != nil {
+		nts.storeError(w, err)
+		return
+	}
+
+	// A concurrent upgrade of the same card may have finished first; its
+	// token wins so every caller gets the same one
+	dual, err = nts.store.Update(ctx, dual.NetworkToken, func(t *NetworkToken) error {
+		if t.UpgradedTo == "" {
+			t.UpgradedTo = networkToken.NetworkToken
+		}
+		return nil
+	})
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+	if dual.UpgradedTo == networkToken.NetworkToken {
+		nts.countStat(ctx, statTokensUpgraded)
+	}
+	nts.respondUpgraded(w, r, dual.UpgradedTo)
+}
+
+func (nts *NetworkTokenService) respondUpgraded(w http.ResponseWriter, r *http.Request, networkToken string) {
+	token, err := nts.store.Get(r.Context(), networkToken)
+	if err != nil {
+		nts.storeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(UpgradeTokenResponse{Success: true, NetworkToken: token})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/AnuragDani/subscription-platform/internal/models"
+)
+
+const (
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+	auditPurgeBatch    = 1000
+)
+
+// AuditWriter stores audit entries in batches off the request path. When
+// its buffer is full the entry is written synchronously rather than dropped.
+type AuditWriter struct {
+	db      *DB
+	entries chan *models.AuditLog
+}
+
+// NewAuditWriter creates a writer buffering up to size entries
+func NewAuditWriter(db *DB, size int) *AuditWriter {
+	return &AuditWriter{db: db, entries: make(chan *models.AuditLog, size)}
+}
+
+// Record queues an entry to be stored
+func (a *AuditWriter) Record(entry *models.AuditLog) {
+	select {
+	case a.entries <- entry:
+	default:
+		a.insert([]*models.AuditLog{entry})
+	}
+}
+
+// Run stores queued entries, a batch at a time
+func (a *AuditWriter) Run() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*models.AuditLog, 0, auditBatchSize)
+	for {
+		select {
+		case entry := <-a.entries:
+			batch = append(batch, entry)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		a.insert(batch)
+		batch = batch[:0]
+	}
+}
+
+func (a *AuditWriter) insert(batch []*models.AuditLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := a.db.InsertAuditLogs(ctx, batch); err != nil {
+		log.Printf("Failed to store %d audit log entries: %v", len(batch), err)
+	}
+}
+
+// purgeAuditLogsLoop deletes audit entries past retention, in batches so
+// a large backlog doesn't hold locks for long
+func (o *PaymentOrchestrator) purgeAuditLogsLoop(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-retention)
+		var purged int64
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			n, err := o.db.PurgeAuditLogs(ctx, cutoff, auditPurgeBatch)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to purge audit logs: %v", err)
+				break
+			}
+			purged += n
+			if n < auditPurgeBatch {
+				break
+			}
+		}
+		if purged > 0 {
+			log.Printf("Purged %d audit log entries older than %s", purged, cutoff.Format(time.RFC3339))
+		}
+	}
+}
+
+// AuditLogListResponse is one page of audit entries, newest first
+type AuditLogListResponse struct {
+	Entries    []*models.AuditLog `json:"entries"`
+	HasMore    bool               `json:"has_more"`
+	NextCursor string             `json:"next_cursor,omitempty"` // Pass as ?cursor= for the next page
+}
+
+func encodeAuditLogCursor(last *models.AuditLog) string {
+	data, _ := json.Marshal(AuditLogCursor{CreatedAt: last.Timestamp, ID: last.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAuditLogCursor(cursor string) (*AuditLogCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, false
+	}
+	var c AuditLogCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.CreatedAt.IsZero() {
+		return nil, false
+	}
+	if _, err := uuid.Parse(c.ID); err != nil {
+		return nil, false
+	}
+	return &c, true
+}
+
+// parseAuditLogFilter reads audit log filters from the query string,
+// returning a message describing the first invalid parameter
+func parseAuditLogFilter(r *http.Request) (AuditLogFilter, string) {
+	query := r.URL.Query()
+	filter := AuditLogFilter{
+		TransactionID: query.Get("transaction_id"),
+		Processor:     query.Get("service"),
+		EventType:     query.Get("event_type"),
+		Limit:         100,
+	}
+
+	if _, err := uuid.Parse(filter.TransactionID); filter.TransactionID != "" && err != nil {
+		return filter, "transaction_id must be a UUID"
+	}
+
+	for param, bound := range map[string]**time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, param + " must be an RFC 3339 timestamp"
+			}
+			t = t.UTC()
+			*bound = &t
+		}
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, ok := decodeAuditLogCursor(c)
+		if !ok {
+			return filter, "cursor is invalid"
+		}
+		filter.After = cursor
+	}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 500 {
+			return filter, "limit must be between 1 and 500"
+		}
+		filter.Limit = limit
+	}
+
+	return filter, ""
+}
+
+// listAuditLogs returns outbound calls by transaction and time range
+// (?transaction_id=&service=&event_type=&from=&to=)
+func (o *PaymentOrchestrator) listAuditLogs(w http.ResponseWriter, r *http.Request) {
+	filter, problem := parseAuditLogFilter(r)
+	if problem != "" {
+		respondError(w, http.StatusBadRequest, problem, "INVALID_REQUEST")
+		return
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	entries, err := o.db.ListAuditLogs(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list audit logs: %v", err)
+		http.Error(w, "Failed to list audit logs", http.StatusInternalServerError)
+		return
+	}
+
+	response := AuditLogListResponse{HasMore: len(entries) > pageSize}
+	if response.HasMore {
+		entries = entries[:pageSize]
+		response.NextCursor = encodeAuditLogCursor(entries[len(entries)-1])
+	}
+	response.Entries = entries
+
+	respondJSON(w, http.StatusOK, response)
+}
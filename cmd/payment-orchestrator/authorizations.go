@@ -0,0 +1,914 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+type AuthorizeRequest struct {
+	SubscriptionID  string  `json:"subscription_id"`
+	PaymentMethodID string  `json:"payment_method_id"`
+	AmountMinor     int64   `json:"amount_minor,omitempty"`
+	Amount          float64 `json:"amount,omitempty"` // Deprecated: use amount_minor
+	Currency        string  `json:"currency"`
+	IdempotencyKey  string  `json:"idempotency_key,omitempty"`
+
+	// Currency the merchant is paid in; captures settle at the authorization's rate
+	SettlementCurrency string `json:"settlement_currency,omitempty"`
+
+	// Card-on-file context and 3-D Secure preferences, as for charges
+	StoredCredential *processor.StoredCredential `json:"stored_credential,omitempty"`
+	ThreeDS          *processor.ThreeDSRequest   `json:"three_ds,omitempty"`
+}
+
+// Money returns the authorization amount once the request has been normalized
+func (r AuthorizeRequest) Money() money.Money {
+	return money.Money{Amount: r.AmountMinor, Currency: r.Currency}
+}
+
+type AuthorizeResponse struct {
+	Success         bool       `json:"success"`
+	AuthorizationID string     `json:"authorization_id"`
+	ProcessorUsed   string     `json:"processor_used"`
+	AmountMinor     int64      `json:"amount_minor"`
+	Amount          float64    `json:"amount"` // Deprecated: use amount_minor
+	Currency        string     `json:"currency"`
+	Status          string     `json:"status"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	UserMessage     string     `json:"user_message,omitempty"`
+	ErrorCode       string     `json:"error_code,omitempty"`
+
+	Settlement *SettlementDetails `json:"settlement,omitempty"`
+}
+
+// CaptureRequest captures part or all of an authorization. The amount is in
+// the authorization's currency and defaults to the remaining authorized amount.
+type CaptureRequest struct {
+	AuthorizationID string  `json:"authorization_id"`
+	AmountMinor     int64   `json:"amount_minor,omitempty"`
+	Amount          float64 `json:"amount,omitempty"` // Deprecated: use amount_minor
+	FinalCapture    bool    `json:"final_capture,omitempty"`
+	IdempotencyKey  string  `json:"idempotency_key,omitempty"`
+}
+
+type CaptureResponse struct {
+	Success              bool    `json:"success"`
+	CaptureID            string  `json:"capture_id,omitempty"`
+	AuthorizationID      string  `json:"authorization_id"`
+	ProcessorUsed        string  `json:"processor_used"`
+	AmountMinor          int64   `json:"amount_minor"`
+	Amount               float64 `json:"amount"` // Deprecated: use amount_minor
+	Currency             string  `json:"currency"`
+	CapturedAmountMinor  int64   `json:"captured_amount_minor"`
+	CapturedAmount       float64 `json:"captured_amount"` // Deprecated: use captured_amount_minor
+	RemainingAmountMinor int64   `json:"remaining_amount_minor"`
+	RemainingAmount      float64 `json:"remaining_amount"` // Deprecated: use remaining_amount_minor
+	Status               string  `json:"status"`
+	ErrorCode            string  `json:"error_code,omitempty"`
+	Message              string  `json:"message,omitempty"`
+
+	Settlement *SettlementDetails `json:"settlement,omitempty"`
+}
+
+type VoidRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	Reason          string `json:"reason,omitempty"`
+	IdempotencyKey  string `json:"idempotency_key,omitempty"`
+}
+
+type VoidResponse struct {
+	Success             bool    `json:"success"`
+	VoidID              string  `json:"void_id,omitempty"`
+	AuthorizationID     string  `json:"authorization_id"`
+	ProcessorUsed       string  `json:"processor_used"`
+	ReleasedAmountMinor int64   `json:"released_amount_minor"`
+	ReleasedAmount      float64 `json:"released_amount"` // Deprecated: use released_amount_minor
+	Currency            string  `json:"currency"`
+	Status              string  `json:"status"`
+	ErrorCode           string  `json:"error_code,omitempty"`
+	Message             string  `json:"message,omitempty"`
+}
+
+// errAuthorizationNotOpen is returned when an authorization can no longer be captured or voided
+var errAuthorizationNotOpen = errors.New("authorization is not open")
+
+func (o *PaymentOrchestrator) processAuthorize(w http.ResponseWriter, r *http.Request) {
+	var req AuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.PaymentMethodID == "" {
+		respondError(w, http.StatusBadRequest, "payment_method_id is required", "INVALID_REQUEST")
+		return
+	}
+
+	amount, err := resolveAmount(req.AmountMinor, req.Amount, req.Currency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_AMOUNT")
+		return
+	}
+	req.AmountMinor, req.Amount, req.Currency = amount.Amount, 0, amount.Currency
+
+	if req.StoredCredential != nil {
+		if err := req.StoredCredential.Validate(); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error(), "INVALID_STORED_CREDENTIAL")
+			return
+		}
+	}
+	if err := validateThreeDS(req.ThreeDS, req.StoredCredential); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_THREE_DS")
+		return
+	}
+
+	quote, err := o.settlementQuote(amount.Currency, strings.ToUpper(req.SettlementCurrency))
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "FX_RATE_UNAVAILABLE")
+		return
+	}
+	req.SettlementCurrency = quote.To
+
+	// Generate idempotency key if not provided
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = uuid.New().String()
+	}
+
+	lock := o.beginIdempotent(w, r, "authorize", req.IdempotencyKey, req)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	ctx := r.Context()
+
+	// Keys whose stored response has expired are still recorded on the transaction
+	if existing, err := o.db.GetTransactionByIdempotencyKey(ctx, req.IdempotencyKey); err == nil {
+		if existing.TransactionType != TransactionTypeAuthorization ||
+			existing.Amount != req.AmountMinor || existing.Currency != req.Currency {
+			respondError(w, http.StatusUnprocessableEntity, ErrIdempotencyMismatch.Error(), "IDEMPOTENCY_KEY_MISMATCH")
+			return
+		}
+		status := http.StatusOK
+		if existing.Status == TransactionStatusPending || existing.Status == TransactionStatusUnknown {
+			status = http.StatusAccepted
+		}
+		w.Header().Set("X-Idempotent-Replay", "true")
+		respondJSON(w, status, authorizeResponseFromTransaction(existing))
+		return
+	}
+
+	paymentMethod, err := o.db.GetPaymentMethod(ctx, req.PaymentMethodID)
+	if err != nil {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+	if paymentMethod.DetachedAt != nil {
+		respondError(w, http.StatusConflict, "Payment method has been detached", "PAYMENT_METHOD_DETACHED")
+		return
+	}
+	if code := tokenDeclineCode(paymentMethod); code != "" {
+		respondJSON(w, http.StatusPaymentRequired, &AuthorizeResponse{
+			Success:     false,
+			AmountMinor: amount.Amount,
+			Amount:      amount.Major(),
+			Currency:    amount.Currency,
+			Status:      TransactionStatusFailed,
+			UserMessage: mapErrorToUserMessage(code),
+			ErrorCode:   code,
+		})
+		return
+	}
+
+	// MITs reference the charge that stored the card; processors refuse them without it
+	if req.StoredCredential.IsMIT() && req.StoredCredential.NetworkTransactionID == "" {
+		credential := *req.StoredCredential
+		credential.NetworkTransactionID = paymentMethod.NetworkTransactionID
+		req.StoredCredential = &credential
+	}
+
+	authorization := &Transaction{
+		ID:              uuid.New().String(),
+		SubscriptionID:  req.SubscriptionID,
+		PaymentMethodID: req.PaymentMethodID,
+		ProcessorUsed:   "none",
+		Amount:          amount.Amount,
+		Currency:        amount.Currency,
+		Status:          TransactionStatusPending,
+		TransactionType: TransactionTypeAuthorization,
+		IdempotencyKey:  req.IdempotencyKey,
+
+		StoredCredential: req.StoredCredential,
+	}
+	if err := authorization.settleAt(quote); err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "FX_CONVERSION_FAILED")
+		return
+	}
+
+	// Audit every call made for the authorization against it
+	ctx = audit.WithTransactionID(ctx, authorization.ID)
+
+	// BPAS rules may require 3-D Secure, which holds can only satisfy with an exemption
+	chain, threeDSRequired := o.routingChain(ctx, amount, paymentMethod)
+	req.ThreeDS = threeDSRequest(req.ThreeDS, req.StoredCredential, threeDSRequired)
+	if req.ThreeDS != nil {
+		authorization.ThreeDSExemption = req.ThreeDS.Exemption
+	}
+	if len(chain) > 0 {
+		authorization.ProcessorUsed = chain[0]
+	}
+
+	// Record the authorization before any processor sees it, so a crash
+	// mid-call leaves a pending authorization for the recoverer
+	if err := o.db.CreateTransaction(ctx, authorization); err != nil {
+		log.Printf("Failed to record pending authorization %s: %v", authorization.ID, err)
+		respondError(w, http.StatusInternalServerError, "Unable to record authorization, no hold was placed", "TRANSACTION_RECORD_FAILED")
+		return
+	}
+
+	// Walk the fallback chain, letting the failover policy decide each hop
+	outcome := o.authorizeThroughChain(ctx, authorization.ID, chain, req, paymentMethod)
+	lastProcessor := authorization.ProcessorUsed
+	if outcome.LastProcessor != "" {
+		lastProcessor = outcome.LastProcessor
+	}
+
+	update := authorization.applyAuthorizeOutcome(lastProcessor, outcome.Result, outcome.Ambiguous)
+	if err := o.settleAuthorization(ctx, authorization, update); err != nil {
+		log.Printf("Failed to settle authorization %s as %s, leaving it for recovery: %v", authorization.ID, authorization.Status, err)
+		respondError(w, http.StatusInternalServerError, "Failed to record authorization", "TRANSACTION_RECORD_FAILED")
+		return
+	}
+
+	response := authorizeResponseFromTransaction(authorization)
+	switch authorization.Status {
+	case AuthStatusAuthorized:
+		respondIdempotent(w, lock, http.StatusCreated, response)
+	case TransactionStatusUnknown:
+		// Not stored against the idempotency key: retries read the settled authorization
+		response.ErrorCode = "PAYMENT_PENDING"
+		response.UserMessage = mapErrorToUserMessage("PAYMENT_PENDING")
+		respondJSON(w, http.StatusAccepted, response)
+	default:
+		respondIdempotent(w, lock, http.StatusPaymentRequired, response)
+	}
+}
+
+// applyAuthorizeOutcome sets a pending authorization's outcome from the
+// processor's answer and returns the update that records it. Without an
+// answer it is unknown if a processor may have placed the hold, and failed
+// otherwise.
+func (t *Transaction) applyAuthorizeOutcome(processorName string, result *processor.AuthorizeResponse, ambiguous bool) TransactionUpdate {
+	switch {
+	case result == nil && ambiguous:
+		t.ProcessorUsed = processorName
+		t.Status = TransactionStatusUnknown
+		t.ErrorCode = "OUTCOME_UNKNOWN"
+	case result == nil:
+		t.ProcessorUsed = "none"
+		t.Status = TransactionStatusFailed
+		t.ErrorCode = "PROCESSORS_UNAVAILABLE"
+		t.UserErrorMessage = "Payment processing temporarily unavailable. Please try again in a few minutes."
+	case result.Success:
+		t.ProcessorUsed = processorName
+		t.Status = AuthStatusAuthorized
+		t.ProcessorTransactionID = result.AuthorizationID
+		expiresAt := result.ExpiresAt
+		t.AuthExpiresAt = &expiresAt
+	default:
+		t.ProcessorUsed = processorName
+		t.Status = TransactionStatusFailed
+		t.ErrorCode = result.ErrorCode
+		t.UserErrorMessage = mapErrorToUserMessage(result.ErrorCode)
+	}
+
+	return TransactionUpdate{
+		ProcessorUsed:          t.ProcessorUsed,
+		ProcessorTransactionID: t.ProcessorTransactionID,
+		ErrorCode:              t.ErrorCode,
+		ErrorMessage:           t.UserErrorMessage,
+		AuthExpiresAt:          t.AuthExpiresAt,
+	}
+}
+
+// settleAuthorization moves a pending authorization to the status set on it
+func (o *PaymentOrchestrator) settleAuthorization(ctx context.Context, auth *Transaction, update TransactionUpdate) error {
+	return o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		return o.db.TransitionTransactionTx(ctx, tx, auth.ID, auth.Status, update)
+	})
+}
+
+func (o *PaymentOrchestrator) authorizeWithProcessor(ctx context.Context, processorName string, req AuthorizeRequest, pm *PaymentMethod) (*processor.AuthorizeResponse, error) {
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, refusal, err := o.cardCredentials(ctx, processorName, pm, req.Money(), req.StoredCredential)
+	if refusal != nil {
+		// The network won't let a hold be placed on the token, whichever processor is used
+		return &processor.AuthorizeResponse{
+			ErrorCode:     refusal.Code,
+			ErrorMessage:  refusal.Message,
+			ProcessorUsed: processorName,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Authorize(ctx, &processor.AuthorizeRequest{
+		Amount:          req.AmountMinor,
+		Currency:        req.Currency,
+		IdempotencyKey:  req.IdempotencyKey,
+		NetworkToken:    creds.NetworkToken,
+		ProcessorToken:  creds.ProcessorToken,
+		TokenCryptogram: creds.TokenCryptogram,
+
+		StoredCredential: req.StoredCredential,
+		ThreeDS:          req.ThreeDS,
+	})
+}
+
+// authorizeOutcome is the result of walking the fallback chain for an authorization
+type authorizeOutcome struct {
+	Result        *processor.AuthorizeResponse // Definitive answer, nil if no processor gave one
+	LastProcessor string                       // Last processor the authorization was sent to
+	Ambiguous     bool                         // A processor may have placed the hold without us knowing
+}
+
+// authorizeThroughChain sends an authorization down the fallback chain under
+// the same failover policy as charges, so a timed-out hold is verified before
+// another processor is asked for a second one, and within the same chain timeout
+func (o *PaymentOrchestrator) authorizeThroughChain(ctx context.Context, authorizationID string, chain []string, req AuthorizeRequest, pm *PaymentMethod) authorizeOutcome {
+	results := make(map[string]*processor.AuthorizeResponse)
+	chainCtx, cancel := context.WithTimeout(ctx, o.chainTimeout)
+	defer cancel()
+
+	send := func(processorName string) (OutcomeClass, string, error) {
+		result, err := o.authorizeWithProcessor(chainCtx, processorName, req, pm)
+		class := classifyAuthorization(result, err)
+		if class == OutcomeApproved || class == OutcomeIssuerDecline {
+			results[processorName] = result
+			return class, result.ErrorCode, err
+		}
+		return class, "", err
+	}
+	verify := func(processorName string) (OutcomeClass, string) {
+		result, class := o.verifyAuthorization(chainCtx, processorName, req.IdempotencyKey)
+		if result == nil {
+			return class, ""
+		}
+		results[processorName] = result
+		return class, result.ErrorCode
+	}
+	hop := func(from, to string) {
+		err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+			return o.db.SetPendingProcessorTx(ctx, tx, authorizationID, to, 0)
+		})
+		if err != nil {
+			log.Printf("Failed to record failover of %s to %s: %v", authorizationID, to, err)
+		}
+	}
+
+	walk := o.walkChain(chainCtx, "authorization "+authorizationID, chain, send, verify, hop)
+	return authorizeOutcome{
+		Result:        results[walk.Decided],
+		LastProcessor: walk.LastProcessor,
+		Ambiguous:     walk.Ambiguous,
+	}
+}
+
+// classifyAuthorization sorts an authorization attempt into an outcome class
+func classifyAuthorization(result *processor.AuthorizeResponse, err error) OutcomeClass {
+	switch {
+	case err == nil && result.Success:
+		return OutcomeApproved
+	case err == nil:
+		return OutcomeIssuerDecline
+	case isAmbiguousFailure(err):
+		return OutcomeAmbiguous
+	}
+	return OutcomeProcessorError
+}
+
+// verifyAuthorization asks a processor whether an authorization that timed out placed a hold
+func (o *PaymentOrchestrator) verifyAuthorization(ctx context.Context, processorName, idempotencyKey string) (*processor.AuthorizeResponse, OutcomeClass) {
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		return nil, OutcomeAmbiguous
+	}
+
+	resp, err := client.LookupAuthorization(ctx, idempotencyKey)
+	switch {
+	case errors.Is(err, processor.ErrAuthorizationNotFound):
+		// Never processed, so it is safe to move on
+		return nil, OutcomeProcessorError
+	case err != nil:
+		log.Printf("Could not verify authorization with %s: %v", processorName, err)
+		return nil, OutcomeAmbiguous
+	case resp.Success:
+		return resp, OutcomeApproved
+	}
+	return resp, OutcomeIssuerDecline
+}
+
+func (o *PaymentOrchestrator) processCapture(w http.ResponseWriter, r *http.Request) {
+	var req CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.AuthorizationID == "" || req.AmountMinor < 0 || req.Amount < 0 {
+		respondError(w, http.StatusBadRequest, "authorization_id is required and amount cannot be negative", "INVALID_REQUEST")
+		return
+	}
+
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = "capture_" + uuid.New().String()
+	}
+
+	lock := o.beginIdempotent(w, r, "capture", req.IdempotencyKey, req)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	ctx := r.Context()
+
+	// Keys whose stored response has expired are still recorded on the transaction
+	if existing, err := o.db.GetTransactionByIdempotencyKey(ctx, req.IdempotencyKey); err == nil {
+		if existing.TransactionType != TransactionTypeCapture ||
+			existing.OriginalTransactionID == nil || *existing.OriginalTransactionID != req.AuthorizationID {
+			respondError(w, http.StatusUnprocessableEntity, ErrIdempotencyMismatch.Error(), "IDEMPOTENCY_KEY_MISMATCH")
+			return
+		}
+		status := http.StatusOK
+		if existing.Status == TransactionStatusPending || existing.Status == TransactionStatusUnknown {
+			status = http.StatusAccepted
+		}
+		w.Header().Set("X-Idempotent-Replay", "true")
+		respondJSON(w, status, CaptureResponse{
+			Success:         existing.Status == TransactionStatusSuccess,
+			CaptureID:       existing.ID,
+			AuthorizationID: req.AuthorizationID,
+			ProcessorUsed:   existing.ProcessorUsed,
+			AmountMinor:     existing.Amount,
+			Amount:          existing.Money().Major(),
+			Currency:        existing.Currency,
+			Status:          existing.Status,
+			ErrorCode:       existing.ErrorCode,
+		})
+		return
+	}
+
+	capture, auth, client, ok := o.beginCapture(w, r, req)
+	if !ok {
+		return
+	}
+
+	// The processor is called outside any transaction, so a slow capture
+	// doesn't hold the authorization's lock. Calls are audited against the capture.
+	captureCtx := audit.WithTransactionID(ctx, capture.ID)
+	captureResp, err := client.Capture(captureCtx, &processor.CaptureRequest{
+		AuthorizationID: auth.ProcessorTransactionID,
+		Amount:          capture.Amount,
+		FinalCapture:    req.FinalCapture,
+		IdempotencyKey:  req.IdempotencyKey,
+	})
+	ambiguous := isAmbiguousFailure(err)
+	if ambiguous {
+		// The funds may have been captured before the call failed, so ask
+		captureResp, err = client.LookupCapture(captureCtx, req.IdempotencyKey)
+		ambiguous = err != nil && !errors.Is(err, processor.ErrCaptureNotFound)
+	}
+	if err != nil {
+		// An error body is not the processor's answer to the capture
+		log.Printf("Capture %s failed: %v", capture.ID, err)
+		captureResp = nil
+	}
+
+	status, update := captureOutcome(captureResp, ambiguous)
+	auth, err = o.settleCapture(ctx, capture, status, update, captureResp)
+	if err != nil {
+		log.Printf("Failed to settle capture %s as %s, leaving it for recovery: %v", capture.ID, status, err)
+		http.Error(w, "Failed to record capture", http.StatusInternalServerError)
+		return
+	}
+
+	remainingAfter := auth.Amount - auth.CapturedAmount
+	if auth.Status != AuthStatusAuthorized && auth.Status != AuthStatusPartiallyCaptured {
+		remainingAfter = 0
+	}
+
+	response := CaptureResponse{
+		Success:              status == TransactionStatusSuccess,
+		CaptureID:            capture.ID,
+		AuthorizationID:      auth.ID,
+		ProcessorUsed:        auth.ProcessorUsed,
+		AmountMinor:          capture.Amount,
+		Amount:               capture.Money().Major(),
+		Currency:             auth.Currency,
+		CapturedAmountMinor:  auth.CapturedAmount,
+		CapturedAmount:       money.ToMajor(auth.CapturedAmount, auth.Currency),
+		RemainingAmountMinor: remainingAfter,
+		RemainingAmount:      money.ToMajor(remainingAfter, auth.Currency),
+		Status:               auth.Status,
+		ErrorCode:            capture.ErrorCode,
+		Message:              capture.UserErrorMessage,
+		Settlement:           settlementDetails(capture),
+	}
+
+	switch {
+	case status == TransactionStatusSuccess:
+		respondIdempotent(w, lock, http.StatusCreated, response)
+	case status == TransactionStatusUnknown:
+		// Not stored against the idempotency key: retries read the settled capture
+		response.Status = TransactionStatusUnknown
+		response.Message = "Capture is being confirmed with the processor"
+		respondJSON(w, http.StatusAccepted, response)
+	case captureResp == nil:
+		respondError(w, http.StatusBadGateway, "Capture processing failed, please retry with a new idempotency key", "PROCESSOR_ERROR")
+	default:
+		respondIdempotent(w, lock, http.StatusUnprocessableEntity, response)
+	}
+}
+
+// beginCapture checks a capture against its authorization and records it
+// as pending, so a crash or lost response while the processor handles it
+// leaves a row for the recoverer. Captures still in flight count against
+// what is left to capture. It replies itself when the capture can't go
+// ahead, and otherwise returns the capture, its authorization and the
+// processor to send it to.
+func (o *PaymentOrchestrator) beginCapture(w http.ResponseWriter, r *http.Request, req CaptureRequest) (*Transaction, *Transaction, processor.ProcessorInterface, bool) {
+	ctx := r.Context()
+
+	// Lock the authorization so concurrent captures can't exceed it
+	tx, err := o.db.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Failed to start capture", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	defer tx.Rollback()
+
+	auth, err := o.openAuthorization(ctx, tx, req.AuthorizationID)
+	if err != nil {
+		o.respondAuthorizationError(w, tx, auth, err)
+		return nil, nil, nil, false
+	}
+
+	inFlight, err := o.db.InFlightAmountTx(ctx, tx, auth.ID, TransactionTypeCapture)
+	if err != nil {
+		log.Printf("Failed to load captures in flight for %s: %v", auth.ID, err)
+		http.Error(w, "Failed to load authorization", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	remaining := money.Money{Amount: auth.Amount - auth.CapturedAmount - inFlight, Currency: auth.Currency}
+	requested, err := money.Resolve(req.AmountMinor, req.Amount, auth.Currency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_AMOUNT")
+		return nil, nil, nil, false
+	}
+	amount := requested.Amount
+	if amount == 0 {
+		amount = remaining.Amount
+	}
+	if amount <= 0 || amount > remaining.Amount {
+		respondError(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("Capture amount exceeds remaining authorized amount %s", remaining),
+			"AMOUNT_EXCEEDS_AUTHORIZATION")
+		return nil, nil, nil, false
+	}
+
+	// Captures settle at the rate quoted when the authorization was made
+	settlement, err := auth.FX.Convert(money.Money{Amount: amount, Currency: auth.Currency})
+	if err != nil {
+		log.Printf("Failed to convert capture of %s: %v", auth.ID, err)
+		http.Error(w, "Failed to convert capture amount", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	// Route to the processor that made the authorization
+	client, err := o.processors.GetProcessor(auth.ProcessorUsed)
+	if err != nil {
+		http.Error(w, "Unknown processor", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	capture := &Transaction{
+		ID:                    uuid.New().String(),
+		SubscriptionID:        auth.SubscriptionID,
+		PaymentMethodID:       auth.PaymentMethodID,
+		ProcessorUsed:         auth.ProcessorUsed,
+		Amount:                amount,
+		Currency:              auth.Currency,
+		Status:                TransactionStatusPending,
+		TransactionType:       TransactionTypeCapture,
+		IdempotencyKey:        req.IdempotencyKey,
+		OriginalTransactionID: &auth.ID,
+		SettlementAmount:      settlement.Amount,
+		SettlementCurrency:    settlement.Currency,
+		FX:                    auth.FX,
+	}
+	capture.ExpectedFee = o.expectedFee(auth.ProcessorUsed, capture.Money(), o.feePaymentMethod(ctx, auth.PaymentMethodID))
+
+	if err := o.db.CreateTransactionTx(ctx, tx, capture); err != nil {
+		log.Printf("Failed to record pending capture: %v", err)
+		respondError(w, http.StatusInternalServerError, "Unable to record capture, nothing was captured", "TRANSACTION_RECORD_FAILED")
+		return nil, nil, nil, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit pending capture: %v", err)
+		respondError(w, http.StatusInternalServerError, "Unable to record capture, nothing was captured", "TRANSACTION_RECORD_FAILED")
+		return nil, nil, nil, false
+	}
+
+	return capture, auth, client, true
+}
+
+// captureOutcome returns the status and update that record a processor's
+// answer to a capture. Without an answer the capture is unknown if funds
+// may have moved, and failed otherwise.
+func captureOutcome(resp *processor.CaptureResponse, ambiguous bool) (string, TransactionUpdate) {
+	switch {
+	case resp == nil && ambiguous:
+		return TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"}
+	case resp == nil:
+		return TransactionStatusFailed, TransactionUpdate{
+			ErrorCode:    "PROCESSOR_ERROR",
+			ErrorMessage: "Capture could not be sent to the processor",
+		}
+	}
+	return getStatus(resp.Success), TransactionUpdate{
+		ProcessorTransactionID: resp.TransactionID,
+		ErrorCode:              resp.ErrorCode,
+		ErrorMessage:           resp.ErrorMessage,
+	}
+}
+
+// settleCapture moves a pending capture to its outcome and applies it to the
+// authorization, which is returned as it stands afterwards. The capture is
+// updated in place.
+func (o *PaymentOrchestrator) settleCapture(ctx context.Context, capture *Transaction, status string, update TransactionUpdate, resp *processor.CaptureResponse) (*Transaction, error) {
+	var auth *Transaction
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		auth, err = o.db.GetAuthorizationForUpdate(ctx, tx, *capture.OriginalTransactionID)
+		if err != nil {
+			return err
+		}
+		if err := o.db.TransitionTransactionTx(ctx, tx, capture.ID, status, update); err != nil {
+			return err
+		}
+
+		switch {
+		case status == TransactionStatusSuccess:
+			auth.CapturedAmount += capture.Amount
+			auth.Status = AuthStatusPartiallyCaptured
+			if resp.Status == AuthStatusCaptured {
+				auth.Status = AuthStatusCaptured
+			}
+		case resp != nil && resp.ErrorCode == "AUTHORIZATION_EXPIRED":
+			auth.Status = AuthStatusExpired
+		default:
+			return nil
+		}
+		return o.db.UpdateAuthorizationTx(ctx, tx, auth.ID, auth.CapturedAmount, auth.Status)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	capture.Status = status
+	capture.ProcessorTransactionID = update.ProcessorTransactionID
+	capture.ErrorCode = update.ErrorCode
+	capture.UserErrorMessage = update.ErrorMessage
+	return auth, nil
+}
+
+func (o *PaymentOrchestrator) processVoid(w http.ResponseWriter, r *http.Request) {
+	var req VoidRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.AuthorizationID == "" {
+		respondError(w, http.StatusBadRequest, "authorization_id is required", "INVALID_REQUEST")
+		return
+	}
+
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = "void_" + uuid.New().String()
+	}
+
+	lock := o.beginIdempotent(w, r, "void", req.IdempotencyKey, req)
+	if lock == nil {
+		return
+	}
+	defer lock.Release()
+
+	ctx := r.Context()
+
+	tx, err := o.db.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Failed to start void", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	auth, err := o.openAuthorization(ctx, tx, req.AuthorizationID)
+	if err != nil {
+		o.respondAuthorizationError(w, tx, auth, err)
+		return
+	}
+
+	// A capture still in flight may take part of what the void would release
+	inFlight, err := o.db.InFlightAmountTx(ctx, tx, auth.ID, TransactionTypeCapture)
+	if err != nil {
+		log.Printf("Failed to load captures in flight for %s: %v", auth.ID, err)
+		http.Error(w, "Failed to load authorization", http.StatusInternalServerError)
+		return
+	}
+	if inFlight > 0 {
+		respondError(w, http.StatusConflict, "Authorization has a capture in progress", "CAPTURE_IN_PROGRESS")
+		return
+	}
+
+	// Route to the processor that made the authorization
+	client, err := o.processors.GetProcessor(auth.ProcessorUsed)
+	if err != nil {
+		http.Error(w, "Unknown processor", http.StatusInternalServerError)
+		return
+	}
+
+	// Calls to the processor are audited against the void
+	voidID := uuid.New().String()
+	voidResp, err := client.Void(audit.WithTransactionID(ctx, voidID), &processor.VoidRequest{
+		AuthorizationID: auth.ProcessorTransactionID,
+		Reason:          req.Reason,
+		IdempotencyKey:  req.IdempotencyKey,
+	})
+	if err != nil {
+		log.Printf("Void failed: %v", err)
+		http.Error(w, "Void processing failed", http.StatusInternalServerError)
+		return
+	}
+
+	released := auth.Amount - auth.CapturedAmount
+	releasedSettlement, err := auth.FX.Convert(money.Money{Amount: released, Currency: auth.Currency})
+	if err != nil {
+		log.Printf("Failed to convert void of %s: %v", auth.ID, err)
+		http.Error(w, "Failed to record void", http.StatusInternalServerError)
+		return
+	}
+	void := &Transaction{
+		ID:                     voidID,
+		SubscriptionID:         auth.SubscriptionID,
+		PaymentMethodID:        auth.PaymentMethodID,
+		ProcessorUsed:          auth.ProcessorUsed,
+		Amount:                 released,
+		Currency:               auth.Currency,
+		Status:                 getStatus(voidResp.Success),
+		TransactionType:        TransactionTypeVoid,
+		IdempotencyKey:         req.IdempotencyKey,
+		ProcessorTransactionID: voidResp.AuthorizationID,
+		OriginalTransactionID:  &auth.ID,
+		ErrorCode:              voidResp.ErrorCode,
+		UserErrorMessage:       voidResp.ErrorMessage,
+		SettlementAmount:       releasedSettlement.Amount,
+		SettlementCurrency:     releasedSettlement.Currency,
+		FX:                     auth.FX,
+	}
+
+	authStatus := auth.Status
+	if voidResp.Success {
+		authStatus = AuthStatusVoided
+	} else if voidResp.ErrorCode == "AUTHORIZATION_EXPIRED" {
+		authStatus = AuthStatusExpired
+	}
+
+	if err := o.db.CreateTransactionTx(ctx, tx, void); err != nil {
+		log.Printf("Failed to store void: %v", err)
+		http.Error(w, "Failed to record void", http.StatusInternalServerError)
+		return
+	}
+	if err := o.db.UpdateAuthorizationTx(ctx, tx, auth.ID, auth.CapturedAmount, authStatus); err != nil {
+		log.Printf("Failed to update authorization %s: %v", auth.ID, err)
+		http.Error(w, "Failed to record void", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit void: %v", err)
+		http.Error(w, "Failed to record void", http.StatusInternalServerError)
+		return
+	}
+
+	response := VoidResponse{
+		Success:             voidResp.Success,
+		VoidID:              void.ID,
+		AuthorizationID:     auth.ID,
+		ProcessorUsed:       auth.ProcessorUsed,
+		ReleasedAmountMinor: void.Amount,
+		ReleasedAmount:      void.Money().Major(),
+		Currency:            auth.Currency,
+		Status:              authStatus,
+		ErrorCode:           voidResp.ErrorCode,
+		Message:             voidResp.ErrorMessage,
+	}
+
+	status := http.StatusOK
+	if !voidResp.Success {
+		status = http.StatusUnprocessableEntity
+	}
+	respondIdempotent(w, lock, status, response)
+}
+
+// openAuthorization locks an authorization and checks it can still be
+// captured or voided. An authorization past its hold is marked expired.
+func (o *PaymentOrchestrator) openAuthorization(ctx context.Context, tx *sql.Tx, id string) (*Transaction, error) {
+	auth, err := o.db.GetAuthorizationForUpdate(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.Status == AuthStatusAuthorized || auth.Status == AuthStatusPartiallyCaptured {
+		if auth.AuthExpiresAt != nil && time.Now().After(*auth.AuthExpiresAt) {
+			if err := o.db.UpdateAuthorizationTx(ctx, tx, auth.ID, auth.CapturedAmount, AuthStatusExpired); err != nil {
+				return nil, err
+			}
+			auth.Status = AuthStatusExpired
+			return auth, errAuthorizationNotOpen
+		}
+		return auth, nil
+	}
+
+	return auth, errAuthorizationNotOpen
+}
+
+// respondAuthorizationError replies for an authorization that can't be captured or voided
+func (o *PaymentOrchestrator) respondAuthorizationError(w http.ResponseWriter, tx *sql.Tx, auth *Transaction, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		respondError(w, http.StatusNotFound, "Authorization not found", "AUTHORIZATION_NOT_FOUND")
+	case errors.Is(err, errAuthorizationNotOpen) && auth.Status == AuthStatusExpired:
+		// Persist the expiry before replying
+		if err := tx.Commit(); err != nil {
+			log.Printf("Failed to mark authorization %s expired: %v", auth.ID, err)
+		}
+		respondError(w, http.StatusGone, "Authorization hold has expired", "AUTHORIZATION_EXPIRED")
+	case errors.Is(err, errAuthorizationNotOpen):
+		respondError(w, http.StatusConflict, fmt.Sprintf("Authorization is already %s", auth.Status), "AUTHORIZATION_CLOSED")
+	default:
+		log.Printf("Failed to load authorization: %v", err)
+		http.Error(w, "Failed to load authorization", http.StatusInternalServerError)
+	}
+}
+
+// expireAuthorizationsLoop periodically marks authorizations past their hold as expired
+func (o *PaymentOrchestrator) expireAuthorizationsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		count, err := o.db.ExpireAuthorizations(ctx)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to expire authorizations: %v", err)
+		} else if count > 0 {
+			log.Printf("Expired %d authorizations past their hold", count)
+		}
+	}
+}
+
+func authorizeResponseFromTransaction(t *Transaction) AuthorizeResponse {
+	return AuthorizeResponse{
+		Success:         t.Status != TransactionStatusFailed && t.Status != TransactionStatusPending && t.Status != TransactionStatusUnknown,
+		AuthorizationID: t.ID,
+		ProcessorUsed:   t.ProcessorUsed,
+		AmountMinor:     t.Amount,
+		Amount:          t.Money().Major(),
+		Currency:        t.Currency,
+		Status:          t.Status,
+		ExpiresAt:       t.AuthExpiresAt,
+		UserMessage:     t.UserErrorMessage,
+		ErrorCode:       t.ErrorCode,
+		Settlement:      settlementDetails(t),
+	}
+}
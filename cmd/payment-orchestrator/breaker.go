@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a processor circuit breaker
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// ErrCircuitOpen is returned when a breaker rejects a call
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerConfig holds the thresholds for a processor circuit breaker
+type BreakerConfig struct {
+	Window                time.Duration // Length of the rolling window
+	Buckets               int           // Number of buckets the window is split into
+	MinRequests           int           // Minimum calls in the window before the breaker can trip
+	ErrorRateThreshold    float64       // Percentage of failed calls that trips the breaker
+	SlowCallThreshold     time.Duration // Calls slower than this count as slow
+	SlowCallRateThreshold float64       // Percentage of slow calls that trips the breaker
+	OpenTimeout           time.Duration // How long the breaker stays open before probing
+	HalfOpenProbes        int           // Successful probes needed to close again
+	ProbeInterval         time.Duration // How often the health probe runs while not closed
+}
+
+// DefaultBreakerConfig returns the default breaker thresholds
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Window:                60 * time.Second,
+		Buckets:               12,
+		MinRequests:           10,
+		ErrorRateThreshold:    50,
+		SlowCallThreshold:     2 * time.Second,
+		SlowCallRateThreshold: 80,
+		OpenTimeout:           30 * time.Second,
+		HalfOpenProbes:        3,
+		ProbeInterval:         10 * time.Second,
+	}
+}
+
+// BreakerSnapshot is a point-in-time view of a breaker and its window
+type BreakerSnapshot struct {
+	Processor      string       `json:"processor"`
+	State          BreakerState `json:"state"`
+	Requests       int          `json:"requests"`
+	Failures       int          `json:"failures"`
+	SlowCalls      int          `json:"slow_calls"`
+	SuccessRate    float64      `json:"success_rate"`
+	AvgLatencyMs   int          `json:"avg_latency_ms"`
+	Reason         string       `json:"reason,omitempty"`
+	StateChangedAt time.Time    `json:"state_changed_at"`
+}
+
+// BreakerTransition describes a change of breaker state
+type BreakerTransition struct {
+	From     BreakerState
+	To       BreakerState
+	Snapshot BreakerSnapshot
+}
+
+type breakerBucket struct {
+	start     time.Time
+	requests  int
+	failures  int
+	slowCalls int
+	latency   time.Duration
+}
+
+// CircuitBreaker tracks call outcomes for one processor over a rolling window
+type CircuitBreaker struct {
+	name         string
+	config       BreakerConfig
+	onTransition func(BreakerTransition)
+
+	mu             sync.Mutex
+	state          BreakerState
+	buckets        []breakerBucket
+	openedAt       time.Time
+	stateChangedAt time.Time
+	reason         string
+	probesInFlight int
+	probeSuccesses int
+}
+
+// NewCircuitBreaker creates a closed breaker
+func NewCircuitBreaker(name string, config BreakerConfig, onTransition func(BreakerTransition)) *CircuitBreaker {
+	if config.Buckets <= 0 {
+		config.Buckets = 1
+	}
+	if config.HalfOpenProbes <= 0 {
+		config.HalfOpenProbes = 1
+	}
+
+	return &CircuitBreaker{
+		name:           name,
+		config:         config,
+		onTransition:   onTransition,
+		state:          BreakerClosed,
+		buckets:        make([]breakerBucket, config.Buckets),
+		stateChangedAt: time.Now(),
+	}
+}
+
+// Allow reports whether a call may go through. Every allowed call must be
+// followed by exactly one Record.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	var transition *BreakerTransition
+	defer func() {
+		b.mu.Unlock()
+		b.notify(transition)
+	}()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		transition = b.setState(BreakerHalfOpen, "open timeout elapsed, probing")
+		fallthrough
+	case BreakerHalfOpen:
+		// Only let through as many calls as we need probes
+		if b.probesInFlight+b.probeSuccesses >= b.config.HalfOpenProbes {
+			return ErrCircuitOpen
+		}
+		b.probesInFlight++
+	}
+
+	return nil
+}
+
+// Record reports the outcome of a call previously admitted by Allow
+func (b *CircuitBreaker) Record(success bool, latency time.Duration) {
+	b.mu.Lock()
+	var transition *BreakerTransition
+	defer func() {
+		b.mu.Unlock()
+		b.notify(transition)
+	}()
+
+	now := time.Now()
+	bucket := b.currentBucket(now)
+	bucket.requests++
+	bucket.latency += latency
+	if !success {
+		bucket.failures++
+	}
+	if latency >= b.config.SlowCallThreshold {
+		bucket.slowCalls++
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if b.probesInFlight > 0 {
+			b.probesInFlight--
+		}
+		if !success {
+			transition = b.trip(now, fmt.Sprintf("probe failed after %dms", latency.Milliseconds()))
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.config.HalfOpenProbes {
+			b.resetWindow()
+			transition = b.setState(BreakerClosed, fmt.Sprintf("%d consecutive probes succeeded", b.probeSuccesses))
+		}
+
+	case BreakerClosed:
+		if reason := b.tripReason(now); reason != "" {
+			transition = b.trip(now, reason)
+		}
+	}
+}
+
+// State returns the current breaker state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Snapshot returns the current breaker state and window statistics
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.snapshotLocked(time.Now())
+}
+
+// tripReason returns why the breaker should open, or "" if it should not
+func (b *CircuitBreaker) tripReason(now time.Time) string {
+	requests, failures, slowCalls, _ := b.windowTotals(now)
+	if requests < b.config.MinRequests {
+		return ""
+	}
+
+	errorRate := float64(failures) / float64(requests) * 100
+	if errorRate >= b.config.ErrorRateThreshold {
+		return fmt.Sprintf("error rate %.1f%% over %d calls in %s exceeded %.1f%%",
+			errorRate, requests, b.config.Window, b.config.ErrorRateThreshold)
+	}
+
+	slowRate := float64(slowCalls) / float64(requests) * 100
+	if slowRate >= b.config.SlowCallRateThreshold {
+		return fmt.Sprintf("slow call rate %.1f%% (>%s) over %d calls in %s exceeded %.1f%%",
+			slowRate, b.config.SlowCallThreshold, requests, b.config.Window, b.config.SlowCallRateThreshold)
+	}
+
+	return ""
+}
+
+func (b *CircuitBreaker) trip(now time.Time, reason string) *BreakerTransition {
+	b.openedAt = now
+	return b.setState(BreakerOpen, reason)
+}
+
+// setState must be called with the lock held
+func (b *CircuitBreaker) setState(state BreakerState, reason string) *BreakerTransition {
+	from := b.state
+	b.state = state
+	b.reason = reason
+	b.stateChangedAt = time.Now()
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+
+	return &BreakerTransition{
+		From:     from,
+		To:       state,
+		Snapshot: b.snapshotLocked(b.stateChangedAt),
+	}
+}
+
+func (b *CircuitBreaker) notify(transition *BreakerTransition) {
+	if transition == nil || b.onTransition == nil {
+		return
+	}
+	b.onTransition(*transition)
+}
+
+func (b *CircuitBreaker) bucketWidth() time.Duration {
+	return b.config.Window / time.Duration(len(b.buckets))
+}
+
+// currentBucket returns the bucket for now, clearing it if it belongs to an
+// earlier rotation of the window
+func (b *CircuitBreaker) currentBucket(now time.Time) *breakerBucket {
+	width := b.bucketWidth()
+	start := now.Truncate(width)
+	idx := int(start.UnixNano()/int64(width)) % len(b.buckets)
+
+	bucket := &b.buckets[idx]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+func (b *CircuitBreaker) windowTotals(now time.Time) (requests, failures, slowCalls int, latency time.Duration) {
+	cutoff := now.Add(-b.config.Window)
+	for _, bucket := range b.buckets {
+		if bucket.start.IsZero() || !bucket.start.After(cutoff) {
+			continue
+		}
+		requests += bucket.requests
+		failures += bucket.failures
+		slowCalls += bucket.slowCalls
+		latency += bucket.latency
+	}
+	return
+}
+
+func (b *CircuitBreaker) resetWindow() {
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+}
+
+func (b *CircuitBreaker) snapshotLocked(now time.Time) BreakerSnapshot {
+	requests, failures, slowCalls, latency := b.windowTotals(now)
+
+	successRate := float64(100)
+	avgLatencyMs := 0
+	if requests > 0 {
+		successRate = float64(requests-failures) / float64(requests) * 100
+		avgLatencyMs = int(latency.Milliseconds() / int64(requests))
+	}
+
+	return BreakerSnapshot{
+		Processor:      b.name,
+		State:          b.state,
+		Requests:       requests,
+		Failures:       failures,
+		SlowCalls:      slowCalls,
+		SuccessRate:    successRate,
+		AvgLatencyMs:   avgLatencyMs,
+		Reason:         b.reason,
+		StateChangedAt: b.stateChangedAt,
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Window:                time.Minute,
+		Buckets:               6,
+		MinRequests:           4,
+		ErrorRateThreshold:    50,
+		SlowCallThreshold:     time.Second,
+		SlowCallRateThreshold: 80,
+		OpenTimeout:           time.Minute,
+		HalfOpenProbes:        2,
+	}
+}
+
+// recordCalls admits and records calls with the same outcome
+func recordCalls(t *testing.T, b *CircuitBreaker, calls int, success bool, latency time.Duration) {
+	t.Helper()
+	for i := 0; i < calls; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("call %d not allowed: %v", i, err)
+		}
+		b.Record(success, latency)
+	}
+}
+
+// elapseOpenTimeout backdates the trip so the next Allow starts probing
+func elapseOpenTimeout(b *CircuitBreaker) {
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.config.OpenTimeout)
+	b.mu.Unlock()
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		run         func(t *testing.T, b *CircuitBreaker)
+		want        BreakerState
+		transitions []BreakerState // States moved to, in order
+	}{
+		{
+			name: "stays closed below minimum requests",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 3, false, time.Millisecond)
+			},
+			want: BreakerClosed,
+		},
+		{
+			name: "stays closed under the error rate",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 3, true, time.Millisecond)
+				recordCalls(t, b, 1, false, time.Millisecond)
+			},
+			want: BreakerClosed,
+		},
+		{
+			name: "opens on error rate",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 2, true, time.Millisecond)
+				recordCalls(t, b, 2, false, time.Millisecond)
+			},
+			want:        BreakerOpen,
+			transitions: []BreakerState{BreakerOpen},
+		},
+		{
+			name: "opens on slow call rate",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, true, 2*time.Second)
+			},
+			want:        BreakerOpen,
+			transitions: []BreakerState{BreakerOpen},
+		},
+		{
+			name: "rejects calls while open",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+					t.Fatalf("Allow() = %v, want ErrCircuitOpen", err)
+				}
+			},
+			want:        BreakerOpen,
+			transitions: []BreakerState{BreakerOpen},
+		},
+		{
+			name: "half-opens after the open timeout",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				elapseOpenTimeout(b)
+				if err := b.Allow(); err != nil {
+					t.Fatalf("probe not allowed: %v", err)
+				}
+			},
+			want:        BreakerHalfOpen,
+			transitions: []BreakerState{BreakerOpen, BreakerHalfOpen},
+		},
+		{
+			name: "admits only as many probes as it needs",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				elapseOpenTimeout(b)
+				for i := 0; i < 2; i++ {
+					if err := b.Allow(); err != nil {
+						t.Fatalf("probe %d not allowed: %v", i, err)
+					}
+				}
+				if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+					t.Fatalf("third probe: Allow() = %v, want ErrCircuitOpen", err)
+				}
+			},
+			want:        BreakerHalfOpen,
+			transitions: []BreakerState{BreakerOpen, BreakerHalfOpen},
+		},
+		{
+			name: "closes after enough successful probes",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				elapseOpenTimeout(b)
+				recordCalls(t, b, 2, true, time.Millisecond)
+			},
+			want:        BreakerClosed,
+			transitions: []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed},
+		},
+		{
+			name: "reopens when a probe fails",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				elapseOpenTimeout(b)
+				recordCalls(t, b, 1, true, time.Millisecond)
+				recordCalls(t, b, 1, false, time.Millisecond)
+			},
+			want:        BreakerOpen,
+			transitions: []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen},
+		},
+		{
+			name: "starts a fresh window once closed",
+			run: func(t *testing.T, b *CircuitBreaker) {
+				recordCalls(t, b, 4, false, time.Millisecond)
+				elapseOpenTimeout(b)
+				recordCalls(t, b, 2, true, time.Millisecond)
+				// The failures that tripped it no longer count
+				recordCalls(t, b, 3, false, time.Millisecond)
+			},
+			want:        BreakerClosed,
+			transitions: []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transitions []BreakerState
+			b := NewCircuitBreaker("processor_a", testBreakerConfig(), func(tr BreakerTransition) {
+				transitions = append(transitions, tr.To)
+			})
+
+			tt.run(t, b)
+
+			if got := b.State(); got != tt.want {
+				t.Errorf("State() = %s, want %s", got, tt.want)
+			}
+			if !reflect.DeepEqual(transitions, tt.transitions) {
+				t.Errorf("transitions = %v, want %v", transitions, tt.transitions)
+			}
+		})
+	}
+}
@@ -4,157 +4,214 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
 )
 
-// ProcessorClient handles communication with payment processors
+// ProcessorClient wraps a processor API client with a circuit breaker. It
+// implements processor.ProcessorInterface so it can live in the factory.
 type ProcessorClient struct {
-	name       string
-	baseURL    string
-	httpClient *http.Client
-	healthy    bool
-	mu         sync.RWMutex
+	*processor.Client
+	breaker *CircuitBreaker
 }
 
-type ProcessorChargeRequest struct {
-	Amount         float64 `json:"amount"`
-	Currency       string  `json:"currency"`
-	Token          string  `json:"network_token,omitempty"`
-	IdempotencyKey string  `json:"idempotency_key"`
-}
+func NewProcessorClient(config *processor.ProcessorConfig, breakerCfg BreakerConfig, onTransition func(BreakerTransition), recorder audit.Recorder) *ProcessorClient {
+	client := &ProcessorClient{
+		Client:  processor.NewClient(config.Name, config.BaseURL, config.Timeout),
+		breaker: NewCircuitBreaker(config.Name, breakerCfg, onTransition),
+	}
+	client.SetTransport(audit.NewTransport(recorder, audit.KindProcessor, config.Name))
 
-type ProcessorChargeResponse struct {
-	Success       bool   `json:"success"`
-	TransactionID string `json:"transaction_id"`
-	AuthCode      string `json:"auth_code,omitempty"`
-	ErrorCode     string `json:"error_code,omitempty"`
-	ErrorMessage  string `json:"error_message,omitempty"`
-}
+	// Start probe goroutine
+	go client.probeLoop()
 
-type ProcessorRefundRequest struct {
-	OriginalTransactionID string  `json:"original_transaction_id"`
-	Amount                float64 `json:"amount"`
-	Reason                string  `json:"reason"`
+	return client
 }
 
-type ProcessorRefundResponse struct {
-	Success  bool   `json:"success"`
-	RefundID string `json:"refund_id"`
-	Message  string `json:"message"`
+// Charge sends a charge through the breaker. Declines are returned as a
+// response rather than an error so they don't trigger failover.
+func (c *ProcessorClient) Charge(ctx context.Context, req *processor.ChargeRequest) (*processor.ChargeResponse, error) {
+	var resp *processor.ChargeResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Charge(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
+	}
+	return resp, err
 }
 
-func NewProcessorClient(name, baseURL string) *ProcessorClient {
-	client := &ProcessorClient{
-		name:    name,
-		baseURL: baseURL,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
-		healthy: true,
+// Refund sends a refund through the breaker
+func (c *ProcessorClient) Refund(ctx context.Context, req *processor.RefundRequest) (*processor.RefundResponse, error) {
+	var resp *processor.RefundResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Refund(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
 	}
-
-	// Start health check goroutine
-	go client.healthCheckLoop()
-
-	return client
+	return resp, err
 }
 
-func (c *ProcessorClient) Charge(ctx context.Context, req ProcessorChargeRequest) (*ProcessorChargeResponse, error) {
-	url := fmt.Sprintf("%s/charge", c.baseURL)
+// Authorize places a hold through the breaker. Declines are returned as a response.
+func (c *ProcessorClient) Authorize(ctx context.Context, req *processor.AuthorizeRequest) (*processor.AuthorizeResponse, error) {
+	var resp *processor.AuthorizeResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Authorize(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
+	}
+	return resp, err
+}
 
-	jsonData, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
+// Verify runs a zero-amount authorization through the breaker. Declines are returned as a response.
+func (c *ProcessorClient) Verify(ctx context.Context, req *processor.VerifyRequest) (*processor.VerifyResponse, error) {
+	var resp *processor.VerifyResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Verify(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
 	}
+	return resp, err
+}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
+// Capture collects funds from an authorization through the breaker
+func (c *ProcessorClient) Capture(ctx context.Context, req *processor.CaptureRequest) (*processor.CaptureResponse, error) {
+	var resp *processor.CaptureResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Capture(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
+	return resp, err
+}
 
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		c.markUnhealthy()
-		return nil, fmt.Errorf("processor %s request failed: %w", c.name, err)
+// Void releases an authorization through the breaker
+func (c *ProcessorClient) Void(ctx context.Context, req *processor.VoidRequest) (*processor.VoidResponse, error) {
+	var resp *processor.VoidResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.Void(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
 	}
-	defer resp.Body.Close()
+	return resp, err
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPaymentRequired {
-		c.markUnhealthy()
-		return nil, fmt.Errorf("processor %s returned status %d", c.name, resp.StatusCode)
+// SubmitDisputeEvidence sends dispute evidence through the breaker. A
+// rejection is returned as a response.
+func (c *ProcessorClient) SubmitDisputeEvidence(ctx context.Context, req *processor.DisputeEvidenceRequest) (*processor.DisputeEvidenceResponse, error) {
+	var resp *processor.DisputeEvidenceResponse
+	err := c.call(func() (err error) {
+		resp, err = c.Client.SubmitDisputeEvidence(ctx, req)
+		return err
+	})
+	if resp != nil && isDecline(err) {
+		return resp, nil
 	}
+	return resp, err
+}
 
-	var result ProcessorChargeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+// call runs a processor request through the circuit breaker and records its outcome
+func (c *ProcessorClient) call(fn func() error) error {
+	if err := c.breaker.Allow(); err != nil {
+		return fmt.Errorf("processor %s unavailable: %w", c.GetName(), err)
 	}
 
-	return &result, nil
+	start := time.Now()
+	err := fn()
+	c.breaker.Record(!isProcessorFailure(err), time.Since(start))
+	return err
 }
 
-func (c *ProcessorClient) Refund(ctx context.Context, req ProcessorRefundRequest) (*ProcessorRefundResponse, error) {
-	url := fmt.Sprintf("%s/refund", c.baseURL)
-
-	jsonData, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
+// isDecline reports whether an error is a business-level rejection from a
+// processor that is otherwise working
+func isDecline(err error) bool {
+	return err != nil && !isProcessorFailure(err)
+}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
+// isProcessorFailure reports whether an error means the processor itself is
+// unwell. Declines and validation errors mean it is up; only network errors,
+// server errors, timeouts and throttling count against the breaker.
+func isProcessorFailure(err error) bool {
+	if err == nil {
+		return false
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("refund request failed: %w", err)
+	var procErr *processor.ProcessorError
+	if !errors.As(err, &procErr) {
+		return true
 	}
-	defer resp.Body.Close()
-
-	var result ProcessorRefundResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	if procErr.StatusCode == 0 {
+		return procErr.Code == "NETWORK_ERROR"
 	}
-
-	return &result, nil
+	return procErr.StatusCode >= 500 ||
+		procErr.StatusCode == http.StatusRequestTimeout ||
+		procErr.StatusCode == http.StatusTooManyRequests
 }
 
-func (c *ProcessorClient) IsHealthy() bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.healthy
+// isAmbiguousFailure reports whether a failed call may still have been
+// processed, e.g. a timeout after the request was sent. The outcome of such a
+// charge has to be confirmed with the processor.
+func isAmbiguousFailure(err error) bool {
+	var procErr *processor.ProcessorError
+	if err == nil || !errors.As(err, &procErr) {
+		return false
+	}
+	if procErr.StatusCode == 0 {
+		return procErr.Code == "NETWORK_ERROR"
+	}
+	return procErr.StatusCode == http.StatusRequestTimeout ||
+		procErr.StatusCode == http.StatusInternalServerError ||
+		procErr.StatusCode == http.StatusBadGateway ||
+		procErr.StatusCode == http.StatusGatewayTimeout
 }
 
-func (c *ProcessorClient) markUnhealthy() {
-	c.mu.Lock()
-	c.healthy = false
-	c.mu.Unlock()
+// IsHealthy reports whether the processor's circuit is not open
+func (c *ProcessorClient) IsHealthy(ctx context.Context) bool {
+	return c.breaker.State() != BreakerOpen
 }
 
-func (c *ProcessorClient) markHealthy() {
-	c.mu.Lock()
-	c.healthy = true
-	c.mu.Unlock()
+// BreakerSnapshot returns the processor's circuit breaker state
+func (c *ProcessorClient) BreakerSnapshot() BreakerSnapshot {
+	return c.breaker.Snapshot()
 }
 
-func (c *ProcessorClient) healthCheckLoop() {
-	ticker := time.NewTicker(30 * time.Second)
+// probeLoop sends health probes while the circuit is not closed, so an open
+// circuit can recover without spending customer traffic on it
+func (c *ProcessorClient) probeLoop() {
+	ticker := time.NewTicker(c.breaker.config.ProbeInterval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		url := fmt.Sprintf("%s/health", c.baseURL)
-		resp, err := c.httpClient.Get(url)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			c.markUnhealthy()
-		} else {
-			c.markHealthy()
-			resp.Body.Close()
+		if c.breaker.State() == BreakerClosed {
+			continue
 		}
+		if err := c.breaker.Allow(); err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		_, err := c.Health(ctx)
+		c.breaker.Record(err == nil, time.Since(start))
+		cancel()
 	}
 }
 
@@ -164,28 +221,57 @@ type BPASClient struct {
 	httpClient *http.Client
 }
 
+// RoutingRequest is what BPAS evaluates a payment on
+type RoutingRequest struct {
+	Amount       money.Money
+	Marketplace  string
+	CardBrand    string
+	CardCountry  string
+	SuccessRates map[string]float64 // Recent approval rate per processor, in percent
+}
+
+// RoutingDecision is the part of the BPAS evaluation response the orchestrator uses
 type RoutingDecision struct {
-	PrimaryProcessor   string  `json:"primary_processor"`
-	SecondaryProcessor string  `json:"secondary_processor"`
-	Confidence         float64 `json:"confidence"`
+	TargetProcessor string   `json:"target_processor"`
+	FallbackChain   []string `json:"fallback_chain"`
+	RuleMatched     string   `json:"rule_matched"`
+	Confidence      float64  `json:"confidence"`
+	ThreeDSRequired bool     `json:"three_ds_required"` // A rule requires 3-D Secure for the charge
 }
 
-func NewBPASClient(baseURL string) *BPASClient {
+// Chain returns the processors to try, in order
+func (d *RoutingDecision) Chain() []string {
+	if len(d.FallbackChain) > 0 {
+		return d.FallbackChain
+	}
+	if d.TargetProcessor != "" {
+		return []string{d.TargetProcessor}
+	}
+	return nil
+}
+
+func NewBPASClient(baseURL string, recorder audit.Recorder) *BPASClient {
 	return &BPASClient{
 		baseURL: baseURL,
 		httpClient: &http.Client{
-			Timeout: 2 * time.Second,
+			Timeout:   2 * time.Second,
+			Transport: audit.NewTransport(recorder, audit.KindBPAS, "bpas"),
 		},
 	}
 }
 
-func (c *BPASClient) GetRoutingDecision(ctx context.Context, amount float64, currency, marketplace string) (*RoutingDecision, error) {
+func (c *BPASClient) GetRoutingDecision(ctx context.Context, routing RoutingRequest) (*RoutingDecision, error) {
 	url := fmt.Sprintf("%s/bpas/evaluate", c.baseURL)
 
+	// BPAS rule thresholds are written in major units; fees are estimated on minor units
 	req := map[string]interface{}{
-		"amount":      amount,
-		"currency":    currency,
-		"marketplace": marketplace,
+		"amount":                  routing.Amount.Major(),
+		"amount_minor":            routing.Amount.Amount,
+		"currency":                routing.Amount.Currency,
+		"marketplace":             routing.Marketplace,
+		"card_brand":              routing.CardBrand,
+		"card_country":            routing.CardCountry,
+		"processor_success_rates": routing.SuccessRates,
 	}
 
 	jsonData, err := json.Marshal(req)
@@ -201,15 +287,14 @@ func (c *BPASClient) GetRoutingDecision(ctx context.Context, amount float64, cur
 
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
-		// Default routing on BPAS failure
-		return &RoutingDecision{
-			PrimaryProcessor:   "processor_a",
-			SecondaryProcessor: "processor_b",
-			Confidence:         0.5,
-		}, nil
+		return nil, fmt.Errorf("BPAS request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("BPAS returned status %d", resp.StatusCode)
+	}
+
 	var result RoutingDecision
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, err
@@ -218,17 +303,96 @@ func (c *BPASClient) GetRoutingDecision(ctx context.Context, amount float64, cur
 	return &result, nil
 }
 
-// TokenManager handles token selection and management
-type TokenManager struct {
-	networkTokenURL string
-	processorA      *ProcessorClient
-	processorB      *ProcessorClient
+// SubscriptionClient calls the subscription service
+type SubscriptionClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// ErrSubscriptionNotUpdatable is returned when the subscription service
+// refuses the change for good, e.g. the subscription is gone or canceled
+var ErrSubscriptionNotUpdatable = errors.New("subscription cannot be updated")
+
+func NewSubscriptionClient(baseURL string, recorder audit.Recorder) *SubscriptionClient {
+	return &SubscriptionClient{
+		baseURL: baseURL,
+		httpClient: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: audit.NewTransport(recorder, audit.KindSubscription, "subscription_service"),
+		},
+	}
+}
+
+// MarkPastDue puts a subscription into past_due. Repeating it is harmless.
+func (c *SubscriptionClient) MarkPastDue(ctx context.Context, subscriptionID, reason, disputeID string) error {
+	url := fmt.Sprintf("%s/subscriptions/%s/past_due", c.baseURL, subscriptionID)
+
+	jsonData, err := json.Marshal(map[string]string{
+		"reason":     reason,
+		"dispute_id": disputeID,
+	})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("subscription service request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%w: status %d", ErrSubscriptionNotUpdatable, resp.StatusCode)
+	}
+	return fmt.Errorf("subscription service returned status %d", resp.StatusCode)
 }
 
-func NewTokenManager(networkTokenURL string, processorA, processorB *ProcessorClient) *TokenManager {
-	return &TokenManager{
-		networkTokenURL: networkTokenURL,
-		processorA:      processorA,
-		processorB:      processorB,
+// RequirePaymentMethod flags a subscription as needing a new payment method
+// because its current one can no longer be charged. Repeating it is harmless.
+func (c *SubscriptionClient) RequirePaymentMethod(ctx context.Context, subscriptionID, paymentMethodID, reason string) error {
+	url := fmt.Sprintf("%s/subscriptions/%s/payment_method_required", c.baseURL, subscriptionID)
+
+	jsonData, err := json.Marshal(map[string]string{
+		"payment_method_id": paymentMethodID,
+		"reason":            reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
 	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("subscription service request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%w: status %d", ErrSubscriptionNotUpdatable, resp.StatusCode)
+	}
+	return fmt.Errorf("subscription service returned status %d", resp.StatusCode)
+}
+
+// NewTokenManager creates a network token service client whose calls are audited
+func NewTokenManager(networkTokenURL string, recorder audit.Recorder) *tokens.TokenManager {
+	manager := tokens.NewTokenManager(networkTokenURL)
+	manager.SetTransport(audit.NewTransport(recorder, audit.KindNetworkToken, "network_token"))
+	return manager
 }
@@ -3,13 +3,25 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+	"github.com/AnuragDani/subscription-platform/internal/models"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+	"github.com/AnuragDani/subscription-platform/internal/vault"
 )
 
 type DB struct {
-	conn *sql.DB
+	conn   *sql.DB
+	tokens *vault.Vault // Encrypts payment method tokens
 }
 
 type Transaction struct {
@@ -17,7 +29,7 @@ type Transaction struct {
 	SubscriptionID         string    `json:"subscription_id"`
 	PaymentMethodID        string    `json:"payment_method_id"`
 	ProcessorUsed          string    `json:"processor_used"`
-	Amount                 float64   `json:"amount"`
+	Amount                 int64     `json:"amount_minor"` // Minor units of Currency
 	Currency               string    `json:"currency"`
 	Status                 string    `json:"status"`
 	TransactionType        string    `json:"transaction_type"`
@@ -27,6 +39,116 @@ type Transaction struct {
 	ErrorCode              string    `json:"error_code,omitempty"`
 	UserErrorMessage       string    `json:"user_error_message,omitempty"`
 	CreatedAt              time.Time `json:"created_at"`
+
+	// Authorization fields (transaction_type = 'authorization')
+	CapturedAmount int64      `json:"captured_amount_minor,omitempty"`
+	AuthExpiresAt  *time.Time `json:"auth_expires_at,omitempty"`
+
+	// Total successfully refunded against a charge or capture
+	RefundedAmount int64 `json:"refunded_amount_minor,omitempty"`
+
+	// What the merchant receives, and the rate used to convert from Currency
+	SettlementAmount   int64    `json:"settlement_amount_minor"`
+	SettlementCurrency string   `json:"settlement_currency"`
+	FX                 fx.Quote `json:"fx"`
+
+	// Fee the processor is expected to charge, in minor units of Currency
+	ExpectedFee int64 `json:"expected_fee_minor"`
+
+	// Stored credential flags the charge was sent with
+	StoredCredential *processor.StoredCredential `json:"stored_credential,omitempty"`
+
+	// 3-D Secure: the exemption requested and, while the status is
+	// requires_action, the challenge the cardholder must complete
+	ThreeDSExemption   string `json:"three_ds_exemption,omitempty"`
+	ThreeDSChallengeID string `json:"three_ds_challenge_id,omitempty"`
+	ThreeDSRedirectURL string `json:"three_ds_redirect_url,omitempty"`
+}
+
+// Money returns the transaction amount in its presentment currency
+func (t *Transaction) Money() money.Money {
+	return money.Money{Amount: t.Amount, Currency: t.Currency}
+}
+
+// Settlement returns the amount in the settlement currency
+func (t *Transaction) Settlement() money.Money {
+	return money.Money{Amount: t.SettlementAmount, Currency: t.SettlementCurrency}
+}
+
+// settleAt converts the transaction amount with quote and records the rate
+func (t *Transaction) settleAt(quote fx.Quote) error {
+	settlement, err := quote.Convert(t.Money())
+	if err != nil {
+		return err
+	}
+	t.SettlementAmount = settlement.Amount
+	t.SettlementCurrency = settlement.Currency
+	t.FX = quote
+	return nil
+}
+
+// minorToDecimal fills a deprecated DECIMAL column from a minor-unit parameter
+func minorToDecimal(param, currencyParam string) string {
+	return param + "::numeric / power(10, currency_exponent(" + currencyParam + "))"
+}
+
+// Transaction types
+const (
+	TransactionTypeCharge        = "charge"
+	TransactionTypeRefund        = "refund"
+	TransactionTypeAuthorization = "authorization"
+	TransactionTypeCapture       = "capture"
+	TransactionTypeVoid          = "void"
+)
+
+// Transaction statuses. A transaction is written as pending before it is
+// sent to a processor; unknown means the processor's answer was lost, and
+// requires_action that the cardholder must complete a 3-D Secure challenge.
+const (
+	TransactionStatusPending        = "pending"
+	TransactionStatusSuccess        = "success"
+	TransactionStatusFailed         = "failed"
+	TransactionStatusUnknown        = "unknown"
+	TransactionStatusRequiresAction = "requires_action"
+)
+
+// Authorization statuses
+const (
+	AuthStatusAuthorized        = "authorized"
+	AuthStatusPartiallyCaptured = "partially_captured"
+	AuthStatusCaptured          = "captured"
+	AuthStatusVoided            = "voided"
+	AuthStatusExpired           = "expired"
+)
+
+// transactionTransitions lists the statuses a transaction may move to from each status
+var transactionTransitions = map[string][]string{
+	TransactionStatusPending:        {AuthStatusAuthorized, TransactionStatusSuccess, TransactionStatusFailed, TransactionStatusUnknown, TransactionStatusRequiresAction},
+	TransactionStatusUnknown:        {AuthStatusAuthorized, TransactionStatusSuccess, TransactionStatusFailed, TransactionStatusRequiresAction},
+	TransactionStatusRequiresAction: {TransactionStatusSuccess, TransactionStatusFailed},
+	AuthStatusAuthorized:            {AuthStatusPartiallyCaptured, AuthStatusCaptured, AuthStatusVoided, AuthStatusExpired},
+	AuthStatusPartiallyCaptured:     {AuthStatusPartiallyCaptured, AuthStatusCaptured, AuthStatusVoided, AuthStatusExpired},
+}
+
+// ErrInvalidTransition is returned when a transaction is not in a status that
+// can move to the requested one
+var ErrInvalidTransition = errors.New("invalid transaction status transition")
+
+// ErrDuplicateTransaction is returned when a transaction with the same
+// idempotency key already exists
+var ErrDuplicateTransaction = errors.New("transaction with this idempotency key already exists")
+
+// transitionSources returns the statuses that may move to status
+func transitionSources(status string) []string {
+	var sources []string
+	for from, targets := range transactionTransitions {
+		for _, to := range targets {
+			if to == status {
+				sources = append(sources, from)
+			}
+		}
+	}
+	return sources
 }
 
 type PaymentMethod struct {
@@ -37,9 +159,28 @@ type PaymentMethod struct {
 	ProcessorBToken string `json:"processor_b_token,omitempty"`
 	TokenType       string `json:"token_type"`
 	LastFour        string `json:"last_four"`
+	CardBrand       string `json:"card_brand,omitempty"`
+	CardCountry     string `json:"card_country,omitempty"` // ISO 3166 alpha-2 of the issuer
+
+	// Network transaction ID of the initial CIT that stored the card, referenced by MITs
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+
+	// ProcessorTokens holds vaulted tokens keyed by processor name
+	ProcessorTokens map[string]string `json:"processor_tokens,omitempty"`
+
+	ExpMonth   int        `json:"exp_month"`
+	ExpYear    int        `json:"exp_year"`
+	IsDefault  bool       `json:"is_default"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"` // Passed a zero-amount verification when attached
+	DetachedAt *time.Time `json:"detached_at,omitempty"` // Removed by the user; kept for past transactions
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// Set by the card network through lifecycle notifications
+	TokenStatus       string `json:"token_status"` // active, suspended or deleted
+	TokenStatusReason string `json:"token_status_reason,omitempty"`
 }
 
-func NewDB(connectionString string) (*DB, error) {
+func NewDB(connectionString string, tokenVault *vault.Vault) (*DB, error) {
 	conn, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, err
@@ -54,7 +195,7 @@ func NewDB(connectionString string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, tokens: tokenVault}, nil
 }
 
 func (db *DB) Close() error {
@@ -65,51 +206,145 @@ func (db *DB) Ping() error {
 	return db.conn.Ping()
 }
 
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// BeginTx starts a database transaction
+func (db *DB) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return db.conn.BeginTx(ctx, nil)
+}
+
+// WithTx runs fn in a database transaction, committing only if it returns nil
+func (db *DB) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *DB) CreateTransaction(ctx context.Context, t *Transaction) error {
+	return createTransaction(ctx, db.conn, t)
+}
+
+// CreateTransactionTx inserts a transaction as part of a database transaction
+func (db *DB) CreateTransactionTx(ctx context.Context, tx *sql.Tx, t *Transaction) error {
+	return createTransaction(ctx, tx, t)
+}
+
+func createTransaction(ctx context.Context, ex execer, t *Transaction) error {
 	query := `
 		INSERT INTO transactions (
 			id, subscription_id, payment_method_id, processor_used,
-			amount, currency, status, idempotency_key,
+			amount_minor, amount, currency, status, transaction_type, idempotency_key,
 			processor_transaction_id, original_transaction_id,
-			error_code, user_error_message, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			error_code, error_message, auth_expires_at, created_at,
+			settlement_currency, settlement_amount_minor,
+			fx_rate, fx_mid_rate, fx_markup_bps, fx_rate_as_of, expected_fee_minor,
+			stored_credential, three_ds_exemption
+		) VALUES ($1, $2, $3, $4, $5, ` + minorToDecimal("$5", "$6") + `, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			$16, $17, $18, $19, $20, $21, $22, $23, NULLIF($24, ''))
 		ON CONFLICT (idempotency_key) DO NOTHING`
 
-	_, err := db.conn.ExecContext(ctx, query,
-		t.ID, t.SubscriptionID, t.PaymentMethodID, t.ProcessorUsed,
-		t.Amount, t.Currency, t.Status, t.IdempotencyKey,
+	transactionType := t.TransactionType
+	if transactionType == "" {
+		transactionType = TransactionTypeCharge
+	}
+
+	// Without a quote the transaction settles in its own currency
+	if t.SettlementCurrency == "" {
+		if err := t.settleAt(fx.Identity(t.Currency)); err != nil {
+			return err
+		}
+	}
+	var rateAsOf *time.Time
+	if !t.FX.AsOf.IsZero() {
+		rateAsOf = &t.FX.AsOf
+	}
+	var storedCredential []byte
+	if t.StoredCredential != nil {
+		data, err := json.Marshal(t.StoredCredential)
+		if err != nil {
+			return err
+		}
+		storedCredential = data
+	}
+
+	result, err := ex.ExecContext(ctx, query,
+		t.ID, sql.NullString{String: t.SubscriptionID, Valid: t.SubscriptionID != ""}, t.PaymentMethodID, t.ProcessorUsed,
+		t.Amount, t.Currency, t.Status, transactionType, t.IdempotencyKey,
 		sql.NullString{String: t.ProcessorTransactionID, Valid: t.ProcessorTransactionID != ""},
 		t.OriginalTransactionID,
 		sql.NullString{String: t.ErrorCode, Valid: t.ErrorCode != ""},
 		sql.NullString{String: t.UserErrorMessage, Valid: t.UserErrorMessage != ""},
+		t.AuthExpiresAt,
 		time.Now(),
+		t.SettlementCurrency, t.SettlementAmount,
+		t.FX.Rate, t.FX.MidRate, t.FX.MarkupBps, rateAsOf, t.ExpectedFee,
+		nullJSON(storedCredential), t.ThreeDSExemption,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrDuplicateTransaction
+	}
+	return nil
 }
 
-func (db *DB) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
-	query := `
-		SELECT id, subscription_id, payment_method_id, processor_used,
-			   amount, currency, status, idempotency_key,
-			   processor_transaction_id, original_transaction_id,
-			   error_code, user_error_message, created_at
-		FROM transactions WHERE id = $1`
+const transactionColumns = `
+	id, subscription_id, payment_method_id, processor_used,
+	amount_minor, currency, status, transaction_type, idempotency_key,
+	processor_transaction_id, original_transaction_id,
+	error_code, error_message, created_at,
+	captured_amount_minor, auth_expires_at, refunded_amount_minor,
+	settlement_currency, settlement_amount_minor,
+	fx_rate, fx_mid_rate, fx_markup_bps, fx_rate_as_of, expected_fee_minor,
+	stored_credential, three_ds_exemption, three_ds_challenge_id, three_ds_redirect_url`
 
+func scanTransaction(row rowScanner) (*Transaction, error) {
 	var t Transaction
-	var processorTxID, errorCode, errorMessage sql.NullString
+	var subscriptionID, processorTxID, errorCode, errorMessage sql.NullString
 	var originalTxID sql.NullString
+	var authExpiresAt, rateAsOf sql.NullTime
+	var storedCredential []byte
+	var threeDSExemption, threeDSChallengeID, threeDSRedirectURL sql.NullString
 
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
-		&t.ID, &t.SubscriptionID, &t.PaymentMethodID, &t.ProcessorUsed,
-		&t.Amount, &t.Currency, &t.Status, &t.IdempotencyKey,
+	err := row.Scan(
+		&t.ID, &subscriptionID, &t.PaymentMethodID, &t.ProcessorUsed,
+		&t.Amount, &t.Currency, &t.Status, &t.TransactionType, &t.IdempotencyKey,
 		&processorTxID, &originalTxID,
 		&errorCode, &errorMessage, &t.CreatedAt,
+		&t.CapturedAmount, &authExpiresAt, &t.RefundedAmount,
+		&t.SettlementCurrency, &t.SettlementAmount,
+		&t.FX.Rate, &t.FX.MidRate, &t.FX.MarkupBps, &rateAsOf, &t.ExpectedFee,
+		&storedCredential, &threeDSExemption, &threeDSChallengeID, &threeDSRedirectURL,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if subscriptionID.Valid {
+		t.SubscriptionID = subscriptionID.String
+	}
 	if processorTxID.Valid {
 		t.ProcessorTransactionID = processorTxID.String
 	}
@@ -122,137 +357,1943 @@ func (db *DB) GetTransaction(ctx context.Context, id string) (*Transaction, erro
 	if errorMessage.Valid {
 		t.UserErrorMessage = errorMessage.String
 	}
+	if authExpiresAt.Valid {
+		t.AuthExpiresAt = &authExpiresAt.Time
+	}
+	t.FX.From = t.Currency
+	t.FX.To = t.SettlementCurrency
+	if rateAsOf.Valid {
+		t.FX.AsOf = rateAsOf.Time
+	}
+	if len(storedCredential) > 0 {
+		var credential processor.StoredCredential
+		if err := json.Unmarshal(storedCredential, &credential); err != nil {
+			return nil, err
+		}
+		t.StoredCredential = &credential
+	}
+	t.ThreeDSExemption = threeDSExemption.String
+	t.ThreeDSChallengeID = threeDSChallengeID.String
+	t.ThreeDSRedirectURL = threeDSRedirectURL.String
 
 	return &t, nil
 }
 
+func (db *DB) GetTransaction(ctx context.Context, id string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1`
+	return scanTransaction(db.conn.QueryRowContext(ctx, query, id))
+}
+
 func (db *DB) GetTransactionByIdempotencyKey(ctx context.Context, key string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE idempotency_key = $1`
+	return scanTransaction(db.conn.QueryRowContext(ctx, query, key))
+}
+
+// TransactionUpdate holds the fields set alongside a status transition.
+// Empty fields are left unchanged.
+type TransactionUpdate struct {
+	ProcessorUsed          string
+	ProcessorTransactionID string
+	ErrorCode              string
+	ErrorMessage           string
+	ThreeDSChallengeID     string
+	ThreeDSRedirectURL     string
+	AuthExpiresAt          *time.Time // When an authorization's hold lapses
+}
+
+// TransitionTransactionTx moves a transaction to a new status, failing with
+// ErrInvalidTransition if its current status can't move there
+func (db *DB) TransitionTransactionTx(ctx context.Context, tx *sql.Tx, id, status string, update TransactionUpdate) error {
 	query := `
-		SELECT id, subscription_id, payment_method_id, processor_used,
-			   amount, currency, status, idempotency_key,
-			   processor_transaction_id, original_transaction_id,
-			   error_code, user_error_message, created_at
-		FROM transactions WHERE idempotency_key = $1`
+		UPDATE transactions
+		SET status = $2,
+			processor_used = COALESCE(NULLIF($3, ''), processor_used),
+			processor_transaction_id = COALESCE(NULLIF($4, ''), processor_transaction_id),
+			error_code = COALESCE(NULLIF($5, ''), error_code),
+			error_message = COALESCE(NULLIF($6, ''), error_message),
+			three_ds_challenge_id = COALESCE(NULLIF($8, ''), three_ds_challenge_id),
+			three_ds_redirect_url = COALESCE(NULLIF($9, ''), three_ds_redirect_url),
+			auth_expires_at = COALESCE($10, auth_expires_at),
+			updated_at = NOW()
+		WHERE id = $1 AND status = ANY($7)`
 
-	var t Transaction
-	var processorTxID, errorCode, errorMessage sql.NullString
-	var originalTxID sql.NullString
+	result, err := tx.ExecContext(ctx, query, id, status,
+		update.ProcessorUsed, update.ProcessorTransactionID, update.ErrorCode, update.ErrorMessage,
+		pq.Array(transitionSources(status)), update.ThreeDSChallengeID, update.ThreeDSRedirectURL, update.AuthExpiresAt)
+	if err != nil {
+		return err
+	}
 
-	err := db.conn.QueryRowContext(ctx, query, key).Scan(
-		&t.ID, &t.SubscriptionID, &t.PaymentMethodID, &t.ProcessorUsed,
-		&t.Amount, &t.Currency, &t.Status, &t.IdempotencyKey,
-		&processorTxID, &originalTxID,
-		&errorCode, &errorMessage, &t.CreatedAt,
-	)
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: transaction %s to %s", ErrInvalidTransition, id, status)
+	}
+	return nil
+}
+
+// SetPendingProcessorTx records which processor a pending transaction is
+// being sent to, and the fee that processor is expected to charge
+func (db *DB) SetPendingProcessorTx(ctx context.Context, tx *sql.Tx, id, processorName string, expectedFee int64) error {
+	query := `
+		UPDATE transactions
+		SET processor_used = $2, expected_fee_minor = $3, updated_at = NOW()
+		WHERE id = $1 AND status = 'pending'`
+
+	_, err := tx.ExecContext(ctx, query, id, processorName, expectedFee)
+	return err
+}
+
+// GetStuckTransactions returns charges, authorizations, captures and refunds
+// left pending since before cutoff, or whose outcome is unknown, that haven't
+// used up their recovery attempts
+func (db *DB) GetStuckTransactions(ctx context.Context, cutoff time.Time, maxAttempts, limit int) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE transaction_type IN ('charge', 'authorization', 'capture', 'refund')
+		  AND ((status = 'pending' AND created_at < $1) OR status = 'unknown')
+		  AND recovery_attempts < $2
+		ORDER BY created_at
+		LIMIT $3`
 
+	rows, err := db.conn.QueryContext(ctx, query, cutoff, maxAttempts, limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if processorTxID.Valid {
-		t.ProcessorTransactionID = processorTxID.String
+	var transactions []*Transaction
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
 	}
-	if originalTxID.Valid {
-		t.OriginalTransactionID = &originalTxID.String
+	return transactions, rows.Err()
+}
+
+// GetTransactionByThreeDSChallenge finds the charge a processor's 3-D Secure
+// challenge belongs to
+func (db *DB) GetTransactionByThreeDSChallenge(ctx context.Context, processorName, challengeID string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE processor_used = $1 AND three_ds_challenge_id = $2`
+	return scanTransaction(db.conn.QueryRowContext(ctx, query, processorName, challengeID))
+}
+
+// GetStaleThreeDSTransactions returns charges that have been waiting on a
+// 3-D Secure challenge since before cutoff
+func (db *DB) GetStaleThreeDSTransactions(ctx context.Context, cutoff time.Time, limit int) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE status = 'requires_action' AND updated_at < $1
+		ORDER BY updated_at
+		LIMIT $2`
+
+	rows, err := db.conn.QueryContext(ctx, query, cutoff, limit)
+	if err != nil {
+		return nil, err
 	}
-	if errorCode.Valid {
-		t.ErrorCode = errorCode.String
+	defer rows.Close()
+
+	var transactions []*Transaction
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
 	}
-	if errorMessage.Valid {
-		t.UserErrorMessage = errorMessage.String
+	return transactions, rows.Err()
+}
+
+// RecordRecoveryAttempt counts an attempt to settle a stuck transaction and
+// returns the new total
+func (db *DB) RecordRecoveryAttempt(ctx context.Context, id string) (int, error) {
+	query := `
+		UPDATE transactions
+		SET recovery_attempts = recovery_attempts + 1, last_recovery_at = NOW()
+		WHERE id = $1
+		RETURNING recovery_attempts`
+
+	var attempts int
+	err := db.conn.QueryRowContext(ctx, query, id).Scan(&attempts)
+	return attempts, err
+}
+
+// GetTransactionForUpdate loads a transaction and locks its row until tx ends
+func (db *DB) GetTransactionForUpdate(ctx context.Context, tx *sql.Tx, id string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM transactions WHERE id = $1 FOR UPDATE`
+	return scanTransaction(tx.QueryRowContext(ctx, query, id))
+}
+
+// AddRefundedAmountTx adds a successful refund to the running total of its original transaction
+func (db *DB) AddRefundedAmountTx(ctx context.Context, tx *sql.Tx, id string, amount int64) error {
+	query := `
+		UPDATE transactions
+		SET refunded_amount_minor = refunded_amount_minor + $2,
+		    refunded_amount = ` + minorToDecimal("(refunded_amount_minor + $2)", "currency") + `,
+		    updated_at = NOW()
+		WHERE id = $1`
+
+	_, err := tx.ExecContext(ctx, query, id, amount)
+	return err
+}
+
+// RefundedSettlementTx sums the settlement amounts of refunds against a
+// transaction that succeeded or may still succeed
+func (db *DB) RefundedSettlementTx(ctx context.Context, tx *sql.Tx, originalTransactionID string) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(settlement_amount_minor), 0)
+		FROM transactions
+		WHERE original_transaction_id = $1 AND transaction_type = 'refund'
+		  AND status IN ('success', 'pending', 'unknown')`
+
+	var settled int64
+	err := tx.QueryRowContext(ctx, query, originalTransactionID).Scan(&settled)
+	return settled, err
+}
+
+// InFlightAmountTx sums the refunds or captures against a transaction that
+// have been sent to the processor but not settled. They count against what
+// is left until their outcome is known.
+func (db *DB) InFlightAmountTx(ctx context.Context, tx *sql.Tx, originalTransactionID, transactionType string) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(amount_minor), 0)
+		FROM transactions
+		WHERE original_transaction_id = $1 AND transaction_type = $2
+		  AND status IN ('pending', 'unknown')`
+
+	var amount int64
+	err := tx.QueryRowContext(ctx, query, originalTransactionID, transactionType).Scan(&amount)
+	return amount, err
+}
+
+// ListRefunds returns every refund attempt against a transaction, oldest first
+func (db *DB) ListRefunds(ctx context.Context, originalTransactionID string) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE original_transaction_id = $1 AND transaction_type = 'refund'
+		ORDER BY created_at`
+
+	rows, err := db.conn.QueryContext(ctx, query, originalTransactionID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return &t, nil
+	refunds := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, t)
+	}
+	return refunds, rows.Err()
 }
 
-func (db *DB) GetPaymentMethod(ctx context.Context, id string) (*PaymentMethod, error) {
+// ListRefundsByOriginal returns the refunds against each of the given
+// transactions, oldest first, keyed by original transaction ID
+func (db *DB) ListRefundsByOriginal(ctx context.Context, originalTransactionIDs []string) (map[string][]*Transaction, error) {
+	refunds := make(map[string][]*Transaction)
+	if len(originalTransactionIDs) == 0 {
+		return refunds, nil
+	}
+
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE original_transaction_id = ANY($1::uuid[]) AND transaction_type = 'refund'
+		ORDER BY created_at, id`
+
+	rows, err := db.conn.QueryContext(ctx, query, pq.Array(originalTransactionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		original := *t.OriginalTransactionID
+		refunds[original] = append(refunds[original], t)
+	}
+	return refunds, rows.Err()
+}
+
+// Columns transactions can be listed by
+const (
+	TransactionSortCreatedAt = "created_at"
+	TransactionSortAmount    = "amount_minor"
+)
+
+// TransactionCursor is the position of the last transaction on a page
+type TransactionCursor struct {
+	CreatedAt time.Time `json:"c,omitempty"`
+	Amount    int64     `json:"a,omitempty"`
+	ID        string    `json:"i"`
+}
+
+// TransactionFilter narrows a transaction search; zero fields match everything
+type TransactionFilter struct {
+	SubscriptionID  string
+	PaymentMethodID string
+	Processor       string
+	Statuses        []string
+	Types           []string
+	Currency        string
+	MinAmount       *int64     // Inclusive, minor units
+	MaxAmount       *int64     // Inclusive, minor units
+	CreatedFrom     *time.Time // Inclusive
+	CreatedTo       *time.Time // Exclusive
+
+	SortBy     string // TransactionSortCreatedAt or TransactionSortAmount
+	Descending bool
+	After      *TransactionCursor // Continue after this transaction
+	Limit      int
+}
+
+// ListTransactions returns transactions matching filter in the requested
+// order, breaking ties on ID so pages never overlap or skip rows
+func (db *DB) ListTransactions(ctx context.Context, filter TransactionFilter) ([]*Transaction, error) {
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.SubscriptionID != "" {
+		conditions = append(conditions, "subscription_id = "+arg(filter.SubscriptionID))
+	}
+	if filter.PaymentMethodID != "" {
+		conditions = append(conditions, "payment_method_id = "+arg(filter.PaymentMethodID))
+	}
+	if filter.Processor != "" {
+		conditions = append(conditions, "processor_used = "+arg(filter.Processor))
+	}
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status = ANY("+arg(pq.Array(filter.Statuses))+")")
+	}
+	if len(filter.Types) > 0 {
+		conditions = append(conditions, "transaction_type = ANY("+arg(pq.Array(filter.Types))+")")
+	}
+	if filter.Currency != "" {
+		conditions = append(conditions, "currency = "+arg(filter.Currency))
+	}
+	if filter.MinAmount != nil {
+		conditions = append(conditions, "amount_minor >= "+arg(*filter.MinAmount))
+	}
+	if filter.MaxAmount != nil {
+		conditions = append(conditions, "amount_minor <= "+arg(*filter.MaxAmount))
+	}
+	if filter.CreatedFrom != nil {
+		conditions = append(conditions, "created_at >= "+arg(*filter.CreatedFrom))
+	}
+	if filter.CreatedTo != nil {
+		conditions = append(conditions, "created_at < "+arg(*filter.CreatedTo))
+	}
+
+	sortColumn := TransactionSortCreatedAt
+	if filter.SortBy == TransactionSortAmount {
+		sortColumn = TransactionSortAmount
+	}
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	if filter.After != nil {
+		var value interface{} = filter.After.CreatedAt
+		if sortColumn == TransactionSortAmount {
+			value = filter.After.Amount
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s, %s)",
+			sortColumn, comparison, arg(value), arg(filter.After.ID)))
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM transactions`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, id %s LIMIT %s`, sortColumn, direction, direction, arg(filter.Limit))
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// GetAuthorizationForUpdate loads an authorization and locks its row until tx ends
+func (db *DB) GetAuthorizationForUpdate(ctx context.Context, tx *sql.Tx, id string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE id = $1 AND transaction_type = 'authorization'
+		FOR UPDATE`
+	return scanTransaction(tx.QueryRowContext(ctx, query, id))
+}
+
+// UpdateAuthorizationTx records the captured amount and status of an authorization
+func (db *DB) UpdateAuthorizationTx(ctx context.Context, tx *sql.Tx, id string, capturedAmount int64, status string) error {
 	query := `
-		SELECT id, user_id, network_token, processor_a_token, processor_b_token,
-			   token_type, last_four
-		FROM payment_methods WHERE id = $1`
+		UPDATE transactions
+		SET captured_amount_minor = $2, captured_amount = ` + minorToDecimal("$2", "currency") + `,
+		    status = $3, updated_at = NOW()
+		WHERE id = $1 AND transaction_type = 'authorization'`
 
+	_, err := tx.ExecContext(ctx, query, id, capturedAmount, status)
+	return err
+}
+
+// ExpireAuthorizations marks open authorizations past their hold window as expired
+func (db *DB) ExpireAuthorizations(ctx context.Context) (int64, error) {
+	query := `
+		UPDATE transactions
+		SET status = 'expired', updated_at = NOW()
+		WHERE transaction_type = 'authorization'
+		  AND status IN ('authorized', 'partially_captured')
+		  AND auth_expires_at < NOW()`
+
+	result, err := db.conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const paymentMethodColumns = `
+	id, user_id, network_token, processor_a_token, processor_b_token,
+	COALESCE(processor_tokens, '{}'), token_type, COALESCE(last_four, ''),
+	COALESCE(card_brand, ''), COALESCE(card_country, ''),
+	COALESCE(network_transaction_id, ''),
+	COALESCE(exp_month, 0), COALESCE(exp_year, 0), COALESCE(is_default, false),
+	verified_at, detached_at, COALESCE(created_at, NOW()),
+	token_status, COALESCE(token_status_reason, ''),
+	token_key_version, wrapped_data_key`
+
+// scanPaymentMethod reads a payment method, decrypting its tokens. Rows
+// without a key version were stored before encryption and are read as is.
+func (db *DB) scanPaymentMethod(row rowScanner) (*PaymentMethod, error) {
 	var pm PaymentMethod
 	var networkToken, processorAToken, processorBToken sql.NullString
+	var processorTokens, wrappedKey []byte
+	var verifiedAt, detachedAt sql.NullTime
+	var keyVersion sql.NullInt64
 
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
+	err := row.Scan(
 		&pm.ID, &pm.UserID, &networkToken, &processorAToken, &processorBToken,
-		&pm.TokenType, &pm.LastFour,
+		&processorTokens, &pm.TokenType, &pm.LastFour,
+		&pm.CardBrand, &pm.CardCountry,
+		&pm.NetworkTransactionID,
+		&pm.ExpMonth, &pm.ExpYear, &pm.IsDefault,
+		&verifiedAt, &detachedAt, &pm.CreatedAt,
+		&pm.TokenStatus, &pm.TokenStatusReason,
+		&keyVersion, &wrappedKey,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if networkToken.Valid {
-		pm.NetworkToken = networkToken.String
+	stored := vault.Tokens{
+		NetworkToken:    networkToken.String,
+		ProcessorAToken: processorAToken.String,
+		ProcessorBToken: processorBToken.String,
+		ProcessorTokens: make(map[string]string),
+	}
+	if err := json.Unmarshal(processorTokens, &stored.ProcessorTokens); err != nil {
+		return nil, fmt.Errorf("invalid processor_tokens for payment method %s: %w", pm.ID, err)
+	}
+	if keyVersion.Valid {
+		envelope, err := db.tokens.OpenEnvelope(int(keyVersion.Int64), wrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("payment method %s: %w", pm.ID, err)
+		}
+		if stored, err = envelope.Open(stored); err != nil {
+			return nil, fmt.Errorf("payment method %s: %w", pm.ID, err)
+		}
+	}
+
+	pm.NetworkToken = stored.NetworkToken
+	pm.ProcessorAToken = stored.ProcessorAToken
+	pm.ProcessorBToken = stored.ProcessorBToken
+	pm.ProcessorTokens = stored.ProcessorTokens
+	if pm.ProcessorAToken != "" {
+		if _, exists := pm.ProcessorTokens["processor_a"]; !exists {
+			pm.ProcessorTokens["processor_a"] = pm.ProcessorAToken
+		}
 	}
-	if processorAToken.Valid {
-		pm.ProcessorAToken = processorAToken.String
+	if pm.ProcessorBToken != "" {
+		if _, exists := pm.ProcessorTokens["processor_b"]; !exists {
+			pm.ProcessorTokens["processor_b"] = pm.ProcessorBToken
+		}
 	}
-	if processorBToken.Valid {
-		pm.ProcessorBToken = processorBToken.String
+	if verifiedAt.Valid {
+		pm.VerifiedAt = &verifiedAt.Time
+	}
+	if detachedAt.Valid {
+		pm.DetachedAt = &detachedAt.Time
 	}
 
 	return &pm, nil
 }
 
-func (db *DB) GetTransactionStats(ctx context.Context) (map[string]interface{}, error) {
-	query := `
-		SELECT 
-			COUNT(*) as total_transactions,
-			SUM(CASE WHEN status = 'success' THEN 1 ELSE 0 END) as successful,
-			SUM(CASE WHEN status = 'failed' THEN 1 ELSE 0 END) as failed,
-			SUM(amount) as total_volume,
-			AVG(amount) as avg_transaction_size
-		FROM transactions
-		WHERE created_at > NOW() - INTERVAL '24 hours'`
-
-	var stats struct {
-		TotalTransactions  sql.NullInt64
-		Successful         sql.NullInt64
-		Failed             sql.NullInt64
-		TotalVolume        sql.NullFloat64
-		AvgTransactionSize sql.NullFloat64
-	}
-
-	err := db.conn.QueryRowContext(ctx, query).Scan(
-		&stats.TotalTransactions,
-		&stats.Successful,
-		&stats.Failed,
-		&stats.TotalVolume,
-		&stats.AvgTransactionSize,
-	)
+func (db *DB) GetPaymentMethod(ctx context.Context, id string) (*PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE id = $1`
+	return db.scanPaymentMethod(db.conn.QueryRowContext(ctx, query, id))
+}
 
+// GetPaymentMethodForUpdate loads a payment method and locks its row until tx ends
+func (db *DB) GetPaymentMethodForUpdate(ctx context.Context, tx *sql.Tx, id string) (*PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + ` FROM payment_methods WHERE id = $1 FOR UPDATE`
+	return db.scanPaymentMethod(tx.QueryRowContext(ctx, query, id))
+}
+
+// ListPaymentMethods returns a user's attached payment methods, the default first
+func (db *DB) ListPaymentMethods(ctx context.Context, userID string) ([]*PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + `
+		FROM payment_methods
+		WHERE user_id = $1 AND detached_at IS NULL
+		ORDER BY is_default DESC, created_at DESC, id`
+
+	rows, err := db.conn.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	methods := []*PaymentMethod{}
+	for rows.Next() {
+		pm, err := db.scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, pm)
+	}
+	return methods, rows.Err()
+}
+
+// CreatePaymentMethodTx stores a tokenized card, its tokens encrypted under a
+// new data key. When it is the default, the user's other methods stop being
+// the default.
+func (db *DB) CreatePaymentMethodTx(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error {
+	if pm.IsDefault {
+		if err := clearDefaultPaymentMethod(ctx, tx, pm.UserID); err != nil {
+			return err
+		}
+	}
 
-	totalTx := int64(0)
-	if stats.TotalTransactions.Valid {
-		totalTx = stats.TotalTransactions.Int64
+	envelope, sealed, processorTokens, err := db.sealTokens(pm)
+	if err != nil {
+		return err
 	}
 
-	successful := int64(0)
-	if stats.Successful.Valid {
-		successful = stats.Successful.Int64
+	query := `
+		INSERT INTO payment_methods (
+			id, user_id, network_token, processor_a_token, processor_b_token, processor_tokens,
+			token_type, last_four, card_brand, card_country, exp_month, exp_year,
+			is_default, verified_at, created_at,
+			token_key_version, wrapped_data_key, network_token_hash
+		) VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6,
+			$7, $8, NULLIF($9, ''), NULLIF($10, ''), $11, $12, $13, $14, $15,
+			$16, $17, NULLIF($18, ''))`
+
+	_, err = tx.ExecContext(ctx, query,
+		pm.ID, pm.UserID, sealed.NetworkToken, sealed.ProcessorAToken, sealed.ProcessorBToken, processorTokens,
+		pm.TokenType, pm.LastFour, pm.CardBrand, pm.CardCountry, pm.ExpMonth, pm.ExpYear,
+		pm.IsDefault, pm.VerifiedAt, pm.CreatedAt,
+		envelope.KeyVersion, envelope.WrappedKey, db.tokens.Index(pm.NetworkToken))
+	return err
+}
+
+// sealTokens encrypts a payment method's tokens under a new data key
+func (db *DB) sealTokens(pm *PaymentMethod) (*vault.Envelope, vault.Tokens, []byte, error) {
+	envelope, err := db.tokens.NewEnvelope()
+	if err != nil {
+		return nil, vault.Tokens{}, nil, err
+	}
+	sealed, err := envelope.Seal(vault.Tokens{
+		NetworkToken:    pm.NetworkToken,
+		ProcessorAToken: pm.ProcessorAToken,
+		ProcessorBToken: pm.ProcessorBToken,
+		ProcessorTokens: pm.ProcessorTokens,
+	})
+	if err != nil {
+		return nil, vault.Tokens{}, nil, err
+	}
+	processorTokens, err := json.Marshal(sealed.ProcessorTokens)
+	if err != nil {
+		return nil, vault.Tokens{}, nil, err
 	}
+	return envelope, sealed, processorTokens, nil
+}
 
-	failed := int64(0)
-	if stats.Failed.Valid {
-		failed = stats.Failed.Int64
+// HasDefaultPaymentMethodTx reports whether a user has an attached default payment method
+func (db *DB) HasDefaultPaymentMethodTx(ctx context.Context, tx *sql.Tx, userID string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM payment_methods
+			WHERE user_id = $1 AND is_default AND detached_at IS NULL
+		)`
+
+	var exists bool
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&exists)
+	return exists, err
+}
+
+// SetDefaultPaymentMethodTx makes a payment method its user's only default
+func (db *DB) SetDefaultPaymentMethodTx(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error {
+	if err := clearDefaultPaymentMethod(ctx, tx, pm.UserID); err != nil {
+		return err
 	}
+	_, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = true WHERE id = $1`, pm.ID)
+	return err
+}
+
+func clearDefaultPaymentMethod(ctx context.Context, tx *sql.Tx, userID string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE payment_methods SET is_default = false WHERE user_id = $1 AND is_default`, userID)
+	return err
+}
+
+// DetachPaymentMethodTx removes a payment method from its user. The row is
+// kept for the transactions that reference it. If it was the default, the
+// user's newest remaining method takes over.
+func (db *DB) DetachPaymentMethodTx(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error {
+	query := `
+		UPDATE payment_methods
+		SET detached_at = NOW(), is_default = false
+		WHERE id = $1 AND detached_at IS NULL`
 
-	successRate := float64(0)
-	if totalTx > 0 {
-		successRate = float64(successful) / float64(totalTx) * 100
+	if _, err := tx.ExecContext(ctx, query, pm.ID); err != nil {
+		return err
+	}
+	if !pm.IsDefault {
+		return nil
 	}
 
-	return map[string]interface{}{
-		"total_transactions":   totalTx,
-		"successful":           successful,
-		"failed":               failed,
-		"success_rate":         successRate,
-		"total_volume":         stats.TotalVolume.Float64,
-		"avg_transaction_size": stats.AvgTransactionSize.Float64,
-	}, nil
+	query = `
+		UPDATE payment_methods
+		SET is_default = true
+		WHERE id = (
+			SELECT id FROM payment_methods
+			WHERE user_id = $1 AND detached_at IS NULL
+			ORDER BY created_at DESC, id
+			LIMIT 1
+		)`
+
+	_, err := tx.ExecContext(ctx, query, pm.UserID)
+	return err
+}
+
+// PaymentMethodInUseTx reports whether a subscription that still bills
+// charges the payment method
+func (db *DB) PaymentMethodInUseTx(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM subscriptions
+			WHERE payment_method_id = $1 AND status IN ('active', 'trialing', 'past_due', 'paused')
+		)`
+
+	var inUse bool
+	err := tx.QueryRowContext(ctx, query, id).Scan(&inUse)
+	return inUse, err
+}
+
+// SetPaymentMethodNetworkTransactionIDTx records the network transaction ID
+// of a charge that stored the card, for later MITs to reference
+func (db *DB) SetPaymentMethodNetworkTransactionIDTx(ctx context.Context, tx *sql.Tx, id, networkTransactionID string) error {
+	query := `
+		UPDATE payment_methods
+		SET network_transaction_id = $2, network_transaction_id_at = NOW()
+		WHERE id = $1`
+
+	_, err := tx.ExecContext(ctx, query, id, networkTransactionID)
+	return err
+}
+
+// ApplyTokenNotificationTx records a network token's state from a lifecycle
+// notification on every payment method holding the token, and returns the
+// ones that changed. Notifications older than the last one applied are
+// ignored. Encrypted tokens are matched by their hash.
+func (db *DB) ApplyTokenNotificationTx(ctx context.Context, tx *sql.Tx, n *tokens.LifecycleNotification) ([]*PaymentMethod, error) {
+	query := `
+		UPDATE payment_methods
+		SET token_status = $2, token_status_reason = NULLIF($3, ''),
+			last_four = COALESCE(NULLIF($4, ''), last_four),
+			exp_month = COALESCE(NULLIF($5, 0), exp_month),
+			exp_year = COALESCE(NULLIF($6, 0), exp_year),
+			token_updated_at = $7
+		WHERE (network_token_hash = $8 OR (token_key_version IS NULL AND network_token = $1))
+		  AND (token_updated_at IS NULL OR token_updated_at < $7)
+		RETURNING ` + paymentMethodColumns
+
+	rows, err := tx.QueryContext(ctx, query, n.NetworkToken, n.Status, n.Reason,
+		n.LastFour, n.ExpMonth, n.ExpYear, n.OccurredAt, db.tokens.Index(n.NetworkToken))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed []*PaymentMethod
+	for rows.Next() {
+		pm, err := db.scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, pm)
+	}
+	return changed, rows.Err()
+}
+
+// PaymentMethodRequirement is a billing subscription whose payment method
+// can no longer be charged and that hasn't yet asked for a new one
+type PaymentMethodRequirement struct {
+	SubscriptionID  string
+	PaymentMethodID string
+	TokenStatus     string
+}
+
+// ListPaymentMethodRequirements finds billing subscriptions charging a
+// suspended or deleted network token, optionally only for one token, that
+// the subscription service hasn't been told about
+func (db *DB) ListPaymentMethodRequirements(ctx context.Context, networkToken string, limit int) ([]PaymentMethodRequirement, error) {
+	query := `
+		SELECT s.id, pm.id, pm.token_status
+		FROM subscriptions s
+		JOIN payment_methods pm ON pm.id = s.payment_method_id
+		WHERE pm.token_status IN ('suspended', 'deleted')
+		  AND s.status IN ('active', 'trialing', 'past_due', 'paused')
+		  AND s.payment_method_required_at IS NULL
+		  AND ($1 = '' OR pm.network_token_hash = $3 OR (pm.token_key_version IS NULL AND pm.network_token = $1))
+		ORDER BY s.id
+		LIMIT $2`
+
+	rows, err := db.conn.QueryContext(ctx, query, networkToken, limit, db.tokens.Index(networkToken))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requirements []PaymentMethodRequirement
+	for rows.Next() {
+		var req PaymentMethodRequirement
+		if err := rows.Scan(&req.SubscriptionID, &req.PaymentMethodID, &req.TokenStatus); err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, req)
+	}
+	return requirements, rows.Err()
+}
+
+// Name of the dual-vault to network token migration in token_migration_checkpoints
+const tokenMigrationJob = "dual_vault_to_network"
+
+// TokenMigrationCheckpoint is where the dual-vault migration is in its
+// current pass, or was at the end of its last one
+type TokenMigrationCheckpoint struct {
+	CursorID        string     `json:"cursor_id,omitempty"` // Last payment method tried; empty between passes
+	PassStartedAt   *time.Time `json:"pass_started_at,omitempty"`
+	PassCompletedAt *time.Time `json:"pass_completed_at,omitempty"`
+	PassAttempted   int        `json:"pass_attempted"`
+	PassMigrated    int        `json:"pass_migrated"`
+	PassFailed      int        `json:"pass_failed"`
+	PassesCompleted int        `json:"passes_completed"`
+	Running         bool       `json:"running"` // A replica holds the lease
+	UpdatedAt       *time.Time `json:"updated_at,omitempty"`
+}
+
+// ClaimTokenMigration takes or renews the migration lease for owner, so only
+// one replica migrates at a time, and returns the checkpoint to resume from.
+// ok is false while another replica holds the lease.
+func (db *DB) ClaimTokenMigration(ctx context.Context, owner string, lease time.Duration) (cursorID string, ok bool, err error) {
+	_, err = db.conn.ExecContext(ctx,
+		`INSERT INTO token_migration_checkpoints (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, tokenMigrationJob)
+	if err != nil {
+		return "", false, err
+	}
+
+	// A pass starts when there is no cursor to resume from
+	query := `
+		UPDATE token_migration_checkpoints
+		SET lease_owner = $2, lease_expires_at = NOW() + $3 * INTERVAL '1 second',
+			pass_started_at = CASE WHEN cursor_id IS NULL THEN NOW() ELSE pass_started_at END,
+			pass_completed_at = CASE WHEN cursor_id IS NULL THEN NULL ELSE pass_completed_at END,
+			pass_attempted = CASE WHEN cursor_id IS NULL THEN 0 ELSE pass_attempted END,
+			pass_migrated = CASE WHEN cursor_id IS NULL THEN 0 ELSE pass_migrated END,
+			pass_failed = CASE WHEN cursor_id IS NULL THEN 0 ELSE pass_failed END
+		WHERE name = $1 AND (lease_owner IS NULL OR lease_owner = $2 OR lease_expires_at < NOW())
+		RETURNING COALESCE(cursor_id::text, '')`
+
+	err = db.conn.QueryRowContext(ctx, query, tokenMigrationJob, owner, int(lease.Seconds())).Scan(&cursorID)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return cursorID, true, nil
+}
+
+// SaveTokenMigrationCheckpoint records a finished batch. The cursor only
+// moves while owner holds the lease; when the pass is done the cursor is
+// cleared and the lease released.
+func (db *DB) SaveTokenMigrationCheckpoint(ctx context.Context, owner, cursorID string, attempted, migrated, failed int, done bool) error {
+	query := `
+		UPDATE token_migration_checkpoints
+		SET cursor_id = CASE WHEN $7 THEN NULL ELSE NULLIF($3, '')::uuid END,
+			pass_attempted = pass_attempted + $4,
+			pass_migrated = pass_migrated + $5,
+			pass_failed = pass_failed + $6,
+			passes_completed = passes_completed + CASE WHEN $7 THEN 1 ELSE 0 END,
+			pass_completed_at = CASE WHEN $7 THEN NOW() ELSE NULL END,
+			lease_owner = CASE WHEN $7 THEN NULL ELSE lease_owner END,
+			lease_expires_at = CASE WHEN $7 THEN NULL ELSE lease_expires_at END,
+			updated_at = NOW()
+		WHERE name = $1 AND lease_owner = $2`
+
+	result, err := db.conn.ExecContext(ctx, query, tokenMigrationJob, owner, cursorID, attempted, migrated, failed, done)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("token migration lease lost")
+	}
+	return nil
+}
+
+// ReleaseTokenMigration gives up the lease without finishing the pass, so
+// another replica can resume from the checkpoint
+func (db *DB) ReleaseTokenMigration(ctx context.Context, owner string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		UPDATE token_migration_checkpoints
+		SET lease_owner = NULL, lease_expires_at = NULL
+		WHERE name = $1 AND lease_owner = $2`, tokenMigrationJob, owner)
+	return err
+}
+
+// GetTokenMigrationCheckpoint returns the migration's checkpoint, or a zero
+// one if it has never run
+func (db *DB) GetTokenMigrationCheckpoint(ctx context.Context) (*TokenMigrationCheckpoint, error) {
+	query := `
+		SELECT COALESCE(cursor_id::text, ''), pass_started_at, pass_completed_at,
+			pass_attempted, pass_migrated, pass_failed, passes_completed,
+			lease_owner IS NOT NULL AND lease_expires_at > NOW(), updated_at
+		FROM token_migration_checkpoints
+		WHERE name = $1`
+
+	var c TokenMigrationCheckpoint
+	var started, completed, updated sql.NullTime
+	err := db.conn.QueryRowContext(ctx, query, tokenMigrationJob).Scan(
+		&c.CursorID, &started, &completed,
+		&c.PassAttempted, &c.PassMigrated, &c.PassFailed, &c.PassesCompleted,
+		&c.Running, &updated,
+	)
+	if err == sql.ErrNoRows {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if started.Valid {
+		c.PassStartedAt = &started.Time
+	}
+	if completed.Valid {
+		c.PassCompletedAt = &completed.Time
+	}
+	if updated.Valid {
+		c.UpdatedAt = &updated.Time
+	}
+	return &c, nil
+}
+
+// ListDualVaultPaymentMethods returns attached dual-vault payment methods
+// after cursorID, in ID order, that haven't been tried since triedBefore
+func (db *DB) ListDualVaultPaymentMethods(ctx context.Context, cursorID string, triedBefore time.Time, limit int) ([]*PaymentMethod, error) {
+	query := `SELECT ` + paymentMethodColumns + `
+		FROM payment_methods
+		WHERE token_type = 'dual_vault' AND detached_at IS NULL AND token_status = 'active'
+		  AND ($1 = '' OR id > NULLIF($1, '')::uuid)
+		  AND (network_token_attempted_at IS NULL OR network_token_attempted_at < $2)
+		ORDER BY id
+		LIMIT $3`
+
+	rows, err := db.conn.QueryContext(ctx, query, cursorID, triedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var methods []*PaymentMethod
+	for rows.Next() {
+		pm, err := db.scanPaymentMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, pm)
+	}
+	return methods, rows.Err()
+}
+
+// RecordNetworkTokenAttempt records why a dual-vault payment method still
+// couldn't get a network token
+func (db *DB) RecordNetworkTokenAttempt(ctx context.Context, id, result string) error {
+	query := `
+		UPDATE payment_methods
+		SET network_token_attempted_at = NOW(), network_token_attempt_result = $2
+		WHERE id = $1`
+
+	_, err := db.conn.ExecContext(ctx, query, id, result)
+	return err
+}
+
+// MigrateToNetworkTokenTx makes a dual-vault payment method a network token
+// one. Its processor tokens are kept as a fallback; all tokens are encrypted
+// again under a new data key.
+func (db *DB) MigrateToNetworkTokenTx(ctx context.Context, tx *sql.Tx, pm *PaymentMethod, networkToken string) error {
+	pm.NetworkToken = networkToken
+	envelope, sealed, processorTokens, err := db.sealTokens(pm)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE payment_methods
+		SET token_type = 'network', network_token = $2, network_token_hash = $3,
+			processor_a_token = NULLIF($4, ''), processor_b_token = NULLIF($5, ''), processor_tokens = $6,
+			token_key_version = $7, wrapped_data_key = $8,
+			network_token_attempted_at = NOW(), network_token_attempt_result = 'migrated',
+			network_token_migrated_at = NOW()
+		WHERE id = $1 AND token_type = 'dual_vault'`
+
+	_, err = tx.ExecContext(ctx, query, pm.ID, sealed.NetworkToken, db.tokens.Index(networkToken),
+		sealed.ProcessorAToken, sealed.ProcessorBToken, processorTokens,
+		envelope.KeyVersion, envelope.WrappedKey)
+	if err != nil {
+		return err
+	}
+	pm.TokenType = "network"
+	return nil
+}
+
+// TokenMigrationProgress counts payment methods by where they are in the
+// dual-vault migration
+type TokenMigrationProgress struct {
+	Remaining int            `json:"remaining"` // Attached dual-vault payment methods
+	Due       int            `json:"due"`       // Of those, the ones the next pass will try
+	Migrated  int            `json:"migrated"`  // Moved to a network token so far
+	Failures  map[string]int `json:"failures"`  // Remaining ones by the result of their last attempt
+}
+
+// GetTokenMigrationProgress counts the dual-vault migration's progress;
+// payment methods last tried before triedBefore are due
+func (db *DB) GetTokenMigrationProgress(ctx context.Context, triedBefore time.Time) (*TokenMigrationProgress, error) {
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE token_type = 'dual_vault' AND detached_at IS NULL),
+			COUNT(*) FILTER (WHERE token_type = 'dual_vault' AND detached_at IS NULL AND token_status = 'active'
+				AND (network_token_attempted_at IS NULL OR network_token_attempted_at < $1)),
+			COUNT(*) FILTER (WHERE network_token_migrated_at IS NOT NULL)
+		FROM payment_methods`
+
+	p := &TokenMigrationProgress{Failures: map[string]int{}}
+	if err := db.conn.QueryRowContext(ctx, query, triedBefore).Scan(&p.Remaining, &p.Due, &p.Migrated); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT network_token_attempt_result, COUNT(*)
+		FROM payment_methods
+		WHERE token_type = 'dual_vault' AND detached_at IS NULL AND network_token_attempt_result IS NOT NULL
+		GROUP BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result string
+		var count int
+		if err := rows.Scan(&result, &count); err != nil {
+			return nil, err
+		}
+		p.Failures[result] = count
+	}
+	return p, rows.Err()
+}
+
+// CurrencyStats aggregates the transactions in one presentment currency
+type CurrencyStats struct {
+	Currency     string `json:"currency"`
+	Transactions int64  `json:"transactions"`
+	Successful   int64  `json:"successful"`
+	Failed       int64  `json:"failed"`
+	Payments     int64  `json:"payments"`     // Successful charges and captures
+	VolumeMinor  int64  `json:"volume_minor"` // Total of those payments
+}
+
+// GetTransactionStatsByCurrency aggregates transactions created since a point in time, per currency
+func (db *DB) GetTransactionStatsByCurrency(ctx context.Context, since time.Time) ([]CurrencyStats, error) {
+	query := `
+		SELECT
+			currency,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'success'),
+			COUNT(*) FILTER (WHERE status = 'failed'),
+			COUNT(*) FILTER (WHERE status = 'success' AND transaction_type IN ('charge', 'capture')),
+			COALESCE(SUM(amount_minor) FILTER (
+				WHERE status = 'success' AND transaction_type IN ('charge', 'capture')
+			), 0)
+		FROM transactions
+		WHERE created_at > $1
+		GROUP BY currency
+		ORDER BY currency`
+
+	rows, err := db.conn.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []CurrencyStats{}
+	for rows.Next() {
+		var s CurrencyStats
+		if err := rows.Scan(&s.Currency, &s.Transactions, &s.Successful, &s.Failed, &s.Payments, &s.VolumeMinor); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// UpsertProcessorHealth records the latest circuit breaker state for a processor
+func (db *DB) UpsertProcessorHealth(ctx context.Context, s BreakerSnapshot) error {
+	query := `
+		INSERT INTO processor_health (
+			processor_name, is_healthy, last_check, failure_count, success_rate,
+			avg_response_time_ms, circuit_state, state_reason, state_changed_at
+		) VALUES ($1, $2, NOW(), $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (processor_name) DO UPDATE SET
+			is_healthy = EXCLUDED.is_healthy,
+			last_check = EXCLUDED.last_check,
+			failure_count = EXCLUDED.failure_count,
+			success_rate = EXCLUDED.success_rate,
+			avg_response_time_ms = EXCLUDED.avg_response_time_ms,
+			circuit_state = EXCLUDED.circuit_state,
+			state_reason = EXCLUDED.state_reason,
+			state_changed_at = EXCLUDED.state_changed_at`
+
+	_, err := db.conn.ExecContext(ctx, query,
+		s.Processor, s.State != BreakerOpen, s.Failures, s.SuccessRate,
+		s.AvgLatencyMs, string(s.State), s.Reason, s.StateChangedAt,
+	)
+	return err
+}
+
+// IdempotencyRecord is the stored state of an idempotency key
+type IdempotencyRecord struct {
+	Key          string          `json:"key"`
+	Scope        string          `json:"scope"`
+	RequestHash  string          `json:"request_hash"`
+	Status       string          `json:"status"` // in_flight or completed
+	ResponseCode int             `json:"response_code,omitempty"`
+	ResponseBody json.RawMessage `json:"response_body,omitempty"`
+	LockedUntil  *time.Time      `json:"locked_until,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+}
+
+// AcquireIdempotencyKey inserts an in-flight record for the key, taking over
+// one whose lock has lapsed or whose retention has passed. It reports whether
+// the caller now holds the key.
+func (db *DB) AcquireIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (idempotency_key, scope, request_hash, status, locked_until, created_at, expires_at)
+		VALUES ($1, $2, $3, 'in_flight', $4, $5, $6)
+		ON CONFLICT (idempotency_key) DO UPDATE SET
+			scope = EXCLUDED.scope,
+			request_hash = EXCLUDED.request_hash,
+			status = 'in_flight',
+			response_code = NULL,
+			response_body = NULL,
+			locked_until = EXCLUDED.locked_until,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE (idempotency_keys.status = 'in_flight' AND idempotency_keys.locked_until < NOW())
+		   OR idempotency_keys.expires_at < NOW()
+		RETURNING idempotency_key`
+
+	var key string
+	err := db.conn.QueryRowContext(ctx, query,
+		rec.Key, rec.Scope, rec.RequestHash, rec.LockedUntil, rec.CreatedAt, rec.ExpiresAt,
+	).Scan(&key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *DB) GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	query := `
+		SELECT idempotency_key, scope, request_hash, status, COALESCE(response_code, 0),
+			response_body, locked_until, created_at, expires_at
+		FROM idempotency_keys
+		WHERE idempotency_key = $1`
+
+	var rec IdempotencyRecord
+	var body []byte
+	err := db.conn.QueryRowContext(ctx, query, key).Scan(
+		&rec.Key, &rec.Scope, &rec.RequestHash, &rec.Status, &rec.ResponseCode,
+		&body, &rec.LockedUntil, &rec.CreatedAt, &rec.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 {
+		rec.ResponseBody = body
+	}
+	return &rec, nil
+}
+
+// CompleteIdempotencyKey stores the response for a key and releases its lock
+func (db *DB) CompleteIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status = 'completed', response_code = $2, response_body = $3,
+			locked_until = NULL, expires_at = $4
+		WHERE idempotency_key = $1 AND request_hash = $5`
+
+	_, err := db.conn.ExecContext(ctx, query,
+		rec.Key, rec.ResponseCode, []byte(rec.ResponseBody), rec.ExpiresAt, rec.RequestHash)
+	return err
+}
+
+// ReleaseIdempotencyKey drops an in-flight key so the request can be retried
+func (db *DB) ReleaseIdempotencyKey(ctx context.Context, key, requestHash string) error {
+	query := `DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND request_hash = $2 AND status = 'in_flight'`
+	_, err := db.conn.ExecContext(ctx, query, key, requestHash)
+	return err
+}
+
+func (db *DB) DeleteExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE expires_at < NOW() AND status = 'completed'`
+
+	result, err := db.conn.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const webhookEndpointColumns = `id, merchant_id, url, secret, event_types, COALESCE(description, ''), enabled, created_at, updated_at`
+
+func scanWebhookEndpoint(row rowScanner) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	err := row.Scan(&e.ID, &e.MerchantID, &e.URL, &e.Secret, pq.Array(&e.EventTypes),
+		&e.Description, &e.Enabled, &e.CreatedAt, &e.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (db *DB) CreateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	query := `
+		INSERT INTO webhook_endpoints (merchant_id, url, secret, event_types, description, enabled)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		RETURNING id, created_at, updated_at`
+
+	return db.conn.QueryRowContext(ctx, query,
+		e.MerchantID, e.URL, e.Secret, pq.Array(e.EventTypes), e.Description, e.Enabled,
+	).Scan(&e.ID, &e.CreatedAt, &e.UpdatedAt)
+}
+
+func (db *DB) GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE id = $1`
+	return scanWebhookEndpoint(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// ListWebhookEndpoints returns a merchant's endpoints, or every endpoint when merchantID is empty
+func (db *DB) ListWebhookEndpoints(ctx context.Context, merchantID string, enabledOnly bool) ([]*WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + `
+		FROM webhook_endpoints
+		WHERE ($1 = '' OR merchant_id = $1) AND (NOT $2 OR enabled)
+		ORDER BY created_at`
+
+	rows, err := db.conn.QueryContext(ctx, query, merchantID, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []*WebhookEndpoint{}
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+func (db *DB) UpdateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	query := `
+		UPDATE webhook_endpoints
+		SET url = $2, event_types = $3, description = NULLIF($4, ''), enabled = $5, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at`
+
+	return db.conn.QueryRowContext(ctx, query,
+		e.ID, e.URL, pq.Array(e.EventTypes), e.Description, e.Enabled,
+	).Scan(&e.UpdatedAt)
+}
+
+// DeleteWebhookEndpoint removes an endpoint along with its delivery log
+func (db *DB) DeleteWebhookEndpoint(ctx context.Context, id string) (bool, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM webhook_endpoints WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event_type, payload, status, attempts,
+	next_attempt_at, last_attempt_at, COALESCE(last_status_code, 0), COALESCE(last_error, ''),
+	delivered_at, created_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload []byte
+	err := row.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastAttemptAt, &d.LastStatusCode, &d.LastError,
+		&d.DeliveredAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	return &d, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CreateWebhookDelivery queues an event for an endpoint. Queuing the same
+// event for the same endpoint twice is a no-op.
+func (db *DB) CreateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, status, next_attempt_at)
+		VALUES ($1, $2, $3, $4, 'pending', NOW())
+		ON CONFLICT (endpoint_id, event_id) DO NOTHING`
+
+	_, err := db.conn.ExecContext(ctx, query, d.EndpointID, d.EventID, d.EventType, []byte(d.Payload))
+	return err
+}
+
+// ClaimDueWebhookDeliveries picks pending deliveries whose next attempt is
+// due and pushes that attempt back by lease, so other instances skip them
+// while they are being sent
+func (db *DB) ClaimDueWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + webhookDeliveryColumns
+
+	rows, err := db.conn.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+func (db *DB) GetWebhookDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = $1`
+	return scanWebhookDelivery(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// WebhookDeliveryFilter narrows the delivery log; empty fields match everything
+type WebhookDeliveryFilter struct {
+	EndpointID string
+	Status     string
+	EventType  string
+	Limit      int
+}
+
+// ListWebhookDeliveries returns deliveries matching filter, newest first
+func (db *DB) ListWebhookDeliveries(ctx context.Context, filter WebhookDeliveryFilter) ([]*WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE ($1 = '' OR endpoint_id::text = $1)
+		  AND ($2 = '' OR status = $2)
+		  AND ($3 = '' OR event_type = $3)
+		ORDER BY created_at DESC
+		LIMIT $4`
+
+	rows, err := db.conn.QueryContext(ctx, query, filter.EndpointID, filter.Status, filter.EventType, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// RecordWebhookAttempt logs an attempt and stores the delivery state it led to
+func (db *DB) RecordWebhookAttempt(ctx context.Context, d *WebhookDelivery, a *WebhookAttempt) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_delivery_attempts (delivery_id, attempt, status_code, error, duration_ms, manual, attempted_at)
+		VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, ''), $5, $6, $7)`,
+		d.ID, a.Attempt, a.StatusCode, a.Error, a.DurationMs, a.Manual, a.AttemptedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = $5,
+			last_status_code = NULLIF($6, 0), last_error = NULLIF($7, ''), delivered_at = $8
+		WHERE id = $1`,
+		d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastAttemptAt,
+		d.LastStatusCode, d.LastError, d.DeliveredAt,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListWebhookAttempts returns the attempts made for a delivery, oldest first
+func (db *DB) ListWebhookAttempts(ctx context.Context, deliveryID string) ([]WebhookAttempt, error) {
+	query := `
+		SELECT attempt, COALESCE(status_code, 0), COALESCE(error, ''), duration_ms, manual, attempted_at
+		FROM webhook_delivery_attempts
+		WHERE delivery_id = $1
+		ORDER BY attempted_at, id`
+
+	rows, err := db.conn.QueryContext(ctx, query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []WebhookAttempt{}
+	for rows.Next() {
+		var a WebhookAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.DurationMs, &a.Manual, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// GetDisputableTransaction finds the successful charge or capture a
+// processor refers to by its own transaction ID
+func (db *DB) GetDisputableTransaction(ctx context.Context, tx *sql.Tx, processorName, processorTransactionID string) (*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE processor_used = $1 AND processor_transaction_id = $2
+		  AND transaction_type IN ('charge', 'capture') AND status = 'success'`
+	return scanTransaction(tx.QueryRowContext(ctx, query, processorName, processorTransactionID))
+}
+
+const disputeColumns = `id, transaction_id, COALESCE(subscription_id::text, ''), processor, processor_dispute_id,
+	reason_code, COALESCE(reason, ''), amount_minor, currency, status, evidence_due_by, evidence,
+	evidence_submitted_at, resolved_at, subscription_synced_at, created_at, updated_at`
+
+func scanDispute(row rowScanner) (*Dispute, error) {
+	var d Dispute
+	var evidence []byte
+	err := row.Scan(&d.ID, &d.TransactionID, &d.SubscriptionID, &d.Processor, &d.ProcessorDisputeID,
+		&d.ReasonCode, &d.Reason, &d.Amount, &d.Currency, &d.Status, &d.EvidenceDueBy, &evidence,
+		&d.EvidenceSubmittedAt, &d.ResolvedAt, &d.SubscriptionSyncedAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if evidence != nil {
+		d.Evidence = evidence
+	}
+	return &d, nil
+}
+
+func scanDisputes(rows *sql.Rows) ([]*Dispute, error) {
+	defer rows.Close()
+
+	disputes := []*Dispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+// CreateDisputeTx records a new dispute in needs_response
+func (db *DB) CreateDisputeTx(ctx context.Context, tx *sql.Tx, d *Dispute) error {
+	query := `
+		INSERT INTO disputes (
+			transaction_id, subscription_id, processor, processor_dispute_id,
+			reason_code, reason, amount_minor, currency, status, evidence_due_by
+		) VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10)
+		RETURNING id, created_at, updated_at`
+
+	return tx.QueryRowContext(ctx, query,
+		d.TransactionID, d.SubscriptionID, d.Processor, d.ProcessorDisputeID,
+		d.ReasonCode, d.Reason, d.Amount, d.Currency, d.Status, d.EvidenceDueBy,
+	).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+}
+
+func (db *DB) GetDispute(ctx context.Context, id string) (*Dispute, error) {
+	query := `SELECT ` + disputeColumns + ` FROM disputes WHERE id = $1`
+	return scanDispute(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// GetDisputeByProcessorIDForUpdate locks the dispute a processor refers to
+// by its own dispute ID
+func (db *DB) GetDisputeByProcessorIDForUpdate(ctx context.Context, tx *sql.Tx, processorName, processorDisputeID string) (*Dispute, error) {
+	query := `SELECT ` + disputeColumns + ` FROM disputes WHERE processor = $1 AND processor_dispute_id = $2 FOR UPDATE`
+	return scanDispute(tx.QueryRowContext(ctx, query, processorName, processorDisputeID))
+}
+
+// DisputeFilter narrows the dispute list; empty fields match everything
+type DisputeFilter struct {
+	Status        string
+	TransactionID string
+	Limit         int
+}
+
+// ListDisputes returns disputes matching filter, newest first
+func (db *DB) ListDisputes(ctx context.Context, filter DisputeFilter) ([]*Dispute, error) {
+	query := `SELECT ` + disputeColumns + `
+		FROM disputes
+		WHERE ($1 = '' OR status = $1)
+		  AND ($2 = '' OR transaction_id::text = $2)
+		ORDER BY created_at DESC
+		LIMIT $3`
+
+	rows, err := db.conn.QueryContext(ctx, query, filter.Status, filter.TransactionID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDisputes(rows)
+}
+
+// TransitionDisputeTx moves a dispute to a new status, failing with
+// ErrInvalidDisputeTransition if its current status can't move there.
+// Evidence is stored when given.
+func (db *DB) TransitionDisputeTx(ctx context.Context, tx *sql.Tx, d *Dispute, status string, evidence json.RawMessage) error {
+	query := `
+		UPDATE disputes
+		SET status = $2,
+			evidence = COALESCE($3, evidence),
+			evidence_submitted_at = CASE WHEN $3::jsonb IS NULL THEN evidence_submitted_at ELSE NOW() END,
+			resolved_at = CASE WHEN $2 IN ('won', 'lost') THEN NOW() ELSE resolved_at END,
+			updated_at = NOW()
+		WHERE id = $1 AND status = ANY($4)
+		RETURNING ` + disputeColumns
+
+	var evidenceParam interface{}
+	if len(evidence) > 0 {
+		evidenceParam = []byte(evidence)
+	}
+
+	updated, err := scanDispute(tx.QueryRowContext(ctx, query, d.ID, status, evidenceParam,
+		pq.Array(disputeTransitionSources(status))))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: dispute %s to %s", ErrInvalidDisputeTransition, d.ID, status)
+	}
+	if err != nil {
+		return err
+	}
+	*d = *updated
+	return nil
+}
+
+// ListDisputesAwaitingSubscriptionSync returns lost disputes whose
+// subscription has not yet been put past due
+func (db *DB) ListDisputesAwaitingSubscriptionSync(ctx context.Context, limit int) ([]*Dispute, error) {
+	query := `SELECT ` + disputeColumns + `
+		FROM disputes
+		WHERE status = 'lost' AND subscription_id IS NOT NULL AND subscription_synced_at IS NULL
+		ORDER BY updated_at
+		LIMIT $1`
+
+	rows, err := db.conn.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDisputes(rows)
+}
+
+// MarkDisputeSubscriptionSynced records that the subscription service put
+// the subscription past due, or refused for good, so it is not asked again
+func (db *DB) MarkDisputeSubscriptionSynced(ctx context.Context, id string) error {
+	_, err := db.conn.ExecContext(ctx, `
+		UPDATE disputes SET subscription_synced_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND subscription_synced_at IS NULL`, id)
+	return err
+}
+
+// GetTransactionsByProcessorIDs returns a processor's transactions keyed by
+// the processor's own transaction ID
+func (db *DB) GetTransactionsByProcessorIDs(ctx context.Context, processorName string, processorTransactionIDs []string) (map[string]*Transaction, error) {
+	transactions := make(map[string]*Transaction)
+	if len(processorTransactionIDs) == 0 {
+		return transactions, nil
+	}
+
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE processor_used = $1 AND processor_transaction_id = ANY($2)`
+
+	rows, err := db.conn.QueryContext(ctx, query, processorName, pq.Array(processorTransactionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions[t.ProcessorTransactionID] = t
+	}
+	return transactions, rows.Err()
+}
+
+// ListSettleableTransactions returns the successful charges, captures and
+// refunds a processor should have settled for transactions made in [from, to)
+func (db *DB) ListSettleableTransactions(ctx context.Context, processorName string, from, to time.Time) ([]*Transaction, error) {
+	query := `SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE processor_used = $1 AND status = 'success'
+		  AND transaction_type IN ('charge', 'capture', 'refund')
+		  AND created_at >= $2 AND created_at < $3
+		ORDER BY created_at`
+
+	rows, err := db.conn.QueryContext(ctx, query, processorName, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+const reconciliationRunColumns = `id, processor, to_char(settlement_date, 'YYYY-MM-DD'), status,
+	record_count, matched_count, missing_count, extra_count, amount_mismatch_count, status_mismatch_count,
+	totals, COALESCE(error, ''), started_at, completed_at`
+
+func scanReconciliationRun(row rowScanner) (*ReconciliationRun, error) {
+	var run ReconciliationRun
+	var totals []byte
+	err := row.Scan(&run.ID, &run.Processor, &run.SettlementDate, &run.Status,
+		&run.RecordCount, &run.MatchedCount, &run.MissingCount, &run.ExtraCount,
+		&run.AmountMismatchCount, &run.StatusMismatchCount,
+		&totals, &run.Error, &run.StartedAt, &run.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(totals, &run.Totals); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (db *DB) CreateReconciliationRun(ctx context.Context, run *ReconciliationRun) error {
+	query := `
+		INSERT INTO reconciliation_runs (processor, settlement_date, status)
+		VALUES ($1, $2, 'running')
+		RETURNING id, status, started_at`
+
+	return db.conn.QueryRowContext(ctx, query, run.Processor, run.SettlementDate).
+		Scan(&run.ID, &run.Status, &run.StartedAt)
+}
+
+// CompleteReconciliationRun stores the ingested settlement lines and the
+// discrepancies found, and marks the run completed
+func (db *DB) CompleteReconciliationRun(ctx context.Context, run *ReconciliationRun, records []processor.SettlementRecord, discrepancies []*Discrepancy) error {
+	return db.WithTx(ctx, func(tx *sql.Tx) error {
+		for _, r := range records {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO settlement_records (
+					run_id, processor_transaction_id, original_processor_transaction_id, record_type, status,
+					amount_minor, currency, fee_minor, net_minor, processed_at
+				) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10)`,
+				run.ID, r.TransactionID, r.OriginalTransactionID, r.Type, r.Status,
+				r.Amount, r.Currency, r.Fee, r.Net, r.ProcessedAt,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, d := range discrepancies {
+			recorded, settled := d.Recorded, d.Settled
+			if recorded == nil {
+				recorded = &DiscrepancySide{}
+			}
+			if settled == nil {
+				settled = &DiscrepancySide{}
+			}
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO reconciliation_discrepancies (
+					run_id, kind, processor_transaction_id, transaction_id,
+					recorded_type, recorded_status, recorded_amount_minor, recorded_currency,
+					settled_type, settled_status, settled_amount_minor, settled_currency
+				) VALUES ($1, $2, $3, NULLIF($4, '')::uuid,
+					NULLIF($5, ''), NULLIF($6, ''), $7, NULLIF($8, ''),
+					NULLIF($9, ''), NULLIF($10, ''), $11, NULLIF($12, ''))`,
+				run.ID, d.Kind, d.ProcessorTransactionID, d.TransactionID,
+				recorded.Type, recorded.Status, sideAmount(d.Recorded), recorded.Currency,
+				settled.Type, settled.Status, sideAmount(d.Settled), settled.Currency,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		totals, err := json.Marshal(run.Totals)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, `
+			UPDATE reconciliation_runs
+			SET status = 'completed', record_count = $2, matched_count = $3, missing_count = $4,
+				extra_count = $5, amount_mismatch_count = $6, status_mismatch_count = $7,
+				totals = $8, completed_at = NOW()
+			WHERE id = $1
+			RETURNING status, completed_at`,
+			run.ID, run.RecordCount, run.MatchedCount, run.MissingCount,
+			run.ExtraCount, run.AmountMismatchCount, run.StatusMismatchCount, totals,
+		).Scan(&run.Status, &run.CompletedAt)
+	})
+}
+
+// sideAmount is a discrepancy side's amount, or NULL when the side is absent
+func sideAmount(side *DiscrepancySide) *int64 {
+	if side == nil {
+		return nil
+	}
+	return &side.Amount
+}
+
+// FailReconciliationRun marks a run failed with the reason
+func (db *DB) FailReconciliationRun(ctx context.Context, run *ReconciliationRun, reason string) error {
+	return db.conn.QueryRowContext(ctx, `
+		UPDATE reconciliation_runs SET status = 'failed', error = $2, completed_at = NOW()
+		WHERE id = $1
+		RETURNING status, error, completed_at`, run.ID, reason,
+	).Scan(&run.Status, &run.Error, &run.CompletedAt)
+}
+
+func (db *DB) GetReconciliationRun(ctx context.Context, id string) (*ReconciliationRun, error) {
+	query := `SELECT ` + reconciliationRunColumns + ` FROM reconciliation_runs WHERE id = $1`
+	return scanReconciliationRun(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// ReconciliationRunFilter narrows the run list; empty fields match everything
+type ReconciliationRunFilter struct {
+	Processor      string
+	SettlementDate string
+	Status         string
+	Limit          int
+}
+
+// ListReconciliationRuns returns runs matching filter, latest settlement day first
+func (db *DB) ListReconciliationRuns(ctx context.Context, filter ReconciliationRunFilter) ([]*ReconciliationRun, error) {
+	query := `SELECT ` + reconciliationRunColumns + `
+		FROM reconciliation_runs
+		WHERE ($1 = '' OR processor = $1)
+		  AND ($2 = '' OR settlement_date = NULLIF($2, '')::date)
+		  AND ($3 = '' OR status = $3)
+		ORDER BY settlement_date DESC, started_at DESC
+		LIMIT $4`
+
+	rows, err := db.conn.QueryContext(ctx, query, filter.Processor, filter.SettlementDate, filter.Status, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*ReconciliationRun{}
+	for rows.Next() {
+		run, err := scanReconciliationRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// HasCompletedReconciliation reports whether a processor's settlement day
+// has been reconciled
+func (db *DB) HasCompletedReconciliation(ctx context.Context, processorName, settlementDate string) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM reconciliation_runs
+			WHERE processor = $1 AND settlement_date = $2::date AND status = 'completed'
+		)`, processorName, settlementDate,
+	).Scan(&exists)
+	return exists, err
+}
+
+// ListDiscrepancies returns a run's discrepancies, optionally of one kind
+func (db *DB) ListDiscrepancies(ctx context.Context, runID, kind string) ([]*Discrepancy, error) {
+	query := `
+		SELECT kind, processor_transaction_id, COALESCE(transaction_id::text, ''),
+			recorded_type, recorded_status, recorded_amount_minor, recorded_currency,
+			settled_type, settled_status, settled_amount_minor, settled_currency
+		FROM reconciliation_discrepancies
+		WHERE run_id = $1 AND ($2 = '' OR kind = $2)
+		ORDER BY kind, id`
+
+	rows, err := db.conn.QueryContext(ctx, query, runID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discrepancies := []*Discrepancy{}
+	for rows.Next() {
+		var d Discrepancy
+		var recordedType, recordedStatus, recordedCurrency sql.NullString
+		var settledType, settledStatus, settledCurrency sql.NullString
+		var recordedAmount, settledAmount sql.NullInt64
+		err := rows.Scan(&d.Kind, &d.ProcessorTransactionID, &d.TransactionID,
+			&recordedType, &recordedStatus, &recordedAmount, &recordedCurrency,
+			&settledType, &settledStatus, &settledAmount, &settledCurrency)
+		if err != nil {
+			return nil, err
+		}
+		if recordedAmount.Valid {
+			d.Recorded = &DiscrepancySide{
+				Type:     recordedType.String,
+				Status:   recordedStatus.String,
+				Amount:   recordedAmount.Int64,
+				Currency: recordedCurrency.String,
+			}
+		}
+		if settledAmount.Valid {
+			d.Settled = &DiscrepancySide{
+				Type:     settledType.String,
+				Status:   settledStatus.String,
+				Amount:   settledAmount.Int64,
+				Currency: settledCurrency.String,
+			}
+		}
+		discrepancies = append(discrepancies, &d)
+	}
+	return discrepancies, rows.Err()
+}
+
+// GetProcessorApprovalRates returns the share of charges and authorizations
+// each processor approved since a point in time, in percent. Processors
+// with fewer than minAttempts decided attempts are left out.
+func (db *DB) GetProcessorApprovalRates(ctx context.Context, since time.Time, minAttempts int) (map[string]float64, error) {
+	query := `
+		SELECT processor_used,
+			COUNT(*) FILTER (WHERE status <> 'failed'),
+			COUNT(*)
+		FROM transactions
+		WHERE transaction_type IN ('charge', 'authorization')
+		  AND created_at > $1
+		  AND status NOT IN ('pending', 'unknown', 'requires_action')
+		  AND processor_used <> 'none'
+		GROUP BY processor_used
+		HAVING COUNT(*) >= $2`
+
+	// Anything decided and not failed was approved, including charges since
+	// refunded and authorizations since captured, voided or expired
+	rows, err := db.conn.QueryContext(ctx, query, since, minAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := make(map[string]float64)
+	for rows.Next() {
+		var processorName string
+		var approved, attempts int64
+		if err := rows.Scan(&processorName, &approved, &attempts); err != nil {
+			return nil, err
+		}
+		rates[processorName] = float64(approved) / float64(attempts) * 100
+	}
+	return rates, rows.Err()
+}
+
+// InsertAuditLogs stores a batch of audit entries
+func (db *DB) InsertAuditLogs(ctx context.Context, entries []*models.AuditLog) error {
+	return db.WithTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, `
+			INSERT INTO audit_logs (
+				transaction_id, event_type, processor, method, endpoint,
+				status_code, latency_ms, error, request_payload, response_payload, created_at
+			) VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, NULLIF($6, 0), $7, NULLIF($8, ''), $9, $10, $11)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, e := range entries {
+			_, err := stmt.ExecContext(ctx,
+				e.TransactionID, e.EventType, e.Processor, e.Method, e.Endpoint,
+				e.StatusCode, e.LatencyMs, e.Error, nullJSON(e.RequestPayload), nullJSON(e.ResponsePayload), e.Timestamp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// nullJSON passes an empty payload as SQL NULL
+func nullJSON(payload json.RawMessage) interface{} {
+	if len(payload) == 0 {
+		return nil
+	}
+	return []byte(payload)
+}
+
+const auditLogColumns = `
+	id, COALESCE(transaction_id::text, ''), event_type, processor, method, endpoint,
+	COALESCE(status_code, 0), latency_ms, COALESCE(error, ''), request_payload, response_payload, created_at`
+
+func scanAuditLog(row rowScanner) (*models.AuditLog, error) {
+	var e models.AuditLog
+	var request, response []byte
+	err := row.Scan(&e.ID, &e.TransactionID, &e.EventType, &e.Processor, &e.Method, &e.Endpoint,
+		&e.StatusCode, &e.LatencyMs, &e.Error, &request, &response, &e.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	e.RequestPayload = request
+	e.ResponsePayload = response
+	return &e, nil
+}
+
+// AuditLogCursor is the position after the last entry of a page
+type AuditLogCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+// AuditLogFilter narrows the audit log; empty fields match everything
+type AuditLogFilter struct {
+	TransactionID string
+	Processor     string
+	EventType     string
+	From          *time.Time // Inclusive
+	To            *time.Time // Exclusive
+	After         *AuditLogCursor
+	Limit         int
+}
+
+// ListAuditLogs returns audit entries matching filter, newest first
+func (db *DB) ListAuditLogs(ctx context.Context, filter AuditLogFilter) ([]*models.AuditLog, error) {
+	query := `SELECT ` + auditLogColumns + `
+		FROM audit_logs
+		WHERE ($1 = '' OR transaction_id = NULLIF($1, '')::uuid)
+		  AND ($2 = '' OR processor = $2)
+		  AND ($3 = '' OR event_type = $3)
+		  AND ($4::timestamp IS NULL OR created_at >= $4)
+		  AND ($5::timestamp IS NULL OR created_at < $5)
+		  AND ($6::timestamp IS NULL OR (created_at, id) < ($6, $7::uuid))
+		ORDER BY created_at DESC, id DESC
+		LIMIT $8`
+
+	var afterTime *time.Time
+	var afterID interface{}
+	if filter.After != nil {
+		afterTime = &filter.After.CreatedAt
+		afterID = filter.After.ID
+	}
+
+	rows, err := db.conn.QueryContext(ctx, query, filter.TransactionID, filter.Processor, filter.EventType,
+		filter.From, filter.To, afterTime, afterID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*models.AuditLog{}
+	for rows.Next() {
+		e, err := scanAuditLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// PurgeAuditLogs deletes up to limit entries older than cutoff, oldest first
+func (db *DB) PurgeAuditLogs(ctx context.Context, cutoff time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM audit_logs
+		WHERE id IN (
+			SELECT id FROM audit_logs WHERE created_at < $1 ORDER BY created_at LIMIT $2
+		)`
+
+	result, err := db.conn.ExecContext(ctx, query, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
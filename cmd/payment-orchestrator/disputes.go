@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// Dispute statuses. A dispute needs a response until evidence is submitted
+// or its deadline passes.
+const (
+	DisputeStatusNeedsResponse = "needs_response"
+	DisputeStatusUnderReview   = "under_review"
+	DisputeStatusWon           = "won"
+	DisputeStatusLost          = "lost"
+)
+
+// disputeTransitions lists the statuses a dispute may move to from each status
+var disputeTransitions = map[string][]string{
+	DisputeStatusNeedsResponse: {DisputeStatusUnderReview, DisputeStatusLost},
+	DisputeStatusUnderReview:   {DisputeStatusWon, DisputeStatusLost},
+}
+
+// ErrInvalidDisputeTransition is returned when a dispute is not in a status
+// that can move to the requested one
+var ErrInvalidDisputeTransition = errors.New("invalid dispute status transition")
+
+// disputeTransitionSources returns the statuses that may move to status
+func disputeTransitionSources(status string) []string {
+	var sources []string
+	for from, targets := range disputeTransitions {
+		for _, to := range targets {
+			if to == status {
+				sources = append(sources, from)
+			}
+		}
+	}
+	return sources
+}
+
+// disputePath returns the statuses a dispute passes through to reach status,
+// or nil if it can't get there. A processor may skip a step we never heard
+// about, e.g. report a dispute won that we still have as needs_response.
+func disputePath(from, to string) []string {
+	for _, next := range disputeTransitions[from] {
+		if next == to {
+			return []string{to}
+		}
+	}
+	for _, next := range disputeTransitions[from] {
+		for _, after := range disputeTransitions[next] {
+			if after == to {
+				return []string{next, to}
+			}
+		}
+	}
+	return nil
+}
+
+// Dispute is a chargeback raised against a charge or capture
+type Dispute struct {
+	ID                   string          `json:"id"`
+	TransactionID        string          `json:"transaction_id"`
+	SubscriptionID       string          `json:"subscription_id,omitempty"`
+	Processor            string          `json:"processor"`
+	ProcessorDisputeID   string          `json:"processor_dispute_id"`
+	ReasonCode           string          `json:"reason_code"`
+	Reason               string          `json:"reason,omitempty"`
+	Amount               int64           `json:"amount_minor"`
+	Currency             string          `json:"currency"`
+	Status               string          `json:"status"`
+	EvidenceDueBy        time.Time       `json:"evidence_due_by"`
+	Evidence             json.RawMessage `json:"evidence,omitempty"`
+	EvidenceSubmittedAt  *time.Time      `json:"evidence_submitted_at,omitempty"`
+	ResolvedAt           *time.Time      `json:"resolved_at,omitempty"`
+	SubscriptionSyncedAt *time.Time      `json:"subscription_synced_at,omitempty"`
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+}
+
+// errDisputeRejected is returned from the intake transaction with the
+// response to send when a notification can't be recorded
+type errDisputeRejected struct {
+	status  int
+	message string
+	code    string
+}
+
+func (e *errDisputeRejected) Error() string { return e.message }
+
+// handleDisputeNotification records a dispute raised or updated by a
+// processor (POST /processors/{processor}/disputes). Only the dispute ID is
+// taken from the notification; the dispute itself is read back from the
+// processor, so a forged notification can't open or resolve one.
+// Notifications are retried by the processor, so repeats and stale ones are
+// acknowledged without changing anything.
+func (o *PaymentOrchestrator) handleDisputeNotification(w http.ResponseWriter, r *http.Request) {
+	processorName := mux.Vars(r)["processor"]
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Unknown processor", "UNKNOWN_PROCESSOR")
+		return
+	}
+
+	var notification processor.DisputeNotification
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	if notification.DisputeID == "" {
+		respondError(w, http.StatusBadRequest, "dispute_id is required", "INVALID_REQUEST")
+		return
+	}
+
+	ctx := r.Context()
+	n, err := client.GetDispute(ctx, notification.DisputeID)
+	if errors.Is(err, processor.ErrDisputeNotFound) {
+		log.Printf("Rejected notification for dispute %s, which %s has no record of", notification.DisputeID, processorName)
+		respondError(w, http.StatusNotFound, "Dispute not found on the processor", "DISPUTE_NOT_FOUND")
+		return
+	}
+	if err != nil {
+		log.Printf("Could not read back dispute %s from %s: %v", notification.DisputeID, processorName, err)
+		respondError(w, http.StatusBadGateway, "Could not read the dispute from the processor", "PROCESSOR_UNAVAILABLE")
+		return
+	}
+	if n.DisputeID != notification.DisputeID || n.TransactionID == "" || n.ReasonCode == "" || n.EvidenceDueBy.IsZero() {
+		log.Printf("Processor %s returned an incomplete dispute for %s", processorName, notification.DisputeID)
+		respondError(w, http.StatusBadGateway, "Processor returned an incomplete dispute", "PROCESSOR_ERROR")
+		return
+	}
+	if _, known := disputeEvents[n.Status]; !known {
+		log.Printf("Processor %s reports dispute %s with unknown status %s", processorName, n.DisputeID, n.Status)
+		respondError(w, http.StatusBadGateway, "Processor reported unknown dispute status "+n.Status, "PROCESSOR_ERROR")
+		return
+	}
+
+	var dispute *Dispute
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		dispute, err = o.db.GetDisputeByProcessorIDForUpdate(ctx, tx, processorName, n.DisputeID)
+		if errors.Is(err, sql.ErrNoRows) {
+			dispute, err = o.openDispute(ctx, tx, processorName, n)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, status := range disputePath(dispute.Status, n.Status) {
+			if err := o.db.TransitionDisputeTx(ctx, tx, dispute, status, nil); err != nil {
+				return err
+			}
+			if err := o.events.EmitDispute(ctx, tx, dispute); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var rejected *errDisputeRejected
+	if errors.As(err, &rejected) {
+		log.Printf("Rejected dispute %s from %s: %s", n.DisputeID, processorName, rejected.message)
+		respondError(w, rejected.status, rejected.message, rejected.code)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record dispute %s from %s: %v", n.DisputeID, processorName, err)
+		http.Error(w, "Failed to record dispute", http.StatusInternalServerError)
+		return
+	}
+
+	if dispute.Status != n.Status {
+		log.Printf("Processor reports dispute %s as %s, which can't follow %s; left unchanged", dispute.ID, n.Status, dispute.Status)
+	}
+	if dispute.Status == DisputeStatusLost {
+		o.syncLostDispute(ctx, dispute)
+	}
+
+	respondJSON(w, http.StatusOK, dispute)
+}
+
+// openDispute links a new processor dispute to the transaction it is
+// against and records it as needing a response
+func (o *PaymentOrchestrator) openDispute(ctx context.Context, tx *sql.Tx, processorName string, n *processor.DisputeNotification) (*Dispute, error) {
+	transaction, err := o.db.GetDisputableTransaction(ctx, tx, processorName, n.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &errDisputeRejected{http.StatusNotFound, "No successful payment with processor transaction " + n.TransactionID, "TRANSACTION_NOT_FOUND"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Currency != transaction.Currency {
+		return nil, &errDisputeRejected{http.StatusUnprocessableEntity,
+			fmt.Sprintf("Dispute currency %s does not match transaction currency %s", n.Currency, transaction.Currency),
+			"CURRENCY_MISMATCH"}
+	}
+	if n.Amount <= 0 || n.Amount > transaction.Amount {
+		return nil, &errDisputeRejected{http.StatusUnprocessableEntity,
+			fmt.Sprintf("Dispute amount must be between 1 and %d", transaction.Amount),
+			"INVALID_AMOUNT"}
+	}
+
+	dispute := &Dispute{
+		TransactionID:      transaction.ID,
+		SubscriptionID:     transaction.SubscriptionID,
+		Processor:          processorName,
+		ProcessorDisputeID: n.DisputeID,
+		ReasonCode:         n.ReasonCode,
+		Reason:             n.Reason,
+		Amount:             n.Amount,
+		Currency:           n.Currency,
+		Status:             DisputeStatusNeedsResponse,
+		EvidenceDueBy:      n.EvidenceDueBy.UTC(),
+	}
+	if err := o.db.CreateDisputeTx(ctx, tx, dispute); err != nil {
+		return nil, err
+	}
+	if err := o.events.EmitDispute(ctx, tx, dispute); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Dispute %s opened against transaction %s for %d %s (%s %s)",
+		dispute.ID, transaction.ID, dispute.Amount, dispute.Currency, dispute.ReasonCode, dispute.Reason)
+	return dispute, nil
+}
+
+// submitDisputeEvidence contests a dispute (POST /disputes/{id}/evidence).
+// The body is the evidence itself.
+func (o *PaymentOrchestrator) submitDisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var evidence processor.DisputeEvidence
+	if err := json.NewDecoder(r.Body).Decode(&evidence); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	evidenceJSON, _ := json.Marshal(evidence)
+	if string(evidenceJSON) == "{}" {
+		respondError(w, http.StatusBadRequest, "At least one evidence field is required", "INVALID_REQUEST")
+		return
+	}
+
+	dispute, ok := o.loadDispute(w, r, id)
+	if !ok {
+		return
+	}
+	if dispute.Status != DisputeStatusNeedsResponse {
+		respondError(w, http.StatusConflict,
+			fmt.Sprintf("Dispute is %s and no longer accepts evidence", dispute.Status), "DISPUTE_NOT_OPEN")
+		return
+	}
+	if time.Now().After(dispute.EvidenceDueBy) {
+		respondError(w, http.StatusConflict, "The evidence deadline has passed", "EVIDENCE_DEADLINE_PASSED")
+		return
+	}
+
+	client, err := o.processors.GetProcessor(dispute.Processor)
+	if err != nil {
+		http.Error(w, "Unknown processor", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := client.SubmitDisputeEvidence(audit.WithTransactionID(ctx, dispute.TransactionID), &processor.DisputeEvidenceRequest{
+		DisputeID: dispute.ProcessorDisputeID,
+		Evidence:  evidence,
+	})
+	if err != nil {
+		log.Printf("Evidence submission for dispute %s failed: %v", dispute.ID, err)
+		respondError(w, http.StatusBadGateway, "Evidence submission failed, please retry", "PROCESSOR_ERROR")
+		return
+	}
+	if !resp.Success {
+		respondError(w, http.StatusConflict, resp.ErrorMessage, resp.ErrorCode)
+		return
+	}
+
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := o.db.TransitionDisputeTx(ctx, tx, dispute, DisputeStatusUnderReview, evidenceJSON); err != nil {
+			return err
+		}
+		return o.events.EmitDispute(ctx, tx, dispute)
+	})
+	if errors.Is(err, ErrInvalidDisputeTransition) {
+		respondError(w, http.StatusConflict, "Dispute changed while evidence was being submitted", "DISPUTE_NOT_OPEN")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record evidence for dispute %s: %v", dispute.ID, err)
+		http.Error(w, "Failed to record evidence", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Evidence submitted for dispute %s", dispute.ID)
+	respondJSON(w, http.StatusOK, dispute)
+}
+
+func (o *PaymentOrchestrator) getDispute(w http.ResponseWriter, r *http.Request) {
+	if dispute, ok := o.loadDispute(w, r, mux.Vars(r)["id"]); ok {
+		respondJSON(w, http.StatusOK, dispute)
+	}
+}
+
+// loadDispute fetches a dispute, responding with an error and returning
+// false if it can't
+func (o *PaymentOrchestrator) loadDispute(w http.ResponseWriter, r *http.Request, id string) (*Dispute, bool) {
+	if _, err := uuid.Parse(id); err != nil {
+		respondError(w, http.StatusNotFound, "Dispute not found", "DISPUTE_NOT_FOUND")
+		return nil, false
+	}
+	dispute, err := o.db.GetDispute(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Dispute not found", "DISPUTE_NOT_FOUND")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load dispute %s: %v", id, err)
+		http.Error(w, "Failed to load dispute", http.StatusInternalServerError)
+		return nil, false
+	}
+	return dispute, true
+}
+
+// listDisputes lists disputes, newest first (?status=&transaction_id=&limit=)
+func (o *PaymentOrchestrator) listDisputes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := DisputeFilter{
+		Status:        query.Get("status"),
+		TransactionID: query.Get("transaction_id"),
+		Limit:         50,
+	}
+
+	if _, known := disputeEvents[filter.Status]; filter.Status != "" && !known {
+		respondError(w, http.StatusBadRequest, "unknown dispute status "+filter.Status, "INVALID_REQUEST")
+		return
+	}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 200 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 200", "INVALID_REQUEST")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	disputes, err := o.db.ListDisputes(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list disputes: %v", err)
+		http.Error(w, "Failed to list disputes", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"disputes": disputes,
+		"count":    len(disputes),
+	})
+}
+
+// syncLostDispute puts the disputed subscription past due. Failures are
+// left for syncLostDisputesLoop to retry.
+func (o *PaymentOrchestrator) syncLostDispute(ctx context.Context, dispute *Dispute) {
+	if dispute.SubscriptionID == "" || dispute.SubscriptionSyncedAt != nil {
+		return
+	}
+
+	err := o.subscriptions.MarkPastDue(ctx, dispute.SubscriptionID, "dispute_lost", dispute.ID)
+	if errors.Is(err, ErrSubscriptionNotUpdatable) {
+		log.Printf("Subscription %s not put past due for lost dispute %s: %v", dispute.SubscriptionID, dispute.ID, err)
+	} else if err != nil {
+		log.Printf("Failed to put subscription %s past due for lost dispute %s: %v", dispute.SubscriptionID, dispute.ID, err)
+		return
+	}
+
+	if err := o.db.MarkDisputeSubscriptionSynced(ctx, dispute.ID); err != nil {
+		log.Printf("Failed to record subscription update for dispute %s: %v", dispute.ID, err)
+	}
+}
+
+// syncLostDisputesLoop retries putting subscriptions past due for lost
+// disputes the subscription service couldn't be told about
+func (o *PaymentOrchestrator) syncLostDisputesLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		disputes, err := o.db.ListDisputesAwaitingSubscriptionSync(ctx, 50)
+		if err != nil {
+			log.Printf("Failed to load lost disputes: %v", err)
+		}
+		for _, dispute := range disputes {
+			o.syncLostDispute(ctx, dispute)
+		}
+		cancel()
+	}
+}
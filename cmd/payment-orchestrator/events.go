@@ -1,47 +1,56 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/AnuragDani/subscription-platform/internal/events"
+	"github.com/AnuragDani/subscription-platform/internal/money"
 	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
 )
 
-// EventEmitter handles emitting events to WebSocket clients
+// EventEmitter records payment events in the outbox, where the relay picks
+// them up for WebSocket clients and webhooks. Processor health is broadcast
+// straight to the hub since it describes no stored change.
 type EventEmitter struct {
-	hub *ws.Hub
+	hub    *ws.Hub
+	outbox *events.Outbox
 }
 
 // NewEventEmitter creates a new event emitter
 func NewEventEmitter(hub *ws.Hub) *EventEmitter {
-	return &EventEmitter{hub: hub}
+	return &EventEmitter{hub: hub, outbox: events.NewOutbox("payment-orchestrator")}
 }
 
-// EmitChargeInitiated emits a charge initiated event
-func (e *EventEmitter) EmitChargeInitiated(transactionID, subscriptionID string, amount float64, currency string) {
-	if e.hub == nil {
-		return
+// record writes an event as part of ex's transaction
+func (e *EventEmitter) record(ctx context.Context, ex events.Execer, msgType, event string, data interface{}) error {
+	if e == nil {
+		return nil
 	}
+	return e.outbox.Write(ctx, ex, msgType, event, data)
+}
 
-	e.hub.BroadcastEvent(ws.TypeTransaction, ws.EventChargeInitiated, ws.TransactionData{
+// EmitChargeInitiated emits a charge initiated event
+func (e *EventEmitter) EmitChargeInitiated(ctx context.Context, ex events.Execer, transactionID, subscriptionID string, amount money.Money) error {
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventChargeInitiated, ws.TransactionData{
 		TransactionID:  transactionID,
 		SubscriptionID: subscriptionID,
-		Amount:         amount,
-		Currency:       currency,
+		Amount:         amount.Major(),
+		AmountMinor:    amount.Amount,
+		Currency:       amount.Currency,
 		Status:         "initiated",
 	})
 }
 
 // EmitChargeSucceeded emits a charge succeeded event
-func (e *EventEmitter) EmitChargeSucceeded(transactionID, subscriptionID string, amount float64, currency, processor string, duration time.Duration) {
-	if e.hub == nil {
-		return
-	}
-
-	e.hub.BroadcastEvent(ws.TypeTransaction, ws.EventChargeSucceeded, ws.TransactionData{
+func (e *EventEmitter) EmitChargeSucceeded(ctx context.Context, ex events.Execer, transactionID, subscriptionID string, amount money.Money, processor string, duration time.Duration) error {
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventChargeSucceeded, ws.TransactionData{
 		TransactionID:  transactionID,
 		SubscriptionID: subscriptionID,
-		Amount:         amount,
-		Currency:       currency,
+		Amount:         amount.Major(),
+		AmountMinor:    amount.Amount,
+		Currency:       amount.Currency,
 		ProcessorUsed:  processor,
 		Status:         "succeeded",
 		Duration:       duration.String(),
@@ -49,16 +58,13 @@ func (e *EventEmitter) EmitChargeSucceeded(transactionID, subscriptionID string,
 }
 
 // EmitChargeFailed emits a charge failed event
-func (e *EventEmitter) EmitChargeFailed(transactionID, subscriptionID string, amount float64, currency, processor, errorCode, errorMessage string) {
-	if e.hub == nil {
-		return
-	}
-
-	e.hub.BroadcastEvent(ws.TypeTransaction, ws.EventChargeFailed, ws.TransactionData{
+func (e *EventEmitter) EmitChargeFailed(ctx context.Context, ex events.Execer, transactionID, subscriptionID string, amount money.Money, processor, errorCode, errorMessage string) error {
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventChargeFailed, ws.TransactionData{
 		TransactionID:  transactionID,
 		SubscriptionID: subscriptionID,
-		Amount:         amount,
-		Currency:       currency,
+		Amount:         amount.Major(),
+		AmountMinor:    amount.Amount,
+		Currency:       amount.Currency,
 		ProcessorUsed:  processor,
 		Status:         "failed",
 		ErrorCode:      errorCode,
@@ -66,16 +72,26 @@ func (e *EventEmitter) EmitChargeFailed(transactionID, subscriptionID string, am
 	})
 }
 
-// EmitFailoverTriggered emits a failover event
-func (e *EventEmitter) EmitFailoverTriggered(transactionID string, amount float64, currency, fromProcessor, toProcessor string) {
-	if e.hub == nil {
-		return
-	}
+// EmitChargeRequiresAction emits an event for a charge waiting on a 3-D Secure challenge
+func (e *EventEmitter) EmitChargeRequiresAction(ctx context.Context, ex events.Execer, transactionID, subscriptionID string, amount money.Money, processor string) error {
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventChargeRequiresAction, ws.TransactionData{
+		TransactionID:  transactionID,
+		SubscriptionID: subscriptionID,
+		Amount:         amount.Major(),
+		AmountMinor:    amount.Amount,
+		Currency:       amount.Currency,
+		ProcessorUsed:  processor,
+		Status:         "requires_action",
+	})
+}
 
-	e.hub.BroadcastEvent(ws.TypeTransaction, ws.EventFailoverTriggered, ws.TransactionData{
+// EmitFailoverTriggered emits a failover event
+func (e *EventEmitter) EmitFailoverTriggered(ctx context.Context, ex events.Execer, transactionID string, amount money.Money, fromProcessor, toProcessor string) error {
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventFailoverTriggered, ws.TransactionData{
 		TransactionID:     transactionID,
-		Amount:            amount,
-		Currency:          currency,
+		Amount:            amount.Major(),
+		AmountMinor:       amount.Amount,
+		Currency:          amount.Currency,
 		ProcessorUsed:     toProcessor,
 		PreviousProcessor: fromProcessor,
 		Status:            "failover",
@@ -83,57 +99,85 @@ func (e *EventEmitter) EmitFailoverTriggered(transactionID string, amount float6
 }
 
 // EmitRefundProcessed emits a refund processed event
-func (e *EventEmitter) EmitRefundProcessed(transactionID string, amount float64, currency, processor string, success bool) {
-	if e.hub == nil {
-		return
-	}
-
+func (e *EventEmitter) EmitRefundProcessed(ctx context.Context, ex events.Execer, transactionID string, amount money.Money, processor string, success bool) error {
 	status := "refunded"
 	if !success {
 		status = "refund_failed"
 	}
 
-	e.hub.BroadcastEvent(ws.TypeTransaction, ws.EventRefundProcessed, ws.TransactionData{
+	return e.record(ctx, ex, ws.TypeTransaction, ws.EventRefundProcessed, ws.TransactionData{
 		TransactionID: transactionID,
-		Amount:        amount,
-		Currency:      currency,
+		Amount:        amount.Major(),
+		AmountMinor:   amount.Amount,
+		Currency:      amount.Currency,
 		ProcessorUsed: processor,
 		Status:        status,
 	})
 }
 
-// EmitProcessorHealth emits a processor health event
-func (e *EventEmitter) EmitProcessorHealth(processor string, healthy bool, successRate float64) {
+// disputeEvents maps dispute statuses to the event recorded on entering them
+var disputeEvents = map[string]string{
+	DisputeStatusNeedsResponse: ws.EventDisputeOpened,
+	DisputeStatusUnderReview:   ws.EventDisputeUnderReview,
+	DisputeStatusWon:           ws.EventDisputeWon,
+	DisputeStatusLost:          ws.EventDisputeLost,
+}
+
+// EmitDispute emits the event for a dispute's current status
+func (e *EventEmitter) EmitDispute(ctx context.Context, ex events.Execer, d *Dispute) error {
+	amount := money.Money{Amount: d.Amount, Currency: d.Currency}
+	return e.record(ctx, ex, ws.TypeTransaction, disputeEvents[d.Status], ws.DisputeData{
+		DisputeID:          d.ID,
+		TransactionID:      d.TransactionID,
+		SubscriptionID:     d.SubscriptionID,
+		Processor:          d.Processor,
+		ProcessorDisputeID: d.ProcessorDisputeID,
+		ReasonCode:         d.ReasonCode,
+		Reason:             d.Reason,
+		Amount:             amount.Major(),
+		AmountMinor:        amount.Amount,
+		Currency:           amount.Currency,
+		Status:             d.Status,
+		EvidenceDueBy:      d.EvidenceDueBy.UTC().Format(time.RFC3339),
+	})
+}
+
+// EmitPaymentMethodToken emits the event for a change the card network made
+// to a payment method's network token
+func (e *EventEmitter) EmitPaymentMethodToken(ctx context.Context, ex events.Execer, event string, pm *PaymentMethod) error {
+	return e.record(ctx, ex, ws.TypePaymentMethod, event, events.PaymentMethodEventData{
+		PaymentMethodID: pm.ID,
+		UserID:          pm.UserID,
+		LastFour:        pm.LastFour,
+		ExpMonth:        pm.ExpMonth,
+		ExpYear:         pm.ExpYear,
+		Reason:          pm.TokenStatusReason,
+	})
+}
+
+// EmitProcessorHealth emits a processor health event for a circuit breaker state
+func (e *EventEmitter) EmitProcessorHealth(processor string, state BreakerState, successRate float64, avgLatencyMs int, reason string) {
 	if e.hub == nil {
 		return
 	}
 
 	event := ws.EventProcessorHealthy
 	status := "healthy"
-	if !healthy {
+	switch state {
+	case BreakerOpen:
 		event = ws.EventProcessorUnhealthy
 		status = "unhealthy"
+	case BreakerHalfOpen:
+		event = ws.EventProcessorProbing
+		status = "degraded"
 	}
 
 	e.hub.BroadcastEvent(ws.TypeHealth, event, ws.HealthData{
-		Processor:   processor,
-		Status:      status,
-		SuccessRate: successRate,
+		Processor:    processor,
+		Status:       status,
+		SuccessRate:  successRate,
+		Latency:      fmt.Sprintf("%dms", avgLatencyMs),
+		CircuitState: string(state),
+		Reason:       reason,
 	})
 }
-
-// EmitSubscriptionEvent emits a subscription event (for cross-service events)
-func (e *EventEmitter) EmitSubscriptionEvent(event string, data ws.SubscriptionData) {
-	if e.hub == nil {
-		return
-	}
-	e.hub.BroadcastEvent(ws.TypeSubscription, event, data)
-}
-
-// EmitSchedulerEvent emits a scheduler event (for cross-service events)
-func (e *EventEmitter) EmitSchedulerEvent(event string, data ws.SchedulerData) {
-	if e.hub == nil {
-		return
-	}
-	e.hub.BroadcastEvent(ws.TypeScheduler, event, data)
-}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// OutcomeClass classifies the result of one charge attempt
+type OutcomeClass string
+
+const (
+	OutcomeApproved       OutcomeClass = "approved"
+	OutcomeIssuerDecline  OutcomeClass = "issuer_decline"
+	OutcomeProcessorError OutcomeClass = "processor_error"
+	OutcomeAmbiguous      OutcomeClass = "ambiguous_timeout"
+	OutcomeRequiresAction OutcomeClass = "requires_action" // Waiting on a 3-D Secure challenge
+)
+
+// FailoverAction is what to do after an attempt that wasn't approved
+type FailoverAction string
+
+const (
+	FailoverCascade FailoverAction = "cascade"
+	FailoverStop    FailoverAction = "stop"
+	FailoverVerify  FailoverAction = "verify"
+)
+
+// FailoverPolicy decides whether a charge moves down the fallback chain.
+// It is loaded from configs/failover-policy.yaml.
+type FailoverPolicy struct {
+	Version     string                    `yaml:"version"`
+	MaxAttempts int                       `yaml:"max_attempts"`
+	Defaults    FailoverDefaults          `yaml:"defaults"`
+	ErrorCodes  map[string]FailoverAction `yaml:"error_codes"`
+}
+
+// FailoverDefaults holds the action for each outcome class
+type FailoverDefaults struct {
+	IssuerDecline    FailoverAction `yaml:"issuer_decline"`
+	ProcessorError   FailoverAction `yaml:"processor_error"`
+	AmbiguousTimeout FailoverAction `yaml:"ambiguous_timeout"`
+}
+
+// DefaultFailoverPolicy stops on declines, cascades on processor errors and
+// verifies timeouts before moving on
+func DefaultFailoverPolicy() *FailoverPolicy {
+	return &FailoverPolicy{
+		Version:     "1.0",
+		MaxAttempts: 3,
+		Defaults: FailoverDefaults{
+			IssuerDecline:    FailoverStop,
+			ProcessorError:   FailoverCascade,
+			AmbiguousTimeout: FailoverVerify,
+		},
+		ErrorCodes: map[string]FailoverAction{},
+	}
+}
+
+// LoadFailoverPolicy reads a failover policy from a YAML file
+func LoadFailoverPolicy(path string) (*FailoverPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read failover policy: %w", err)
+	}
+
+	policy := DefaultFailoverPolicy()
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse failover policy: %w", err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks every action is known and verify is only used for timeouts
+func (p *FailoverPolicy) Validate() error {
+	if p.MaxAttempts <= 0 {
+		return fmt.Errorf("failover policy: max_attempts must be positive")
+	}
+
+	check := func(name string, action FailoverAction, allowVerify bool) error {
+		switch action {
+		case FailoverCascade, FailoverStop:
+			return nil
+		case FailoverVerify:
+			if allowVerify {
+				return nil
+			}
+		}
+		return fmt.Errorf("failover policy: invalid action %q for %s", action, name)
+	}
+
+	if err := check("issuer_decline", p.Defaults.IssuerDecline, false); err != nil {
+		return err
+	}
+	if err := check("processor_error", p.Defaults.ProcessorError, false); err != nil {
+		return err
+	}
+	if err := check("ambiguous_timeout", p.Defaults.AmbiguousTimeout, true); err != nil {
+		return err
+	}
+	for code, action := range p.ErrorCodes {
+		if err := check(code, action, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Action returns what to do after an attempt of the given class
+func (p *FailoverPolicy) Action(class OutcomeClass, errorCode string) FailoverAction {
+	switch class {
+	case OutcomeIssuerDecline:
+		if action, ok := p.ErrorCodes[errorCode]; ok {
+			return action
+		}
+		return p.Defaults.IssuerDecline
+	case OutcomeProcessorError:
+		return p.Defaults.ProcessorError
+	case OutcomeAmbiguous:
+		return p.Defaults.AmbiguousTimeout
+	}
+	return FailoverStop
+}
+
+// classifyOutcome sorts a charge attempt into an outcome class
+func classifyOutcome(result *ChargeResponse, err error) OutcomeClass {
+	switch {
+	case err == nil && result.Status == TransactionStatusRequiresAction:
+		return OutcomeRequiresAction
+	case err == nil && result.Success:
+		return OutcomeApproved
+	case err == nil:
+		return OutcomeIssuerDecline
+	case isAmbiguousFailure(err):
+		return OutcomeAmbiguous
+	}
+	return OutcomeProcessorError
+}
+
+// chainWalk is the result of sending a payment down the fallback chain
+type chainWalk struct {
+	Decided       string // Processor whose answer stands, empty if none gave one
+	LastProcessor string // Last processor the payment was sent to
+	Ambiguous     bool   // A processor may have taken the payment without us knowing
+	FailedOver    bool
+}
+
+// walkChain sends a payment down the fallback chain, letting the failover
+// policy decide after each attempt whether to move on. send makes the
+// attempt with a processor, verify asks it whether an attempt that timed out
+// went through, and hop records the move to the next processor. No new
+// processor is tried once ctx is done.
+func (o *PaymentOrchestrator) walkChain(ctx context.Context, id string, chain []string,
+	send func(processorName string) (OutcomeClass, string, error),
+	verify func(processorName string) (OutcomeClass, string),
+	hop func(from, to string)) chainWalk {
+	var walk chainWalk
+	var declinedBy string
+
+	for i, processorName := range chain {
+		if i >= o.failover.MaxAttempts {
+			break
+		}
+		if i > 0 {
+			hop(chain[i-1], processorName)
+		}
+		walk.LastProcessor = processorName
+
+		class, errorCode, err := send(processorName)
+		action := o.failover.Action(class, errorCode)
+
+		if class == OutcomeAmbiguous && action == FailoverVerify {
+			class, errorCode = verify(processorName)
+			action = o.failover.Action(class, errorCode)
+			if class == OutcomeAmbiguous {
+				// Still can't tell; moving on could take the payment twice
+				action = FailoverStop
+			}
+		}
+
+		if err != nil && class != OutcomeApproved {
+			log.Printf("Processor %s failed (%s): %v", processorName, class, err)
+		}
+
+		switch class {
+		case OutcomeApproved, OutcomeRequiresAction:
+			walk.Decided = processorName
+			walk.Ambiguous = false
+			return walk
+		case OutcomeIssuerDecline:
+			declinedBy = processorName
+		case OutcomeAmbiguous:
+			walk.Ambiguous = true
+		}
+
+		if action == FailoverStop || i+1 >= len(chain) || i+1 >= o.failover.MaxAttempts {
+			break
+		}
+		if ctx.Err() != nil {
+			log.Printf("Not failing over %s to %s: chain time is up", id, chain[i+1])
+			break
+		}
+
+		log.Printf("Failing over %s from %s to %s after %s %s",
+			id, processorName, chain[i+1], class, errorCode)
+		walk.FailedOver = true
+	}
+
+	// An unresolved attempt wins over a decline: the payment may have gone through
+	if !walk.Ambiguous {
+		walk.Decided = declinedBy
+	}
+	return walk
+}
+
+// chainOutcome is the result of walking the fallback chain for a charge
+type chainOutcome struct {
+	Result        *ChargeResponse // Definitive answer, nil if no processor gave one
+	LastProcessor string          // Last processor the charge was sent to
+	Ambiguous     bool            // A processor may have charged the card without us knowing
+	FailedOver    bool
+}
+
+// chargeThroughChain sends a charge down the fallback chain, letting the
+// failover policy decide after each attempt whether to move on. Processor
+// calls share the chain timeout so the walk ends before the response is due.
+func (o *PaymentOrchestrator) chargeThroughChain(ctx context.Context, transactionID string, chain []string, req ChargeRequest, pm *PaymentMethod) chainOutcome {
+	results := make(map[string]*ChargeResponse)
+	chainCtx, cancel := context.WithTimeout(ctx, o.chainTimeout)
+	defer cancel()
+
+	send := func(processorName string) (OutcomeClass, string, error) {
+		result, err := o.chargeWithProcessor(chainCtx, processorName, req, pm)
+		results[processorName] = result
+		if result != nil {
+			return classifyOutcome(result, err), result.ErrorCode, err
+		}
+		return classifyOutcome(result, err), "", err
+	}
+	verify := func(processorName string) (OutcomeClass, string) {
+		result, class := o.verifyCharge(chainCtx, processorName, req)
+		results[processorName] = result
+		if result != nil {
+			return class, result.ErrorCode
+		}
+		return class, ""
+	}
+	hop := func(from, to string) {
+		err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+			if err := o.db.SetPendingProcessorTx(ctx, tx, transactionID, to,
+				o.expectedFee(to, req.Money(), pm)); err != nil {
+				return err
+			}
+			return o.events.EmitFailoverTriggered(ctx, tx, transactionID, req.Money(), from, to)
+		})
+		if err != nil {
+			log.Printf("Failed to record failover of %s to %s: %v", transactionID, to, err)
+		}
+	}
+
+	walk := o.walkChain(chainCtx, "charge "+transactionID, chain, send, verify, hop)
+	return chainOutcome{
+		Result:        results[walk.Decided],
+		LastProcessor: walk.LastProcessor,
+		Ambiguous:     walk.Ambiguous,
+		FailedOver:    walk.FailedOver,
+	}
+}
+
+// verifyCharge asks a processor whether a charge that timed out went through
+func (o *PaymentOrchestrator) verifyCharge(ctx context.Context, processorName string, req ChargeRequest) (*ChargeResponse, OutcomeClass) {
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		return nil, OutcomeAmbiguous
+	}
+
+	resp, err := client.LookupCharge(ctx, req.IdempotencyKey)
+	switch {
+	case errors.Is(err, processor.ErrChargeNotFound):
+		// Never processed, so it is safe to move on
+		return nil, OutcomeProcessorError
+	case err != nil:
+		log.Printf("Could not verify charge with %s: %v", processorName, err)
+		return nil, OutcomeAmbiguous
+	}
+
+	result := chargeResponseFromProcessor(processorName, req, resp)
+	switch {
+	case resp.RequiresAction():
+		return result, OutcomeRequiresAction
+	case resp.Success:
+		return result, OutcomeApproved
+	}
+	return result, OutcomeIssuerDecline
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// scriptedAttempt is how a processor answers a charge and a later lookup
+type scriptedAttempt struct {
+	class      OutcomeClass
+	code       string
+	verify     OutcomeClass // What a lookup reports after an ambiguous attempt
+	verifyCode string
+}
+
+// chainRun records what walkChain asked of each processor
+type chainRun struct {
+	sent     []string
+	verified []string
+	hops     []string
+}
+
+func runChain(ctx context.Context, policy *FailoverPolicy, chain []string, script map[string]scriptedAttempt) (chainWalk, chainRun) {
+	o := &PaymentOrchestrator{failover: policy}
+	var run chainRun
+
+	send := func(processorName string) (OutcomeClass, string, error) {
+		run.sent = append(run.sent, processorName)
+		attempt := script[processorName]
+		var err error
+		if attempt.class == OutcomeProcessorError || attempt.class == OutcomeAmbiguous {
+			err = errors.New(string(attempt.class))
+		}
+		return attempt.class, attempt.code, err
+	}
+	verify := func(processorName string) (OutcomeClass, string) {
+		run.verified = append(run.verified, processorName)
+		return script[processorName].verify, script[processorName].verifyCode
+	}
+	hop := func(from, to string) {
+		run.hops = append(run.hops, from+">"+to)
+	}
+
+	return o.walkChain(ctx, "charge test", chain, send, verify, hop), run
+}
+
+func TestWalkChain(t *testing.T) {
+	chain := []string{"processor_a", "processor_b", "processor_c"}
+
+	withCodes := DefaultFailoverPolicy()
+	withCodes.ErrorCodes = map[string]FailoverAction{
+		"CURRENCY_NOT_SUPPORTED": FailoverCascade,
+		"INSUFFICIENT_FUNDS":     FailoverStop,
+	}
+	twoAttempts := DefaultFailoverPolicy()
+	twoAttempts.MaxAttempts = 2
+	cascadeTimeouts := DefaultFailoverPolicy()
+	cascadeTimeouts.Defaults.AmbiguousTimeout = FailoverCascade
+
+	tests := []struct {
+		name     string
+		policy   *FailoverPolicy
+		script   map[string]scriptedAttempt
+		want     chainWalk
+		sent     []string
+		verified []string
+	}{
+		{
+			name:   "approved by the first processor",
+			script: map[string]scriptedAttempt{"processor_a": {class: OutcomeApproved}},
+			want:   chainWalk{Decided: "processor_a", LastProcessor: "processor_a"},
+			sent:   []string{"processor_a"},
+		},
+		{
+			name:   "decline stops",
+			script: map[string]scriptedAttempt{"processor_a": {class: OutcomeIssuerDecline, code: "DO_NOT_HONOR"}},
+			want:   chainWalk{Decided: "processor_a", LastProcessor: "processor_a"},
+			sent:   []string{"processor_a"},
+		},
+		{
+			name: "processor error cascades",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeProcessorError},
+				"processor_b": {class: OutcomeApproved},
+			},
+			want: chainWalk{Decided: "processor_b", LastProcessor: "processor_b", FailedOver: true},
+			sent: []string{"processor_a", "processor_b"},
+		},
+		{
+			name: "every processor errors",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeProcessorError},
+				"processor_b": {class: OutcomeProcessorError},
+				"processor_c": {class: OutcomeProcessorError},
+			},
+			want: chainWalk{LastProcessor: "processor_c", FailedOver: true},
+			sent: []string{"processor_a", "processor_b", "processor_c"},
+		},
+		{
+			name:   "max attempts ends the walk",
+			policy: twoAttempts,
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeProcessorError},
+				"processor_b": {class: OutcomeProcessorError},
+				"processor_c": {class: OutcomeApproved},
+			},
+			want: chainWalk{LastProcessor: "processor_b", FailedOver: true},
+			sent: []string{"processor_a", "processor_b"},
+		},
+		{
+			name: "ambiguous attempt verified as charged does not cascade",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeAmbiguous, verify: OutcomeApproved},
+				"processor_b": {class: OutcomeApproved},
+			},
+			want:     chainWalk{Decided: "processor_a", LastProcessor: "processor_a"},
+			sent:     []string{"processor_a"},
+			verified: []string{"processor_a"},
+		},
+		{
+			name: "ambiguous attempt verified as declined stops",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeAmbiguous, verify: OutcomeIssuerDecline, verifyCode: "DO_NOT_HONOR"},
+			},
+			want:     chainWalk{Decided: "processor_a", LastProcessor: "processor_a"},
+			sent:     []string{"processor_a"},
+			verified: []string{"processor_a"},
+		},
+		{
+			name: "ambiguous attempt never received cascades",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeAmbiguous, verify: OutcomeProcessorError},
+				"processor_b": {class: OutcomeApproved},
+			},
+			want:     chainWalk{Decided: "processor_b", LastProcessor: "processor_b", FailedOver: true},
+			sent:     []string{"processor_a", "processor_b"},
+			verified: []string{"processor_a"},
+		},
+		{
+			name: "verify still ambiguous stops",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeAmbiguous, verify: OutcomeAmbiguous},
+				"processor_b": {class: OutcomeApproved},
+			},
+			want:     chainWalk{LastProcessor: "processor_a", Ambiguous: true},
+			sent:     []string{"processor_a"},
+			verified: []string{"processor_a"},
+		},
+		{
+			name:   "ambiguous cascade without verify stays ambiguous",
+			policy: cascadeTimeouts,
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeAmbiguous},
+				"processor_b": {class: OutcomeIssuerDecline, code: "DO_NOT_HONOR"},
+			},
+			want: chainWalk{LastProcessor: "processor_b", Ambiguous: true, FailedOver: true},
+			sent: []string{"processor_a", "processor_b"},
+		},
+		{
+			name:   "error code override cascades a decline",
+			policy: withCodes,
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeIssuerDecline, code: "CURRENCY_NOT_SUPPORTED"},
+				"processor_b": {class: OutcomeApproved},
+			},
+			want: chainWalk{Decided: "processor_b", LastProcessor: "processor_b", FailedOver: true},
+			sent: []string{"processor_a", "processor_b"},
+		},
+		{
+			name:   "error code override keeps the last decline",
+			policy: withCodes,
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeIssuerDecline, code: "CURRENCY_NOT_SUPPORTED"},
+				"processor_b": {class: OutcomeIssuerDecline, code: "INSUFFICIENT_FUNDS"},
+				"processor_c": {class: OutcomeApproved},
+			},
+			want: chainWalk{Decided: "processor_b", LastProcessor: "processor_b", FailedOver: true},
+			sent: []string{"processor_a", "processor_b"},
+		},
+		{
+			name: "requires action stops on that processor",
+			script: map[string]scriptedAttempt{
+				"processor_a": {class: OutcomeRequiresAction},
+			},
+			want: chainWalk{Decided: "processor_a", LastProcessor: "processor_a"},
+			sent: []string{"processor_a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := tt.policy
+			if policy == nil {
+				policy = DefaultFailoverPolicy()
+			}
+			walk, run := runChain(context.Background(), policy, chain, tt.script)
+
+			if walk != tt.want {
+				t.Errorf("walk = %+v, want %+v", walk, tt.want)
+			}
+			if !reflect.DeepEqual(run.sent, tt.sent) {
+				t.Errorf("sent to %v, want %v", run.sent, tt.sent)
+			}
+			if !reflect.DeepEqual(run.verified, tt.verified) {
+				t.Errorf("verified with %v, want %v", run.verified, tt.verified)
+			}
+			if len(run.hops) != len(run.sent)-1 {
+				t.Errorf("hops = %v for %d attempts", run.hops, len(run.sent))
+			}
+		})
+	}
+}
+
+func TestWalkChainStopsWhenTimeIsUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	walk, run := runChain(ctx, DefaultFailoverPolicy(), []string{"processor_a", "processor_b"}, map[string]scriptedAttempt{
+		"processor_a": {class: OutcomeProcessorError},
+		"processor_b": {class: OutcomeApproved},
+	})
+
+	want := chainWalk{LastProcessor: "processor_a"}
+	if walk != want {
+		t.Errorf("walk = %+v, want %+v", walk, want)
+	}
+	if len(run.hops) != 0 {
+		t.Errorf("failed over %v after the chain timed out", run.hops)
+	}
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *ChargeResponse
+		err    error
+		want   OutcomeClass
+	}{
+		{"approved", &ChargeResponse{Success: true, Status: TransactionStatusSuccess}, nil, OutcomeApproved},
+		{"declined", &ChargeResponse{ErrorCode: "DO_NOT_HONOR", Status: TransactionStatusFailed}, nil, OutcomeIssuerDecline},
+		{"3-D Secure challenge", &ChargeResponse{Status: TransactionStatusRequiresAction}, nil, OutcomeRequiresAction},
+		{"network error", nil, &processor.ProcessorError{Code: "NETWORK_ERROR"}, OutcomeAmbiguous},
+		{"gateway timeout", nil, &processor.ProcessorError{Code: "TIMEOUT", StatusCode: 504}, OutcomeAmbiguous},
+		{"internal server error", nil, &processor.ProcessorError{Code: "PROCESSOR_ERROR", StatusCode: 500}, OutcomeAmbiguous},
+		{"service unavailable", nil, &processor.ProcessorError{Code: "SERVICE_UNAVAILABLE", StatusCode: 503}, OutcomeProcessorError},
+		{"rate limited", nil, &processor.ProcessorError{Code: "RATE_LIMITED", StatusCode: 429}, OutcomeProcessorError},
+		{"circuit open", nil, ErrCircuitOpen, OutcomeProcessorError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyOutcome(tt.result, tt.err); got != tt.want {
+				t.Errorf("classifyOutcome = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailoverPolicyAction(t *testing.T) {
+	policy := DefaultFailoverPolicy()
+	policy.ErrorCodes = map[string]FailoverAction{"FOREIGN_CARD_DECLINED": FailoverCascade}
+
+	tests := []struct {
+		class OutcomeClass
+		code  string
+		want  FailoverAction
+	}{
+		{OutcomeIssuerDecline, "DO_NOT_HONOR", FailoverStop},
+		{OutcomeIssuerDecline, "FOREIGN_CARD_DECLINED", FailoverCascade},
+		{OutcomeProcessorError, "", FailoverCascade},
+		// Overrides only apply to declines
+		{OutcomeProcessorError, "FOREIGN_CARD_DECLINED", FailoverCascade},
+		{OutcomeAmbiguous, "", FailoverVerify},
+		{OutcomeApproved, "", FailoverStop},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.class)+"/"+tt.code, func(t *testing.T) {
+			if got := policy.Action(tt.class, tt.code); got != tt.want {
+				t.Errorf("Action(%s, %q) = %s, want %s", tt.class, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailoverPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(p *FailoverPolicy)
+		wantErr bool
+	}{
+		{"defaults", func(p *FailoverPolicy) {}, false},
+		{"no attempts", func(p *FailoverPolicy) { p.MaxAttempts = 0 }, true},
+		{"verify a decline", func(p *FailoverPolicy) { p.Defaults.IssuerDecline = FailoverVerify }, true},
+		{"verify a processor error", func(p *FailoverPolicy) { p.Defaults.ProcessorError = FailoverVerify }, true},
+		{"verify an error code", func(p *FailoverPolicy) { p.ErrorCodes["DO_NOT_HONOR"] = FailoverVerify }, true},
+		{"unknown action", func(p *FailoverPolicy) { p.ErrorCodes["DO_NOT_HONOR"] = "retry" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultFailoverPolicy()
+			tt.modify(policy)
+			if err := policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadFailoverPolicyConfig(t *testing.T) {
+	policy, err := LoadFailoverPolicy(filepath.Join("..", "..", "configs", "failover-policy.yaml"))
+	if err != nil {
+		t.Fatalf("LoadFailoverPolicy: %v", err)
+	}
+	if got := policy.Action(OutcomeAmbiguous, ""); got != FailoverVerify {
+		t.Errorf("shipped policy handles timeouts with %s, want verify", got)
+	}
+	if got := policy.Action(OutcomeIssuerDecline, "CURRENCY_NOT_SUPPORTED"); got != FailoverCascade {
+		t.Errorf("shipped policy handles CURRENCY_NOT_SUPPORTED with %s, want cascade", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/fees"
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+// loadFeeSchedules reads processor pricing from the config directory.
+// Without it every transaction records an expected fee of zero.
+func loadFeeSchedules(cfg *Config, rates *fx.Service) *fees.Table {
+	table, err := fees.LoadFile(filepath.Join(cfg.ConfigPath, "fee-schedules.yaml"), rates.ConvertMid)
+	if err != nil {
+		log.Printf("Warning: %v, expected fees will not be recorded", err)
+		return nil
+	}
+	log.Printf("Loaded fee schedules for %d processors", len(table.Schedules()))
+	return table
+}
+
+// expectedFee estimates what a processor will charge for a payment, in
+// minor units of the payment currency. It is zero when the processor has
+// no schedule or the fee can't be estimated.
+func (o *PaymentOrchestrator) expectedFee(processorName string, amount money.Money, pm *PaymentMethod) int64 {
+	if o.fees == nil || processorName == "" || processorName == "none" {
+		return 0
+	}
+
+	payment := fees.Payment{Amount: amount}
+	if pm != nil {
+		payment.CardBrand = pm.CardBrand
+		payment.CardCountry = pm.CardCountry
+	}
+	estimate, err := o.fees.Estimate(processorName, payment)
+	if err != nil {
+		log.Printf("Cannot estimate %s fee for %s: %v", processorName, amount, err)
+		return 0
+	}
+	return estimate.Fee.Amount
+}
+
+// feePaymentMethod loads the payment method whose card details price a
+// payment. On failure the fee is estimated at the base rate.
+func (o *PaymentOrchestrator) feePaymentMethod(ctx context.Context, id string) *PaymentMethod {
+	pm, err := o.db.GetPaymentMethod(ctx, id)
+	if err != nil {
+		log.Printf("Failed to load payment method %s for fee estimate: %v", id, err)
+		return nil
+	}
+	return pm
+}
+
+// ApprovalRates holds each processor's recent approval rate in percent,
+// sent to BPAS for cost-optimized routing
+type ApprovalRates struct {
+	mu    sync.RWMutex
+	rates map[string]float64
+}
+
+// Get returns a copy of the latest rates
+func (a *ApprovalRates) Get() map[string]float64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	rates := make(map[string]float64, len(a.rates))
+	for name, rate := range a.rates {
+		rates[name] = rate
+	}
+	return rates
+}
+
+func (a *ApprovalRates) set(rates map[string]float64) {
+	a.mu.Lock()
+	a.rates = rates
+	a.mu.Unlock()
+}
+
+// refreshApprovalRatesLoop recomputes approval rates over the trailing
+// window. Processors with too few attempts in the window have no rate.
+func (o *PaymentOrchestrator) refreshApprovalRatesLoop(interval, window time.Duration, minAttempts int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		rates, err := o.db.GetProcessorApprovalRates(ctx, time.Now().Add(-window), minAttempts)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to refresh processor approval rates: %v", err)
+		} else {
+			o.approvalRates.set(rates)
+		}
+		<-ticker.C
+	}
+}
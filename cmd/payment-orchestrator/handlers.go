@@ -2,31 +2,83 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
 )
 
 type ChargeRequest struct {
 	SubscriptionID  string  `json:"subscription_id"`
 	PaymentMethodID string  `json:"payment_method_id"`
-	Amount          float64 `json:"amount"`
+	AmountMinor     int64   `json:"amount_minor,omitempty"`
+	Amount          float64 `json:"amount,omitempty"` // Deprecated: use amount_minor
 	Currency        string  `json:"currency"`
 	IdempotencyKey  string  `json:"idempotency_key,omitempty"`
+
+	// Currency the merchant is paid in; defaults to SETTLEMENT_CURRENCY, then to Currency
+	SettlementCurrency string `json:"settlement_currency,omitempty"`
+
+	// Set when the card is stored or charged on file. MITs without a network
+	// transaction ID use the one stored on the payment method.
+	StoredCredential *processor.StoredCredential `json:"stored_credential,omitempty"`
+
+	// Asks for 3-D Secure or an exemption from it. BPAS rules can also require it.
+	ThreeDS *processor.ThreeDSRequest `json:"three_ds,omitempty"`
+}
+
+// Money returns the charge amount once the request has been normalized
+func (r ChargeRequest) Money() money.Money {
+	return money.Money{Amount: r.AmountMinor, Currency: r.Currency}
 }
 
 type ChargeResponse struct {
 	Success       bool    `json:"success"`
 	TransactionID string  `json:"transaction_id"`
 	ProcessorUsed string  `json:"processor_used"`
-	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
+	Amount        float64 `json:"amount"` // Deprecated: use amount_minor
 	Currency      string  `json:"currency"`
 	UserMessage   string  `json:"user_message,omitempty"`
 	ErrorCode     string  `json:"error_code,omitempty"`
+	Status        string  `json:"status,omitempty"`
+
+	NetworkTransactionID string             `json:"network_transaction_id,omitempty"`
+	Settlement           *SettlementDetails `json:"settlement,omitempty"`
+
+	// Set while the status is requires_action
+	NextAction *NextAction `json:"next_action,omitempty"`
+}
+
+// SettlementDetails is what the merchant receives for a payment
+type SettlementDetails struct {
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	FX          *fx.Quote `json:"fx,omitempty"` // Absent when no conversion was needed
+}
+
+func settlementDetails(t *Transaction) *SettlementDetails {
+	details := &SettlementDetails{
+		AmountMinor: t.SettlementAmount,
+		Currency:    t.SettlementCurrency,
+	}
+	if !t.FX.IsIdentity() {
+		quote := t.FX
+		details.FX = &quote
+	}
+	return details
 }
 
 func (o *PaymentOrchestrator) processCharge(w http.ResponseWriter, r *http.Request) {
@@ -38,94 +90,200 @@ func (o *PaymentOrchestrator) processCharge(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Older clients send a decimal amount; normalize so both forms share idempotency fingerprints
+	amount, err := resolveAmount(req.AmountMinor, req.Amount, req.Currency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_AMOUNT")
+		return
+	}
+	req.AmountMinor, req.Amount, req.Currency = amount.Amount, 0, amount.Currency
+
+	if req.StoredCredential != nil {
+		if err := req.StoredCredential.Validate(); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error(), "INVALID_STORED_CREDENTIAL")
+			return
+		}
+	}
+	if err := validateThreeDS(req.ThreeDS, req.StoredCredential); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_THREE_DS")
+		return
+	}
+
+	// Quote the settlement rate up front so a missing rate fails before any processor call
+	quote, err := o.settlementQuote(amount.Currency, strings.ToUpper(req.SettlementCurrency))
+	if err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "FX_RATE_UNAVAILABLE")
+		return
+	}
+	req.SettlementCurrency = quote.To
+
 	// Generate idempotency key if not provided
 	if req.IdempotencyKey == "" {
 		req.IdempotencyKey = uuid.New().String()
 	}
 
-	// Generate transaction ID early for event tracking
-	transactionID := uuid.New().String()
-
-	// Emit charge initiated event
-	if o.events != nil {
-		o.events.EmitChargeInitiated(transactionID, req.SubscriptionID, req.Amount, req.Currency)
+	// Hold the idempotency key until the charge completes
+	lock := o.beginIdempotent(w, r, "charge", req.IdempotencyKey, req)
+	if lock == nil {
+		return
 	}
+	defer lock.Release()
 
-	// Check idempotency
+	// Keys whose stored response has expired are still recorded on the transaction
 	ctx := r.Context()
-	if cached, err := o.checkIdempotency(ctx, req.IdempotencyKey); err == nil && cached != nil {
-		w.Header().Set("Content-Type", "application/json")
+	if existing, err := o.db.GetTransactionByIdempotencyKey(ctx, req.IdempotencyKey); err == nil {
+		if existing.Amount != req.AmountMinor || existing.Currency != req.Currency {
+			respondError(w, http.StatusUnprocessableEntity, ErrIdempotencyMismatch.Error(), "IDEMPOTENCY_KEY_MISMATCH")
+			return
+		}
+		status := http.StatusOK
+		switch existing.Status {
+		case TransactionStatusPending, TransactionStatusUnknown, TransactionStatusRequiresAction:
+			status = http.StatusAccepted
+		}
 		w.Header().Set("X-Idempotent-Replay", "true")
-		json.NewEncoder(w).Encode(cached)
+		respondJSON(w, status, chargeResponseFromTransaction(existing))
 		return
 	}
 
-	// Get routing decision from BPAS
-	routingDecision, err := o.bpasClient.GetRoutingDecision(ctx, req.Amount, req.Currency, "")
-	if err != nil || routingDecision == nil || routingDecision.PrimaryProcessor == "" {
-		log.Printf("BPAS routing failed or returned empty, using defaults: %v", err)
-		routingDecision = &RoutingDecision{
-			PrimaryProcessor:   "processor_a",
-			SecondaryProcessor: "processor_b",
-			Confidence:         0.5,
-		}
-	}
+	// Generate transaction ID early for event tracking, and audit every
+	// outbound call made for the charge against it
+	transactionID := uuid.New().String()
+	ctx = audit.WithTransactionID(ctx, transactionID)
 
-	// Ensure we have valid processor names
-	if routingDecision.PrimaryProcessor == "" {
-		routingDecision.PrimaryProcessor = "processor_a"
+	// Get payment method tokens
+	paymentMethod, err := o.db.GetPaymentMethod(ctx, req.PaymentMethodID)
+	if err != nil {
+		http.Error(w, "Payment method not found", http.StatusNotFound)
+		return
+	}
+	if paymentMethod.DetachedAt != nil {
+		respondError(w, http.StatusConflict, "Payment method has been detached", "PAYMENT_METHOD_DETACHED")
+		return
+	}
+	if code := tokenDeclineCode(paymentMethod); code != "" {
+		respondJSON(w, http.StatusPaymentRequired, &ChargeResponse{
+			Success:     false,
+			AmountMinor: req.AmountMinor,
+			Amount:      req.Money().Major(),
+			Currency:    req.Currency,
+			UserMessage: mapErrorToUserMessage(code),
+			ErrorCode:   code,
+			Status:      TransactionStatusFailed,
+		})
+		return
 	}
-	if routingDecision.SecondaryProcessor == "" {
-		routingDecision.SecondaryProcessor = "processor_b"
+
+	// MITs reference the charge that stored the card; processors refuse them without it
+	if req.StoredCredential.IsMIT() && req.StoredCredential.NetworkTransactionID == "" {
+		credential := *req.StoredCredential
+		credential.NetworkTransactionID = paymentMethod.NetworkTransactionID
+		req.StoredCredential = &credential
 	}
 
-	log.Printf("Using routing: Primary=%s, Secondary=%s",
-		routingDecision.PrimaryProcessor,
-		routingDecision.SecondaryProcessor)
+	// Get routing decision from BPAS, whose rules may require 3-D Secure
+	chain, threeDSRequired := o.routingChain(ctx, amount, paymentMethod)
+	log.Printf("Using routing chain: %v", chain)
+	req.ThreeDS = threeDSRequest(req.ThreeDS, req.StoredCredential, threeDSRequired)
 
-	// Make sure it's not nil or empty
-	if routingDecision == nil || routingDecision.PrimaryProcessor == "" {
-		routingDecision = &RoutingDecision{
-			PrimaryProcessor:   "processor_a",
-			SecondaryProcessor: "processor_b",
+	// Record the charge before any processor sees it, so a crash mid-call
+	// leaves a pending transaction for the recoverer
+	transaction := &Transaction{
+		ID:              transactionID,
+		SubscriptionID:  req.SubscriptionID,
+		PaymentMethodID: req.PaymentMethodID,
+		ProcessorUsed:   "none",
+		Amount:          amount.Amount,
+		Currency:        amount.Currency,
+		Status:          TransactionStatusPending,
+		TransactionType: TransactionTypeCharge,
+		IdempotencyKey:  req.IdempotencyKey,
+
+		StoredCredential: req.StoredCredential,
+	}
+	if req.ThreeDS != nil {
+		transaction.ThreeDSExemption = req.ThreeDS.Exemption
+	}
+	if len(chain) > 0 {
+		transaction.ProcessorUsed = chain[0]
+		transaction.ExpectedFee = o.expectedFee(chain[0], amount, paymentMethod)
+	}
+	if err := transaction.settleAt(quote); err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "FX_CONVERSION_FAILED")
+		return
+	}
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := o.db.CreateTransactionTx(ctx, tx, transaction); err != nil {
+			return err
 		}
+		return o.events.EmitChargeInitiated(ctx, tx, transactionID, req.SubscriptionID, amount)
+	})
+	if err != nil {
+		log.Printf("Failed to record pending charge %s: %v", transactionID, err)
+		respondError(w, http.StatusInternalServerError, "Unable to record charge, no payment was attempted", "TRANSACTION_RECORD_FAILED")
+		return
 	}
 
-	// Get payment method tokens
-	paymentMethod, err := o.db.GetPaymentMethod(ctx, req.PaymentMethodID)
-	if err != nil {
-		http.Error(w, "Payment method not found", http.StatusNotFound)
+	// Walk the fallback chain, letting the failover policy decide each hop
+	outcome := o.chargeThroughChain(ctx, transactionID, chain, req, paymentMethod)
+	result := outcome.Result
+	lastProcessor := transaction.ProcessorUsed
+	if outcome.LastProcessor != "" {
+		lastProcessor = outcome.LastProcessor
+	}
+	failedOver := outcome.FailedOver
+
+	if result == nil && outcome.Ambiguous {
+		// A processor may have charged the card without us hearing back
+		o.settleCharge(ctx, transactionID, TransactionStatusUnknown, TransactionUpdate{
+			ProcessorUsed: lastProcessor,
+			ErrorCode:     "OUTCOME_UNKNOWN",
+		}, nil)
+
+		// Not stored against the idempotency key: retries read the settled transaction
+		respondJSON(w, http.StatusAccepted, &ChargeResponse{
+			Success:       false,
+			TransactionID: transactionID,
+			ProcessorUsed: lastProcessor,
+			AmountMinor:   amount.Amount,
+			Amount:        amount.Major(),
+			Currency:      amount.Currency,
+			Status:        TransactionStatusUnknown,
+			ErrorCode:     "PAYMENT_PENDING",
+			UserMessage:   mapErrorToUserMessage("PAYMENT_PENDING"),
+			Settlement:    settlementDetails(transaction),
+		})
 		return
 	}
 
-	// Try primary processor
-	failedOver := false
-	result, err := o.chargeWithProcessor(ctx, routingDecision.PrimaryProcessor, req, paymentMethod)
-	if err != nil {
-		log.Printf("Primary processor %s failed: %v", routingDecision.PrimaryProcessor, err)
+	if result != nil && result.Status == TransactionStatusRequiresAction {
+		// The cardholder must authenticate; the processor's 3DS notification settles the charge
+		result.TransactionID = transactionID
+		result.Settlement = settlementDetails(transaction)
+		o.settleCharge(ctx, transactionID, TransactionStatusRequiresAction, TransactionUpdate{
+			ProcessorUsed:      result.ProcessorUsed,
+			ThreeDSChallengeID: result.NextAction.ChallengeID,
+			ThreeDSRedirectURL: result.NextAction.RedirectURL,
+		}, func(tx *sql.Tx) error {
+			return o.events.EmitChargeRequiresAction(ctx, tx, transactionID, req.SubscriptionID, amount, result.ProcessorUsed)
+		})
+
+		// Not stored against the idempotency key: retries read the transaction
+		respondJSON(w, http.StatusAccepted, result)
+		return
+	}
 
-		// Emit failover event
-		if o.events != nil {
-			o.events.EmitFailoverTriggered(transactionID, req.Amount, req.Currency,
-				routingDecision.PrimaryProcessor, routingDecision.SecondaryProcessor)
-		}
-		failedOver = true
-
-		// Try secondary processor
-		result, err = o.chargeWithProcessor(ctx, routingDecision.SecondaryProcessor, req, paymentMethod)
-		if err != nil {
-			log.Printf("Secondary processor %s failed: %v", routingDecision.SecondaryProcessor, err)
-
-			// Both processors failed
-			result = &ChargeResponse{
-				Success:       false,
-				TransactionID: transactionID,
-				ProcessorUsed: "none",
-				Amount:        req.Amount,
-				Currency:      req.Currency,
-				ErrorCode:     "PROCESSORS_UNAVAILABLE",
-				UserMessage:   "Payment processing temporarily unavailable. Please try again in a few minutes.",
-			}
+	if result == nil {
+		// Every processor in the chain failed
+		result = &ChargeResponse{
+			Success:       false,
+			TransactionID: transactionID,
+			ProcessorUsed: "none",
+			AmountMinor:   amount.Amount,
+			Amount:        amount.Major(),
+			Currency:      amount.Currency,
+			ErrorCode:     "PROCESSORS_UNAVAILABLE",
+			UserMessage:   "Payment processing temporarily unavailable. Please try again in a few minutes.",
 		}
 	}
 
@@ -133,165 +291,258 @@ func (o *PaymentOrchestrator) processCharge(w http.ResponseWriter, r *http.Reque
 
 	// Use our transaction ID
 	result.TransactionID = transactionID
+	result.Status = getStatus(result.Success)
+	result.Settlement = settlementDetails(transaction)
 
-	// Store transaction
-	transaction := &Transaction{
-		ID:                     transactionID,
-		SubscriptionID:         req.SubscriptionID,
-		PaymentMethodID:        req.PaymentMethodID,
+	// The outcome and its event commit together
+	duration := time.Since(startTime)
+	o.settleCharge(ctx, transactionID, result.Status, TransactionUpdate{
 		ProcessorUsed:          result.ProcessorUsed,
-		Amount:                 req.Amount,
-		Currency:               req.Currency,
-		Status:                 getStatus(result.Success),
-		IdempotencyKey:         req.IdempotencyKey,
 		ProcessorTransactionID: processorTransactionID,
 		ErrorCode:              result.ErrorCode,
-		UserErrorMessage:       result.UserMessage,
-	}
-
-	if err := o.db.CreateTransaction(ctx, transaction); err != nil {
-		log.Printf("Failed to store transaction: %v", err)
-	}
-
-	// Cache result for idempotency
-	o.cacheIdempotencyResult(ctx, req.IdempotencyKey, result)
-
-	// Emit success or failure event
-	duration := time.Since(startTime)
-	if o.events != nil {
+		ErrorMessage:           result.UserMessage,
+	}, func(tx *sql.Tx) error {
+		if result.Success && req.StoredCredential.EstablishesCredential() && result.NetworkTransactionID != "" {
+			err := o.db.SetPaymentMethodNetworkTransactionIDTx(ctx, tx, req.PaymentMethodID, result.NetworkTransactionID)
+			if err != nil {
+				return err
+			}
+		}
 		if result.Success {
-			o.events.EmitChargeSucceeded(transactionID, req.SubscriptionID, req.Amount, req.Currency,
+			return o.events.EmitChargeSucceeded(ctx, tx, transactionID, req.SubscriptionID, amount,
 				result.ProcessorUsed, duration)
-		} else {
-			o.events.EmitChargeFailed(transactionID, req.SubscriptionID, req.Amount, req.Currency,
-				result.ProcessorUsed, result.ErrorCode, result.UserMessage)
 		}
-	}
+		return o.events.EmitChargeFailed(ctx, tx, transactionID, req.SubscriptionID, amount,
+			result.ProcessorUsed, result.ErrorCode, result.UserMessage)
+	})
 
 	// Log failover if it happened
 	if failedOver && result.Success {
 		log.Printf("Charge succeeded after failover to %s", result.ProcessorUsed)
 	}
 
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	if result.Success {
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		w.WriteHeader(http.StatusPaymentRequired)
+	// Return response, keeping it for replays of the same key
+	status := http.StatusCreated
+	if !result.Success {
+		status = http.StatusPaymentRequired
 	}
-	json.NewEncoder(w).Encode(result)
+	respondIdempotent(w, lock, status, result)
 }
 
-func (o *PaymentOrchestrator) chargeWithProcessor(ctx context.Context, processorName string, req ChargeRequest, pm *PaymentMethod) (*ChargeResponse, error) {
-	var processor *ProcessorClient
-	var token string
+// settleCharge moves a pending charge to its outcome, recording the
+// outcome's event in the same transaction when emit is set. If that fails
+// the transaction stays pending and the recoverer settles it from the processor.
+func (o *PaymentOrchestrator) settleCharge(ctx context.Context, transactionID, status string, update TransactionUpdate, emit func(tx *sql.Tx) error) {
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := o.db.TransitionTransactionTx(ctx, tx, transactionID, status, update); err != nil {
+			return err
+		}
+		if emit != nil {
+			return emit(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to settle charge %s as %s, leaving it for recovery: %v", transactionID, status, err)
+	}
+}
 
-	// Select processor and token
-	switch processorName {
-	case "processor_a":
-		processor = o.processorA
-		token = o.selectToken(pm, "processor_a")
-	case "processor_b":
-		processor = o.processorB
-		token = o.selectToken(pm, "processor_b")
-	default:
-		return nil, fmt.Errorf("unknown processor: %s", processorName)
+// routingChain returns the processors to try for a charge, in order, and
+// whether a BPAS rule requires 3-D Secure. It uses the BPAS fallback chain,
+// skipping processors that aren't configured here, and falls back to
+// configured priority order if BPAS is unavailable.
+func (o *PaymentOrchestrator) routingChain(ctx context.Context, amount money.Money, pm *PaymentMethod) ([]string, bool) {
+	configured := o.processors.GetProcessorNames()
+
+	decision, err := o.bpasClient.GetRoutingDecision(ctx, RoutingRequest{
+		Amount:       amount,
+		CardBrand:    pm.CardBrand,
+		CardCountry:  pm.CardCountry,
+		SuccessRates: o.approvalRates.Get(),
+	})
+	if err != nil || decision == nil || len(decision.Chain()) == 0 {
+		log.Printf("BPAS routing failed or returned empty, using configured order: %v", err)
+		return configured, decision != nil && decision.ThreeDSRequired
 	}
 
-	// Check processor health
-	if !processor.IsHealthy() {
-		return nil, fmt.Errorf("processor %s is unhealthy", processorName)
+	var chain []string
+	seen := make(map[string]bool)
+	for _, name := range decision.Chain() {
+		if seen[name] {
+			continue
+		}
+		if _, exists := o.processors.GetProcessorConfig(name); !exists {
+			log.Printf("BPAS returned unconfigured processor %s, skipping", name)
+			continue
+		}
+		seen[name] = true
+		chain = append(chain, name)
 	}
 
-	// Process charge
-	processorReq := ProcessorChargeRequest{
-		Amount:         req.Amount,
-		Currency:       req.Currency,
-		Token:          token,
-		IdempotencyKey: req.IdempotencyKey,
+	if len(chain) == 0 {
+		return configured, decision.ThreeDSRequired
 	}
+	return chain, decision.ThreeDSRequired
+}
 
-	processorResp, err := processor.Charge(ctx, processorReq)
+func (o *PaymentOrchestrator) chargeWithProcessor(ctx context.Context, processorName string, req ChargeRequest, pm *PaymentMethod) (*ChargeResponse, error) {
+	client, err := o.processors.GetProcessor(processorName)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ChargeResponse{
-		Success:       processorResp.Success,
-		TransactionID: processorResp.TransactionID,
-		ProcessorUsed: processorName,
-		Amount:        req.Amount,
-		Currency:      req.Currency,
-		UserMessage:   mapErrorToUserMessage(processorResp.ErrorCode),
-		ErrorCode:     processorResp.ErrorCode,
-	}, nil
-}
-
-func (o *PaymentOrchestrator) selectToken(pm *PaymentMethod, processor string) string {
-	// Prefer network token
-	if pm.NetworkToken != "" {
-		return pm.NetworkToken
+	creds, refusal, err := o.cardCredentials(ctx, processorName, pm, req.Money(), req.StoredCredential)
+	if refusal != nil {
+		// The network won't let the token be charged, whichever processor is used
+		return chargeResponseFromProcessor(processorName, req, &processor.ChargeResponse{
+			ErrorCode:    refusal.Code,
+			ErrorMessage: refusal.Message,
+		}), nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Fall back to processor-specific token
-	if processor == "processor_a" && pm.ProcessorAToken != "" {
-		return pm.ProcessorAToken
+	processorReq := &processor.ChargeRequest{
+		Amount:          req.AmountMinor,
+		Currency:        req.Currency,
+		IdempotencyKey:  req.IdempotencyKey,
+		NetworkToken:    creds.NetworkToken,
+		ProcessorToken:  creds.ProcessorToken,
+		TokenCryptogram: creds.TokenCryptogram,
+
+		StoredCredential: req.StoredCredential,
+		ThreeDS:          req.ThreeDS,
 	}
-	if processor == "processor_b" && pm.ProcessorBToken != "" {
-		return pm.ProcessorBToken
+
+	// Process charge (rejected up front if the processor's circuit is open)
+	processorResp, err := client.Charge(ctx, processorReq)
+	if err != nil {
+		return nil, err
 	}
 
-	// Default to any available token
-	if pm.ProcessorAToken != "" {
-		return pm.ProcessorAToken
+	return chargeResponseFromProcessor(processorName, req, processorResp), nil
+}
+
+// chargeResponseFromProcessor builds the response for a processor's answer to a charge
+func chargeResponseFromProcessor(processorName string, req ChargeRequest, resp *processor.ChargeResponse) *ChargeResponse {
+	result := &ChargeResponse{
+		Success:       resp.Success,
+		TransactionID: resp.TransactionID,
+		ProcessorUsed: processorName,
+		AmountMinor:   req.AmountMinor,
+		Amount:        req.Money().Major(),
+		Currency:      req.Currency,
+		UserMessage:   mapErrorToUserMessage(resp.ErrorCode),
+		ErrorCode:     resp.ErrorCode,
+
+		NetworkTransactionID: resp.NetworkTransactionID,
 	}
-	if pm.ProcessorBToken != "" {
-		return pm.ProcessorBToken
+	if resp.RequiresAction() {
+		result.Status = TransactionStatusRequiresAction
+		result.UserMessage = mapErrorToUserMessage("AUTHENTICATION_REQUIRED")
+		result.NextAction = nextAction(resp.ThreeDS)
 	}
+	return result
+}
 
-	return ""
+// cardCredentials is how a processor is told which card to use
+type cardCredentials struct {
+	NetworkToken    string
+	ProcessorToken  string
+	TokenCryptogram string
 }
 
-func (o *PaymentOrchestrator) checkIdempotency(ctx context.Context, key string) (*ChargeResponse, error) {
-	// Check Redis cache
-	cacheKey := fmt.Sprintf("idempotency:%s", key)
-	val, err := o.cache.Get(ctx, cacheKey)
-	if err == nil && val != "" {
-		var response ChargeResponse
-		if err := json.Unmarshal([]byte(val), &response); err == nil {
-			return &response, nil
-		}
+// cardCredentials picks the token to send to a processor. Network token CITs
+// carry a single-use cryptogram; MITs may send the token alone. A refusal is
+// the network declining to issue a cryptogram, which no processor can get
+// past.
+func (o *PaymentOrchestrator) cardCredentials(ctx context.Context, processorName string, pm *PaymentMethod, amount money.Money, sc *processor.StoredCredential) (cardCredentials, *tokens.TokenError, error) {
+	networkToken, processorToken, err := selectToken(pm, processorName)
+	if err != nil {
+		return cardCredentials{}, nil, err
 	}
+	creds := cardCredentials{NetworkToken: networkToken, ProcessorToken: processorToken}
+	if networkToken == "" || sc.IsMIT() {
+		return creds, nil, nil
+	}
+
+	cryptogram, err := o.tokenManager.RequestCryptogram(ctx, &tokens.CryptogramRequest{
+		NetworkToken: networkToken,
+		Amount:       amount.Amount,
+		Currency:     amount.Currency,
+		MerchantID:   o.merchantID,
+	})
+	var tokenErr *tokens.TokenError
+	switch {
+	case errors.As(err, &tokenErr) && tokenErr.Refused():
+		log.Printf("Network refused a cryptogram for payment method %s: %s", pm.ID, tokenErr.Code)
+		return creds, tokenErr, nil
+	case err != nil && pm.ProcessorTokens[processorName] != "":
+		// Methods moved off the dual vault keep their processor tokens for this
+		log.Printf("Cryptogram unavailable for payment method %s, using its %s token: %v", pm.ID, processorName, err)
+		return cardCredentials{ProcessorToken: pm.ProcessorTokens[processorName]}, nil, nil
+	case err != nil:
+		return creds, nil, fmt.Errorf("failed to get network token cryptogram: %w", err)
+	}
+	creds.TokenCryptogram = cryptogram.Cryptogram
+	return creds, nil, nil
+}
 
-	// Check database
-	transaction, err := o.db.GetTransactionByIdempotencyKey(ctx, key)
-	if err == nil && transaction != nil {
-		return &ChargeResponse{
-			Success:       transaction.Status == "success",
-			TransactionID: transaction.ID,
-			ProcessorUsed: transaction.ProcessorUsed,
-			Amount:        transaction.Amount,
-			Currency:      transaction.Currency,
-			UserMessage:   transaction.UserErrorMessage,
-			ErrorCode:     transaction.ErrorCode,
-		}, nil
+// selectToken picks the token to send to a processor, preferring the portable
+// network token over a processor-specific vaulted token
+func selectToken(pm *PaymentMethod, processorName string) (networkToken, processorToken string, err error) {
+	if pm.NetworkToken != "" {
+		return pm.NetworkToken, "", nil
+	}
+	if token := pm.ProcessorTokens[processorName]; token != "" {
+		return "", token, nil
 	}
+	return "", "", fmt.Errorf("payment method %s has no token for processor %s", pm.ID, processorName)
+}
 
-	return nil, fmt.Errorf("not found")
+// resolveAmount reads a request amount sent as minor units or, by older
+// clients, as a decimal in major units. The amount must be positive.
+func resolveAmount(minor int64, legacy float64, currency string) (money.Money, error) {
+	amount, err := money.Resolve(minor, legacy, currency)
+	if err == nil && !amount.IsPositive() {
+		err = money.ErrInvalidAmount
+	}
+	if err != nil {
+		return money.Money{}, fmt.Errorf("a positive amount_minor and a supported currency are required: %w", err)
+	}
+	return amount, nil
 }
 
-func (o *PaymentOrchestrator) cacheIdempotencyResult(ctx context.Context, key string, result *ChargeResponse) {
-	cacheKey := fmt.Sprintf("idempotency:%s", key)
-	data, _ := json.Marshal(result)
-	o.cache.Set(ctx, cacheKey, string(data), 24*time.Hour)
+func chargeResponseFromTransaction(t *Transaction) *ChargeResponse {
+	response := &ChargeResponse{
+		Success:       t.Status == TransactionStatusSuccess,
+		TransactionID: t.ID,
+		ProcessorUsed: t.ProcessorUsed,
+		AmountMinor:   t.Amount,
+		Amount:        t.Money().Major(),
+		Currency:      t.Currency,
+		UserMessage:   t.UserErrorMessage,
+		ErrorCode:     t.ErrorCode,
+		Status:        t.Status,
+		Settlement:    settlementDetails(t),
+	}
+	if t.Status == TransactionStatusRequiresAction && t.ThreeDSChallengeID != "" {
+		response.UserMessage = mapErrorToUserMessage("AUTHENTICATION_REQUIRED")
+		response.NextAction = &NextAction{
+			Type:        "redirect_to_url",
+			RedirectURL: t.ThreeDSRedirectURL,
+			ChallengeID: t.ThreeDSChallengeID,
+		}
+	}
+	return response
 }
 
 func getStatus(success bool) string {
 	if success {
-		return "success"
+		return TransactionStatusSuccess
 	}
-	return "failed"
+	return TransactionStatusFailed
 }
 
 func mapErrorToUserMessage(errorCode string) string {
@@ -302,6 +553,21 @@ func mapErrorToUserMessage(errorCode string) string {
 		"NETWORK_ERROR":         "Network error. Please try again in a few moments.",
 		"PROCESSOR_UNAVAILABLE": "Payment system temporarily unavailable. Please try again later.",
 		"FRAUD_SUSPECTED":       "Payment declined for security reasons. Please contact your bank.",
+		"PAYMENT_PENDING":       "Your payment is being confirmed. Please check back shortly before trying again.",
+		"NOT_PROCESSED":         "Payment was not processed. Please try again.",
+
+		"STORED_CREDENTIAL_INVALID": "This saved card can't be charged automatically. Please make a payment with it to confirm it.",
+
+		"TOKEN_NOT_FOUND":    "This saved card is no longer available. Please add your card again.",
+		"TOKEN_NOT_ELIGIBLE": "This saved card is no longer available. Please add your card again.",
+		"TOKEN_EXPIRED":      "Your card has expired. Please update your payment method.",
+		"CRYPTOGRAM_INVALID": "Payment could not be verified with your card network. Please try again.",
+		"TOKEN_SUSPENDED":    "Your card has been suspended by your bank. Please use a different payment method.",
+		"TOKEN_DELETED":      "Your card is no longer active. Please update your payment method.",
+
+		"AUTHENTICATION_REQUIRED": "Please confirm this payment with your bank to complete it.",
+		"AUTHENTICATION_FAILED":   "Your bank could not confirm this payment. Please try again or use a different card.",
+		"AUTHENTICATION_EXPIRED":  "The payment confirmation timed out. Please try again.",
 	}
 
 	if msg, ok := messages[errorCode]; ok {
@@ -309,3 +575,26 @@ func mapErrorToUserMessage(errorCode string) string {
 	}
 	return "Payment could not be processed. Please try again."
 }
+
+// ErrorResponse is the body of an error reply
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// respondJSON sends a JSON response
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if data != nil {
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+// respondError sends an error response
+func respondError(w http.ResponseWriter, status int, message string, code string) {
+	respondJSON(w, status, ErrorResponse{
+		Error: message,
+		Code:  code,
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Idempotency key states
+const (
+	IdempotencyInFlight  = "in_flight"
+	IdempotencyCompleted = "completed"
+)
+
+var (
+	ErrIdempotencyInFlight = errors.New("a request with this idempotency key is already in progress")
+	ErrIdempotencyMismatch = errors.New("idempotency key was already used with a different request")
+)
+
+// IdempotencyStore locks idempotency keys while a request is in flight and
+// keeps the response for replay. The Postgres row is the only authority on
+// who holds a key; Redis caches completed responses so replays can skip the
+// database, and is never trusted to grant a lock.
+type IdempotencyStore struct {
+	cache       *RedisClient
+	db          *DB
+	lockTimeout time.Duration // How long an in-flight lock survives a crashed request
+	retention   time.Duration // How long a completed key is replayed
+}
+
+func NewIdempotencyStore(cache *RedisClient, db *DB, lockTimeout, retention time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		cache:       cache,
+		db:          db,
+		lockTimeout: lockTimeout,
+		retention:   retention,
+	}
+}
+
+// IdempotencyLock is an idempotency key held by the current request
+type IdempotencyLock struct {
+	store  *IdempotencyStore
+	record *IdempotencyRecord
+	done   bool
+}
+
+// Acquire claims key for a request. It returns a lock if the caller should
+// process the request, or the stored record if it already completed.
+// ErrIdempotencyInFlight and ErrIdempotencyMismatch report a key that can't be used.
+func (s *IdempotencyStore) Acquire(ctx context.Context, scope, key string, request interface{}) (*IdempotencyLock, *IdempotencyRecord, error) {
+	hash, err := requestHash(scope, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A cached response can be replayed without touching the database
+	if cached := s.cachedRecord(ctx, key); cached != nil {
+		rec, err := checkExisting(cached, hash)
+		return nil, rec, err
+	}
+
+	now := time.Now()
+	lockedUntil := now.Add(s.lockTimeout)
+	record := &IdempotencyRecord{
+		Key:         key,
+		Scope:       scope,
+		RequestHash: hash,
+		Status:      IdempotencyInFlight,
+		LockedUntil: &lockedUntil,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.retention),
+	}
+
+	// Retry once in case the existing row is released between INSERT and SELECT
+	for attempt := 0; attempt < 2; attempt++ {
+		acquired, err := s.db.AcquireIdempotencyKey(ctx, record)
+		if err != nil {
+			return nil, nil, err
+		}
+		if acquired {
+			return &IdempotencyLock{store: s, record: record}, nil, nil
+		}
+
+		existing, err := s.db.GetIdempotencyRecord(ctx, record.Key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		rec, err := checkExisting(existing, record.RequestHash)
+		if rec != nil {
+			s.cacheRecord(ctx, rec)
+		}
+		return nil, rec, err
+	}
+
+	return nil, nil, ErrIdempotencyInFlight
+}
+
+// cachedRecord returns the completed record Redis holds for key, if any. Redis
+// errors are logged and treated as a miss, since Postgres has the answer.
+func (s *IdempotencyStore) cachedRecord(ctx context.Context, key string) *IdempotencyRecord {
+	stored, err := s.cache.Get(ctx, idempotencyCacheKey(key))
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Redis unavailable for idempotency key %s, using database: %v", key, err)
+		return nil
+	}
+
+	var rec IdempotencyRecord
+	if err := json.Unmarshal([]byte(stored), &rec); err != nil || rec.Status != IdempotencyCompleted {
+		log.Printf("Ignoring unusable cached idempotency record for %s", key)
+		return nil
+	}
+	return &rec
+}
+
+// cacheRecord copies a completed record to Redis until its retention ends
+func (s *IdempotencyStore) cacheRecord(ctx context.Context, rec *IdempotencyRecord) {
+	ttl := time.Until(rec.ExpiresAt)
+	if ttl <= 0 {
+		return
+	}
+	value, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to encode idempotency record for %s: %v", rec.Key, err)
+		return
+	}
+	if err := s.cache.Set(ctx, idempotencyCacheKey(rec.Key), string(value), ttl); err != nil {
+		log.Printf("Failed to cache idempotent response for %s: %v", rec.Key, err)
+	}
+}
+
+// checkExisting decides what to do with a key that is already taken
+func checkExisting(existing *IdempotencyRecord, hash string) (*IdempotencyRecord, error) {
+	if existing.RequestHash != hash {
+		return nil, ErrIdempotencyMismatch
+	}
+	if existing.Status != IdempotencyCompleted {
+		return nil, ErrIdempotencyInFlight
+	}
+	return existing, nil
+}
+
+// Complete stores the response for replay and releases the in-flight lock.
+// The response is cached only once Postgres has it. If it can't be stored
+// the key is released instead, so retries run the request again rather than
+// waiting out the lock.
+func (l *IdempotencyLock) Complete(status int, body interface{}) {
+	if l.done {
+		return
+	}
+	l.done = true
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to encode idempotent response for %s: %v", l.record.Key, err)
+		l.release()
+		return
+	}
+
+	completed := *l.record
+	completed.Status = IdempotencyCompleted
+	completed.ResponseCode = status
+	completed.ResponseBody = data
+	completed.LockedUntil = nil
+	completed.ExpiresAt = time.Now().Add(l.store.retention)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = l.store.db.CompleteIdempotencyKey(ctx, &completed)
+	if err != nil {
+		log.Printf("Failed to store idempotent response for %s, retrying: %v", l.record.Key, err)
+		err = l.store.db.CompleteIdempotencyKey(ctx, &completed)
+	}
+	if err != nil {
+		log.Printf("Failed to store idempotent response for %s, releasing the key: %v", l.record.Key, err)
+		l.release()
+		return
+	}
+	l.store.cacheRecord(ctx, &completed)
+}
+
+// Release drops the in-flight lock without storing a response, so the
+// request can be retried. It does nothing once the lock is completed.
+func (l *IdempotencyLock) Release() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.release()
+}
+
+func (l *IdempotencyLock) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := l.store.db.ReleaseIdempotencyKey(ctx, l.record.Key, l.record.RequestHash); err != nil {
+		log.Printf("Failed to release idempotency key %s: %v", l.record.Key, err)
+	}
+}
+
+// cleanupLoop periodically removes expired keys from the database.
+// Cached responses expire from Redis on their own.
+func (s *IdempotencyStore) cleanupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		count, err := s.db.DeleteExpiredIdempotencyKeys(ctx)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to clean up idempotency keys: %v", err)
+		} else if count > 0 {
+			log.Printf("Removed %d expired idempotency keys", count)
+		}
+	}
+}
+
+func idempotencyCacheKey(key string) string {
+	return fmt.Sprintf("idempotency:%s", key)
+}
+
+// requestHash fingerprints a request so a reused key with a different payload can be detected
+func requestHash(scope string, request interface{}) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(scope+":"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// beginIdempotent claims the idempotency key for a request. It returns nil
+// after writing the response when the request is a replay or is rejected.
+func (o *PaymentOrchestrator) beginIdempotent(w http.ResponseWriter, r *http.Request, scope, key string, request interface{}) *IdempotencyLock {
+	lock, existing, err := o.idempotency.Acquire(r.Context(), scope, key, request)
+	switch {
+	case err == nil && existing != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Idempotent-Replay", "true")
+		w.WriteHeader(existing.ResponseCode)
+		w.Write(existing.ResponseBody)
+		return nil
+	case err == nil:
+		return lock
+	case errors.Is(err, ErrIdempotencyInFlight):
+		w.Header().Set("Retry-After", "1")
+		respondError(w, http.StatusConflict, err.Error(), "IDEMPOTENCY_KEY_IN_USE")
+	case errors.Is(err, ErrIdempotencyMismatch):
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "IDEMPOTENCY_KEY_MISMATCH")
+	default:
+		log.Printf("Failed to acquire idempotency key %s: %v", key, err)
+		respondError(w, http.StatusServiceUnavailable, "Unable to process request safely, please retry", "IDEMPOTENCY_UNAVAILABLE")
+	}
+	return nil
+}
+
+// respondIdempotent stores the response against the held key and sends it
+func respondIdempotent(w http.ResponseWriter, lock *IdempotencyLock, status int, body interface{}) {
+	lock.Complete(status, body)
+	respondJSON(w, status, body)
+}
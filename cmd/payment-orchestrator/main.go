@@ -7,23 +7,48 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/fees"
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+	"github.com/AnuragDani/subscription-platform/internal/vault"
 	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
 )
 
+// serverWriteTimeout bounds how long a handler may take to answer; the
+// fallback chain's CHAIN_TIMEOUT has to fit inside it
+const serverWriteTimeout = 15 * time.Second
+
 type PaymentOrchestrator struct {
-	db           *DB
-	cache        *RedisClient
-	processorA   *ProcessorClient
-	processorB   *ProcessorClient
-	bpasClient   *BPASClient
-	tokenManager *TokenManager
-	wsHub        *ws.Hub
-	events       *EventEmitter
+	db            *DB
+	cache         *RedisClient
+	processors    *processor.ProcessorFactory
+	bpasClient    *BPASClient
+	subscriptions *SubscriptionClient
+	tokenManager  *tokens.TokenManager
+	wsHub         *ws.Hub
+	events        *EventEmitter
+	webhooks      *WebhookDispatcher
+	idempotency   *IdempotencyStore
+	failover      *FailoverPolicy
+	chainTimeout  time.Duration
+	fx            *fx.Service
+	rateFile      string
+	fees          *fees.Table // Nil when no fee schedules are loaded
+	approvalRates *ApprovalRates
+
+	tokenMigration *TokenMigration
+
+	settlementCurrency string // Default settlement currency; empty settles in the presentment currency
+	reportingCurrency  string
+	merchantID         string // Merchant network token cryptograms are requested for
 }
 
 func main() {
@@ -32,8 +57,19 @@ func main() {
 	// Initialize configuration
 	cfg := LoadConfig()
 
+	// A walk that outlives the write timeout would settle a charge the client never hears about
+	if cfg.ChainTimeout <= 0 || cfg.ChainTimeout >= serverWriteTimeout {
+		log.Fatalf("CHAIN_TIMEOUT must be between 0 and the %s write timeout, got %s", serverWriteTimeout, cfg.ChainTimeout)
+	}
+
+	// Load the keys payment method tokens are encrypted with
+	tokenVault, err := vault.Load()
+	if err != nil {
+		log.Fatal("Failed to load token keys:", err)
+	}
+
 	// Connect to database
-	db, err := NewDB(cfg.DatabaseURL)
+	db, err := NewDB(cfg.DatabaseURL, tokenVault)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -46,16 +82,6 @@ func main() {
 	}
 	defer cache.Close()
 
-	// Initialize processor clients
-	processorA := NewProcessorClient("processor_a", cfg.ProcessorAURL)
-	processorB := NewProcessorClient("processor_b", cfg.ProcessorBURL)
-
-	// Initialize BPAS client
-	bpasClient := NewBPASClient(cfg.BPASServiceURL)
-
-	// Initialize token manager
-	tokenManager := NewTokenManager(cfg.NetworkTokenURL, processorA, processorB)
-
 	// Initialize WebSocket hub
 	logger := log.New(os.Stdout, "[WS-HUB] ", log.LstdFlags)
 	wsHub := ws.NewHub(logger)
@@ -65,18 +91,89 @@ func main() {
 	// Initialize event emitter
 	eventEmitter := NewEventEmitter(wsHub)
 
+	// Initialize webhook delivery
+	webhooks := NewWebhookDispatcher(db, cfg.Webhooks, cfg.MerchantID)
+	go webhooks.Run()
+
+	// Record outbound calls to processors and services
+	auditWriter := NewAuditWriter(db, cfg.AuditBufferSize)
+	go auditWriter.Run()
+
+	// Initialize processor clients
+	processors := loadProcessors(cfg, newBreakerObserver(db, eventEmitter), auditWriter)
+	log.Printf("Loaded processors: %v", processors.GetProcessorNames())
+
+	// Initialize BPAS client
+	bpasClient := NewBPASClient(cfg.BPASServiceURL, auditWriter)
+
+	// Initialize subscription service client, used when disputes are lost
+	subscriptionClient := NewSubscriptionClient(cfg.SubscriptionServiceURL, auditWriter)
+
+	// Initialize network token service client, used to tokenize new cards
+	tokenManager := NewTokenManager(cfg.NetworkTokenURL, auditWriter)
+
+	// Load exchange rates, also used to convert fixed processor fees
+	rates := loadFXRates(cfg)
+
 	// Create orchestrator
 	orchestrator := &PaymentOrchestrator{
-		db:           db,
-		cache:        cache,
-		processorA:   processorA,
-		processorB:   processorB,
-		bpasClient:   bpasClient,
-		tokenManager: tokenManager,
-		wsHub:        wsHub,
-		events:       eventEmitter,
+		db:            db,
+		cache:         cache,
+		processors:    processors,
+		bpasClient:    bpasClient,
+		subscriptions: subscriptionClient,
+		tokenManager:  tokenManager,
+		wsHub:         wsHub,
+		events:        eventEmitter,
+		webhooks:      webhooks,
+		idempotency:   NewIdempotencyStore(cache, db, cfg.IdempotencyLockTimeout, cfg.IdempotencyRetention),
+		failover:      loadFailoverPolicy(cfg),
+		chainTimeout:  cfg.ChainTimeout,
+		fx:            rates,
+		rateFile:      rateFilePath(cfg),
+		fees:          loadFeeSchedules(cfg, rates),
+		approvalRates: &ApprovalRates{},
+
+		tokenMigration: newTokenMigration(cfg),
+
+		settlementCurrency: cfg.SettlementCurrency,
+		reportingCurrency:  cfg.ReportingCurrency,
+		merchantID:         cfg.MerchantID,
 	}
 
+	// Expire authorization holds that were never captured
+	go orchestrator.expireAuthorizationsLoop(time.Minute)
+
+	// Remove idempotency keys past their retention from the database fallback
+	go orchestrator.idempotency.cleanupLoop(time.Hour)
+
+	// Settle charges left pending or unknown
+	go orchestrator.recoverTransactionsLoop(cfg)
+
+	// Retry putting subscriptions past due for lost disputes
+	go orchestrator.syncLostDisputesLoop(time.Minute)
+
+	// Retry asking for new payment methods when card networks retire tokens
+	go orchestrator.requirePaymentMethodsLoop(time.Minute)
+
+	// Retry network tokenization for dual-vault payment methods
+	go orchestrator.tokenMigrationLoop()
+
+	// Reconcile processor settlement files against recorded transactions
+	go orchestrator.reconcileLoop(cfg.ReconciliationInterval, cfg.ReconciliationDelay)
+
+	// Keep processor approval rates current for cost-optimized routing
+	go orchestrator.refreshApprovalRatesLoop(time.Minute, cfg.RoutingStatsWindow, cfg.RoutingStatsMinAttempts)
+
+	// Drop audit entries past retention
+	go orchestrator.purgeAuditLogsLoop(cfg.AuditRetention)
+
+	// Fail charges whose 3-D Secure challenge was never completed
+	go orchestrator.expireThreeDSLoop(time.Minute, cfg.ThreeDSTimeout)
+
+	// Publish events from the outbox to WebSocket clients and webhooks
+	orchestrator.startOutboxRelay(cfg)
+
 	// Setup routes
 	r := mux.NewRouter()
 	r.HandleFunc("/health", orchestrator.healthCheck).Methods("GET")
@@ -84,9 +181,44 @@ func main() {
 	r.HandleFunc("/ws/stats", orchestrator.wsStats).Methods("GET")
 	r.HandleFunc("/orchestrator/charge", orchestrator.processCharge).Methods("POST")
 	r.HandleFunc("/orchestrator/refund", orchestrator.processRefund).Methods("POST")
+	r.HandleFunc("/orchestrator/refunds/{id}", orchestrator.getRefund).Methods("GET")
+	r.HandleFunc("/transactions", orchestrator.listTransactions).Methods("GET")
+	r.HandleFunc("/orchestrator/transactions/{id}/refunds", orchestrator.listRefunds).Methods("GET")
+	r.HandleFunc("/orchestrator/authorize", orchestrator.processAuthorize).Methods("POST")
+	r.HandleFunc("/orchestrator/capture", orchestrator.processCapture).Methods("POST")
+	r.HandleFunc("/orchestrator/void", orchestrator.processVoid).Methods("POST")
+	r.HandleFunc("/payment-methods", orchestrator.attachPaymentMethod).Methods("POST")
+	r.HandleFunc("/payment-methods", orchestrator.listPaymentMethods).Methods("GET")
+	r.HandleFunc("/payment-methods/{id}", orchestrator.getPaymentMethod).Methods("GET")
+	r.HandleFunc("/payment-methods/{id}", orchestrator.detachPaymentMethod).Methods("DELETE")
+	r.HandleFunc("/payment-methods/{id}/default", orchestrator.setDefaultPaymentMethod).Methods("POST")
 	r.HandleFunc("/admin/stats", orchestrator.getStats).Methods("GET")
 	r.HandleFunc("/stats/transactions", orchestrator.getTransactionStats).Methods("GET")
 	r.HandleFunc("/stats/processors", orchestrator.getProcessorStats).Methods("GET")
+	r.HandleFunc("/admin/fx/rates", orchestrator.getFXRates).Methods("GET")
+	r.HandleFunc("/admin/fx/rates", orchestrator.putFXRates).Methods("PUT")
+	r.HandleFunc("/admin/fx/reload", orchestrator.reloadFXRates).Methods("POST")
+	r.HandleFunc("/admin/token-migration", orchestrator.getTokenMigration).Methods("GET")
+	r.HandleFunc("/admin/token-migration/run", orchestrator.runTokenMigration).Methods("POST")
+	r.HandleFunc("/webhooks/endpoints", orchestrator.createWebhookEndpoint).Methods("POST")
+	r.HandleFunc("/webhooks/endpoints", orchestrator.listWebhookEndpoints).Methods("GET")
+	r.HandleFunc("/webhooks/endpoints/{id}", orchestrator.getWebhookEndpoint).Methods("GET")
+	r.HandleFunc("/webhooks/endpoints/{id}", orchestrator.updateWebhookEndpoint).Methods("PATCH")
+	r.HandleFunc("/webhooks/endpoints/{id}", orchestrator.deleteWebhookEndpoint).Methods("DELETE")
+	r.HandleFunc("/webhooks/deliveries", orchestrator.listWebhookDeliveries).Methods("GET")
+	r.HandleFunc("/webhooks/deliveries/{id}", orchestrator.getWebhookDelivery).Methods("GET")
+	r.HandleFunc("/webhooks/deliveries/{id}/redeliver", orchestrator.redeliverWebhook).Methods("POST")
+	r.HandleFunc("/disputes", orchestrator.listDisputes).Methods("GET")
+	r.HandleFunc("/disputes/{id}", orchestrator.getDispute).Methods("GET")
+	r.HandleFunc("/disputes/{id}/evidence", orchestrator.submitDisputeEvidence).Methods("POST")
+	r.HandleFunc("/processors/{processor}/disputes", orchestrator.handleDisputeNotification).Methods("POST")
+	r.HandleFunc("/processors/{processor}/3ds", orchestrator.handleThreeDSNotification).Methods("POST")
+	r.HandleFunc("/network-tokens/notifications", orchestrator.handleTokenNotification).Methods("POST")
+	r.HandleFunc("/reconciliation/runs", orchestrator.createReconciliationRun).Methods("POST")
+	r.HandleFunc("/reconciliation/runs", orchestrator.listReconciliationRuns).Methods("GET")
+	r.HandleFunc("/reconciliation/runs/{id}", orchestrator.getReconciliationReport).Methods("GET")
+	r.HandleFunc("/events", orchestrator.listEvents).Methods("GET")
+	r.HandleFunc("/audit/logs", orchestrator.listAuditLogs).Methods("GET")
 	r.HandleFunc("/internal/events", orchestrator.handleInternalEvent).Methods("POST")
 
 	// Start server with graceful shutdown
@@ -94,7 +226,7 @@ func main() {
 		Addr:         ":8001",
 		Handler:      r,
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 	}
 
 	go func() {
@@ -121,17 +253,20 @@ func main() {
 }
 
 func (o *PaymentOrchestrator) healthCheck(w http.ResponseWriter, r *http.Request) {
+	dependencies := map[string]string{
+		"database": o.checkDatabaseHealth(),
+		"redis":    o.checkRedisHealth(),
+	}
+	for _, snapshot := range o.breakerSnapshots() {
+		dependencies[snapshot.Processor] = processorHealthStatus(snapshot.State)
+	}
+
 	health := map[string]interface{}{
-		"service":   "payment-orchestrator",
-		"status":    "healthy",
-		"timestamp": time.Now(),
-		"version":   "1.0.0",
-		"dependencies": map[string]string{
-			"database":    o.checkDatabaseHealth(),
-			"redis":       o.checkRedisHealth(),
-			"processor_a": o.checkProcessorHealth(o.processorA),
-			"processor_b": o.checkProcessorHealth(o.processorB),
-		},
+		"service":      "payment-orchestrator",
+		"status":       "healthy",
+		"timestamp":    time.Now(),
+		"version":      "1.0.0",
+		"dependencies": dependencies,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -153,11 +288,85 @@ func (o *PaymentOrchestrator) checkRedisHealth() string {
 	return "healthy"
 }
 
-func (o *PaymentOrchestrator) checkProcessorHealth(client *ProcessorClient) string {
-	if client.IsHealthy() {
-		return "healthy"
+func processorHealthStatus(state BreakerState) string {
+	switch state {
+	case BreakerOpen:
+		return "unhealthy"
+	case BreakerHalfOpen:
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// loadProcessors registers every processor from configs/processors.yaml,
+// falling back to PROCESSOR_A_URL/PROCESSOR_B_URL when the file is missing
+func loadProcessors(cfg *Config, onTransition func(BreakerTransition), recorder audit.Recorder) *processor.ProcessorFactory {
+	processors, err := processor.ProcessorFactoryFromFile(filepath.Join(cfg.ConfigPath, "processors.yaml"))
+	if err != nil {
+		log.Printf("Warning: %v, using PROCESSOR_A_URL/PROCESSOR_B_URL", err)
+		processors = processor.ProcessorFromConfig(cfg.ProcessorAURL, cfg.ProcessorBURL)
+	}
+
+	processors.SetBuilder(func(pc *processor.ProcessorConfig) processor.ProcessorInterface {
+		return NewProcessorClient(pc, cfg.Breaker, onTransition, recorder)
+	})
+
+	// Create every client up front so their probes start running
+	if _, err := processors.GetAllProcessors(); err != nil {
+		log.Fatal("Failed to initialize processors:", err)
+	}
+
+	return processors
+}
+
+// loadFailoverPolicy reads configs/failover-policy.yaml, falling back to the default policy
+func loadFailoverPolicy(cfg *Config) *FailoverPolicy {
+	policy, err := LoadFailoverPolicy(filepath.Join(cfg.ConfigPath, "failover-policy.yaml"))
+	if err != nil {
+		log.Printf("Warning: %v, using default failover policy", err)
+		return DefaultFailoverPolicy()
+	}
+	return policy
+}
+
+// breakerSnapshots returns the circuit breaker state of each processor in priority order
+func (o *PaymentOrchestrator) breakerSnapshots() []BreakerSnapshot {
+	all, _ := o.processors.GetAllProcessors()
+
+	snapshots := make([]BreakerSnapshot, 0, len(all))
+	for _, p := range all {
+		if client, ok := p.(*ProcessorClient); ok {
+			snapshots = append(snapshots, client.BreakerSnapshot())
+		}
+	}
+	return snapshots
+}
+
+// newBreakerObserver persists breaker transitions and broadcasts them
+func newBreakerObserver(db *DB, events *EventEmitter) func(BreakerTransition) {
+	return func(t BreakerTransition) {
+		s := t.Snapshot
+		log.Printf("Circuit breaker for %s: %s -> %s (%s)", s.Processor, t.From, t.To, s.Reason)
+
+		events.EmitProcessorHealth(s.Processor, s.State, s.SuccessRate, s.AvgLatencyMs, s.Reason)
+
+		// Written inline so rapid transitions land in order
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := db.UpsertProcessorHealth(ctx, s); err != nil {
+			log.Printf("Failed to record processor health for %s: %v", s.Processor, err)
+		}
 	}
-	return "unhealthy"
+}
+
+// getProcessorStats returns the circuit breaker state of each processor
+func (o *PaymentOrchestrator) getProcessorStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"processors":     o.breakerSnapshots(),
+		"approval_rates": o.approvalRates.Get(),
+		"timestamp":      time.Now(),
+	})
 }
 
 // wsStats returns WebSocket hub statistics
@@ -174,7 +383,8 @@ type InternalEventRequest struct {
 	Data  interface{} `json:"data"`
 }
 
-// handleInternalEvent receives events from other services and broadcasts them
+// handleInternalEvent records an event from a service that has no database
+// access in the outbox, which then relays it like any other
 func (o *PaymentOrchestrator) handleInternalEvent(w http.ResponseWriter, r *http.Request) {
 	var req InternalEventRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -182,8 +392,15 @@ func (o *PaymentOrchestrator) handleInternalEvent(w http.ResponseWriter, r *http
 		return
 	}
 
-	// Broadcast the event to all WebSocket clients
-	o.wsHub.BroadcastEvent(req.Type, req.Event, req.Data)
+	if req.Type == "" || req.Event == "" {
+		respondError(w, http.StatusBadRequest, "type and event are required", "INVALID_REQUEST")
+		return
+	}
+	if err := o.events.record(r.Context(), o.db.conn, req.Type, req.Event, req.Data); err != nil {
+		log.Printf("Failed to record internal event %s.%s: %v", req.Type, req.Event, err)
+		http.Error(w, "Failed to record event", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/events"
+	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
+)
+
+// startOutboxRelay publishes events written to the outbox by this and the
+// other services
+func (o *PaymentOrchestrator) startOutboxRelay(cfg *Config) {
+	relay := events.NewRelay(o.db.conn, o.publishEvent)
+	if err := relay.Listen(cfg.DatabaseURL); err != nil {
+		log.Printf("Warning: outbox notifications unavailable, polling every %s: %v", cfg.OutboxPollInterval, err)
+	}
+	go relay.Run(cfg.OutboxPollInterval)
+	go o.pruneOutboxLoop(cfg.OutboxRetention)
+}
+
+// publishEvent hands a relayed event to WebSocket clients and webhook
+// endpoints. Webhooks are deduplicated on the event ID, so republishing
+// after a crash queues nothing twice.
+func (o *PaymentOrchestrator) publishEvent(ctx context.Context, e *events.OutboxEvent) error {
+	msg := &ws.Message{
+		ID:        e.ID,
+		Sequence:  e.Sequence,
+		Type:      e.Type,
+		Event:     e.Event,
+		Data:      e.Data,
+		Timestamp: e.CreatedAt.UTC(),
+	}
+
+	if err := o.webhooks.Enqueue(ctx, msg); err != nil {
+		return err
+	}
+	if err := o.wsHub.BroadcastMessage(msg); err != nil {
+		log.Printf("Failed to broadcast event %d: %v", e.Sequence, err)
+	}
+	return nil
+}
+
+// pruneOutboxLoop drops published events once they are past replay retention
+func (o *PaymentOrchestrator) pruneOutboxLoop(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if n, err := events.PruneOutbox(ctx, o.db.conn, time.Now().Add(-retention)); err != nil {
+			log.Printf("Failed to prune event outbox: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d published events from the outbox", n)
+		}
+		cancel()
+	}
+}
+
+// listEvents replays published events after a sequence number
+// (?after=120&limit=100) so consumers can catch up after a disconnect
+func (o *PaymentOrchestrator) listEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var after int64
+	if a := query.Get("after"); a != "" {
+		parsed, err := strconv.ParseInt(a, 10, 64)
+		if err != nil || parsed < 0 {
+			respondError(w, http.StatusBadRequest, "after must be a sequence number", "INVALID_REQUEST")
+			return
+		}
+		after = parsed
+	}
+
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 1000", "INVALID_REQUEST")
+			return
+		}
+		limit = parsed
+	}
+
+	replayed, err := events.ReadOutbox(r.Context(), o.db.conn, after, limit)
+	if err != nil {
+		log.Printf("Failed to read event outbox: %v", err)
+		http.Error(w, "Failed to read events", http.StatusInternalServerError)
+		return
+	}
+
+	// Consumers pass next_after back to continue from where this page ends
+	next := after
+	if len(replayed) > 0 {
+		next = replayed[len(replayed)-1].Sequence
+	}
+	if replayed == nil {
+		replayed = []*events.OutboxEvent{}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"events":     replayed,
+		"next_after": next,
+	})
+}
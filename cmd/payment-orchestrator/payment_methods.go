@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+)
+
+// AttachPaymentMethodRequest adds a card for a user. The card number and
+// security code are only passed on to the network token service.
+type AttachPaymentMethodRequest struct {
+	UserID      string `json:"user_id"`
+	CardNumber  string `json:"card_number"`
+	ExpMonth    int    `json:"exp_month"`
+	ExpYear     int    `json:"exp_year"`
+	CVV         string `json:"cvv"`
+	CardCountry string `json:"card_country,omitempty"` // Issuer country, ISO 3166 alpha-2
+
+	// The user's first payment method is always the default
+	SetDefault bool `json:"set_default,omitempty"`
+
+	// Run a zero-amount verification before storing the card
+	Verify         bool   `json:"verify,omitempty"`
+	VerifyCurrency string `json:"verify_currency,omitempty"` // Defaults to USD
+}
+
+// PaymentMethodResponse is a payment method as shown to clients, without its tokens
+type PaymentMethodResponse struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	TokenType   string     `json:"token_type"` // network or dual_vault
+	LastFour    string     `json:"last_four"`
+	CardBrand   string     `json:"card_brand,omitempty"`
+	CardCountry string     `json:"card_country,omitempty"`
+	ExpMonth    int        `json:"exp_month"`
+	ExpYear     int        `json:"exp_year"`
+	IsDefault   bool       `json:"is_default"`
+	VerifiedAt  *time.Time `json:"verified_at,omitempty"`
+	DetachedAt  *time.Time `json:"detached_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	TokenStatus       string `json:"token_status"` // active, suspended or deleted by the card network
+	TokenStatusReason string `json:"token_status_reason,omitempty"`
+}
+
+func paymentMethodResponse(pm *PaymentMethod) *PaymentMethodResponse {
+	return &PaymentMethodResponse{
+		ID:          pm.ID,
+		UserID:      pm.UserID,
+		TokenType:   pm.TokenType,
+		LastFour:    pm.LastFour,
+		CardBrand:   pm.CardBrand,
+		CardCountry: pm.CardCountry,
+		ExpMonth:    pm.ExpMonth,
+		ExpYear:     pm.ExpYear,
+		IsDefault:   pm.IsDefault,
+		VerifiedAt:  pm.VerifiedAt,
+		DetachedAt:  pm.DetachedAt,
+		CreatedAt:   pm.CreatedAt,
+
+		TokenStatus:       pm.TokenStatus,
+		TokenStatusReason: pm.TokenStatusReason,
+	}
+}
+
+// validate checks the card details, returning a message describing the first problem
+func (req *AttachPaymentMethodRequest) validate(now time.Time) string {
+	if _, err := uuid.Parse(req.UserID); err != nil {
+		return "user_id must be a UUID"
+	}
+	if len(req.CardNumber) < 13 || len(req.CardNumber) > 19 || !allDigits(req.CardNumber) {
+		return "card_number must be 13 to 19 digits"
+	}
+	if req.ExpMonth < 1 || req.ExpMonth > 12 {
+		return "exp_month must be between 1 and 12"
+	}
+	if req.ExpYear < now.Year() || (req.ExpYear == now.Year() && req.ExpMonth < int(now.Month())) {
+		return "card has expired"
+	}
+	if req.CVV != "" && (len(req.CVV) < 3 || len(req.CVV) > 4 || !allDigits(req.CVV)) {
+		return "cvv must be 3 or 4 digits"
+	}
+	if req.CardCountry != "" && len(req.CardCountry) != 2 {
+		return "card_country must be an ISO 3166 alpha-2 code"
+	}
+	if req.Verify {
+		if !money.IsSupported(req.VerifyCurrency) {
+			return "verify_currency is not supported"
+		}
+	}
+	return ""
+}
+
+func allDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// attachPaymentMethod tokenizes a card through the network token service
+// and stores it for the user (POST /payment-methods). Cards the service
+// can't network-tokenize are stored with dual-vault processor tokens.
+func (o *PaymentOrchestrator) attachPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	var req AttachPaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	req.CardNumber = strings.ReplaceAll(req.CardNumber, " ", "")
+	req.CardCountry = strings.ToUpper(req.CardCountry)
+	req.VerifyCurrency = strings.ToUpper(req.VerifyCurrency)
+	if req.VerifyCurrency == "" {
+		req.VerifyCurrency = "USD"
+	}
+	if problem := req.validate(time.Now()); problem != "" {
+		respondError(w, http.StatusBadRequest, problem, "INVALID_CARD")
+		return
+	}
+
+	ctx := r.Context()
+	tokenResp, err := o.tokenManager.CreateToken(ctx, &tokens.TokenRequest{
+		CardNumber: req.CardNumber,
+		ExpMonth:   req.ExpMonth,
+		ExpYear:    req.ExpYear,
+		CVV:        req.CVV,
+	})
+	var tokenErr *tokens.TokenError
+	switch {
+	case errors.As(err, &tokenErr) && tokenErr.Code == "INVALID_CARD":
+		respondError(w, http.StatusUnprocessableEntity, tokenErr.Message, tokenErr.Code)
+		return
+	case err != nil:
+		log.Printf("Failed to tokenize card for user %s: %v", req.UserID, err)
+		respondError(w, http.StatusBadGateway, "Card tokenization is temporarily unavailable", "TOKENIZATION_UNAVAILABLE")
+		return
+	case !tokenResp.Success || tokenResp.NetworkToken == nil:
+		respondError(w, http.StatusUnprocessableEntity, tokenResp.ErrorMessage, tokenResp.ErrorCode)
+		return
+	}
+
+	pm := paymentMethodFromToken(req, tokenResp.NetworkToken)
+	if tokenResp.FallbackInfo != nil {
+		log.Printf("Card for user %s stored in dual vault: %s", req.UserID, tokenResp.FallbackInfo.Reason)
+	}
+
+	if req.Verify {
+		verification, processorName, err := o.verifyPaymentMethod(ctx, pm, req.VerifyCurrency)
+		if err != nil {
+			log.Printf("Could not verify card for user %s: %v", req.UserID, err)
+			respondError(w, http.StatusServiceUnavailable, "Card verification is temporarily unavailable", "VERIFICATION_UNAVAILABLE")
+			return
+		}
+		if !verification.Success {
+			log.Printf("Card for user %s failed verification with %s: %s", req.UserID, processorName, verification.ErrorCode)
+			respondError(w, http.StatusPaymentRequired, mapErrorToUserMessage(verification.ErrorCode), verification.ErrorCode)
+			return
+		}
+		verifiedAt := time.Now().UTC()
+		pm.VerifiedAt = &verifiedAt
+	}
+
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if !pm.IsDefault {
+			hasDefault, err := o.db.HasDefaultPaymentMethodTx(ctx, tx, pm.UserID)
+			if err != nil {
+				return err
+			}
+			pm.IsDefault = !hasDefault
+		}
+		return o.db.CreatePaymentMethodTx(ctx, tx, pm)
+	})
+	if err != nil {
+		log.Printf("Failed to store payment method for user %s: %v", req.UserID, err)
+		http.Error(w, "Failed to store payment method", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Attached %s payment method %s for user %s", pm.TokenType, pm.ID, pm.UserID)
+	respondJSON(w, http.StatusCreated, paymentMethodResponse(pm))
+}
+
+// paymentMethodFromToken builds the payment method stored for a tokenized card
+func paymentMethodFromToken(req AttachPaymentMethodRequest, token *tokens.NetworkToken) *PaymentMethod {
+	pm := &PaymentMethod{
+		ID:              uuid.New().String(),
+		UserID:          req.UserID,
+		TokenType:       token.TokenType,
+		LastFour:        token.LastFour,
+		CardBrand:       token.Brand,
+		CardCountry:     req.CardCountry,
+		ExpMonth:        req.ExpMonth,
+		ExpYear:         req.ExpYear,
+		IsDefault:       req.SetDefault,
+		ProcessorTokens: map[string]string{},
+		CreatedAt:       time.Now().UTC(),
+		TokenStatus:     tokens.TokenStatusActive,
+	}
+
+	if token.TokenType == "network" {
+		pm.NetworkToken = token.NetworkToken
+		return pm
+	}
+
+	pm.ProcessorAToken = token.ProcessorAToken
+	pm.ProcessorBToken = token.ProcessorBToken
+	if token.ProcessorAToken != "" {
+		pm.ProcessorTokens["processor_a"] = token.ProcessorAToken
+	}
+	if token.ProcessorBToken != "" {
+		pm.ProcessorTokens["processor_b"] = token.ProcessorBToken
+	}
+	return pm
+}
+
+// verifyPaymentMethod runs a zero-amount verification with the first
+// configured processor that gives a definitive answer
+func (o *PaymentOrchestrator) verifyPaymentMethod(ctx context.Context, pm *PaymentMethod, currency string) (*processor.VerifyResponse, string, error) {
+	var lastErr error
+	for _, processorName := range o.processors.GetProcessorNames() {
+		client, err := o.processors.GetProcessor(processorName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		networkToken, processorToken, err := selectToken(pm, processorName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := client.Verify(ctx, &processor.VerifyRequest{
+			Currency:       currency,
+			IdempotencyKey: "verify_" + pm.ID,
+			NetworkToken:   networkToken,
+			ProcessorToken: processorToken,
+		})
+		if err == nil {
+			return resp, processorName, nil
+		}
+		log.Printf("Verification with %s failed: %v", processorName, err)
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no processors configured")
+	}
+	return nil, "", lastErr
+}
+
+// listPaymentMethods returns a user's attached payment methods (?user_id=)
+func (o *PaymentOrchestrator) listPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if _, err := uuid.Parse(userID); err != nil {
+		respondError(w, http.StatusBadRequest, "user_id must be a UUID", "INVALID_REQUEST")
+		return
+	}
+
+	methods, err := o.db.ListPaymentMethods(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to list payment methods for user %s: %v", userID, err)
+		http.Error(w, "Failed to list payment methods", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]*PaymentMethodResponse, 0, len(methods))
+	for _, pm := range methods {
+		response = append(response, paymentMethodResponse(pm))
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"payment_methods": response,
+	})
+}
+
+func (o *PaymentOrchestrator) getPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		respondError(w, http.StatusNotFound, "Payment method not found", "PAYMENT_METHOD_NOT_FOUND")
+		return
+	}
+
+	pm, err := o.db.GetPaymentMethod(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Payment method not found", "PAYMENT_METHOD_NOT_FOUND")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load payment method: %v", err)
+		http.Error(w, "Failed to load payment method", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, paymentMethodResponse(pm))
+}
+
+// errPaymentMethodRejected carries the response for a payment method that
+// can't be changed as asked
+type errPaymentMethodRejected struct {
+	status  int
+	message string
+	code    string
+}
+
+func (e *errPaymentMethodRejected) Error() string { return e.message }
+
+// updatePaymentMethod locks a payment method and applies change to it,
+// answering with the method as it ends up
+func (o *PaymentOrchestrator) updatePaymentMethod(w http.ResponseWriter, r *http.Request, action string, change func(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		respondError(w, http.StatusNotFound, "Payment method not found", "PAYMENT_METHOD_NOT_FOUND")
+		return
+	}
+
+	ctx := r.Context()
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		pm, err := o.db.GetPaymentMethodForUpdate(ctx, tx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &errPaymentMethodRejected{http.StatusNotFound, "Payment method not found", "PAYMENT_METHOD_NOT_FOUND"}
+		}
+		if err != nil {
+			return err
+		}
+		if pm.DetachedAt != nil {
+			return &errPaymentMethodRejected{http.StatusConflict, "Payment method has been detached", "PAYMENT_METHOD_DETACHED"}
+		}
+		return change(ctx, tx, pm)
+	})
+
+	var rejected *errPaymentMethodRejected
+	if errors.As(err, &rejected) {
+		respondError(w, rejected.status, rejected.message, rejected.code)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to %s payment method %s: %v", action, id, err)
+		http.Error(w, "Failed to update payment method", http.StatusInternalServerError)
+		return
+	}
+
+	pm, err := o.db.GetPaymentMethod(ctx, id)
+	if err != nil {
+		log.Printf("Failed to reload payment method %s: %v", id, err)
+		http.Error(w, "Failed to load payment method", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, paymentMethodResponse(pm))
+}
+
+// setDefaultPaymentMethod makes a payment method its user's default
+// (POST /payment-methods/{id}/default)
+func (o *PaymentOrchestrator) setDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	o.updatePaymentMethod(w, r, "set default", func(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error {
+		if pm.IsDefault {
+			return nil
+		}
+		return o.db.SetDefaultPaymentMethodTx(ctx, tx, pm)
+	})
+}
+
+// detachPaymentMethod removes a payment method from its user
+// (DELETE /payment-methods/{id}). Methods a billing subscription charges
+// must be replaced on the subscription first.
+func (o *PaymentOrchestrator) detachPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	o.updatePaymentMethod(w, r, "detach", func(ctx context.Context, tx *sql.Tx, pm *PaymentMethod) error {
+		inUse, err := o.db.PaymentMethodInUseTx(ctx, tx, pm.ID)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return &errPaymentMethodRejected{http.StatusConflict,
+				"Payment method is used by a subscription; switch the subscription to another method first",
+				"PAYMENT_METHOD_IN_USE"}
+		}
+		return o.db.DetachPaymentMethodTx(ctx, tx, pm)
+	})
+}
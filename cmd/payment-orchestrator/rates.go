@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/fx"
+)
+
+// RateTableResponse is the current FX rate table and where it came from
+type RateTableResponse struct {
+	Source   string       `json:"source"`
+	LoadedAt time.Time    `json:"loaded_at"`
+	Table    fx.RateTable `json:"table"`
+}
+
+// rateFilePath is where the FX rate table is loaded from at startup and on reload
+func rateFilePath(cfg *Config) string {
+	return filepath.Join(cfg.ConfigPath, "fx-rates.yaml")
+}
+
+// loadFXRates creates the rate service from the rate file. Without a file
+// only same-currency charges can be settled.
+func loadFXRates(cfg *Config) *fx.Service {
+	service := fx.NewService(cfg.FXRateMaxAge)
+	if err := service.LoadFile(rateFilePath(cfg)); err != nil {
+		log.Printf("Warning: %v, no exchange rates loaded", err)
+	}
+	return service
+}
+
+// getFXRates returns the rate table in use
+func (o *PaymentOrchestrator) getFXRates(w http.ResponseWriter, r *http.Request) {
+	table, source, loadedAt := o.fx.Snapshot()
+	respondJSON(w, http.StatusOK, RateTableResponse{
+		Source:   source,
+		LoadedAt: loadedAt,
+		Table:    table,
+	})
+}
+
+// putFXRates replaces the whole rate table
+func (o *PaymentOrchestrator) putFXRates(w http.ResponseWriter, r *http.Request) {
+	var table fx.RateTable
+	if err := json.NewDecoder(r.Body).Decode(&table); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rate table", "INVALID_REQUEST")
+		return
+	}
+
+	if err := o.fx.SetRates(&table, "admin_api"); err != nil {
+		respondError(w, http.StatusUnprocessableEntity, err.Error(), "INVALID_RATE_TABLE")
+		return
+	}
+
+	log.Printf("FX rate table replaced through admin API: %d rates as of %s", len(table.Rates), table.AsOf.Format(time.RFC3339))
+	o.getFXRates(w, r)
+}
+
+// reloadFXRates re-reads the rate file
+func (o *PaymentOrchestrator) reloadFXRates(w http.ResponseWriter, r *http.Request) {
+	if err := o.fx.LoadFile(o.rateFile); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, fx.ErrInvalidRate) {
+			status = http.StatusUnprocessableEntity
+		}
+		respondError(w, status, err.Error(), "RATE_RELOAD_FAILED")
+		return
+	}
+
+	log.Printf("FX rate table reloaded from %s", o.rateFile)
+	o.getFXRates(w, r)
+}
+
+// settlementQuote picks the settlement currency for a new payment and
+// quotes the rate from the presentment currency
+func (o *PaymentOrchestrator) settlementQuote(presentment, requested string) (fx.Quote, error) {
+	settlement := requested
+	if settlement == "" {
+		settlement = o.settlementCurrency
+	}
+	if settlement == "" {
+		settlement = presentment
+	}
+	return o.fx.Quote(presentment, settlement)
+}
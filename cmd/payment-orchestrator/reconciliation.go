@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// Reconciliation run states
+const (
+	ReconciliationRunning   = "running"
+	ReconciliationCompleted = "completed"
+	ReconciliationFailed    = "failed"
+)
+
+// Discrepancy kinds
+const (
+	DiscrepancyMissing        = "missing"         // We recorded a successful transaction the processor did not settle
+	DiscrepancyExtra          = "extra"           // The processor settled a transaction we have no record of
+	DiscrepancyAmountMismatch = "amount_mismatch" // Amount or currency differ
+	DiscrepancyStatusMismatch = "status_mismatch" // Settled, but our record is not a successful transaction of the same type
+)
+
+// SettlementStatusSettled is the status of a settled line in a settlement file
+const SettlementStatusSettled = "settled"
+
+// SettlementTotal sums a settlement file in one currency
+type SettlementTotal struct {
+	Gross int64 `json:"gross_minor"` // Payments less refunds
+	Fees  int64 `json:"fees_minor"`
+	Net   int64 `json:"net_minor"` // What the processor pays out
+}
+
+// ReconciliationRun is one processor settlement file checked against our transactions
+type ReconciliationRun struct {
+	ID                  string                     `json:"id"`
+	Processor           string                     `json:"processor"`
+	SettlementDate      string                     `json:"settlement_date"` // UTC day, YYYY-MM-DD
+	Status              string                     `json:"status"`
+	RecordCount         int                        `json:"record_count"`
+	MatchedCount        int                        `json:"matched_count"`
+	MissingCount        int                        `json:"missing_count"`
+	ExtraCount          int                        `json:"extra_count"`
+	AmountMismatchCount int                        `json:"amount_mismatch_count"`
+	StatusMismatchCount int                        `json:"status_mismatch_count"`
+	Totals              map[string]SettlementTotal `json:"totals"` // By currency
+	Error               string                     `json:"error,omitempty"`
+	StartedAt           time.Time                  `json:"started_at"`
+	CompletedAt         *time.Time                 `json:"completed_at,omitempty"`
+}
+
+// DiscrepancySide is what one party has for a transaction
+type DiscrepancySide struct {
+	Type     string `json:"type"`
+	Status   string `json:"status"`
+	Amount   int64  `json:"amount_minor"`
+	Currency string `json:"currency"`
+}
+
+// Discrepancy is a transaction our records and the processor disagree on.
+// Recorded is absent for extra transactions, Settled for missing ones.
+type Discrepancy struct {
+	Kind                   string           `json:"kind"`
+	ProcessorTransactionID string           `json:"processor_transaction_id"`
+	TransactionID          string           `json:"transaction_id,omitempty"`
+	Recorded               *DiscrepancySide `json:"recorded,omitempty"`
+	Settled                *DiscrepancySide `json:"settled,omitempty"`
+}
+
+// ReconciliationReport is a run with the discrepancies it found
+type ReconciliationReport struct {
+	*ReconciliationRun
+	Discrepancies []*Discrepancy `json:"discrepancies"`
+}
+
+func recordedSide(t *Transaction) *DiscrepancySide {
+	return &DiscrepancySide{Type: t.TransactionType, Status: t.Status, Amount: t.Amount, Currency: t.Currency}
+}
+
+func settledSide(r *processor.SettlementRecord) *DiscrepancySide {
+	return &DiscrepancySide{Type: r.Type, Status: r.Status, Amount: r.Amount, Currency: r.Currency}
+}
+
+// reconcileSettlement matches settlement lines against our transactions.
+// known holds our transactions by processor transaction ID; expected are
+// those the processor should have settled on the day. A transaction made
+// just before midnight may settle on the next day's file and show up here
+// as missing.
+func reconcileSettlement(records []processor.SettlementRecord, known map[string]*Transaction, expected []*Transaction) ([]*Discrepancy, int) {
+	discrepancies := []*Discrepancy{}
+	matched := 0
+	seen := make(map[string]bool, len(records))
+
+	for i := range records {
+		record := &records[i]
+		t := known[record.TransactionID]
+		if t == nil || seen[record.TransactionID] {
+			// Unknown, or settled twice
+			discrepancies = append(discrepancies, &Discrepancy{
+				Kind:                   DiscrepancyExtra,
+				ProcessorTransactionID: record.TransactionID,
+				Settled:                settledSide(record),
+			})
+			continue
+		}
+		seen[record.TransactionID] = true
+
+		ok := true
+		if record.Type != t.TransactionType || record.Status != SettlementStatusSettled || t.Status != TransactionStatusSuccess {
+			discrepancies = append(discrepancies, &Discrepancy{
+				Kind:                   DiscrepancyStatusMismatch,
+				ProcessorTransactionID: record.TransactionID,
+				TransactionID:          t.ID,
+				Recorded:               recordedSide(t),
+				Settled:                settledSide(record),
+			})
+			ok = false
+		}
+		if record.Amount != t.Amount || record.Currency != t.Currency {
+			discrepancies = append(discrepancies, &Discrepancy{
+				Kind:                   DiscrepancyAmountMismatch,
+				ProcessorTransactionID: record.TransactionID,
+				TransactionID:          t.ID,
+				Recorded:               recordedSide(t),
+				Settled:                settledSide(record),
+			})
+			ok = false
+		}
+		if ok {
+			matched++
+		}
+	}
+
+	for _, t := range expected {
+		if !seen[t.ProcessorTransactionID] {
+			discrepancies = append(discrepancies, &Discrepancy{
+				Kind:                   DiscrepancyMissing,
+				ProcessorTransactionID: t.ProcessorTransactionID,
+				TransactionID:          t.ID,
+				Recorded:               recordedSide(t),
+			})
+		}
+	}
+
+	return discrepancies, matched
+}
+
+// settlementTotals sums a settlement file by currency
+func settlementTotals(records []processor.SettlementRecord) map[string]SettlementTotal {
+	totals := make(map[string]SettlementTotal)
+	for _, r := range records {
+		total := totals[r.Currency]
+		if r.Type == TransactionTypeRefund {
+			total.Gross -= r.Amount
+		} else {
+			total.Gross += r.Amount
+		}
+		total.Fees += r.Fee
+		total.Net += r.Net
+		totals[r.Currency] = total
+	}
+	return totals
+}
+
+// reconcile fetches a processor's settlement file for day and checks it
+// against our transactions. The run is recorded whether or not it succeeds.
+func (o *PaymentOrchestrator) reconcile(ctx context.Context, processorName string, day time.Time) (*ReconciliationRun, error) {
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &ReconciliationRun{
+		Processor:      processorName,
+		SettlementDate: day.Format("2006-01-02"),
+		Totals:         map[string]SettlementTotal{},
+	}
+	if err := o.db.CreateReconciliationRun(ctx, run); err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (*ReconciliationRun, error) {
+		if recordErr := o.db.FailReconciliationRun(ctx, run, err.Error()); recordErr != nil {
+			log.Printf("Failed to record failed reconciliation %s: %v", run.ID, recordErr)
+		}
+		return run, err
+	}
+
+	records, err := client.GetSettlementReport(ctx, day)
+	if err != nil {
+		return fail(fmt.Errorf("fetch settlement file: %w", err))
+	}
+
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, r.TransactionID)
+	}
+	known, err := o.db.GetTransactionsByProcessorIDs(ctx, processorName, ids)
+	if err != nil {
+		return fail(fmt.Errorf("load settled transactions: %w", err))
+	}
+	expected, err := o.db.ListSettleableTransactions(ctx, processorName, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return fail(fmt.Errorf("load expected transactions: %w", err))
+	}
+
+	discrepancies, matched := reconcileSettlement(records, known, expected)
+	run.RecordCount = len(records)
+	run.MatchedCount = matched
+	run.Totals = settlementTotals(records)
+	for _, d := range discrepancies {
+		switch d.Kind {
+		case DiscrepancyMissing:
+			run.MissingCount++
+		case DiscrepancyExtra:
+			run.ExtraCount++
+		case DiscrepancyAmountMismatch:
+			run.AmountMismatchCount++
+		case DiscrepancyStatusMismatch:
+			run.StatusMismatchCount++
+		}
+	}
+
+	if err := o.db.CompleteReconciliationRun(ctx, run, records, discrepancies); err != nil {
+		return fail(fmt.Errorf("store reconciliation: %w", err))
+	}
+
+	log.Printf("Reconciled %s settlement for %s: %d records, %d matched, %d missing, %d extra, %d amount and %d status mismatches",
+		processorName, run.SettlementDate, run.RecordCount, run.MatchedCount,
+		run.MissingCount, run.ExtraCount, run.AmountMismatchCount, run.StatusMismatchCount)
+	return run, nil
+}
+
+// reconcileLoop reconciles each processor's previous settlement day once
+// its file is final, delay after midnight UTC
+func (o *PaymentOrchestrator) reconcileLoop(interval, delay time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		day := time.Now().UTC().Add(-delay).Truncate(24*time.Hour).AddDate(0, 0, -1)
+		for _, name := range o.processors.GetProcessorNames() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			done, err := o.db.HasCompletedReconciliation(ctx, name, day.Format("2006-01-02"))
+			if err != nil {
+				log.Printf("Failed to check reconciliation for %s: %v", name, err)
+			} else if !done {
+				if _, err := o.reconcile(ctx, name, day); err != nil {
+					log.Printf("Reconciliation of %s for %s failed: %v", name, day.Format("2006-01-02"), err)
+				}
+			}
+			cancel()
+		}
+		<-ticker.C
+	}
+}
+
+// ReconciliationRequest starts a run; date defaults to yesterday (UTC)
+type ReconciliationRequest struct {
+	Processor string `json:"processor"`
+	Date      string `json:"date,omitempty"`
+}
+
+// createReconciliationRun reconciles a settlement day on demand, e.g. to
+// re-run one after a fix (POST /reconciliation/runs)
+func (o *PaymentOrchestrator) createReconciliationRun(w http.ResponseWriter, r *http.Request) {
+	var req ReconciliationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	if _, err := o.processors.GetProcessor(req.Processor); err != nil {
+		respondError(w, http.StatusBadRequest, "Unknown processor", "UNKNOWN_PROCESSOR")
+		return
+	}
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if req.Date != "" {
+		parsed, err := time.Parse("2006-01-02", req.Date)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "date must be YYYY-MM-DD", "INVALID_REQUEST")
+			return
+		}
+		day = parsed
+	}
+
+	run, err := o.reconcile(r.Context(), req.Processor, day)
+	if run == nil {
+		log.Printf("Failed to start reconciliation: %v", err)
+		http.Error(w, "Failed to start reconciliation", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, run.Error, "RECONCILIATION_FAILED")
+		return
+	}
+
+	o.respondReconciliationReport(w, r, run, http.StatusCreated)
+}
+
+// listReconciliationRuns lists runs (?processor=&date=&status=&limit=)
+func (o *PaymentOrchestrator) listReconciliationRuns(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := ReconciliationRunFilter{
+		Processor:      query.Get("processor"),
+		SettlementDate: query.Get("date"),
+		Status:         query.Get("status"),
+		Limit:          50,
+	}
+
+	if filter.SettlementDate != "" {
+		if _, err := time.Parse("2006-01-02", filter.SettlementDate); err != nil {
+			respondError(w, http.StatusBadRequest, "date must be YYYY-MM-DD", "INVALID_REQUEST")
+			return
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 200 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 200", "INVALID_REQUEST")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	runs, err := o.db.ListReconciliationRuns(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list reconciliation runs: %v", err)
+		http.Error(w, "Failed to list reconciliation runs", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"runs":  runs,
+		"count": len(runs),
+	})
+}
+
+// getReconciliationReport returns a run with its discrepancies (?kind= filters them)
+func (o *PaymentOrchestrator) getReconciliationReport(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(id); err != nil {
+		respondError(w, http.StatusNotFound, "Reconciliation run not found", "RUN_NOT_FOUND")
+		return
+	}
+
+	run, err := o.db.GetReconciliationRun(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Reconciliation run not found", "RUN_NOT_FOUND")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load reconciliation run %s: %v", id, err)
+		http.Error(w, "Failed to load reconciliation run", http.StatusInternalServerError)
+		return
+	}
+
+	o.respondReconciliationReport(w, r, run, http.StatusOK)
+}
+
+func (o *PaymentOrchestrator) respondReconciliationReport(w http.ResponseWriter, r *http.Request, run *ReconciliationRun, status int) {
+	discrepancies, err := o.db.ListDiscrepancies(r.Context(), run.ID, r.URL.Query().Get("kind"))
+	if err != nil {
+		log.Printf("Failed to load discrepancies for run %s: %v", run.ID, err)
+		http.Error(w, "Failed to load discrepancies", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, status, ReconciliationReport{
+		ReconciliationRun: run,
+		Discrepancies:     discrepancies,
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// recordedTransaction is a successful transaction of ours with a processor ID
+func recordedTransaction(id, processorID, transactionType string, amount int64, currency string) *Transaction {
+	return &Transaction{
+		ID:                     id,
+		ProcessorTransactionID: processorID,
+		TransactionType:        transactionType,
+		Status:                 TransactionStatusSuccess,
+		Amount:                 amount,
+		Currency:               currency,
+	}
+}
+
+func settlementLine(processorID, transactionType string, amount int64, currency string) processor.SettlementRecord {
+	return processor.SettlementRecord{
+		TransactionID: processorID,
+		Type:          transactionType,
+		Status:        SettlementStatusSettled,
+		Amount:        amount,
+		Currency:      currency,
+	}
+}
+
+func TestReconcileSettlement(t *testing.T) {
+	charge := recordedTransaction("txn_1", "pa_1", TransactionTypeCharge, 1999, "USD")
+	eurCharge := recordedTransaction("txn_2", "pa_2", TransactionTypeCharge, 5000, "EUR")
+	eurRefund := recordedTransaction("txn_3", "pa_r3", TransactionTypeRefund, 2000, "EUR")
+	failedCharge := recordedTransaction("txn_4", "pa_4", TransactionTypeCharge, 1999, "USD")
+	failedCharge.Status = TransactionStatusFailed
+
+	// discrepancy is the kind and processor ID of one expected discrepancy
+	type discrepancy struct {
+		kind        string
+		processorID string
+	}
+
+	tests := []struct {
+		name        string
+		records     []processor.SettlementRecord
+		known       []*Transaction
+		expected    []*Transaction
+		want        []discrepancy
+		wantMatched int
+	}{
+		{
+			name:        "everything settled as recorded",
+			records:     []processor.SettlementRecord{settlementLine("pa_1", TransactionTypeCharge, 1999, "USD")},
+			known:       []*Transaction{charge},
+			expected:    []*Transaction{charge},
+			wantMatched: 1,
+		},
+		{
+			name:     "recorded but not settled",
+			known:    []*Transaction{charge},
+			expected: []*Transaction{charge},
+			want:     []discrepancy{{DiscrepancyMissing, "pa_1"}},
+		},
+		{
+			name:    "settled but never recorded",
+			records: []processor.SettlementRecord{settlementLine("pa_unknown", TransactionTypeCharge, 1999, "USD")},
+			want:    []discrepancy{{DiscrepancyExtra, "pa_unknown"}},
+		},
+		{
+			name: "settled twice",
+			records: []processor.SettlementRecord{
+				settlementLine("pa_1", TransactionTypeCharge, 1999, "USD"),
+				settlementLine("pa_1", TransactionTypeCharge, 1999, "USD"),
+			},
+			known:       []*Transaction{charge},
+			expected:    []*Transaction{charge},
+			want:        []discrepancy{{DiscrepancyExtra, "pa_1"}},
+			wantMatched: 1,
+		},
+		{
+			name:     "settled for a different amount",
+			records:  []processor.SettlementRecord{settlementLine("pa_1", TransactionTypeCharge, 1990, "USD")},
+			known:    []*Transaction{charge},
+			expected: []*Transaction{charge},
+			want:     []discrepancy{{DiscrepancyAmountMismatch, "pa_1"}},
+		},
+		{
+			name:     "settled in a different currency",
+			records:  []processor.SettlementRecord{settlementLine("pa_2", TransactionTypeCharge, 5000, "USD")},
+			known:    []*Transaction{eurCharge},
+			expected: []*Transaction{eurCharge},
+			want:     []discrepancy{{DiscrepancyAmountMismatch, "pa_2"}},
+		},
+		{
+			name:    "settled a transaction we recorded as failed",
+			records: []processor.SettlementRecord{settlementLine("pa_4", TransactionTypeCharge, 1999, "USD")},
+			known:   []*Transaction{failedCharge},
+			want:    []discrepancy{{DiscrepancyStatusMismatch, "pa_4"}},
+		},
+		{
+			name:     "settled as a different type",
+			records:  []processor.SettlementRecord{settlementLine("pa_1", TransactionTypeRefund, 1999, "USD")},
+			known:    []*Transaction{charge},
+			expected: []*Transaction{charge},
+			want:     []discrepancy{{DiscrepancyStatusMismatch, "pa_1"}},
+		},
+		{
+			name: "settlement line not settled",
+			records: []processor.SettlementRecord{{
+				TransactionID: "pa_1", Type: TransactionTypeCharge, Status: "failed", Amount: 1999, Currency: "USD",
+			}},
+			known:    []*Transaction{charge},
+			expected: []*Transaction{charge},
+			want:     []discrepancy{{DiscrepancyStatusMismatch, "pa_1"}},
+		},
+		{
+			name:    "wrong status and amount are both reported",
+			records: []processor.SettlementRecord{settlementLine("pa_4", TransactionTypeCharge, 999, "USD")},
+			known:   []*Transaction{failedCharge},
+			want:    []discrepancy{{DiscrepancyStatusMismatch, "pa_4"}, {DiscrepancyAmountMismatch, "pa_4"}},
+		},
+		{
+			name: "refund settled in the charge currency",
+			records: []processor.SettlementRecord{
+				settlementLine("pa_2", TransactionTypeCharge, 5000, "EUR"),
+				settlementLine("pa_r3", TransactionTypeRefund, 2000, "EUR"),
+			},
+			known:       []*Transaction{eurCharge, eurRefund},
+			expected:    []*Transaction{eurCharge, eurRefund},
+			wantMatched: 2,
+		},
+		{
+			name: "refund settled in the processor's default currency",
+			records: []processor.SettlementRecord{
+				settlementLine("pa_2", TransactionTypeCharge, 5000, "EUR"),
+				settlementLine("pa_r3", TransactionTypeRefund, 2000, "USD"),
+			},
+			known:       []*Transaction{eurCharge, eurRefund},
+			expected:    []*Transaction{eurCharge, eurRefund},
+			want:        []discrepancy{{DiscrepancyAmountMismatch, "pa_r3"}},
+			wantMatched: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			known := make(map[string]*Transaction, len(tt.known))
+			for _, transaction := range tt.known {
+				known[transaction.ProcessorTransactionID] = transaction
+			}
+
+			discrepancies, matched := reconcileSettlement(tt.records, known, tt.expected)
+
+			var got []discrepancy
+			for _, d := range discrepancies {
+				got = append(got, discrepancy{d.Kind, d.ProcessorTransactionID})
+				if (d.Recorded == nil) != (d.Kind == DiscrepancyExtra) {
+					t.Errorf("%s discrepancy for %s: recorded side %+v", d.Kind, d.ProcessorTransactionID, d.Recorded)
+				}
+				if (d.Settled == nil) != (d.Kind == DiscrepancyMissing) {
+					t.Errorf("%s discrepancy for %s: settled side %+v", d.Kind, d.ProcessorTransactionID, d.Settled)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discrepancies = %v, want %v", got, tt.want)
+			}
+			if matched != tt.wantMatched {
+				t.Errorf("matched = %d, want %d", matched, tt.wantMatched)
+			}
+		})
+	}
+}
+
+func TestSettlementTotals(t *testing.T) {
+	records := []processor.SettlementRecord{
+		{Type: TransactionTypeCharge, Amount: 5000, Currency: "EUR", Fee: 150, Net: 4850},
+		{Type: TransactionTypeRefund, Amount: 2000, Currency: "EUR", Net: -2000},
+		{Type: TransactionTypeCharge, Amount: 1999, Currency: "USD", Fee: 88, Net: 1911},
+	}
+
+	want := map[string]SettlementTotal{
+		"EUR": {Gross: 3000, Fees: 150, Net: 2850},
+		"USD": {Gross: 1999, Fees: 88, Net: 1911},
+	}
+	if got := settlementTotals(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("settlementTotals = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// recoverTransactionsLoop periodically settles charges, authorizations,
+// captures and refunds left pending by a crash or marked unknown after a
+// lost processor response
+func (o *PaymentOrchestrator) recoverTransactionsLoop(cfg *Config) {
+	ticker := time.NewTicker(cfg.RecoveryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.RecoveryInterval)
+		o.recoverStuckTransactions(ctx, cfg)
+		cancel()
+	}
+}
+
+func (o *PaymentOrchestrator) recoverStuckTransactions(ctx context.Context, cfg *Config) {
+	cutoff := time.Now().Add(-cfg.RecoveryPendingAge)
+	transactions, err := o.db.GetStuckTransactions(ctx, cutoff, cfg.RecoveryMaxAttempts, 100)
+	if err != nil {
+		log.Printf("Failed to load stuck transactions: %v", err)
+		return
+	}
+
+	for _, t := range transactions {
+		attempts, err := o.db.RecordRecoveryAttempt(ctx, t.ID)
+		if err != nil {
+			log.Printf("Failed to record recovery attempt for %s: %v", t.ID, err)
+			continue
+		}
+
+		if !o.recoverTransaction(ctx, t) && attempts >= cfg.RecoveryMaxAttempts {
+			log.Printf("Transaction %s still unsettled after %d attempts, needs manual review", t.ID, attempts)
+		}
+	}
+}
+
+// recoverTransaction asks each processor what happened to a stuck charge,
+// starting with the one it was last sent to. It reports whether the
+// transaction was settled.
+func (o *PaymentOrchestrator) recoverTransaction(ctx context.Context, t *Transaction) bool {
+	ctx = audit.WithTransactionID(ctx, t.ID)
+	switch t.TransactionType {
+	case TransactionTypeAuthorization:
+		return o.recoverAuthorization(ctx, t)
+	case TransactionTypeRefund:
+		return o.recoverRefund(ctx, t)
+	case TransactionTypeCapture:
+		return o.recoverCapture(ctx, t)
+	}
+
+	unreachable := false
+	var decline *processor.ChargeResponse
+	var declinedBy string
+	for _, name := range o.recoveryOrder(t) {
+		client, err := o.processors.GetProcessor(name)
+		if err != nil {
+			continue
+		}
+
+		resp, err := client.LookupCharge(ctx, t.IdempotencyKey)
+		switch {
+		case errors.Is(err, processor.ErrChargeNotFound):
+			continue
+		case err != nil:
+			log.Printf("Could not check charge %s with %s: %v", t.ID, name, err)
+			unreachable = true
+		case resp.RequiresAction():
+			// The charge reached the processor and waits on the cardholder
+			return o.settleRecovered(ctx, t, TransactionStatusRequiresAction, TransactionUpdate{
+				ProcessorUsed:      name,
+				ThreeDSChallengeID: resp.ThreeDS.ID,
+				ThreeDSRedirectURL: resp.ThreeDS.RedirectURL,
+			})
+		case resp.Success:
+			return o.settleRecovered(ctx, t, TransactionStatusSuccess, TransactionUpdate{
+				ProcessorUsed:          name,
+				ProcessorTransactionID: resp.TransactionID,
+			})
+		default:
+			decline, declinedBy = resp, name
+		}
+	}
+
+	// A processor we couldn't reach may have charged the card
+	if unreachable {
+		if t.Status == TransactionStatusPending {
+			o.settleRecovered(ctx, t, TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"})
+		}
+		return false
+	}
+
+	if decline != nil {
+		return o.settleRecovered(ctx, t, TransactionStatusFailed, TransactionUpdate{
+			ProcessorUsed: declinedBy,
+			ErrorCode:     decline.ErrorCode,
+			ErrorMessage:  mapErrorToUserMessage(decline.ErrorCode),
+		})
+	}
+
+	// No processor received the charge, so no money moved
+	return o.settleRecovered(ctx, t, TransactionStatusFailed, TransactionUpdate{
+		ErrorCode:    "NOT_PROCESSED",
+		ErrorMessage: mapErrorToUserMessage("NOT_PROCESSED"),
+	})
+}
+
+// recoverAuthorization asks each processor whether a stuck authorization
+// placed a hold, the same way recoverTransaction does for charges
+func (o *PaymentOrchestrator) recoverAuthorization(ctx context.Context, t *Transaction) bool {
+	unreachable := false
+	var decline *processor.AuthorizeResponse
+	var declinedBy string
+	for _, name := range o.recoveryOrder(t) {
+		client, err := o.processors.GetProcessor(name)
+		if err != nil {
+			continue
+		}
+
+		resp, err := client.LookupAuthorization(ctx, t.IdempotencyKey)
+		switch {
+		case errors.Is(err, processor.ErrAuthorizationNotFound):
+			continue
+		case err != nil:
+			log.Printf("Could not check authorization %s with %s: %v", t.ID, name, err)
+			unreachable = true
+		case resp.Success:
+			expiresAt := resp.ExpiresAt
+			return o.settleRecovered(ctx, t, AuthStatusAuthorized, TransactionUpdate{
+				ProcessorUsed:          name,
+				ProcessorTransactionID: resp.AuthorizationID,
+				AuthExpiresAt:          &expiresAt,
+			})
+		default:
+			decline, declinedBy = resp, name
+		}
+	}
+
+	// A processor we couldn't reach may have placed the hold
+	if unreachable {
+		if t.Status == TransactionStatusPending {
+			o.settleRecovered(ctx, t, TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"})
+		}
+		return false
+	}
+
+	if decline != nil {
+		return o.settleRecovered(ctx, t, TransactionStatusFailed, TransactionUpdate{
+			ProcessorUsed: declinedBy,
+			ErrorCode:     decline.ErrorCode,
+			ErrorMessage:  mapErrorToUserMessage(decline.ErrorCode),
+		})
+	}
+
+	// No processor received the authorization, so no hold was placed
+	return o.settleRecovered(ctx, t, TransactionStatusFailed, TransactionUpdate{
+		ErrorCode:    "NOT_PROCESSED",
+		ErrorMessage: mapErrorToUserMessage("NOT_PROCESSED"),
+	})
+}
+
+// recoverRefund asks the processor a stuck refund was sent to whether it
+// paid it out. Refunds only ever go to the processor that took the payment.
+func (o *PaymentOrchestrator) recoverRefund(ctx context.Context, t *Transaction) bool {
+	client, err := o.processors.GetProcessor(t.ProcessorUsed)
+	if err != nil {
+		log.Printf("Cannot recover refund %s: %v", t.ID, err)
+		return false
+	}
+
+	resp, err := client.LookupRefund(ctx, t.IdempotencyKey)
+	status, update := refundOutcome(resp, false)
+	switch {
+	case errors.Is(err, processor.ErrRefundNotFound):
+		// The processor never received the refund, so nothing was paid out
+		update = TransactionUpdate{ErrorCode: "NOT_PROCESSED", ErrorMessage: mapErrorToUserMessage("NOT_PROCESSED")}
+	case err != nil:
+		log.Printf("Could not check refund %s with %s: %v", t.ID, t.ProcessorUsed, err)
+		if t.Status != TransactionStatusPending {
+			return false
+		}
+		status, update = TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"}
+	}
+
+	previous := t.Status
+	if _, err := o.settleRefund(ctx, t, status, update); err != nil {
+		log.Printf("Failed to settle recovered transaction %s as %s: %v", t.ID, status, err)
+		return false
+	}
+	log.Printf("Recovered transaction %s: %s -> %s", t.ID, previous, status)
+	return status != TransactionStatusUnknown
+}
+
+// recoverCapture asks the processor holding the authorization whether a
+// stuck capture collected the funds
+func (o *PaymentOrchestrator) recoverCapture(ctx context.Context, t *Transaction) bool {
+	client, err := o.processors.GetProcessor(t.ProcessorUsed)
+	if err != nil {
+		log.Printf("Cannot recover capture %s: %v", t.ID, err)
+		return false
+	}
+
+	resp, err := client.LookupCapture(ctx, t.IdempotencyKey)
+	status, update := captureOutcome(resp, false)
+	switch {
+	case errors.Is(err, processor.ErrCaptureNotFound):
+		// The processor never received the capture, so no funds moved
+		update = TransactionUpdate{ErrorCode: "NOT_PROCESSED", ErrorMessage: mapErrorToUserMessage("NOT_PROCESSED")}
+	case err != nil:
+		log.Printf("Could not check capture %s with %s: %v", t.ID, t.ProcessorUsed, err)
+		if t.Status != TransactionStatusPending {
+			return false
+		}
+		status, update = TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"}
+	}
+
+	previous := t.Status
+	if _, err := o.settleCapture(ctx, t, status, update, resp); err != nil {
+		log.Printf("Failed to settle recovered transaction %s as %s: %v", t.ID, status, err)
+		return false
+	}
+	log.Printf("Recovered transaction %s: %s -> %s", t.ID, previous, status)
+	return status != TransactionStatusUnknown
+}
+
+// recoveryOrder lists the processors to ask about a stuck transaction,
+// starting with the one it was last sent to
+func (o *PaymentOrchestrator) recoveryOrder(t *Transaction) []string {
+	names := []string{t.ProcessorUsed}
+	for _, name := range o.processors.GetProcessorNames() {
+		if name != t.ProcessorUsed {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// settleRecovered applies the recovered outcome and reports a charge's like a live charge
+func (o *PaymentOrchestrator) settleRecovered(ctx context.Context, t *Transaction, status string, update TransactionUpdate) bool {
+	processorUsed := t.ProcessorUsed
+	if update.ProcessorUsed != "" {
+		processorUsed = update.ProcessorUsed
+	}
+
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := o.db.TransitionTransactionTx(ctx, tx, t.ID, status, update); err != nil {
+			return err
+		}
+		if t.TransactionType != TransactionTypeCharge {
+			return nil
+		}
+		switch status {
+		case TransactionStatusSuccess:
+			return o.events.EmitChargeSucceeded(ctx, tx, t.ID, t.SubscriptionID, t.Money(),
+				processorUsed, time.Since(t.CreatedAt))
+		case TransactionStatusFailed:
+			return o.events.EmitChargeFailed(ctx, tx, t.ID, t.SubscriptionID, t.Money(),
+				processorUsed, update.ErrorCode, update.ErrorMessage)
+		case TransactionStatusRequiresAction:
+			return o.events.EmitChargeRequiresAction(ctx, tx, t.ID, t.SubscriptionID, t.Money(), processorUsed)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to settle recovered transaction %s as %s: %v", t.ID, status, err)
+		return false
+	}
+
+	log.Printf("Recovered transaction %s: %s -> %s", t.ID, t.Status, status)
+	return status != TransactionStatusUnknown
+}
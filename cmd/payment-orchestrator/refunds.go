@@ -1,26 +1,61 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/money"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
 )
 
+// RefundRequest refunds part or all of a transaction, in its currency
 type RefundRequest struct {
-	TransactionID string  `json:"transaction_id"`
-	Amount        float64 `json:"amount"`
-	Reason        string  `json:"reason"`
+	TransactionID  string  `json:"transaction_id"`
+	AmountMinor    int64   `json:"amount_minor,omitempty"`
+	Amount         float64 `json:"amount,omitempty"` // Deprecated: use amount_minor
+	Reason         string  `json:"reason"`
+	IdempotencyKey string  `json:"idempotency_key,omitempty"`
 }
 
 type RefundResponse struct {
-	Success       bool    `json:"success"`
-	RefundID      string  `json:"refund_id"`
-	TransactionID string  `json:"transaction_id"`
-	Amount        float64 `json:"amount"`
-	ProcessorUsed string  `json:"processor_used"`
-	Message       string  `json:"message"`
+	Success              bool    `json:"success"`
+	RefundID             string  `json:"refund_id"`
+	TransactionID        string  `json:"transaction_id"`
+	AmountMinor          int64   `json:"amount_minor"`
+	Amount               float64 `json:"amount"` // Deprecated: use amount_minor
+	Currency             string  `json:"currency"`
+	ProcessorUsed        string  `json:"processor_used"`
+	Status               string  `json:"status"`
+	RefundedAmountMinor  int64   `json:"refunded_amount_minor"`
+	RefundedAmount       float64 `json:"refunded_amount"` // Deprecated: use refunded_amount_minor
+	RemainingAmountMinor int64   `json:"remaining_amount_minor"`
+	RemainingAmount      float64 `json:"remaining_amount"` // Deprecated: use remaining_amount_minor
+	ErrorCode            string  `json:"error_code,omitempty"`
+	Message              string  `json:"message"`
+
+	Settlement *SettlementDetails `json:"settlement,omitempty"`
+}
+
+// RefundListResponse lists the refunds made against a transaction
+type RefundListResponse struct {
+	TransactionID        string            `json:"transaction_id"`
+	AmountMinor          int64             `json:"amount_minor"`
+	Amount               float64           `json:"amount"` // Deprecated: use amount_minor
+	Currency             string            `json:"currency"`
+	RefundedAmountMinor  int64             `json:"refunded_amount_minor"`
+	RefundedAmount       float64           `json:"refunded_amount"` // Deprecated: use refunded_amount_minor
+	RemainingAmountMinor int64             `json:"remaining_amount_minor"`
+	RemainingAmount      float64           `json:"remaining_amount"` // Deprecated: use remaining_amount_minor
+	Refunds              []*RefundResponse `json:"refunds"`
 }
 
 func (o *PaymentOrchestrator) processRefund(w http.ResponseWriter, r *http.Request) {
@@ -30,94 +65,363 @@ func (o *PaymentOrchestrator) processRefund(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	ctx := r.Context()
-
-	// Get original transaction
-	transaction, err := o.db.GetTransaction(ctx, req.TransactionID)
-	if err != nil {
-		http.Error(w, "Transaction not found", http.StatusNotFound)
+	if req.TransactionID == "" || (req.AmountMinor <= 0 && req.Amount <= 0) {
+		respondError(w, http.StatusBadRequest, "transaction_id and a positive amount are required", "INVALID_REQUEST")
 		return
 	}
 
-	// Validate refund amount
-	if req.Amount > transaction.Amount {
-		http.Error(w, "Refund amount exceeds original transaction", http.StatusBadRequest)
+	// Without a client key a retry can't be told apart from a new refund
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = "refund_" + uuid.New().String()
+	}
+
+	lock := o.beginIdempotent(w, r, "refund", req.IdempotencyKey, req)
+	if lock == nil {
 		return
 	}
+	defer lock.Release()
 
-	// Route to original processor
-	var processor *ProcessorClient
-	switch transaction.ProcessorUsed {
-	case "processor_a":
-		processor = o.processorA
-	case "processor_b":
-		processor = o.processorB
-	default:
-		http.Error(w, "Unknown processor", http.StatusInternalServerError)
+	ctx := r.Context()
+
+	// Keys whose stored response has expired are still recorded on the refund
+	if existing, err := o.db.GetTransactionByIdempotencyKey(ctx, req.IdempotencyKey); err == nil {
+		requested, err := money.Resolve(req.AmountMinor, req.Amount, existing.Currency)
+		if err != nil || existing.TransactionType != TransactionTypeRefund ||
+			existing.OriginalTransactionID == nil || *existing.OriginalTransactionID != req.TransactionID ||
+			existing.Amount != requested.Amount {
+			respondError(w, http.StatusUnprocessableEntity, ErrIdempotencyMismatch.Error(), "IDEMPOTENCY_KEY_MISMATCH")
+			return
+		}
+		status := http.StatusOK
+		if existing.Status == TransactionStatusPending || existing.Status == TransactionStatusUnknown {
+			status = http.StatusAccepted
+		}
+		w.Header().Set("X-Idempotent-Replay", "true")
+		respondJSON(w, status, refundResponseFromTransaction(existing))
 		return
 	}
 
-	// Process refund
-	originalProcessorTxID := transaction.ProcessorTransactionID
-	if originalProcessorTxID == "" {
-		http.Error(w, "Original processor transaction ID missing", http.StatusUnprocessableEntity)
+	refund, transaction, client, ok := o.beginRefund(w, r, req)
+	if !ok {
 		return
 	}
 
-	refundReq := ProcessorRefundRequest{
-		OriginalTransactionID: originalProcessorTxID,
-		Amount:                req.Amount,
+	// The processor is called outside any transaction, so a slow refund
+	// doesn't hold the original's lock. Calls are audited against the refund.
+	refundCtx := audit.WithTransactionID(ctx, refund.ID)
+	refundResp, err := client.Refund(refundCtx, &processor.RefundRequest{
+		OriginalTransactionID: transaction.ProcessorTransactionID,
+		Amount:                refund.Amount,
+		Currency:              refund.Currency,
 		Reason:                req.Reason,
+		IdempotencyKey:        req.IdempotencyKey,
+	})
+	ambiguous := isAmbiguousFailure(err)
+	if ambiguous {
+		// The refund may have been paid out before the call failed, so ask
+		refundResp, err = client.LookupRefund(refundCtx, req.IdempotencyKey)
+		ambiguous = err != nil && !errors.Is(err, processor.ErrRefundNotFound)
+	}
+	if err != nil {
+		// An error body is not the processor's answer to the refund
+		log.Printf("Refund %s failed: %v", refund.ID, err)
+		refundResp = nil
 	}
 
-	refundResp, err := processor.Refund(ctx, refundReq)
+	status, update := refundOutcome(refundResp, ambiguous)
+	refunded, err := o.settleRefund(ctx, refund, status, update)
 	if err != nil {
-		log.Printf("Refund failed: %v", err)
-		http.Error(w, "Refund processing failed", http.StatusInternalServerError)
+		log.Printf("Failed to settle refund %s as %s, leaving it for recovery: %v", refund.ID, status, err)
+		http.Error(w, "Failed to record refund", http.StatusInternalServerError)
 		return
 	}
 
-	// Store refund transaction
-	refundTransaction := &Transaction{
+	response := refundResponseFromTransaction(refund)
+	response.setBalance(transaction.Amount, refunded)
+
+	switch {
+	case status == TransactionStatusSuccess:
+		respondIdempotent(w, lock, http.StatusCreated, response)
+	case status == TransactionStatusUnknown:
+		// Not stored against the idempotency key: retries read the settled refund
+		respondJSON(w, http.StatusAccepted, response)
+	case refundResp == nil:
+		respondError(w, http.StatusBadGateway, "Refund processing failed, please retry with a new idempotency key", "PROCESSOR_ERROR")
+	default:
+		respondIdempotent(w, lock, http.StatusUnprocessableEntity, response)
+	}
+}
+
+// beginRefund checks a refund against its original transaction and records
+// it as pending, so a crash or lost response while the processor handles it
+// leaves a row for the recoverer. Refunds still in flight count against
+// what is left to refund. It replies itself when the refund can't go ahead,
+// and otherwise returns the refund, its original and the processor to send it to.
+func (o *PaymentOrchestrator) beginRefund(w http.ResponseWriter, r *http.Request, req RefundRequest) (*Transaction, *Transaction, processor.ProcessorInterface, bool) {
+	ctx := r.Context()
+
+	// Lock the original so concurrent refunds can't exceed it
+	tx, err := o.db.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Failed to start refund", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	defer tx.Rollback()
+
+	transaction, err := o.db.GetTransactionForUpdate(ctx, tx, req.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Transaction not found", "TRANSACTION_NOT_FOUND")
+		return nil, nil, nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load transaction %s: %v", req.TransactionID, err)
+		http.Error(w, "Failed to load transaction", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	refundable := (transaction.TransactionType == TransactionTypeCharge || transaction.TransactionType == TransactionTypeCapture) &&
+		transaction.Status == TransactionStatusSuccess
+	if !refundable {
+		respondError(w, http.StatusConflict,
+			fmt.Sprintf("Cannot refund a %s %s transaction", transaction.Status, transaction.TransactionType),
+			"TRANSACTION_NOT_REFUNDABLE")
+		return nil, nil, nil, false
+	}
+
+	// The refund is in the currency of the original transaction
+	requested, err := resolveAmount(req.AmountMinor, req.Amount, transaction.Currency)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error(), "INVALID_AMOUNT")
+		return nil, nil, nil, false
+	}
+	amount := requested.Amount
+
+	// Validate refund amount against what is left after earlier refunds
+	inFlight, err := o.db.InFlightAmountTx(ctx, tx, transaction.ID, TransactionTypeRefund)
+	if err != nil {
+		log.Printf("Failed to load refunds in flight for %s: %v", transaction.ID, err)
+		http.Error(w, "Failed to load transaction", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	remaining := money.Money{Amount: transaction.Amount - transaction.RefundedAmount - inFlight, Currency: transaction.Currency}
+	if amount > remaining.Amount {
+		respondError(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("Refund amount exceeds remaining refundable amount %s", remaining),
+			"REFUND_EXCEEDS_REMAINING")
+		return nil, nil, nil, false
+	}
+
+	// Refunds convert back at the original transaction's rate, not today's
+	settlement, err := o.refundSettlement(ctx, tx, transaction, amount, remaining.Amount)
+	if err != nil {
+		log.Printf("Failed to convert refund of %s: %v", transaction.ID, err)
+		http.Error(w, "Failed to convert refund amount", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	if transaction.ProcessorTransactionID == "" {
+		http.Error(w, "Original processor transaction ID missing", http.StatusUnprocessableEntity)
+		return nil, nil, nil, false
+	}
+
+	// Refunds go to the processor that took the payment
+	client, err := o.processors.GetProcessor(transaction.ProcessorUsed)
+	if err != nil {
+		http.Error(w, "Unknown processor", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	refund := &Transaction{
 		ID:                    uuid.New().String(),
 		SubscriptionID:        transaction.SubscriptionID,
 		PaymentMethodID:       transaction.PaymentMethodID,
 		ProcessorUsed:         transaction.ProcessorUsed,
-		Amount:                -req.Amount, // Negative for refund
+		Amount:                amount,
 		Currency:              transaction.Currency,
-		Status:                "refunded",
-		TransactionType:       "refund",
-		IdempotencyKey:        "refund_" + uuid.New().String(),
-		OriginalTransactionID: &req.TransactionID,
+		Status:                TransactionStatusPending,
+		TransactionType:       TransactionTypeRefund,
+		IdempotencyKey:        req.IdempotencyKey,
+		OriginalTransactionID: &transaction.ID,
+		SettlementAmount:      settlement.Amount,
+		SettlementCurrency:    settlement.Currency,
+		FX:                    transaction.FX,
+	}
+	if err := o.db.CreateTransactionTx(ctx, tx, refund); err != nil {
+		log.Printf("Failed to record pending refund: %v", err)
+		respondError(w, http.StatusInternalServerError, "Unable to record refund, nothing was refunded", "TRANSACTION_RECORD_FAILED")
+		return nil, nil, nil, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit pending refund: %v", err)
+		respondError(w, http.StatusInternalServerError, "Unable to record refund, nothing was refunded", "TRANSACTION_RECORD_FAILED")
+		return nil, nil, nil, false
+	}
+
+	return refund, transaction, client, true
+}
+
+// refundOutcome returns the status and update that record a processor's
+// answer to a refund. Without an answer the refund is unknown if it may
+// have been paid out, and failed otherwise.
+func refundOutcome(resp *processor.RefundResponse, ambiguous bool) (string, TransactionUpdate) {
+	switch {
+	case resp == nil && ambiguous:
+		return TransactionStatusUnknown, TransactionUpdate{ErrorCode: "OUTCOME_UNKNOWN"}
+	case resp == nil:
+		return TransactionStatusFailed, TransactionUpdate{
+			ErrorCode:    "PROCESSOR_ERROR",
+			ErrorMessage: "Refund could not be sent to the processor",
+		}
 	}
+	return getStatus(resp.Success), TransactionUpdate{
+		ProcessorTransactionID: resp.RefundID,
+		ErrorCode:              resp.ErrorCode,
+		ErrorMessage:           resp.ErrorMessage,
+	}
+}
 
-	if err := o.db.CreateTransaction(ctx, refundTransaction); err != nil {
-		log.Printf("Failed to store refund transaction: %v", err)
+// settleRefund moves a pending refund to its outcome and returns the
+// original's refunded total afterwards. The refund is updated in place.
+func (o *PaymentOrchestrator) settleRefund(ctx context.Context, refund *Transaction, status string, update TransactionUpdate) (int64, error) {
+	var refunded int64
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		// Lock the original so the refunded total is read after this refund is added
+		original, err := o.db.GetTransactionForUpdate(ctx, tx, *refund.OriginalTransactionID)
+		if err != nil {
+			return err
+		}
+		if err := o.settleRefundTx(ctx, tx, refund, status, update); err != nil {
+			return err
+		}
+		refunded = original.RefundedAmount
+		if status == TransactionStatusSuccess {
+			refunded += refund.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	// Return response
-	response := RefundResponse{
-		Success:       refundResp.Success,
-		RefundID:      refundTransaction.ID,
-		TransactionID: req.TransactionID,
-		Amount:        req.Amount,
-		ProcessorUsed: transaction.ProcessorUsed,
-		Message:       "Refund processed successfully",
+	refund.Status = status
+	refund.ProcessorTransactionID = update.ProcessorTransactionID
+	refund.ErrorCode = update.ErrorCode
+	refund.UserErrorMessage = update.ErrorMessage
+	return refunded, nil
+}
+
+// settleRefundTx records a refund's outcome. A successful refund is added to
+// the original's refunded total, and a known outcome is reported in an event.
+func (o *PaymentOrchestrator) settleRefundTx(ctx context.Context, tx *sql.Tx, refund *Transaction, status string, update TransactionUpdate) error {
+	if err := o.db.TransitionTransactionTx(ctx, tx, refund.ID, status, update); err != nil {
+		return err
+	}
+	if status == TransactionStatusSuccess {
+		if err := o.db.AddRefundedAmountTx(ctx, tx, *refund.OriginalTransactionID, refund.Amount); err != nil {
+			return err
+		}
+	}
+	if status != TransactionStatusSuccess && status != TransactionStatusFailed {
+		return nil
+	}
+	return o.events.EmitRefundProcessed(ctx, tx, *refund.OriginalTransactionID, refund.Money(),
+		refund.ProcessorUsed, status == TransactionStatusSuccess)
+}
+
+// refundSettlement converts a refund at the original transaction's rate. The
+// refund that clears the remaining balance takes whatever settlement is
+// left, so rounding on earlier partial refunds never leaves a remainder.
+func (o *PaymentOrchestrator) refundSettlement(ctx context.Context, tx *sql.Tx, original *Transaction, amount, remaining int64) (money.Money, error) {
+	if amount < remaining {
+		return original.FX.Convert(money.Money{Amount: amount, Currency: original.Currency})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	settled, err := o.db.RefundedSettlementTx(ctx, tx, original.ID)
+	if err != nil {
+		return money.Money{}, err
+	}
+	return money.Money{Amount: original.SettlementAmount - settled, Currency: original.SettlementCurrency}, nil
 }
 
-func (o *PaymentOrchestrator) getStats(w http.ResponseWriter, r *http.Request) {
+// listRefunds returns the refunds made against a transaction and what is left to refund
+func (o *PaymentOrchestrator) listRefunds(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	transaction, err := o.db.GetTransaction(ctx, id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Transaction not found", "TRANSACTION_NOT_FOUND")
+		return
+	}
 
-	stats, err := o.db.GetTransactionStats(ctx)
+	refunds, err := o.db.ListRefunds(ctx, id)
 	if err != nil {
-		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		log.Printf("Failed to list refunds for %s: %v", id, err)
+		http.Error(w, "Failed to list refunds", http.StatusInternalServerError)
+		return
+	}
+
+	remaining := transaction.Amount - transaction.RefundedAmount
+	response := RefundListResponse{
+		TransactionID:        transaction.ID,
+		AmountMinor:          transaction.Amount,
+		Amount:               transaction.Money().Major(),
+		Currency:             transaction.Currency,
+		RefundedAmountMinor:  transaction.RefundedAmount,
+		RefundedAmount:       money.ToMajor(transaction.RefundedAmount, transaction.Currency),
+		RemainingAmountMinor: remaining,
+		RemainingAmount:      money.ToMajor(remaining, transaction.Currency),
+		Refunds:              make([]*RefundResponse, 0, len(refunds)),
+	}
+	for _, refund := range refunds {
+		response.Refunds = append(response.Refunds, refundResponseFromTransaction(refund))
+	}
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+// getRefund returns the status of a single refund
+func (o *PaymentOrchestrator) getRefund(w http.ResponseWriter, r *http.Request) {
+	refund, err := o.db.GetTransaction(r.Context(), mux.Vars(r)["id"])
+	if err != nil || refund.TransactionType != TransactionTypeRefund {
+		respondError(w, http.StatusNotFound, "Refund not found", "REFUND_NOT_FOUND")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	respondJSON(w, http.StatusOK, refundResponseFromTransaction(refund))
+}
+
+func refundResponseFromTransaction(t *Transaction) *RefundResponse {
+	response := &RefundResponse{
+		Success:       t.Status == TransactionStatusSuccess,
+		RefundID:      t.ID,
+		AmountMinor:   t.Amount,
+		Amount:        t.Money().Major(),
+		Currency:      t.Currency,
+		ProcessorUsed: t.ProcessorUsed,
+		Status:        t.Status,
+		ErrorCode:     t.ErrorCode,
+		Message:       "Refund processed successfully",
+		Settlement:    settlementDetails(t),
+	}
+	if t.OriginalTransactionID != nil {
+		response.TransactionID = *t.OriginalTransactionID
+	}
+	if t.Status == TransactionStatusPending || t.Status == TransactionStatusUnknown {
+		response.Message = "Refund is being confirmed with the processor"
+	} else if !response.Success {
+		response.Message = t.UserErrorMessage
+		if response.Message == "" {
+			response.Message = "Refund could not be processed"
+		}
+	}
+	return response
+}
+
+// setBalance fills in what has been refunded against the original and what is left
+func (r *RefundResponse) setBalance(originalAmount, refunded int64) {
+	r.RefundedAmountMinor = refunded
+	r.RefundedAmount = money.ToMajor(refunded, r.Currency)
+	r.RemainingAmountMinor = originalAmount - refunded
+	r.RemainingAmount = money.ToMajor(originalAmount-refunded, r.Currency)
 }
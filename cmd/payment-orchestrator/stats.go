@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+// CurrencyVolume is one currency's share of the transaction stats
+type CurrencyVolume struct {
+	CurrencyStats
+	NormalizedVolumeMinor *int64 `json:"normalized_volume_minor,omitempty"` // Nil when no rate is available
+}
+
+// TransactionStatsResponse summarizes transactions with volumes normalized to a reporting currency
+type TransactionStatsResponse struct {
+	ReportingCurrency     string           `json:"reporting_currency"`
+	Since                 time.Time        `json:"since"`
+	TotalTransactions     int64            `json:"total_transactions"`
+	Successful            int64            `json:"successful"`
+	Failed                int64            `json:"failed"`
+	SuccessRate           float64          `json:"success_rate"`
+	VolumeMinor           int64            `json:"volume_minor"`
+	AvgTransactionMinor   int64            `json:"avg_transaction_minor"`
+	ByCurrency            []CurrencyVolume `json:"by_currency"`
+	UnconvertedCurrencies []string         `json:"unconverted_currencies,omitempty"`
+}
+
+// transactionStats aggregates transactions since a point in time. Volumes
+// are converted to the reporting currency at the current mid-market rate;
+// currencies without a rate are listed and left out of the totals.
+func (o *PaymentOrchestrator) transactionStats(ctx context.Context, reportingCurrency string, since time.Time) (*TransactionStatsResponse, error) {
+	byCurrency, err := o.db.GetTransactionStatsByCurrency(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &TransactionStatsResponse{
+		ReportingCurrency: reportingCurrency,
+		Since:             since,
+		ByCurrency:        make([]CurrencyVolume, 0, len(byCurrency)),
+	}
+
+	var paymentCount int64
+	for _, c := range byCurrency {
+		stats.TotalTransactions += c.Transactions
+		stats.Successful += c.Successful
+		stats.Failed += c.Failed
+
+		volume := CurrencyVolume{CurrencyStats: c}
+		normalized, err := o.fx.ConvertMid(money.Money{Amount: c.VolumeMinor, Currency: c.Currency}, reportingCurrency)
+		if err != nil {
+			log.Printf("Cannot normalize %s volume to %s: %v", c.Currency, reportingCurrency, err)
+			stats.UnconvertedCurrencies = append(stats.UnconvertedCurrencies, c.Currency)
+		} else {
+			volume.NormalizedVolumeMinor = &normalized.Amount
+			stats.VolumeMinor += normalized.Amount
+			paymentCount += c.Payments
+		}
+		stats.ByCurrency = append(stats.ByCurrency, volume)
+	}
+
+	if stats.TotalTransactions > 0 {
+		stats.SuccessRate = float64(stats.Successful) / float64(stats.TotalTransactions) * 100
+	}
+	if paymentCount > 0 {
+		stats.AvgTransactionMinor = stats.VolumeMinor / paymentCount
+	}
+	return stats, nil
+}
+
+// getTransactionStats reports transaction volume, optionally in a given
+// reporting currency (?currency=EUR) and over a given window (?period=168h)
+func (o *PaymentOrchestrator) getTransactionStats(w http.ResponseWriter, r *http.Request) {
+	reportingCurrency := o.reportingCurrency
+	if c := r.URL.Query().Get("currency"); c != "" {
+		reportingCurrency = strings.ToUpper(c)
+	}
+	if !money.IsSupported(reportingCurrency) {
+		respondError(w, http.StatusBadRequest, "Unsupported reporting currency", "INVALID_CURRENCY")
+		return
+	}
+
+	period := 24 * time.Hour
+	if p := r.URL.Query().Get("period"); p != "" {
+		parsed, err := time.ParseDuration(p)
+		if err != nil || parsed <= 0 {
+			respondError(w, http.StatusBadRequest, "period must be a positive duration such as 24h", "INVALID_PERIOD")
+			return
+		}
+		period = parsed
+	}
+
+	stats, err := o.transactionStats(r.Context(), reportingCurrency, time.Now().Add(-period))
+	if err != nil {
+		log.Printf("Failed to get transaction stats: %v", err)
+		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, stats)
+}
+
+func (o *PaymentOrchestrator) getStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	stats, err := o.transactionStats(ctx, o.reportingCurrency, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total_transactions":   stats.TotalTransactions,
+		"successful":           stats.Successful,
+		"failed":               stats.Failed,
+		"success_rate":         stats.SuccessRate,
+		"reporting_currency":   stats.ReportingCurrency,
+		"total_volume":         money.ToMajor(stats.VolumeMinor, stats.ReportingCurrency),
+		"avg_transaction_size": money.ToMajor(stats.AvgTransactionMinor, stats.ReportingCurrency),
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/AnuragDani/subscription-platform/internal/audit"
+	"github.com/AnuragDani/subscription-platform/internal/processor"
+)
+
+// NextAction is what the cardholder must do before a charge can complete
+type NextAction struct {
+	Type        string     `json:"type"` // redirect_to_url
+	RedirectURL string     `json:"redirect_url"`
+	ChallengeID string     `json:"challenge_id"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func nextAction(challenge *processor.ThreeDSChallenge) *NextAction {
+	action := &NextAction{
+		Type:        "redirect_to_url",
+		RedirectURL: challenge.RedirectURL,
+		ChallengeID: challenge.ID,
+	}
+	if !challenge.ExpiresAt.IsZero() {
+		expiresAt := challenge.ExpiresAt
+		action.ExpiresAt = &expiresAt
+	}
+	return action
+}
+
+// validateThreeDS checks the exemption a charge or authorization asks for.
+// The MIT exemption only applies to payments flagged as merchant-initiated.
+func validateThreeDS(threeDS *processor.ThreeDSRequest, sc *processor.StoredCredential) error {
+	if threeDS == nil || threeDS.Exemption == "" {
+		return nil
+	}
+	if !processor.ValidExemption(threeDS.Exemption) {
+		return errors.New("three_ds.exemption must be low_value, mit or tra")
+	}
+	if threeDS.Exemption == processor.ExemptionMIT && !sc.IsMIT() {
+		return errors.New("the mit exemption requires a merchant-initiated stored_credential")
+	}
+	return nil
+}
+
+// threeDSRequest combines what the client asked for with what BPAS rules
+// require. Merchant-initiated payments are out of SCA scope, so they ask for
+// the MIT exemption unless another one was requested.
+func threeDSRequest(requested *processor.ThreeDSRequest, sc *processor.StoredCredential, requiredByRule bool) *processor.ThreeDSRequest {
+	var threeDS processor.ThreeDSRequest
+	if requested != nil {
+		threeDS = *requested
+	}
+	threeDS.Required = threeDS.Required || requiredByRule
+	if threeDS.Required && threeDS.Exemption == "" && sc.IsMIT() {
+		threeDS.Exemption = processor.ExemptionMIT
+	}
+
+	if !threeDS.Required && threeDS.Exemption == "" {
+		return nil
+	}
+	return &threeDS
+}
+
+// handleThreeDSNotification settles a charge once its 3-D Secure challenge
+// is over (POST /processors/{processor}/3ds). The outcome is read back from
+// the processor rather than trusted from the notification. Notifications
+// are retried by the processor, so repeats are acknowledged.
+func (o *PaymentOrchestrator) handleThreeDSNotification(w http.ResponseWriter, r *http.Request) {
+	processorName := mux.Vars(r)["processor"]
+	client, err := o.processors.GetProcessor(processorName)
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Unknown processor", "UNKNOWN_PROCESSOR")
+		return
+	}
+
+	var n processor.ThreeDSNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	if n.ChallengeID == "" {
+		respondError(w, http.StatusBadRequest, "challenge_id is required", "INVALID_REQUEST")
+		return
+	}
+
+	ctx := r.Context()
+	t, err := o.db.GetTransactionByThreeDSChallenge(ctx, processorName, n.ChallengeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "No charge with challenge "+n.ChallengeID, "TRANSACTION_NOT_FOUND")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load charge for 3DS challenge %s: %v", n.ChallengeID, err)
+		http.Error(w, "Failed to load charge", http.StatusInternalServerError)
+		return
+	}
+	if t.Status != TransactionStatusRequiresAction {
+		respondJSON(w, http.StatusOK, chargeResponseFromTransaction(t))
+		return
+	}
+
+	ctx = audit.WithTransactionID(ctx, t.ID)
+	resp, err := client.LookupCharge(ctx, t.IdempotencyKey)
+	if err != nil {
+		log.Printf("Could not read back charge %s from %s after 3DS: %v", t.ID, processorName, err)
+		respondError(w, http.StatusBadGateway, "Could not read the charge outcome from the processor", "PROCESSOR_UNAVAILABLE")
+		return
+	}
+	if resp.RequiresAction() {
+		respondError(w, http.StatusConflict, "Challenge "+n.ChallengeID+" is still pending", "CHALLENGE_PENDING")
+		return
+	}
+
+	if err := o.completeThreeDS(ctx, t, resp); err != nil && !errors.Is(err, ErrInvalidTransition) {
+		log.Printf("Failed to settle charge %s after 3DS: %v", t.ID, err)
+		http.Error(w, "Failed to settle charge", http.StatusInternalServerError)
+		return
+	}
+
+	settled, err := o.db.GetTransaction(ctx, t.ID)
+	if err != nil {
+		log.Printf("Failed to reload charge %s: %v", t.ID, err)
+		http.Error(w, "Failed to load charge", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, chargeResponseFromTransaction(settled))
+}
+
+// completeThreeDS settles a charge that was waiting on a 3-D Secure
+// challenge with the outcome the processor reports
+func (o *PaymentOrchestrator) completeThreeDS(ctx context.Context, t *Transaction, resp *processor.ChargeResponse) error {
+	status := getStatus(resp.Success)
+	update := TransactionUpdate{ProcessorTransactionID: resp.TransactionID}
+	if !resp.Success {
+		update.ErrorCode = resp.ErrorCode
+		update.ErrorMessage = mapErrorToUserMessage(resp.ErrorCode)
+	}
+
+	err := o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := o.db.TransitionTransactionTx(ctx, tx, t.ID, status, update); err != nil {
+			return err
+		}
+		if !resp.Success {
+			return o.events.EmitChargeFailed(ctx, tx, t.ID, t.SubscriptionID, t.Money(),
+				t.ProcessorUsed, update.ErrorCode, update.ErrorMessage)
+		}
+		if t.StoredCredential.EstablishesCredential() && resp.NetworkTransactionID != "" {
+			err := o.db.SetPaymentMethodNetworkTransactionIDTx(ctx, tx, t.PaymentMethodID, resp.NetworkTransactionID)
+			if err != nil {
+				return err
+			}
+		}
+		return o.events.EmitChargeSucceeded(ctx, tx, t.ID, t.SubscriptionID, t.Money(),
+			t.ProcessorUsed, time.Since(t.CreatedAt))
+	})
+	if err == nil {
+		log.Printf("Charge %s %s after 3DS challenge %s", t.ID, status, t.ThreeDSChallengeID)
+	}
+	return err
+}
+
+// expireThreeDSLoop fails charges whose challenge has waited longer than
+// timeout. The timeout should outlast the processors' own challenge
+// lifetime, so their expiry notification normally arrives first.
+func (o *PaymentOrchestrator) expireThreeDSLoop(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		o.expireStaleThreeDS(ctx, time.Now().Add(-timeout))
+		cancel()
+	}
+}
+
+func (o *PaymentOrchestrator) expireStaleThreeDS(ctx context.Context, cutoff time.Time) {
+	transactions, err := o.db.GetStaleThreeDSTransactions(ctx, cutoff, 100)
+	if err != nil {
+		log.Printf("Failed to load charges waiting on 3DS: %v", err)
+		return
+	}
+
+	for _, t := range transactions {
+		ctx := audit.WithTransactionID(ctx, t.ID)
+		outcome := &processor.ChargeResponse{ErrorCode: "AUTHENTICATION_EXPIRED"}
+
+		// Use the processor's outcome if its notification was lost
+		if client, err := o.processors.GetProcessor(t.ProcessorUsed); err == nil {
+			resp, err := client.LookupCharge(ctx, t.IdempotencyKey)
+			switch {
+			case err == nil && !resp.RequiresAction():
+				outcome = resp
+			case err != nil && !errors.Is(err, processor.ErrChargeNotFound):
+				log.Printf("Could not check 3DS charge %s with %s, retrying later: %v", t.ID, t.ProcessorUsed, err)
+				continue
+			}
+		}
+
+		if err := o.completeThreeDS(ctx, t, outcome); err != nil {
+			log.Printf("Failed to expire 3DS charge %s: %v", t.ID, err)
+		}
+	}
+}
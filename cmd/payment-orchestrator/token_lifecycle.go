@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
+)
+
+// tokenLifecycleEvents maps a lifecycle notification to the payment method
+// event it raises
+var tokenLifecycleEvents = map[string]string{
+	"suspended":   ws.EventPaymentMethodSuspended,
+	"resumed":     ws.EventPaymentMethodResumed,
+	"deleted":     ws.EventPaymentMethodDeleted,
+	"pan_updated": ws.EventPaymentMethodCardUpdated,
+}
+
+// tokenDeclineCode is the decline for a payment method whose network token
+// the card network suspended or deleted; no processor would accept it
+func tokenDeclineCode(pm *PaymentMethod) string {
+	switch pm.TokenStatus {
+	case tokens.TokenStatusSuspended:
+		return "TOKEN_SUSPENDED"
+	case tokens.TokenStatusDeleted:
+		return "TOKEN_DELETED"
+	}
+	return ""
+}
+
+// handleTokenNotification records a network token lifecycle change on the
+// payment methods holding the token (POST /network-tokens/notifications).
+// The token's state is read back from the token service rather than trusted
+// from the notification, and a notification the token no longer matches is
+// ignored. Notifications are retried by the token service, so repeats and
+// stale ones are acknowledged without changing anything.
+func (o *PaymentOrchestrator) handleTokenNotification(w http.ResponseWriter, r *http.Request) {
+	var n tokens.LifecycleNotification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+	if n.EventID == "" || n.NetworkToken == "" || n.OccurredAt.IsZero() {
+		respondError(w, http.StatusBadRequest, "event_id, network_token and occurred_at are required", "INVALID_REQUEST")
+		return
+	}
+	event, known := tokenLifecycleEvents[n.Event]
+	if !known {
+		respondError(w, http.StatusBadRequest, "unknown token event "+n.Event, "INVALID_REQUEST")
+		return
+	}
+	switch n.Status {
+	case tokens.TokenStatusActive, tokens.TokenStatusSuspended, tokens.TokenStatusDeleted:
+	default:
+		respondError(w, http.StatusBadRequest, "unknown token status "+n.Status, "INVALID_REQUEST")
+		return
+	}
+
+	ctx := r.Context()
+	info, err := o.tokenManager.GetTokenInfo(ctx, n.NetworkToken)
+	var tokenErr *tokens.TokenError
+	if errors.As(err, &tokenErr) && tokenErr.Code == "TOKEN_NOT_FOUND" {
+		log.Printf("Rejected token notification %s for a token the token service doesn't know", n.EventID)
+		respondError(w, http.StatusNotFound, "Network token not found", "TOKEN_NOT_FOUND")
+		return
+	}
+	if err != nil {
+		log.Printf("Could not read back network token for notification %s: %v", n.EventID, err)
+		respondError(w, http.StatusBadGateway, "Could not read the token from the token service", "TOKEN_SERVICE_UNAVAILABLE")
+		return
+	}
+	if info.Status != n.Status {
+		log.Printf("Ignored token notification %s (%s): token is now %s", n.EventID, n.Status, info.Status)
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"event_id":                n.EventID,
+			"payment_methods_updated": 0,
+		})
+		return
+	}
+	n.Reason = info.StatusReason
+	n.LastFour = info.LastFour
+	n.ExpMonth = info.ExpiryMonth
+	n.ExpYear = info.ExpiryYear
+	// A timestamp from the future would make every later change look stale
+	if now := time.Now().UTC(); n.OccurredAt.After(now) {
+		n.OccurredAt = now
+	}
+
+	var changed []*PaymentMethod
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if changed, err = o.db.ApplyTokenNotificationTx(ctx, tx, &n); err != nil {
+			return err
+		}
+		for _, pm := range changed {
+			if err := o.events.EmitPaymentMethodToken(ctx, tx, event, pm); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to record token notification %s: %v", n.EventID, err)
+		http.Error(w, "Failed to record token notification", http.StatusInternalServerError)
+		return
+	}
+
+	if len(changed) == 0 {
+		log.Printf("Token notification %s (%s) changed no payment methods", n.EventID, n.Event)
+	}
+	for _, pm := range changed {
+		log.Printf("Payment method %s network token %s (status=%s)", pm.ID, n.Event, pm.TokenStatus)
+	}
+	o.requirePaymentMethods(ctx, n.NetworkToken)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"event_id":                n.EventID,
+		"payment_methods_updated": len(changed),
+	})
+}
+
+// requirePaymentMethods asks the subscription service to request a new
+// payment method for subscriptions charging a suspended or deleted token,
+// only networkToken's when it is set. Failures are left for
+// requirePaymentMethodsLoop to retry.
+func (o *PaymentOrchestrator) requirePaymentMethods(ctx context.Context, networkToken string) {
+	requirements, err := o.db.ListPaymentMethodRequirements(ctx, networkToken, 50)
+	if err != nil {
+		log.Printf("Failed to load subscriptions needing a payment method: %v", err)
+		return
+	}
+
+	for _, req := range requirements {
+		err := o.subscriptions.RequirePaymentMethod(ctx, req.SubscriptionID, req.PaymentMethodID, "token_"+req.TokenStatus)
+		if errors.Is(err, ErrSubscriptionNotUpdatable) {
+			log.Printf("Subscription %s not asked for a new payment method: %v", req.SubscriptionID, err)
+		} else if err != nil {
+			log.Printf("Failed to ask subscription %s for a new payment method: %v", req.SubscriptionID, err)
+		}
+	}
+}
+
+// requirePaymentMethodsLoop retries telling the subscription service about
+// subscriptions whose payment method can no longer be charged
+func (o *PaymentOrchestrator) requirePaymentMethodsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		o.requirePaymentMethods(ctx, "")
+		cancel()
+	}
+}
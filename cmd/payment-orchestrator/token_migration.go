@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+)
+
+// TokenMigration moves dual-vault payment methods to network tokens. About
+// one card in twenty falls back to the dual vault when it is attached, and
+// pays the portability penalty on every charge; issuers join network
+// tokenization over time, so each method is retried every RetryAfter.
+//
+// The network token service looks cards up by their processor tokens, so
+// card numbers never pass through the orchestrator.
+type TokenMigration struct {
+	interval   time.Duration
+	rate       float64 // Network token service calls per second
+	batchSize  int
+	retryAfter time.Duration
+
+	owner   string      // Lease owner for this process
+	running atomic.Bool // A pass is in progress in this process
+}
+
+func newTokenMigration(cfg *Config) *TokenMigration {
+	return &TokenMigration{
+		interval:   cfg.TokenMigrationInterval,
+		rate:       cfg.TokenMigrationRate,
+		batchSize:  cfg.TokenMigrationBatchSize,
+		retryAfter: cfg.TokenMigrationRetryAfter,
+		owner:      uuid.New().String(),
+	}
+}
+
+// TokenMigrationResult counts the payment methods one pass, or the part of it
+// run before stopping, went through
+type TokenMigrationResult struct {
+	Attempted int `json:"attempted"`
+	Migrated  int `json:"migrated"`
+	Failed    int `json:"failed"` // The issuer still can't provision a network token
+	Errors    int `json:"errors"` // Not tried, e.g. the token service was unreachable
+}
+
+// TokenMigrationReport is the migration's progress (GET /admin/token-migration)
+type TokenMigrationReport struct {
+	*TokenMigrationProgress
+	Checkpoint *TokenMigrationCheckpoint `json:"checkpoint"`
+	Settings   TokenMigrationSettings    `json:"settings"`
+}
+
+type TokenMigrationSettings struct {
+	Interval   string  `json:"interval"`
+	RatePerSec float64 `json:"rate_per_second"`
+	BatchSize  int     `json:"batch_size"`
+	RetryAfter string  `json:"retry_after"`
+	Disabled   bool    `json:"disabled"`
+}
+
+func (m *TokenMigration) enabled() bool {
+	return m.interval > 0 && m.rate > 0 && m.batchSize > 0
+}
+
+// tokenMigrationLoop starts a migration pass every interval. Passes resume
+// from the last checkpoint, so one cut short by a restart picks up where it
+// stopped.
+func (o *PaymentOrchestrator) tokenMigrationLoop() {
+	m := o.tokenMigration
+	if !m.enabled() {
+		log.Println("Dual-vault token migration disabled")
+		return
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		o.migrateDualVault(context.Background())
+	}
+}
+
+// migrateDualVault runs a migration pass, unless one is already running here
+// or another replica holds the lease
+func (o *PaymentOrchestrator) migrateDualVault(ctx context.Context) {
+	m := o.tokenMigration
+	if !m.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.running.Store(false)
+
+	// The lease must outlast a batch at the configured rate
+	lease := time.Duration(float64(m.batchSize)/m.rate*float64(time.Second)) + time.Minute
+	limiter := time.NewTicker(time.Duration(float64(time.Second) / m.rate))
+	defer limiter.Stop()
+
+	var total TokenMigrationResult
+	for {
+		cursorID, ok, err := o.db.ClaimTokenMigration(ctx, m.owner, lease)
+		if err != nil {
+			log.Printf("Failed to claim the token migration: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		triedBefore := time.Now().Add(-m.retryAfter)
+		batch, err := o.db.ListDualVaultPaymentMethods(ctx, cursorID, triedBefore, m.batchSize)
+		if err != nil {
+			log.Printf("Failed to load dual-vault payment methods: %v", err)
+			o.db.ReleaseTokenMigration(ctx, m.owner)
+			return
+		}
+
+		var result TokenMigrationResult
+		for _, pm := range batch {
+			select {
+			case <-limiter.C:
+			case <-ctx.Done():
+				o.db.ReleaseTokenMigration(context.Background(), m.owner)
+				return
+			}
+
+			migrated, err := o.migratePaymentMethod(ctx, pm)
+			switch {
+			case errors.Is(err, errPaymentMethodChanged):
+				// Detached or migrated since the batch was loaded; nothing left to try
+			case err != nil:
+				log.Printf("Could not migrate payment method %s, retrying next pass: %v", pm.ID, err)
+				result.Errors++
+			case migrated:
+				result.Attempted++
+				result.Migrated++
+			default:
+				result.Attempted++
+				result.Failed++
+			}
+			cursorID = pm.ID
+		}
+
+		done := len(batch) < m.batchSize
+		err = o.db.SaveTokenMigrationCheckpoint(ctx, m.owner, cursorID, result.Attempted, result.Migrated, result.Failed, done)
+		if err != nil {
+			log.Printf("Failed to save the token migration checkpoint: %v", err)
+			return
+		}
+
+		total.Attempted += result.Attempted
+		total.Migrated += result.Migrated
+		total.Failed += result.Failed
+		total.Errors += result.Errors
+		if done {
+			log.Printf("Dual-vault token migration pass completed: attempted=%d, migrated=%d, failed=%d, errors=%d",
+				total.Attempted, total.Migrated, total.Failed, total.Errors)
+			return
+		}
+	}
+}
+
+// errPaymentMethodChanged means a payment method was detached or stopped
+// being a dual-vault method after its batch was loaded
+var errPaymentMethodChanged = errors.New("payment method changed since its batch was loaded")
+
+// migratable reports whether a payment method is still an attached
+// dual-vault method
+func migratable(pm *PaymentMethod) bool {
+	return pm.TokenType == "dual_vault" && pm.DetachedAt == nil
+}
+
+// upgradeProcessorToken picks the processor token the network token service
+// looks the card up by
+func upgradeProcessorToken(pm *PaymentMethod) string {
+	if token := pm.ProcessorTokens["processor_a"]; token != "" {
+		return token
+	}
+	return pm.ProcessorTokens["processor_b"]
+}
+
+// migratePaymentMethod asks the network token service for a network token
+// for a dual-vault payment method. It reports whether the method moved; an
+// error means it wasn't tried and should be tried again, unless it is
+// errPaymentMethodChanged.
+func (o *PaymentOrchestrator) migratePaymentMethod(ctx context.Context, pm *PaymentMethod) (bool, error) {
+	// The batch may be minutes old by now, and a token provisioned for a
+	// method that has since gone would be left behind
+	pm, err := o.db.GetPaymentMethod(ctx, pm.ID)
+	if err != nil {
+		return false, err
+	}
+	if !migratable(pm) {
+		return false, errPaymentMethodChanged
+	}
+
+	processorToken := upgradeProcessorToken(pm)
+	if processorToken == "" {
+		return false, o.db.RecordNetworkTokenAttempt(ctx, pm.ID, "NO_PROCESSOR_TOKEN")
+	}
+
+	resp, err := o.tokenManager.UpgradeToken(ctx, processorToken)
+	var tokenErr *tokens.TokenError
+	switch {
+	// A 5xx, even with an error body, is the service failing rather than the
+	// card being ineligible, so it is left for the next pass
+	case resp != nil && !resp.Success && errors.As(err, &tokenErr) && tokenErr.Refused():
+		return false, o.db.RecordNetworkTokenAttempt(ctx, pm.ID, tokenErr.Code)
+	case err != nil:
+		return false, err
+	case resp.NetworkToken == nil || resp.NetworkToken.NetworkToken == "":
+		return false, errors.New("network token service returned no token")
+	}
+	networkToken := resp.NetworkToken.NetworkToken
+
+	var current *PaymentMethod
+	migrated := false
+	err = o.db.WithTx(ctx, func(tx *sql.Tx) error {
+		locked, err := o.db.GetPaymentMethodForUpdate(ctx, tx, pm.ID)
+		if err != nil {
+			return err
+		}
+		current = locked
+		// Detached or changed while the token was provisioned
+		if !migratable(current) {
+			return nil
+		}
+		migrated = true
+		return o.db.MigrateToNetworkTokenTx(ctx, tx, current, networkToken)
+	})
+	// Nothing is abandoned when the transaction fails: the token service
+	// hands the same token back for this card on the next pass
+	if err != nil {
+		return false, err
+	}
+	if !migrated {
+		o.abandonNetworkToken(ctx, current, networkToken)
+		return false, errPaymentMethodChanged
+	}
+
+	log.Printf("Payment method %s (%s) moved from the dual vault to a network token", pm.ID, pm.LastFour)
+	return true, nil
+}
+
+// abandonNetworkToken deletes a network token provisioned for a payment
+// method that changed before it could be stored, unless the method holds it
+// anyway because another pass stored it first
+func (o *PaymentOrchestrator) abandonNetworkToken(ctx context.Context, pm *PaymentMethod, networkToken string) {
+	if pm.DetachedAt == nil && pm.NetworkToken == networkToken {
+		return
+	}
+
+	reason := "payment_method_changed"
+	if pm.DetachedAt != nil {
+		reason = "payment_method_detached"
+	}
+	if err := o.tokenManager.DeleteToken(ctx, networkToken, reason); err != nil {
+		log.Printf("Failed to delete the network token provisioned for payment method %s: %v", pm.ID, err)
+		return
+	}
+	log.Printf("Deleted the network token provisioned for payment method %s (%s)", pm.ID, reason)
+}
+
+// getTokenMigration reports the dual-vault migration's progress
+// (GET /admin/token-migration)
+func (o *PaymentOrchestrator) getTokenMigration(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	m := o.tokenMigration
+
+	progress, err := o.db.GetTokenMigrationProgress(ctx, time.Now().Add(-m.retryAfter))
+	if err != nil {
+		log.Printf("Failed to count token migration progress: %v", err)
+		http.Error(w, "Failed to load token migration progress", http.StatusInternalServerError)
+		return
+	}
+	checkpoint, err := o.db.GetTokenMigrationCheckpoint(ctx)
+	if err != nil {
+		log.Printf("Failed to load token migration checkpoint: %v", err)
+		http.Error(w, "Failed to load token migration progress", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, TokenMigrationReport{
+		TokenMigrationProgress: progress,
+		Checkpoint:             checkpoint,
+		Settings: TokenMigrationSettings{
+			Interval:   m.interval.String(),
+			RatePerSec: m.rate,
+			BatchSize:  m.batchSize,
+			RetryAfter: m.retryAfter.String(),
+			Disabled:   !m.enabled(),
+		},
+	})
+}
+
+// runTokenMigration starts a migration pass now, in the background
+// (POST /admin/token-migration/run)
+func (o *PaymentOrchestrator) runTokenMigration(w http.ResponseWriter, r *http.Request) {
+	if !o.tokenMigration.enabled() {
+		respondError(w, http.StatusConflict, "Dual-vault token migration is disabled", "MIGRATION_DISABLED")
+		return
+	}
+	if o.tokenMigration.running.Load() {
+		respondError(w, http.StatusConflict, "A migration pass is already running", "MIGRATION_RUNNING")
+		return
+	}
+
+	go o.migrateDualVault(context.Background())
+	respondJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/tokens"
+)
+
+func TestMigratable(t *testing.T) {
+	detached := time.Now()
+
+	tests := []struct {
+		name string
+		pm   *PaymentMethod
+		want bool
+	}{
+		{"attached dual-vault method", &PaymentMethod{TokenType: "dual_vault"}, true},
+		{"detached dual-vault method", &PaymentMethod{TokenType: "dual_vault", DetachedAt: &detached}, false},
+		{"already migrated", &PaymentMethod{TokenType: "network", NetworkToken: "ntk_1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := migratable(tt.pm); got != tt.want {
+				t.Errorf("migratable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpgradeProcessorToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens map[string]string
+		want   string
+	}{
+		{"both processors", map[string]string{"processor_a": "pa_tok", "processor_b": "pb_tok"}, "pa_tok"},
+		{"processor B only", map[string]string{"processor_b": "pb_tok"}, "pb_tok"},
+		{"another processor only", map[string]string{"processor_c": "pc_tok"}, ""},
+		{"no tokens", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := &PaymentMethod{TokenType: "dual_vault", ProcessorTokens: tt.tokens}
+			if got := upgradeProcessorToken(pm); got != tt.want {
+				t.Errorf("upgradeProcessorToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// deletedTokens runs a network token service that records the tokens
+// deleted through it, answering with status
+func deletedTokens(t *testing.T, status int) (*PaymentOrchestrator, *[]string) {
+	t.Helper()
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("token service got %s %s, want a DELETE", r.Method, r.URL.Path)
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		deleted = append(deleted, r.URL.Path+" "+req.Reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status >= 400 {
+			json.NewEncoder(w).Encode(map[string]string{"error_code": "TOKEN_NOT_FOUND", "error_message": "Network token not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "status": "deleted"})
+	}))
+	t.Cleanup(srv.Close)
+
+	return &PaymentOrchestrator{tokenManager: tokens.NewTokenManager(srv.URL)}, &deleted
+}
+
+func TestAbandonNetworkToken(t *testing.T) {
+	detached := time.Now()
+
+	tests := []struct {
+		name string
+		pm   *PaymentMethod
+		want []string
+	}{
+		{
+			name: "detached while the token was provisioned",
+			pm:   &PaymentMethod{ID: "pm_1", TokenType: "dual_vault", DetachedAt: &detached},
+			want: []string{"/network-tokens/ntk_new payment_method_detached"},
+		},
+		{
+			name: "migrated to another token meanwhile",
+			pm:   &PaymentMethod{ID: "pm_1", TokenType: "network", NetworkToken: "ntk_other"},
+			want: []string{"/network-tokens/ntk_new payment_method_changed"},
+		},
+		{
+			name: "another pass stored the same token",
+			pm:   &PaymentMethod{ID: "pm_1", TokenType: "network", NetworkToken: "ntk_new"},
+		},
+		{
+			name: "stored the same token, then detached",
+			pm:   &PaymentMethod{ID: "pm_1", TokenType: "network", NetworkToken: "ntk_new", DetachedAt: &detached},
+			want: []string{"/network-tokens/ntk_new payment_method_detached"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, deleted := deletedTokens(t, http.StatusOK)
+			o.abandonNetworkToken(context.Background(), tt.pm, "ntk_new")
+			if !reflect.DeepEqual(*deleted, tt.want) {
+				t.Errorf("deleted %v, want %v", *deleted, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbandonNetworkTokenRefused(t *testing.T) {
+	o, deleted := deletedTokens(t, http.StatusNotFound)
+	pm := &PaymentMethod{ID: "pm_1", TokenType: "dual_vault", DetachedAt: new(time.Time)}
+
+	// Logged rather than failing the pass
+	o.abandonNetworkToken(context.Background(), pm, "ntk_gone")
+	if len(*deleted) != 1 {
+		t.Fatalf("deleted %v, want one attempt", *deleted)
+	}
+
+	err := o.tokenManager.DeleteToken(context.Background(), "ntk_gone", "")
+	var tokenErr *tokens.TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.Code != "TOKEN_NOT_FOUND" || !tokenErr.Refused() {
+		t.Errorf("DeleteToken error = %v, want a TOKEN_NOT_FOUND refusal", err)
+	}
+}
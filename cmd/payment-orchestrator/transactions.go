@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+// TransactionListItem is a transaction in search results. Charges and
+// captures carry the refunds made against them.
+type TransactionListItem struct {
+	*Transaction
+	Refunds []*RefundResponse `json:"refunds,omitempty"`
+}
+
+// TransactionListResponse is one page of search results
+type TransactionListResponse struct {
+	Transactions []*TransactionListItem `json:"transactions"`
+	Count        int                    `json:"count"`
+	HasMore      bool                   `json:"has_more"`
+	NextCursor   string                 `json:"next_cursor,omitempty"` // Pass as ?cursor= for the next page
+}
+
+// transactionPageCursor is what an opaque cursor decodes to. It records the
+// sort it was issued for so it cannot be replayed against another order.
+type transactionPageCursor struct {
+	Sort string `json:"s"`
+	TransactionCursor
+}
+
+func encodeTransactionCursor(sort string, last *Transaction) string {
+	data, _ := json.Marshal(transactionPageCursor{
+		Sort: sort,
+		TransactionCursor: TransactionCursor{
+			CreatedAt: last.CreatedAt,
+			Amount:    last.Amount,
+			ID:        last.ID,
+		},
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTransactionCursor(sort, cursor string) (*TransactionCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, false
+	}
+	var c transactionPageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != sort || c.ID == "" {
+		return nil, false
+	}
+	return &c.TransactionCursor, true
+}
+
+// sortKey is the sort parameter the filter was built from, e.g. -created_at
+func (f TransactionFilter) sortKey() string {
+	if f.Descending {
+		return "-" + f.SortBy
+	}
+	return f.SortBy
+}
+
+// splitList reads a comma-separated query parameter
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseTransactionFilter builds a search from query parameters, returning a
+// message for the first invalid one
+func parseTransactionFilter(r *http.Request) (TransactionFilter, string) {
+	query := r.URL.Query()
+	filter := TransactionFilter{
+		SubscriptionID:  query.Get("subscription_id"),
+		PaymentMethodID: query.Get("payment_method_id"),
+		Processor:       query.Get("processor"),
+		Statuses:        splitList(query.Get("status")),
+		Types:           splitList(query.Get("type")),
+		Currency:        strings.ToUpper(query.Get("currency")),
+		SortBy:          TransactionSortCreatedAt,
+		Descending:      true,
+		Limit:           50,
+	}
+
+	for param, id := range map[string]string{
+		"subscription_id":   filter.SubscriptionID,
+		"payment_method_id": filter.PaymentMethodID,
+	} {
+		if _, err := uuid.Parse(id); id != "" && err != nil {
+			return filter, param + " must be a UUID"
+		}
+	}
+	if filter.Currency != "" && !money.IsSupported(filter.Currency) {
+		return filter, "unsupported currency " + filter.Currency
+	}
+
+	for param, bound := range map[string]**int64{
+		"min_amount_minor": &filter.MinAmount,
+		"max_amount_minor": &filter.MaxAmount,
+	} {
+		if v := query.Get(param); v != "" {
+			amount, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return filter, param + " must be an integer amount in minor units"
+			}
+			*bound = &amount
+		}
+	}
+
+	for param, bound := range map[string]**time.Time{
+		"created_from": &filter.CreatedFrom,
+		"created_to":   &filter.CreatedTo,
+	} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, param + " must be an RFC 3339 timestamp"
+			}
+			t = t.UTC()
+			*bound = &t
+		}
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "-" + TransactionSortCreatedAt
+	}
+	filter.Descending = strings.HasPrefix(sort, "-")
+	filter.SortBy = strings.TrimPrefix(sort, "-")
+	if filter.SortBy != TransactionSortCreatedAt && filter.SortBy != TransactionSortAmount {
+		return filter, "sort must be created_at or amount_minor, optionally prefixed with -"
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, ok := decodeTransactionCursor(sort, c)
+		if !ok {
+			return filter, "cursor is invalid or was issued for a different sort"
+		}
+		filter.After = cursor
+	}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 200 {
+			return filter, "limit must be between 1 and 200"
+		}
+		filter.Limit = limit
+	}
+
+	return filter, ""
+}
+
+// listTransactions searches transactions. Filters combine with AND;
+// status and type take comma-separated lists.
+func (o *PaymentOrchestrator) listTransactions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter, problem := parseTransactionFilter(r)
+	if problem != "" {
+		respondError(w, http.StatusBadRequest, problem, "INVALID_REQUEST")
+		return
+	}
+
+	// Fetch one extra row to learn whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	transactions, err := o.db.ListTransactions(ctx, filter)
+	if err != nil {
+		log.Printf("Failed to list transactions: %v", err)
+		http.Error(w, "Failed to list transactions", http.StatusInternalServerError)
+		return
+	}
+
+	response := TransactionListResponse{HasMore: len(transactions) > pageSize}
+	if response.HasMore {
+		transactions = transactions[:pageSize]
+		response.NextCursor = encodeTransactionCursor(filter.sortKey(), transactions[len(transactions)-1])
+	}
+
+	var refundable []string
+	for _, t := range transactions {
+		if t.TransactionType == TransactionTypeCharge || t.TransactionType == TransactionTypeCapture {
+			refundable = append(refundable, t.ID)
+		}
+	}
+	refunds, err := o.db.ListRefundsByOriginal(ctx, refundable)
+	if err != nil {
+		log.Printf("Failed to load refunds for transaction list: %v", err)
+		http.Error(w, "Failed to list transactions", http.StatusInternalServerError)
+		return
+	}
+
+	response.Transactions = make([]*TransactionListItem, 0, len(transactions))
+	for _, t := range transactions {
+		item := &TransactionListItem{Transaction: t}
+		for _, refund := range refunds[t.ID] {
+			item.Refunds = append(item.Refunds, refundResponseFromTransaction(refund))
+		}
+		response.Transactions = append(response.Transactions, item)
+	}
+	response.Count = len(response.Transactions)
+
+	respondJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testCursorTransaction() *Transaction {
+	return &Transaction{
+		ID:        "0b7d4c1e-8f1a-4c55-9d3e-2a6f0c9b1e42",
+		Amount:    1999,
+		CreatedAt: time.Date(2026, 10, 16, 12, 30, 45, 123456789, time.UTC),
+	}
+}
+
+func TestTransactionCursorRoundTrip(t *testing.T) {
+	last := testCursorTransaction()
+
+	for _, sort := range []string{"created_at", "-created_at", "amount_minor", "-amount_minor"} {
+		t.Run(sort, func(t *testing.T) {
+			got, ok := decodeTransactionCursor(sort, encodeTransactionCursor(sort, last))
+			if !ok {
+				t.Fatal("cursor did not decode for the sort it was issued for")
+			}
+			if got.ID != last.ID || got.Amount != last.Amount || !got.CreatedAt.Equal(last.CreatedAt) {
+				t.Errorf("decoded %+v, want position of %+v", got, last)
+			}
+		})
+	}
+}
+
+func TestTransactionCursorRejected(t *testing.T) {
+	last := testCursorTransaction()
+
+	tests := []struct {
+		name   string
+		sort   string
+		cursor string
+	}{
+		{"direction changed", "created_at", encodeTransactionCursor("-created_at", last)},
+		{"column changed", "-amount_minor", encodeTransactionCursor("-created_at", last)},
+		{"column and direction changed", "amount_minor", encodeTransactionCursor("-created_at", last)},
+		{"not base64", "-created_at", "not a cursor!"},
+		{"not JSON", "-created_at", base64.RawURLEncoding.EncodeToString([]byte("garbage"))},
+		{"no sort", "-created_at", base64.RawURLEncoding.EncodeToString([]byte(`{"i":"` + last.ID + `"}`))},
+		{"no transaction", "-created_at", base64.RawURLEncoding.EncodeToString([]byte(`{"s":"-created_at"}`))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, ok := decodeTransactionCursor(tt.sort, tt.cursor); ok {
+				t.Errorf("decodeTransactionCursor(%q) = %+v, want rejected", tt.sort, c)
+			}
+		})
+	}
+}
+
+func TestParseTransactionFilterCursor(t *testing.T) {
+	last := testCursorTransaction()
+
+	tests := []struct {
+		name        string
+		issuedSort  string // Sort key of the page that issued the cursor
+		querySort   string // Sort passed with the cursor; empty uses the default
+		wantProblem bool
+	}{
+		{"default sort", "-created_at", "", false},
+		{"same sort", "amount_minor", "amount_minor", false},
+		{"default sort with another order's cursor", "amount_minor", "", true},
+		{"reversed sort", "-amount_minor", "amount_minor", true},
+		{"different column", "-created_at", "-amount_minor", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"cursor": {encodeTransactionCursor(tt.issuedSort, last)}}
+			if tt.querySort != "" {
+				query.Set("sort", tt.querySort)
+			}
+			r := httptest.NewRequest("GET", "/transactions?"+query.Encode(), nil)
+
+			filter, problem := parseTransactionFilter(r)
+			if (problem != "") != tt.wantProblem {
+				t.Fatalf("problem = %q, wantProblem %v", problem, tt.wantProblem)
+			}
+			if problem != "" {
+				return
+			}
+			if filter.After == nil || filter.After.ID != last.ID {
+				t.Errorf("After = %+v, want cursor at %s", filter.After, last.ID)
+			}
+			if filter.sortKey() != tt.issuedSort {
+				t.Errorf("sortKey() = %q, want %q", filter.sortKey(), tt.issuedSort)
+			}
+		})
+	}
+}
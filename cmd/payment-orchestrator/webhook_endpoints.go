@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// WebhookEndpointRequest creates an endpoint, or updates one when fields are set
+type WebhookEndpointRequest struct {
+	MerchantID  string    `json:"merchant_id"`
+	URL         *string   `json:"url,omitempty"`
+	EventTypes  *[]string `json:"event_types,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Enabled     *bool     `json:"enabled,omitempty"`
+}
+
+// WebhookDeliveryResponse is a delivery with its attempt log
+type WebhookDeliveryResponse struct {
+	*WebhookDelivery
+	AttemptLog []WebhookAttempt `json:"attempt_log"`
+}
+
+// newWebhookSecret generates the signing secret shared with the merchant
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// validateEventTypes accepts "*", "<type>.*" and "<type>.<event>" filters
+func validateEventTypes(filters []string) error {
+	for _, filter := range filters {
+		if filter == "*" {
+			continue
+		}
+		msgType, event, ok := strings.Cut(filter, ".")
+		if !ok || event == "" || !webhookMessageTypes[msgType] {
+			return fmt.Errorf("unknown event type filter %q", filter)
+		}
+	}
+	return nil
+}
+
+func (o *PaymentOrchestrator) createWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req WebhookEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+
+	if req.MerchantID == "" || req.URL == nil {
+		respondError(w, http.StatusBadRequest, "merchant_id and url are required", "INVALID_REQUEST")
+		return
+	}
+
+	endpoint := &WebhookEndpoint{
+		MerchantID: req.MerchantID,
+		URL:        *req.URL,
+		EventTypes: []string{},
+		Enabled:    true,
+	}
+	if !applyWebhookEndpointRequest(w, endpoint, req) {
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		log.Printf("Failed to generate webhook secret: %v", err)
+		http.Error(w, "Failed to create webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+	endpoint.Secret = secret
+
+	if err := o.db.CreateWebhookEndpoint(r.Context(), endpoint); err != nil {
+		log.Printf("Failed to create webhook endpoint: %v", err)
+		http.Error(w, "Failed to create webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Webhook endpoint %s registered for merchant %s: %s", endpoint.ID, endpoint.MerchantID, endpoint.URL)
+	respondJSON(w, http.StatusCreated, endpoint)
+}
+
+// applyWebhookEndpointRequest copies the fields set in req onto endpoint,
+// responding with an error and returning false if any is invalid
+func applyWebhookEndpointRequest(w http.ResponseWriter, endpoint *WebhookEndpoint, req WebhookEndpointRequest) bool {
+	if req.URL != nil {
+		if err := validateWebhookURL(*req.URL); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error(), "INVALID_URL")
+			return false
+		}
+		endpoint.URL = *req.URL
+	}
+	if req.EventTypes != nil {
+		if err := validateEventTypes(*req.EventTypes); err != nil {
+			respondError(w, http.StatusBadRequest, err.Error(), "INVALID_EVENT_TYPE")
+			return false
+		}
+		endpoint.EventTypes = *req.EventTypes
+	}
+	if req.Description != nil {
+		endpoint.Description = *req.Description
+	}
+	if req.Enabled != nil {
+		endpoint.Enabled = *req.Enabled
+	}
+	return true
+}
+
+func (o *PaymentOrchestrator) listWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := o.db.ListWebhookEndpoints(r.Context(), r.URL.Query().Get("merchant_id"), false)
+	if err != nil {
+		log.Printf("Failed to list webhook endpoints: %v", err)
+		http.Error(w, "Failed to list webhook endpoints", http.StatusInternalServerError)
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		endpoint.Secret = ""
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"endpoints": endpoints,
+		"count":     len(endpoints),
+	})
+}
+
+// loadWebhookEndpoint looks up the endpoint named in the URL, responding 404 if there is none
+func (o *PaymentOrchestrator) loadWebhookEndpoint(w http.ResponseWriter, r *http.Request) *WebhookEndpoint {
+	endpoint, err := o.db.GetWebhookEndpoint(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Webhook endpoint not found", "ENDPOINT_NOT_FOUND")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to load webhook endpoint: %v", err)
+		http.Error(w, "Failed to load webhook endpoint", http.StatusInternalServerError)
+		return nil
+	}
+	return endpoint
+}
+
+func (o *PaymentOrchestrator) getWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint := o.loadWebhookEndpoint(w, r)
+	if endpoint == nil {
+		return
+	}
+	endpoint.Secret = ""
+	respondJSON(w, http.StatusOK, endpoint)
+}
+
+func (o *PaymentOrchestrator) updateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req WebhookEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request", "INVALID_REQUEST")
+		return
+	}
+
+	endpoint := o.loadWebhookEndpoint(w, r)
+	if endpoint == nil {
+		return
+	}
+	if !applyWebhookEndpointRequest(w, endpoint, req) {
+		return
+	}
+
+	if err := o.db.UpdateWebhookEndpoint(r.Context(), endpoint); err != nil {
+		log.Printf("Failed to update webhook endpoint %s: %v", endpoint.ID, err)
+		http.Error(w, "Failed to update webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	endpoint.Secret = ""
+	respondJSON(w, http.StatusOK, endpoint)
+}
+
+func (o *PaymentOrchestrator) deleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deleted, err := o.db.DeleteWebhookEndpoint(r.Context(), id)
+	if err != nil {
+		log.Printf("Failed to delete webhook endpoint %s: %v", id, err)
+		http.Error(w, "Failed to delete webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		respondError(w, http.StatusNotFound, "Webhook endpoint not found", "ENDPOINT_NOT_FOUND")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveries returns the delivery log, filtered by
+// ?endpoint_id=, ?status= and ?event_type=
+func (o *PaymentOrchestrator) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := WebhookDeliveryFilter{
+		EndpointID: query.Get("endpoint_id"),
+		Status:     query.Get("status"),
+		EventType:  query.Get("event_type"),
+		Limit:      50,
+	}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 500 {
+			respondError(w, http.StatusBadRequest, "limit must be between 1 and 500", "INVALID_REQUEST")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	deliveries, err := o.db.ListWebhookDeliveries(r.Context(), filter)
+	if err != nil {
+		log.Printf("Failed to list webhook deliveries: %v", err)
+		http.Error(w, "Failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
+	})
+}
+
+// loadWebhookDelivery looks up the delivery named in the URL with its attempt log
+func (o *PaymentOrchestrator) loadWebhookDelivery(w http.ResponseWriter, r *http.Request) *WebhookDeliveryResponse {
+	ctx := r.Context()
+	delivery, err := o.db.GetWebhookDelivery(ctx, mux.Vars(r)["id"])
+	if errors.Is(err, sql.ErrNoRows) {
+		respondError(w, http.StatusNotFound, "Webhook delivery not found", "DELIVERY_NOT_FOUND")
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to load webhook delivery: %v", err)
+		http.Error(w, "Failed to load webhook delivery", http.StatusInternalServerError)
+		return nil
+	}
+
+	attempts, err := o.db.ListWebhookAttempts(ctx, delivery.ID)
+	if err != nil {
+		log.Printf("Failed to load attempts for webhook delivery %s: %v", delivery.ID, err)
+		http.Error(w, "Failed to load webhook delivery", http.StatusInternalServerError)
+		return nil
+	}
+	return &WebhookDeliveryResponse{WebhookDelivery: delivery, AttemptLog: attempts}
+}
+
+func (o *PaymentOrchestrator) getWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	response := o.loadWebhookDelivery(w, r)
+	if response == nil {
+		return
+	}
+	respondJSON(w, http.StatusOK, response)
+}
+
+// redeliverWebhook sends a delivery again right away, whatever its state.
+// Dead-lettered deliveries stay dead-lettered unless the endpoint accepts it.
+func (o *PaymentOrchestrator) redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	response := o.loadWebhookDelivery(w, r)
+	if response == nil {
+		return
+	}
+
+	attempt, err := o.webhooks.Attempt(r.Context(), response.WebhookDelivery, true)
+	if err != nil {
+		log.Printf("Manual redelivery of %s failed: %v", response.ID, err)
+		http.Error(w, "Failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+	response.AttemptLog = append(response.AttemptLog, *attempt)
+
+	status := http.StatusOK
+	if !attempt.Succeeded() {
+		status = http.StatusBadGateway
+	}
+	respondJSON(w, status, response)
+}
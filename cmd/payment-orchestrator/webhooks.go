@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
+)
+
+// Webhook delivery states
+const (
+	WebhookPending    = "pending"
+	WebhookDelivered  = "delivered"
+	WebhookDeadLetter = "dead_letter"
+)
+
+// Message types merchants can subscribe to. Health events stay internal.
+var webhookMessageTypes = map[string]bool{
+	ws.TypeTransaction:   true,
+	ws.TypeSubscription:  true,
+	ws.TypeScheduler:     true,
+	ws.TypePaymentMethod: true,
+}
+
+// WebhookEndpoint is a merchant URL that receives events
+type WebhookEndpoint struct {
+	ID          string    `json:"id"`
+	MerchantID  string    `json:"merchant_id"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"` // Only returned when the endpoint is created
+	EventTypes  []string  `json:"event_types"`      // Empty subscribes to every event
+	Description string    `json:"description,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Subscribes reports whether the endpoint wants events of eventType
+func (e *WebhookEndpoint) Subscribes(eventType string) bool {
+	if len(e.EventTypes) == 0 {
+		return true
+	}
+	for _, filter := range e.EventTypes {
+		if filter == "*" || filter == eventType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(filter, "*"); prefix != filter && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event queued for one endpoint
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// WebhookAttempt is one HTTP request made for a delivery
+type WebhookAttempt struct {
+	Attempt     int       `json:"attempt"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int       `json:"duration_ms"`
+	Manual      bool      `json:"manual"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// Succeeded reports whether the endpoint accepted the event
+func (a *WebhookAttempt) Succeeded() bool {
+	return a.Error == "" && a.StatusCode >= 200 && a.StatusCode < 300
+}
+
+// webhookEventType is the name endpoints filter on, e.g. transaction.charge_succeeded
+func webhookEventType(msgType, event string) string {
+	return msgType + "." + event
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.payload" under secret
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff is the delay after the given number of failed attempts
+func (c WebhookConfig) backoff(attempts int) time.Duration {
+	delay := c.RetryBase
+	for i := 1; i < attempts && delay < c.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > c.RetryMax {
+		delay = c.RetryMax
+	}
+	return delay
+}
+
+// WebhookDispatcher queues events for merchant endpoints and delivers them,
+// retrying with exponential backoff until they are accepted or dead-lettered
+type WebhookDispatcher struct {
+	db         *DB
+	cfg        WebhookConfig
+	merchantID string // Owner of events that don't name a merchant
+	client     *http.Client
+	wake       chan struct{}
+}
+
+// NewWebhookDispatcher creates a dispatcher; call Run to start delivering
+func NewWebhookDispatcher(db *DB, cfg WebhookConfig, merchantID string) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:         db,
+		cfg:        cfg,
+		merchantID: merchantID,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// eventMerchant returns the merchant an event belongs to: the merchant_id
+// in its data, or the deployment's merchant when it names none
+func (d *WebhookDispatcher) eventMerchant(payload []byte) string {
+	var event struct {
+		Data struct {
+			MerchantID string `json:"merchant_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err == nil && event.Data.MerchantID != "" {
+		return event.Data.MerchantID
+	}
+	return d.merchantID
+}
+
+// webhookRecipients picks the endpoints of merchantID subscribed to eventType
+func webhookRecipients(endpoints []*WebhookEndpoint, merchantID, eventType string) []*WebhookEndpoint {
+	var recipients []*WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.MerchantID == merchantID && endpoint.Enabled && endpoint.Subscribes(eventType) {
+			recipients = append(recipients, endpoint)
+		}
+	}
+	return recipients
+}
+
+// Enqueue queues msg for the enabled endpoints of the event's merchant that
+// are subscribed to its event type. The body is the WebSocket message
+// itself; queuing the same event ID again is a no-op.
+func (d *WebhookDispatcher) Enqueue(ctx context.Context, msg *ws.Message) error {
+	if !webhookMessageTypes[msg.Type] {
+		return nil
+	}
+	if msg.ID == "" {
+		msg.ID = uuid.New().String()
+	}
+
+	eventType := webhookEventType(msg.Type, msg.Event)
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	merchantID := d.eventMerchant(payload)
+	if merchantID == "" {
+		log.Printf("Event %s (%s) has no merchant, not queuing webhooks", msg.ID, eventType)
+		return nil
+	}
+
+	endpoints, err := d.db.ListWebhookEndpoints(ctx, merchantID, true)
+	if err != nil {
+		return err
+	}
+
+	queued := 0
+	for _, endpoint := range webhookRecipients(endpoints, merchantID, eventType) {
+		delivery := &WebhookDelivery{
+			EndpointID: endpoint.ID,
+			EventID:    msg.ID,
+			EventType:  eventType,
+			Payload:    payload,
+		}
+		if err := d.db.CreateWebhookDelivery(ctx, delivery); err != nil {
+			return fmt.Errorf("queue %s for endpoint %s: %w", eventType, endpoint.ID, err)
+		}
+		queued++
+	}
+
+	if queued > 0 {
+		d.nudge()
+	}
+	return nil
+}
+
+// nudge wakes the delivery loop without waiting for the next poll
+func (d *WebhookDispatcher) nudge() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due webhooks until the process exits
+func (d *WebhookDispatcher) Run() {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		d.deliverDue()
+	}
+}
+
+// deliverDue sends every delivery whose next attempt is due, a batch at a time
+func (d *WebhookDispatcher) deliverDue() {
+	const batchSize = 20
+	lease := 2 * d.cfg.Timeout
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), lease)
+		deliveries, err := d.db.ClaimDueWebhookDeliveries(ctx, batchSize, lease)
+		if err != nil {
+			cancel()
+			log.Printf("Failed to load due webhook deliveries: %v", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func(delivery *WebhookDelivery) {
+				defer wg.Done()
+				if _, err := d.Attempt(ctx, delivery, false); err != nil {
+					log.Printf("Webhook delivery %s: %v", delivery.ID, err)
+				}
+			}(delivery)
+		}
+		wg.Wait()
+		cancel()
+
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+// Attempt posts a delivery to its endpoint once and records the outcome.
+// Manual attempts never schedule retries or dead-letter a delivery; they
+// only mark it delivered when the endpoint accepts it.
+func (d *WebhookDispatcher) Attempt(ctx context.Context, delivery *WebhookDelivery, manual bool) (*WebhookAttempt, error) {
+	endpoint, err := d.db.GetWebhookEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		return nil, fmt.Errorf("load endpoint %s: %w", delivery.EndpointID, err)
+	}
+
+	attempt := &WebhookAttempt{
+		Attempt:     delivery.Attempts + 1,
+		Manual:      manual,
+		AttemptedAt: time.Now(),
+	}
+	if endpoint.Enabled || manual {
+		attempt.StatusCode, attempt.Error = d.send(ctx, endpoint, delivery)
+	} else {
+		attempt.Error = "endpoint is disabled"
+	}
+	attempt.DurationMs = int(time.Since(attempt.AttemptedAt).Milliseconds())
+
+	delivery.Attempts = attempt.Attempt
+	delivery.LastAttemptAt = &attempt.AttemptedAt
+	delivery.LastStatusCode = attempt.StatusCode
+	delivery.LastError = attempt.Error
+
+	switch {
+	case attempt.Succeeded():
+		delivery.Status = WebhookDelivered
+		delivery.DeliveredAt = &attempt.AttemptedAt
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	case manual:
+		// Leave the retry schedule as it was
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		delivery.Status = WebhookDeadLetter
+		delivery.NextAttemptAt = nil
+		log.Printf("Webhook delivery %s dead-lettered after %d attempts: %s", delivery.ID, delivery.Attempts, attempt.Error)
+	default:
+		next := time.Now().Add(d.cfg.backoff(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+
+	// Record the outcome even if the request context ran out during the send
+	recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.db.RecordWebhookAttempt(recordCtx, delivery, attempt); err != nil {
+		return attempt, fmt.Errorf("record attempt: %w", err)
+	}
+	return attempt, nil
+}
+
+// send posts the signed payload and returns the response status, or an
+// error message when the endpoint did not accept it
+func (d *WebhookDispatcher) send(ctx context.Context, endpoint *WebhookEndpoint, delivery *WebhookDelivery) (int, string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SubscriptionPlatform-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Id", delivery.EventID)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "v1="+signWebhook(endpoint.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Sprintf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, ""
+}
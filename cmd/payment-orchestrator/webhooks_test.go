@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	ws "github.com/AnuragDani/subscription-platform/internal/websocket"
+)
+
+func TestEventMerchant(t *testing.T) {
+	d := &WebhookDispatcher{merchantID: "merchant_demo"}
+
+	tests := []struct {
+		name string
+		data interface{}
+		want string
+	}{
+		{"names its merchant", map[string]interface{}{"transaction_id": "txn_1", "merchant_id": "merchant_a"}, "merchant_a"},
+		{"relayed from the outbox", json.RawMessage(`{"merchant_id":"merchant_b","status":"succeeded"}`), "merchant_b"},
+		{"names no merchant", map[string]interface{}{"transaction_id": "txn_1"}, "merchant_demo"},
+		{"empty merchant", map[string]interface{}{"merchant_id": ""}, "merchant_demo"},
+		{"merchant is not a string", map[string]interface{}{"merchant_id": 42}, "merchant_demo"},
+		{"no data", nil, "merchant_demo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := json.Marshal(ws.NewMessage(ws.TypeTransaction, "charge_succeeded", tt.data))
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if got := d.eventMerchant(payload); got != tt.want {
+				t.Errorf("eventMerchant() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookRecipients(t *testing.T) {
+	endpoints := []*WebhookEndpoint{
+		{ID: "we_a_all", MerchantID: "merchant_a", Enabled: true},
+		{ID: "we_a_refunds", MerchantID: "merchant_a", Enabled: true, EventTypes: []string{"transaction.refund_*"}},
+		{ID: "we_a_disabled", MerchantID: "merchant_a"},
+		{ID: "we_b_all", MerchantID: "merchant_b", Enabled: true},
+		{ID: "we_b_wildcard", MerchantID: "merchant_b", Enabled: true, EventTypes: []string{"*"}},
+	}
+
+	tests := []struct {
+		name       string
+		merchantID string
+		eventType  string
+		want       []string
+	}{
+		{"merchant A's charge", "merchant_a", "transaction.charge_succeeded", []string{"we_a_all"}},
+		{"merchant A's refund", "merchant_a", "transaction.refund_processed", []string{"we_a_all", "we_a_refunds"}},
+		{"merchant B's charge", "merchant_b", "transaction.charge_succeeded", []string{"we_b_all", "we_b_wildcard"}},
+		{"merchant with no endpoints", "merchant_c", "transaction.charge_succeeded", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, endpoint := range webhookRecipients(endpoints, tt.merchantID, tt.eventType) {
+				got = append(got, endpoint.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("recipients = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookRecipientsNeverCrossMerchants(t *testing.T) {
+	d := &WebhookDispatcher{merchantID: "merchant_demo"}
+	endpoints := []*WebhookEndpoint{
+		{ID: "we_a", MerchantID: "merchant_a", Enabled: true},
+		{ID: "we_b", MerchantID: "merchant_b", Enabled: true, EventTypes: []string{"*"}},
+	}
+
+	payload, err := json.Marshal(ws.NewMessage(ws.TypeTransaction, "charge_succeeded",
+		map[string]interface{}{"transaction_id": "txn_1", "merchant_id": "merchant_a"}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// Even if the endpoint lookup returned everyone, only merchant A's
+	// endpoints may be queued
+	recipients := webhookRecipients(endpoints, d.eventMerchant(payload), "transaction.charge_succeeded")
+	if len(recipients) != 1 || recipients[0].ID != "we_a" {
+		for _, endpoint := range recipients {
+			t.Errorf("merchant A's event queued for %s of %s", endpoint.ID, endpoint.MerchantID)
+		}
+		t.Fatalf("got %d recipients, want only we_a", len(recipients))
+	}
+}
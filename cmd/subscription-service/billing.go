@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,7 +15,7 @@ import (
 type Invoice struct {
 	ID             string    `json:"id"`
 	SubscriptionID string    `json:"subscription_id"`
-	Amount         int64     `json:"amount"` // in cents
+	Amount         int64     `json:"amount"` // in minor units of Currency
 	Currency       string    `json:"currency"`
 	Status         string    `json:"status"` // paid, failed, pending
 	TransactionID  string    `json:"transaction_id,omitempty"`
@@ -40,14 +41,16 @@ type ChargeSubscriptionResponse struct {
 // BillingHandler handles billing-related operations
 type BillingHandler struct {
 	db                 *DB
+	events             *EventPublisher
 	orchestratorClient *PaymentOrchestratorClient
 	logger             *log.Logger
 }
 
 // NewBillingHandler creates a new billing handler
-func NewBillingHandler(db *DB, orchestratorURL string, logger *log.Logger) *BillingHandler {
+func NewBillingHandler(db *DB, events *EventPublisher, orchestratorURL string, logger *log.Logger) *BillingHandler {
 	return &BillingHandler{
 		db:                 db,
+		events:             events,
 		orchestratorClient: NewPaymentOrchestratorClient(orchestratorURL),
 		logger:             logger,
 	}
@@ -86,7 +89,12 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Calculate charge amount (could include proration in real implementation)
-	chargeAmount := float64(plan.Amount) / 100 // Convert from cents to dollars for orchestrator
+	chargeAmount, err := plan.Price()
+	if err != nil {
+		bh.logger.Printf("Plan %s has an invalid price: %v", plan.ID, err)
+		respondError(w, http.StatusInternalServerError, "Plan has an invalid price", "INVALID_PLAN_PRICE")
+		return
+	}
 
 	// Generate idempotency key
 	idempotencyKey := fmt.Sprintf("sub_%s_%s", subscriptionID, time.Now().Format("2006-01-02"))
@@ -95,9 +103,15 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 	chargeReq := &OrchestratorChargeRequest{
 		SubscriptionID:  subscriptionID,
 		PaymentMethodID: sub.PaymentMethodID,
-		Amount:          chargeAmount,
-		Currency:        sub.Currency,
+		AmountMinor:     chargeAmount.Amount,
+		Currency:        chargeAmount.Currency,
 		IdempotencyKey:  idempotencyKey,
+		// Renewals are charged without the customer, on the card they stored
+		StoredCredential: &StoredCredential{
+			Initiator: "merchant",
+			Sequence:  "subsequent",
+			Reason:    "recurring",
+		},
 	}
 
 	// If no payment method, we need to handle it gracefully
@@ -106,8 +120,8 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 		chargeReq.PaymentMethodID = "pm_demo_" + uuid.New().String()[:8]
 	}
 
-	bh.logger.Printf("Charging subscription %s: amount=%.2f, currency=%s, payment_method=%s",
-		subscriptionID, chargeAmount, sub.Currency, chargeReq.PaymentMethodID)
+	bh.logger.Printf("Charging subscription %s: amount=%s, payment_method=%s",
+		subscriptionID, chargeAmount, chargeReq.PaymentMethodID)
 
 	// Call Payment Orchestrator
 	chargeResp, err := bh.orchestratorClient.Charge(ctx, chargeReq)
@@ -116,7 +130,7 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 		bh.logger.Printf("Error calling orchestrator: %v", err)
 
 		// Mark subscription as past_due on payment failure
-		bh.db.UpdateSubscriptionStatus(ctx, subscriptionID, SubscriptionStatusPastDue)
+		bh.markPastDue(ctx, subscriptionID)
 
 		respondJSON(w, http.StatusPaymentRequired, ChargeSubscriptionResponse{
 			Success:      false,
@@ -131,8 +145,8 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 	invoice := &Invoice{
 		ID:             uuid.New().String(),
 		SubscriptionID: subscriptionID,
-		Amount:         plan.Amount,
-		Currency:       sub.Currency,
+		Amount:         chargeAmount.Amount,
+		Currency:       chargeAmount.Currency,
 		TransactionID:  chargeResp.TransactionID,
 		ProcessorUsed:  chargeResp.ProcessorUsed,
 		PeriodStart:    now,
@@ -165,7 +179,7 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 		invoice.ErrorMessage = chargeResp.UserMessage
 
 		// Mark subscription as past_due
-		bh.db.UpdateSubscriptionStatus(ctx, subscriptionID, SubscriptionStatusPastDue)
+		bh.markPastDue(ctx, subscriptionID)
 
 		bh.logger.Printf("Subscription %s charge failed: error=%s",
 			subscriptionID, chargeResp.ErrorCode)
@@ -179,6 +193,20 @@ func (bh *BillingHandler) ChargeSubscription(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// markPastDue moves a subscription to past_due and records the event with it
+func (bh *BillingHandler) markPastDue(ctx context.Context, subscriptionID string) {
+	err := bh.db.InTx(ctx, func(tx *DB) error {
+		sub, err := tx.UpdateSubscriptionStatus(ctx, subscriptionID, SubscriptionStatusPastDue)
+		if err != nil {
+			return err
+		}
+		return bh.events.EmitSubscriptionPastDue(ctx, tx.q, sub)
+	})
+	if err != nil {
+		bh.logger.Printf("Error marking subscription %s past due: %v", subscriptionID, err)
+	}
+}
+
 // ListInvoices handles GET /subscriptions/{id}/invoices
 // Note: In a real implementation, invoices would be stored in a database table
 // For the demo, we return mock data based on transaction history
@@ -28,11 +28,22 @@ func NewPaymentOrchestratorClient(baseURL string) *PaymentOrchestratorClient {
 
 // ChargeRequest represents a request to charge a subscription
 type OrchestratorChargeRequest struct {
-	SubscriptionID  string  `json:"subscription_id"`
-	PaymentMethodID string  `json:"payment_method_id"`
-	Amount          float64 `json:"amount"`
-	Currency        string  `json:"currency"`
-	IdempotencyKey  string  `json:"idempotency_key,omitempty"`
+	SubscriptionID  string `json:"subscription_id"`
+	PaymentMethodID string `json:"payment_method_id"`
+	AmountMinor     int64  `json:"amount_minor"`
+	Currency        string `json:"currency"`
+	IdempotencyKey  string `json:"idempotency_key,omitempty"`
+
+	StoredCredential *StoredCredential `json:"stored_credential,omitempty"`
+}
+
+// StoredCredential flags a charge made with a card kept on file. Renewals
+// are merchant-initiated; the orchestrator adds the network transaction ID
+// of the charge that stored the card.
+type StoredCredential struct {
+	Initiator string `json:"initiator"`
+	Sequence  string `json:"sequence"`
+	Reason    string `json:"reason"`
 }
 
 // ChargeResponse represents the response from a charge request
@@ -40,7 +51,7 @@ type OrchestratorChargeResponse struct {
 	Success       bool    `json:"success"`
 	TransactionID string  `json:"transaction_id"`
 	ProcessorUsed string  `json:"processor_used"`
-	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
 	Currency      string  `json:"currency"`
 	UserMessage   string  `json:"user_message,omitempty"`
 	ErrorCode     string  `json:"error_code,omitempty"`
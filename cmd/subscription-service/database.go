@@ -11,9 +11,17 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// querier is satisfied by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // DB wraps the database connection
 type DB struct {
 	conn *sql.DB
+	q    querier // conn, or the transaction inside InTx
 }
 
 // NewDB creates a new database connection
@@ -32,7 +40,22 @@ func NewDB(connectionString string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{conn: conn}, nil
+	return &DB{conn: conn, q: conn}, nil
+}
+
+// InTx runs fn against a DB whose queries share one transaction, committing
+// only if fn succeeds
+func (db *DB) InTx(ctx context.Context, fn func(tx *DB) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&DB{conn: db.conn, q: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Close closes the database connection
@@ -57,7 +80,7 @@ func (db *DB) GetPlan(ctx context.Context, id string) (*Plan, error) {
 	var p Plan
 	var features []byte
 
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
+	err := db.q.QueryRowContext(ctx, query, id).Scan(
 		&p.ID, &p.Name, &p.DisplayName, &p.Amount, &p.Currency, &p.Interval,
 		&p.TrialDays, &features, &p.IsActive, &p.CreatedAt, &p.UpdatedAt,
 	)
@@ -86,7 +109,7 @@ func (db *DB) ListPlans(ctx context.Context, includeInactive bool) ([]Plan, erro
 
 	query += " ORDER BY amount ASC"
 
-	rows, err := db.conn.QueryContext(ctx, query)
+	rows, err := db.q.QueryContext(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list plans: %w", err)
 	}
@@ -125,6 +148,10 @@ func (db *DB) CreateSubscription(ctx context.Context, req *CreateSubscriptionReq
 	if err != nil {
 		return nil, err
 	}
+	price, err := plan.Price()
+	if err != nil {
+		return nil, fmt.Errorf("plan %s has an invalid price: %w", plan.ID, err)
+	}
 
 	now := time.Now()
 
@@ -175,16 +202,16 @@ func (db *DB) CreateSubscription(ctx context.Context, req *CreateSubscriptionReq
 
 	query := `
 		INSERT INTO subscriptions (
-			user_id, plan_id, payment_method_id, status, amount, currency,
+			user_id, plan_id, payment_method_id, status, amount_minor, amount, currency,
 			billing_cycle, current_period_start, current_period_end,
 			next_billing_date, trial_start, trial_end, created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		RETURNING id`
 
 	var returnedID string
-	err = db.conn.QueryRowContext(ctx, query,
+	err = db.q.QueryRowContext(ctx, query,
 		userUUID, req.PlanID, paymentMethodID, status,
-		float64(plan.Amount)/100, plan.Currency, plan.Interval,
+		price.Amount, price.Major(), price.Currency, plan.Interval,
 		now, periodEnd, nextBillingDate, trialStart, trialEnd, now, now,
 	).Scan(&returnedID)
 
@@ -198,21 +225,22 @@ func (db *DB) CreateSubscription(ctx context.Context, req *CreateSubscriptionReq
 // GetSubscription retrieves a subscription by ID
 func (db *DB) GetSubscription(ctx context.Context, id string) (*Subscription, error) {
 	query := `
-		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount, currency,
+		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount_minor, currency,
 			   billing_cycle, current_period_start, current_period_end,
 			   next_billing_date, cancel_at_period_end, canceled_at,
-			   trial_start, trial_end, created_at, updated_at
+			   trial_start, trial_end, created_at, updated_at,
+			   payment_method_required_at, COALESCE(payment_method_required_reason, '')
 		FROM subscriptions WHERE id = $1`
 
 	var s Subscription
 	var paymentMethodID string
-	var amount float64
 
-	err := db.conn.QueryRowContext(ctx, query, id).Scan(
-		&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &amount, &s.Currency,
+	err := db.q.QueryRowContext(ctx, query, id).Scan(
+		&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &s.Amount, &s.Currency,
 		&s.BillingCycle, &s.CurrentPeriodStart, &s.CurrentPeriodEnd,
 		&s.NextBillingDate, &s.CancelAtPeriodEnd, &s.CanceledAt,
 		&s.TrialStart, &s.TrialEnd, &s.CreatedAt, &s.UpdatedAt,
+		&s.PaymentMethodRequiredAt, &s.PaymentMethodRequiredReason,
 	)
 
 	if err == sql.ErrNoRows {
@@ -226,9 +254,6 @@ func (db *DB) GetSubscription(ctx context.Context, id string) (*Subscription, er
 		s.PaymentMethodID = paymentMethodID
 	}
 
-	// Convert amount from dollars to cents
-	s.Amount = int64(amount * 100)
-
 	return &s, nil
 }
 
@@ -254,9 +279,10 @@ func (db *DB) GetSubscriptionWithPlan(ctx context.Context, id string) (*Subscrip
 func (db *DB) ListSubscriptions(ctx context.Context, userID string, status string) ([]SubscriptionWithPlan, error) {
 	query := `
 		SELECT s.id, s.user_id, s.plan_id, COALESCE(s.payment_method_id::text, ''), s.status,
-			   s.amount, s.currency, s.billing_cycle, s.current_period_start, s.current_period_end,
+			   s.amount_minor, s.currency, s.billing_cycle, s.current_period_start, s.current_period_end,
 			   s.next_billing_date, s.cancel_at_period_end, s.canceled_at,
-			   s.trial_start, s.trial_end, s.created_at, s.updated_at
+			   s.trial_start, s.trial_end, s.created_at, s.updated_at,
+			   s.payment_method_required_at, COALESCE(s.payment_method_required_reason, '')
 		FROM subscriptions s
 		WHERE 1=1`
 
@@ -277,7 +303,7 @@ func (db *DB) ListSubscriptions(ctx context.Context, userID string, status strin
 
 	query += " ORDER BY s.created_at DESC"
 
-	rows, err := db.conn.QueryContext(ctx, query, args...)
+	rows, err := db.q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
 	}
@@ -289,13 +315,13 @@ func (db *DB) ListSubscriptions(ctx context.Context, userID string, status strin
 	for rows.Next() {
 		var s Subscription
 		var paymentMethodID string
-		var amount float64
 
 		err := rows.Scan(
 			&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status,
-			&amount, &s.Currency, &s.BillingCycle, &s.CurrentPeriodStart, &s.CurrentPeriodEnd,
+			&s.Amount, &s.Currency, &s.BillingCycle, &s.CurrentPeriodStart, &s.CurrentPeriodEnd,
 			&s.NextBillingDate, &s.CancelAtPeriodEnd, &s.CanceledAt,
 			&s.TrialStart, &s.TrialEnd, &s.CreatedAt, &s.UpdatedAt,
+			&s.PaymentMethodRequiredAt, &s.PaymentMethodRequiredReason,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription: %w", err)
@@ -305,9 +331,6 @@ func (db *DB) ListSubscriptions(ctx context.Context, userID string, status strin
 			s.PaymentMethodID = paymentMethodID
 		}
 
-		// Convert amount from dollars to cents
-		s.Amount = int64(amount * 100)
-
 		// Get plan from cache or database
 		var plan *Plan
 		if cached, ok := planCache[s.PlanID]; ok {
@@ -350,7 +373,7 @@ func (db *DB) UpdateSubscription(ctx context.Context, id string, updates map[str
 	query += fmt.Sprintf(" WHERE id = $%d", argNum)
 	args = append(args, id)
 
-	result, err := db.conn.ExecContext(ctx, query, args...)
+	result, err := db.q.ExecContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update subscription: %w", err)
 	}
@@ -386,10 +409,11 @@ func (db *DB) CancelSubscription(ctx context.Context, id string) (*Subscription,
 // GetSubscriptionsDue retrieves subscriptions due for billing
 func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscription, error) {
 	query := `
-		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount, currency,
+		SELECT id, user_id, plan_id, COALESCE(payment_method_id::text, ''), status, amount_minor, currency,
 			   billing_cycle, current_period_start, current_period_end,
 			   next_billing_date, cancel_at_period_end, canceled_at,
-			   trial_start, trial_end, created_at, updated_at
+			   trial_start, trial_end, created_at, updated_at,
+			   payment_method_required_at, COALESCE(payment_method_required_reason, '')
 		FROM subscriptions
 		WHERE status = 'active'
 		  AND next_billing_date <= NOW()
@@ -397,7 +421,7 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 		ORDER BY next_billing_date ASC
 		LIMIT $1`
 
-	rows, err := db.conn.QueryContext(ctx, query, limit)
+	rows, err := db.q.QueryContext(ctx, query, limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get due subscriptions: %w", err)
 	}
@@ -407,13 +431,13 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 	for rows.Next() {
 		var s Subscription
 		var paymentMethodID string
-		var amount float64
 
 		err := rows.Scan(
-			&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &amount, &s.Currency,
+			&s.ID, &s.UserID, &s.PlanID, &paymentMethodID, &s.Status, &s.Amount, &s.Currency,
 			&s.BillingCycle, &s.CurrentPeriodStart, &s.CurrentPeriodEnd,
 			&s.NextBillingDate, &s.CancelAtPeriodEnd, &s.CanceledAt,
 			&s.TrialStart, &s.TrialEnd, &s.CreatedAt, &s.UpdatedAt,
+			&s.PaymentMethodRequiredAt, &s.PaymentMethodRequiredReason,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan subscription: %w", err)
@@ -423,7 +447,6 @@ func (db *DB) GetSubscriptionsDue(ctx context.Context, limit int) ([]Subscriptio
 			s.PaymentMethodID = paymentMethodID
 		}
 
-		s.Amount = int64(amount * 100)
 		subscriptions = append(subscriptions, s)
 	}
 
@@ -451,7 +474,7 @@ func (db *DB) GetSubscriptionStats(ctx context.Context) (map[string]interface{},
 		ARRMonthly    float64
 	}
 
-	err := db.conn.QueryRowContext(ctx, query).Scan(
+	err := db.q.QueryRowContext(ctx, query).Scan(
 		&stats.ActiveCount, &stats.PastDueCount, &stats.CanceledCount,
 		&stats.TrialingCount, &stats.MRR, &stats.ARRMonthly,
 	)
@@ -1,32 +1,37 @@
 package main
 
 import (
+	"context"
+
 	"github.com/AnuragDani/subscription-platform/internal/events"
+	"github.com/AnuragDani/subscription-platform/internal/money"
 )
 
-// EventPublisher wraps the events publisher for subscription-specific events
+// EventPublisher records subscription events in the outbox. Pass the
+// transaction that changes the subscription so the event commits with it.
 type EventPublisher struct {
-	publisher *events.Publisher
+	outbox *events.Outbox
 }
 
 // NewEventPublisher creates a new event publisher
-func NewEventPublisher(orchestratorURL string) *EventPublisher {
+func NewEventPublisher() *EventPublisher {
 	return &EventPublisher{
-		publisher: events.NewPublisher(orchestratorURL),
+		outbox: events.NewOutbox("subscription-service"),
 	}
 }
 
 // EmitSubscriptionCreated emits a subscription created event
-func (e *EventPublisher) EmitSubscriptionCreated(sub *Subscription, plan *Plan) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitSubscriptionCreated(ctx context.Context, ex events.Execer, sub *Subscription, plan *Plan) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
 	data := events.SubscriptionEventData{
 		SubscriptionID: sub.ID,
 		UserID:         sub.UserID,
 		PlanID:         sub.PlanID,
-		Amount:         float64(sub.Amount) / 100,
+		Amount:         money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:    sub.Amount,
 		Currency:       sub.Currency,
 		Status:         string(sub.Status),
 	}
@@ -35,13 +40,13 @@ func (e *EventPublisher) EmitSubscriptionCreated(sub *Subscription, plan *Plan)
 		data.PlanName = plan.DisplayName
 	}
 
-	e.publisher.PublishSubscriptionCreated(data)
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionCreated, data)
 }
 
 // EmitSubscriptionUpgraded emits a subscription upgraded event
-func (e *EventPublisher) EmitSubscriptionUpgraded(sub *Subscription, plan *Plan, previousPlanID string) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitSubscriptionUpgraded(ctx context.Context, ex events.Execer, sub *Subscription, plan *Plan, previousPlanID string) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
 	data := events.SubscriptionEventData{
@@ -49,7 +54,8 @@ func (e *EventPublisher) EmitSubscriptionUpgraded(sub *Subscription, plan *Plan,
 		UserID:         sub.UserID,
 		PlanID:         sub.PlanID,
 		PreviousPlanID: previousPlanID,
-		Amount:         float64(sub.Amount) / 100,
+		Amount:         money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:    sub.Amount,
 		Currency:       sub.Currency,
 		Status:         string(sub.Status),
 	}
@@ -58,13 +64,13 @@ func (e *EventPublisher) EmitSubscriptionUpgraded(sub *Subscription, plan *Plan,
 		data.PlanName = plan.DisplayName
 	}
 
-	e.publisher.PublishSubscriptionUpgraded(data)
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionUpgraded, data)
 }
 
 // EmitSubscriptionDowngraded emits a subscription downgraded event
-func (e *EventPublisher) EmitSubscriptionDowngraded(sub *Subscription, plan *Plan, previousPlanID string) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitSubscriptionDowngraded(ctx context.Context, ex events.Execer, sub *Subscription, plan *Plan, previousPlanID string) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
 	data := events.SubscriptionEventData{
@@ -72,7 +78,8 @@ func (e *EventPublisher) EmitSubscriptionDowngraded(sub *Subscription, plan *Pla
 		UserID:         sub.UserID,
 		PlanID:         sub.PlanID,
 		PreviousPlanID: previousPlanID,
-		Amount:         float64(sub.Amount) / 100,
+		Amount:         money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:    sub.Amount,
 		Currency:       sub.Currency,
 		Status:         string(sub.Status),
 	}
@@ -81,37 +88,77 @@ func (e *EventPublisher) EmitSubscriptionDowngraded(sub *Subscription, plan *Pla
 		data.PlanName = plan.DisplayName
 	}
 
-	e.publisher.PublishSubscriptionDowngraded(data)
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionDowngraded, data)
 }
 
 // EmitSubscriptionCanceled emits a subscription canceled event
-func (e *EventPublisher) EmitSubscriptionCanceled(sub *Subscription) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitSubscriptionCanceled(ctx context.Context, ex events.Execer, sub *Subscription) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
-	e.publisher.PublishSubscriptionCanceled(events.SubscriptionEventData{
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionCanceled, events.SubscriptionEventData{
 		SubscriptionID: sub.ID,
 		UserID:         sub.UserID,
 		PlanID:         sub.PlanID,
-		Amount:         float64(sub.Amount) / 100,
+		Amount:         money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:    sub.Amount,
 		Currency:       sub.Currency,
 		Status:         string(sub.Status),
 	})
 }
 
 // EmitSubscriptionPastDue emits a subscription past_due event
-func (e *EventPublisher) EmitSubscriptionPastDue(sub *Subscription) {
-	if e == nil || e.publisher == nil {
-		return
+func (e *EventPublisher) EmitSubscriptionPastDue(ctx context.Context, ex events.Execer, sub *Subscription) error {
+	if e == nil || e.outbox == nil {
+		return nil
 	}
 
-	e.publisher.PublishSubscriptionPastDue(events.SubscriptionEventData{
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionPastDue, events.SubscriptionEventData{
 		SubscriptionID: sub.ID,
 		UserID:         sub.UserID,
 		PlanID:         sub.PlanID,
-		Amount:         float64(sub.Amount) / 100,
+		Amount:         money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:    sub.Amount,
 		Currency:       sub.Currency,
 		Status:         "past_due",
 	})
 }
+
+// EmitSubscriptionPaymentMethodRequired emits an event asking the customer
+// for a new payment method
+func (e *EventPublisher) EmitSubscriptionPaymentMethodRequired(ctx context.Context, ex events.Execer, sub *Subscription) error {
+	if e == nil || e.outbox == nil {
+		return nil
+	}
+
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionPaymentMethodRequired, events.SubscriptionEventData{
+		SubscriptionID:  sub.ID,
+		UserID:          sub.UserID,
+		PlanID:          sub.PlanID,
+		Amount:          money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:     sub.Amount,
+		Currency:        sub.Currency,
+		Status:          string(sub.Status),
+		PaymentMethodID: sub.PaymentMethodID,
+		Reason:          sub.PaymentMethodRequiredReason,
+	})
+}
+
+// EmitSubscriptionPaymentMethodUpdated emits a subscription payment method updated event
+func (e *EventPublisher) EmitSubscriptionPaymentMethodUpdated(ctx context.Context, ex events.Execer, sub *Subscription) error {
+	if e == nil || e.outbox == nil {
+		return nil
+	}
+
+	return e.outbox.Write(ctx, ex, events.TypeSubscription, events.SubscriptionPaymentMethodUpdated, events.SubscriptionEventData{
+		SubscriptionID:  sub.ID,
+		UserID:          sub.UserID,
+		PlanID:          sub.PlanID,
+		Amount:          money.ToMajor(sub.Amount, sub.Currency),
+		AmountMinor:     sub.Amount,
+		Currency:        sub.Currency,
+		Status:          string(sub.Status),
+		PaymentMethodID: sub.PaymentMethodID,
+	})
+}
@@ -12,12 +12,13 @@ import (
 // Handler holds dependencies for HTTP handlers
 type Handler struct {
 	db     *DB
+	events *EventPublisher
 	logger *log.Logger
 }
 
 // NewHandler creates a new handler with dependencies
-func NewHandler(db *DB, logger *log.Logger) *Handler {
-	return &Handler{db: db, logger: logger}
+func NewHandler(db *DB, events *EventPublisher, logger *log.Logger) *Handler {
+	return &Handler{db: db, events: events, logger: logger}
 }
 
 // respondJSON sends a JSON response
@@ -93,7 +94,18 @@ func (h *Handler) CreateSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sub, err := h.db.CreateSubscription(ctx, &req)
+	var sub *Subscription
+	err := h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		if sub, err = tx.CreateSubscription(ctx, &req); err != nil {
+			return err
+		}
+		plan, err := tx.GetPlan(ctx, sub.PlanID)
+		if err != nil {
+			return err
+		}
+		return h.events.EmitSubscriptionCreated(ctx, tx.q, sub, plan)
+	})
 	if err != nil {
 		if err == ErrPlanNotFound {
 			respondError(w, http.StatusBadRequest, "Plan not found", "PLAN_NOT_FOUND")
@@ -165,7 +177,14 @@ func (h *Handler) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	sub, err := h.db.CancelSubscription(ctx, id)
+	var sub *Subscription
+	err := h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		if sub, err = tx.CancelSubscription(ctx, id); err != nil {
+			return err
+		}
+		return h.events.EmitSubscriptionCanceled(ctx, tx.q, sub)
+	})
 	if err != nil {
 		if err == ErrSubscriptionNotFound {
 			respondError(w, http.StatusNotFound, "Subscription not found", "SUBSCRIPTION_NOT_FOUND")
@@ -232,6 +251,12 @@ func (h *Handler) UpgradeSubscription(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusInternalServerError, "Failed to get new plan", "INTERNAL_ERROR")
 		return
 	}
+	newPrice, err := newPlan.Price()
+	if err != nil {
+		h.logger.Printf("Plan %s has an invalid price: %v", newPlan.ID, err)
+		respondError(w, http.StatusInternalServerError, "New plan has an invalid price", "INVALID_PLAN_PRICE")
+		return
+	}
 
 	// Verify this is an upgrade (new plan costs more)
 	if newPlan.Amount <= currentPlan.Amount {
@@ -251,13 +276,23 @@ func (h *Handler) UpgradeSubscription(w http.ResponseWriter, r *http.Request) {
 		newPeriodEnd = now.AddDate(1, 0, 0)
 	}
 
-	sub, err := h.db.UpdateSubscription(ctx, id, map[string]interface{}{
-		"plan_id":              req.PlanID,
-		"amount":               float64(newPlan.Amount) / 100,
-		"billing_cycle":        newPlan.Interval,
-		"current_period_start": now,
-		"current_period_end":   newPeriodEnd,
-		"next_billing_date":    newPeriodEnd,
+	var sub *Subscription
+	err = h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		sub, err = tx.UpdateSubscription(ctx, id, map[string]interface{}{
+			"plan_id":              req.PlanID,
+			"amount_minor":         newPrice.Amount,
+			"amount":               newPrice.Major(),
+			"currency":             newPrice.Currency,
+			"billing_cycle":        newPlan.Interval,
+			"current_period_start": now,
+			"current_period_end":   newPeriodEnd,
+			"next_billing_date":    newPeriodEnd,
+		})
+		if err != nil {
+			return err
+		}
+		return h.events.EmitSubscriptionUpgraded(ctx, tx.q, sub, newPlan, currentSub.PlanID)
 	})
 
 	if err != nil {
@@ -323,6 +358,12 @@ func (h *Handler) DowngradeSubscription(w http.ResponseWriter, r *http.Request)
 		respondError(w, http.StatusInternalServerError, "Failed to get new plan", "INTERNAL_ERROR")
 		return
 	}
+	newPrice, err := newPlan.Price()
+	if err != nil {
+		h.logger.Printf("Plan %s has an invalid price: %v", newPlan.ID, err)
+		respondError(w, http.StatusInternalServerError, "New plan has an invalid price", "INVALID_PLAN_PRICE")
+		return
+	}
 
 	// Verify this is a downgrade (new plan costs less)
 	if newPlan.Amount >= currentPlan.Amount {
@@ -331,10 +372,20 @@ func (h *Handler) DowngradeSubscription(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Downgrade takes effect at end of current period
-	sub, err := h.db.UpdateSubscription(ctx, id, map[string]interface{}{
-		"plan_id":       req.PlanID,
-		"amount":        float64(newPlan.Amount) / 100,
-		"billing_cycle": newPlan.Interval,
+	var sub *Subscription
+	err = h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		sub, err = tx.UpdateSubscription(ctx, id, map[string]interface{}{
+			"plan_id":       req.PlanID,
+			"amount_minor":  newPrice.Amount,
+			"amount":        newPrice.Major(),
+			"currency":      newPrice.Currency,
+			"billing_cycle": newPlan.Interval,
+		})
+		if err != nil {
+			return err
+		}
+		return h.events.EmitSubscriptionDowngraded(ctx, tx.q, sub, newPlan, currentSub.PlanID)
 	})
 
 	if err != nil {
@@ -352,6 +403,61 @@ func (h *Handler) DowngradeSubscription(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// MarkPastDue handles PUT /subscriptions/{id}/past_due, used by the payment
+// orchestrator when a payment is clawed back by a lost dispute
+func (h *Handler) MarkPastDue(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var req MarkPastDueRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST")
+			return
+		}
+	}
+
+	var sub *Subscription
+	changed := false
+	err := h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		if sub, err = tx.GetSubscription(ctx, id); err != nil {
+			return err
+		}
+		if sub.Status == SubscriptionStatusCanceled || sub.Status == SubscriptionStatusPastDue {
+			return nil
+		}
+		if sub, err = tx.UpdateSubscriptionStatus(ctx, id, SubscriptionStatusPastDue); err != nil {
+			return err
+		}
+		changed = true
+		return h.events.EmitSubscriptionPastDue(ctx, tx.q, sub)
+	})
+	if err != nil {
+		if err == ErrSubscriptionNotFound {
+			respondError(w, http.StatusNotFound, "Subscription not found", "SUBSCRIPTION_NOT_FOUND")
+			return
+		}
+		h.logger.Printf("Error marking subscription %s past due: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update subscription", "INTERNAL_ERROR")
+		return
+	}
+
+	if sub.Status == SubscriptionStatusCanceled {
+		respondError(w, http.StatusConflict, "Subscription is canceled", "SUBSCRIPTION_CANCELED")
+		return
+	}
+
+	if changed {
+		h.logger.Printf("Subscription %s marked past due (reason=%q dispute=%s)", id, req.Reason, req.DisputeID)
+	}
+	subWithPlan, _ := h.db.GetSubscriptionWithPlan(ctx, sub.ID)
+	respondJSON(w, http.StatusOK, SubscriptionResponse{
+		SubscriptionWithPlan: subWithPlan,
+		Message:              "Subscription is past due",
+	})
+}
+
 // GetSubscriptionStats handles GET /stats/subscriptions
 func (h *Handler) GetSubscriptionStats(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -34,9 +34,12 @@ func main() {
 		logger.Println("Connected to database")
 	}
 
+	// Subscription events go to the outbox with the change they describe
+	eventPublisher := NewEventPublisher()
+
 	// Create handlers
-	handler := NewHandler(db, logger)
-	billingHandler := NewBillingHandler(db, orchestratorURL, logger)
+	handler := NewHandler(db, eventPublisher, logger)
+	billingHandler := NewBillingHandler(db, eventPublisher, orchestratorURL, logger)
 
 	// Setup router
 	r := mux.NewRouter()
@@ -55,6 +58,9 @@ func main() {
 	r.HandleFunc("/subscriptions/{id}/cancel", handler.CancelSubscription).Methods("PUT")
 	r.HandleFunc("/subscriptions/{id}/upgrade", handler.UpgradeSubscription).Methods("PUT")
 	r.HandleFunc("/subscriptions/{id}/downgrade", handler.DowngradeSubscription).Methods("PUT")
+	r.HandleFunc("/subscriptions/{id}/past_due", handler.MarkPastDue).Methods("PUT")
+	r.HandleFunc("/subscriptions/{id}/payment_method", handler.UpdatePaymentMethod).Methods("PUT")
+	r.HandleFunc("/subscriptions/{id}/payment_method_required", handler.RequirePaymentMethod).Methods("PUT")
 
 	// Billing endpoints (Commit 1.3)
 	r.HandleFunc("/subscriptions/{id}/charge", billingHandler.ChargeSubscription).Methods("POST")
@@ -4,6 +4,8 @@ package main
 import (
 	"encoding/json"
 	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
 )
 
 // Plan represents a subscription plan
@@ -11,7 +13,7 @@ type Plan struct {
 	ID          string          `json:"id" db:"id"`
 	Name        string          `json:"name" db:"name"`
 	DisplayName string          `json:"display_name" db:"display_name"`
-	Amount      int64           `json:"amount" db:"amount"` // Amount in cents
+	Amount      int64           `json:"amount" db:"amount"` // Amount in minor units of Currency
 	Currency    string          `json:"currency" db:"currency"`
 	Interval    string          `json:"interval" db:"interval"` // monthly, yearly
 	TrialDays   int             `json:"trial_days" db:"trial_days"`
@@ -21,6 +23,12 @@ type Plan struct {
 	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
 }
 
+// Price returns the plan amount as minor units of the plan currency,
+// refusing a currency internal/money does not know
+func (p *Plan) Price() (money.Money, error) {
+	return money.Resolve(p.Amount, 0, p.Currency)
+}
+
 // Subscription represents a user's subscription (extended from base model)
 type Subscription struct {
 	ID                  string     `json:"id" db:"id"`
@@ -28,7 +36,7 @@ type Subscription struct {
 	PlanID              string     `json:"plan_id" db:"plan_id"`
 	PaymentMethodID     string     `json:"payment_method_id" db:"payment_method_id"`
 	Status              string     `json:"status" db:"status"`
-	Amount              int64      `json:"amount" db:"amount"` // Amount in cents
+	Amount              int64      `json:"amount" db:"amount_minor"` // Amount in minor units of Currency
 	Currency            string     `json:"currency" db:"currency"`
 	BillingCycle        string     `json:"billing_cycle" db:"billing_cycle"`
 	CurrentPeriodStart  *time.Time `json:"current_period_start,omitempty" db:"current_period_start"`
@@ -40,6 +48,10 @@ type Subscription struct {
 	TrialEnd            *time.Time `json:"trial_end,omitempty" db:"trial_end"`
 	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt           time.Time  `json:"updated_at" db:"updated_at"`
+
+	// Set when the payment method can no longer be charged and the customer must provide a new one
+	PaymentMethodRequiredAt     *time.Time `json:"payment_method_required_at,omitempty" db:"payment_method_required_at"`
+	PaymentMethodRequiredReason string     `json:"payment_method_required_reason,omitempty" db:"payment_method_required_reason"`
 }
 
 // SubscriptionWithPlan includes plan details
@@ -88,6 +100,24 @@ type UpdateSubscriptionRequest struct {
 	Status string `json:"status,omitempty"`
 }
 
+// MarkPastDueRequest records why another service put a subscription past due
+type MarkPastDueRequest struct {
+	Reason    string `json:"reason,omitempty"`
+	DisputeID string `json:"dispute_id,omitempty"`
+}
+
+// RequirePaymentMethodRequest records that a subscription's payment method
+// can no longer be charged
+type RequirePaymentMethodRequest struct {
+	PaymentMethodID string `json:"payment_method_id"`
+	Reason          string `json:"reason"` // token_suspended, token_deleted
+}
+
+// UpdatePaymentMethodRequest switches a subscription to another payment method
+type UpdatePaymentMethodRequest struct {
+	PaymentMethodID string `json:"payment_method_id"`
+}
+
 // SubscriptionResponse wraps subscription with additional info
 type SubscriptionResponse struct {
 	*SubscriptionWithPlan
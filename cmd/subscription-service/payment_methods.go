@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// RequirePaymentMethod handles PUT /subscriptions/{id}/payment_method_required.
+// The orchestrator calls it when the card network suspends or deletes the
+// token behind a subscription's payment method; the customer is asked for a
+// new one through the payment_method_required event. Repeating it is harmless.
+func (h *Handler) RequirePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var req RequirePaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST")
+		return
+	}
+	if req.PaymentMethodID == "" || req.Reason == "" {
+		respondError(w, http.StatusBadRequest, "payment_method_id and reason are required", "VALIDATION_ERROR")
+		return
+	}
+
+	var sub *Subscription
+	changed := false
+	err := h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		if sub, err = tx.GetSubscription(ctx, id); err != nil {
+			return err
+		}
+		if sub.Status == SubscriptionStatusCanceled || sub.PaymentMethodID != req.PaymentMethodID || sub.PaymentMethodRequiredAt != nil {
+			return nil
+		}
+		sub, err = tx.UpdateSubscription(ctx, id, map[string]interface{}{
+			"payment_method_required_at":     time.Now(),
+			"payment_method_required_reason": req.Reason,
+		})
+		if err != nil {
+			return err
+		}
+		changed = true
+		return h.events.EmitSubscriptionPaymentMethodRequired(ctx, tx.q, sub)
+	})
+	if err != nil {
+		if err == ErrSubscriptionNotFound {
+			respondError(w, http.StatusNotFound, "Subscription not found", "SUBSCRIPTION_NOT_FOUND")
+			return
+		}
+		h.logger.Printf("Error requiring a payment method for subscription %s: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update subscription", "INTERNAL_ERROR")
+		return
+	}
+
+	switch {
+	case sub.Status == SubscriptionStatusCanceled:
+		respondError(w, http.StatusConflict, "Subscription is canceled", "SUBSCRIPTION_CANCELED")
+		return
+	case sub.PaymentMethodID != req.PaymentMethodID:
+		respondError(w, http.StatusConflict, "Subscription no longer uses this payment method", "PAYMENT_METHOD_CHANGED")
+		return
+	}
+
+	if changed {
+		h.logger.Printf("Subscription %s needs a new payment method (reason=%q)", id, req.Reason)
+	}
+	subWithPlan, _ := h.db.GetSubscriptionWithPlan(ctx, sub.ID)
+	respondJSON(w, http.StatusOK, SubscriptionResponse{
+		SubscriptionWithPlan: subWithPlan,
+		Message:              "A new payment method is required",
+	})
+}
+
+// UpdatePaymentMethod handles PUT /subscriptions/{id}/payment_method. The
+// new payment method must belong to the subscriber and be chargeable.
+func (h *Handler) UpdatePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	var req UpdatePaymentMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST")
+		return
+	}
+	if _, err := uuid.Parse(req.PaymentMethodID); err != nil {
+		respondError(w, http.StatusBadRequest, "payment_method_id must be a payment method ID", "VALIDATION_ERROR")
+		return
+	}
+
+	var sub *Subscription
+	chargeable := false
+	err := h.db.InTx(ctx, func(tx *DB) error {
+		var err error
+		if sub, err = tx.GetSubscription(ctx, id); err != nil {
+			return err
+		}
+		if sub.Status == SubscriptionStatusCanceled {
+			return nil
+		}
+		if chargeable, err = tx.PaymentMethodChargeable(ctx, req.PaymentMethodID, sub.UserID); err != nil || !chargeable {
+			return err
+		}
+		sub, err = tx.UpdateSubscription(ctx, id, map[string]interface{}{
+			"payment_method_id":              req.PaymentMethodID,
+			"payment_method_required_at":     nil,
+			"payment_method_required_reason": nil,
+		})
+		if err != nil {
+			return err
+		}
+		return h.events.EmitSubscriptionPaymentMethodUpdated(ctx, tx.q, sub)
+	})
+	if err != nil {
+		if err == ErrSubscriptionNotFound {
+			respondError(w, http.StatusNotFound, "Subscription not found", "SUBSCRIPTION_NOT_FOUND")
+			return
+		}
+		h.logger.Printf("Error updating payment method of subscription %s: %v", id, err)
+		respondError(w, http.StatusInternalServerError, "Failed to update subscription", "INTERNAL_ERROR")
+		return
+	}
+
+	switch {
+	case sub.Status == SubscriptionStatusCanceled:
+		respondError(w, http.StatusConflict, "Subscription is canceled", "SUBSCRIPTION_CANCELED")
+		return
+	case !chargeable:
+		respondError(w, http.StatusUnprocessableEntity, "Payment method not found or can't be charged", "PAYMENT_METHOD_UNUSABLE")
+		return
+	}
+
+	h.logger.Printf("Subscription %s now charges payment method %s", id, req.PaymentMethodID)
+	subWithPlan, _ := h.db.GetSubscriptionWithPlan(ctx, sub.ID)
+	respondJSON(w, http.StatusOK, SubscriptionResponse{
+		SubscriptionWithPlan: subWithPlan,
+		Message:              "Payment method updated",
+	})
+}
+
+// PaymentMethodChargeable reports whether a payment method belongs to the
+// user, is still attached and its network token hasn't been suspended or
+// deleted
+func (db *DB) PaymentMethodChargeable(ctx context.Context, paymentMethodID, userID string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM payment_methods
+			WHERE id = $1 AND user_id = $2 AND detached_at IS NULL AND token_status = 'active'
+		)`
+
+	var chargeable bool
+	if err := db.q.QueryRowContext(ctx, query, paymentMethodID, userID).Scan(&chargeable); err != nil {
+		return false, fmt.Errorf("failed to check payment method: %w", err)
+	}
+	return chargeable, nil
+}
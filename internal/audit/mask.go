@@ -0,0 +1,162 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// panPattern finds card-number-like digit runs, optionally grouped by spaces or dashes
+var panPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+
+// tokenPrefixes mark path segments and values that are vaulted or network tokens
+var tokenPrefixes = []string{"ntk_", "tok_"}
+
+// Field names, lower case without separators, whose values are masked
+var (
+	panFields = map[string]bool{
+		"pan": true, "cardnumber": true, "number": true, "accountnumber": true, "primaryaccountnumber": true,
+	}
+	cvvFields = map[string]bool{
+		"cvv": true, "cvc": true, "cvv2": true, "cvc2": true, "securitycode": true, "cardsecuritycode": true,
+	}
+	secretFields = map[string]bool{
+		"cryptogram": true, "tokencryptogram": true, "tavv": true, "secret": true, "password": true,
+	}
+)
+
+func normalizeField(name string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(name))
+}
+
+// maskKeepLast replaces all but the last four characters with asterisks
+func maskKeepLast(value string) string {
+	if len(value) <= 4 {
+		return strings.Repeat("*", len(value))
+	}
+	return strings.Repeat("*", len(value)-4) + value[len(value)-4:]
+}
+
+// maskPANs masks card numbers that pass the Luhn check, keeping the last four digits
+func maskPANs(text string) string {
+	return panPattern.ReplaceAllStringFunc(text, func(match string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		if !luhnValid(digits) {
+			return match
+		}
+		return maskKeepLast(digits)
+	})
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func isToken(value string) bool {
+	for _, prefix := range tokenPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskValue masks a JSON value found under field
+func maskValue(field string, value interface{}) interface{} {
+	name := normalizeField(field)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		// Maps of tokens, e.g. processor_tokens keyed by processor
+		all := strings.HasSuffix(name, "tokens")
+		for key, inner := range v {
+			if s, ok := inner.(string); ok && all {
+				v[key] = maskKeepLast(s)
+				continue
+			}
+			v[key] = maskValue(key, inner)
+		}
+		return v
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = maskValue(field, inner)
+		}
+		return v
+	case string:
+		switch {
+		case cvvFields[name], secretFields[name]:
+			return strings.Repeat("*", len(v))
+		case panFields[name], strings.HasSuffix(name, "token"), isToken(v):
+			return maskKeepLast(v)
+		}
+		return maskPANs(v)
+	case json.Number:
+		if cvvFields[name] || panFields[name] {
+			return strings.Repeat("*", len(v))
+		}
+		if masked := maskPANs(v.String()); masked != v.String() {
+			return masked
+		}
+	}
+	return value
+}
+
+// MaskBody returns a copy of a request or response body safe to store:
+// card numbers, security codes, cryptograms and token values are masked.
+// JSON bodies are masked field by field and returned as JSON; anything
+// else is returned as a JSON string with card numbers and tokens masked.
+func MaskBody(body []byte) json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil && !decoder.More() {
+		masked, err := json.Marshal(maskValue("", value))
+		if err == nil {
+			return masked
+		}
+	}
+
+	text := maskPANs(string(body))
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '"' || r == '\n' || r == ' ' || r == '/' || r == '='
+	}) {
+		if isToken(word) {
+			text = strings.ReplaceAll(text, word, maskKeepLast(word))
+		}
+	}
+	encoded, _ := json.Marshal(text)
+	return encoded
+}
+
+// MaskPath masks path segments that carry tokens or card numbers, such as
+// GET /network-tokens/{token}
+func MaskPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isToken(segment) {
+			segments[i] = maskKeepLast(segment)
+			continue
+		}
+		segments[i] = maskPANs(segment)
+	}
+	return strings.Join(segments, "/")
+}
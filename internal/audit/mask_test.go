@@ -0,0 +1,101 @@
+package audit
+
+import "testing"
+
+func TestMaskBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "card number and security code",
+			body: `{"card_number":"4111111111111111","cvv":"123","exp_month":12}`,
+			want: `{"card_number":"************1111","cvv":"***","exp_month":12}`,
+		},
+		{
+			name: "numeric card number and security code",
+			body: `{"pan":4111111111111111,"cvc":123}`,
+			want: `{"cvc":"***","pan":"****************"}`,
+		},
+		{
+			name: "grouped card number in free text",
+			body: `{"description":"card 4111 1111 1111 1111 declined"}`,
+			want: `{"description":"card ************1111 declined"}`,
+		},
+		{
+			name: "digits that fail the Luhn check are kept",
+			body: `{"reference":"4111111111111112"}`,
+			want: `{"reference":"4111111111111112"}`,
+		},
+		{
+			name: "cryptograms",
+			body: `{"token_cryptogram":"AgAAAAAABk4DWZ4C28yUQAAAAAA=","tavv":"AAAB"}`,
+			want: `{"tavv":"****","token_cryptogram":"****************************"}`,
+		},
+		{
+			name: "network token field",
+			body: `{"network_token":"ntk_abc123456789"}`,
+			want: `{"network_token":"************6789"}`,
+		},
+		{
+			name: "token values under any field",
+			body: `{"payment_method":"tok_a_12345678","previous":"ntk_98765432"}`,
+			want: `{"payment_method":"**********5678","previous":"********5432"}`,
+		},
+		{
+			name: "processor tokens map",
+			body: `{"processor_tokens":{"processor_a":"pa_12345678","processor_b":"pb_87654321"}}`,
+			want: `{"processor_tokens":{"processor_a":"*******5678","processor_b":"*******4321"}}`,
+		},
+		{
+			name: "nested objects and arrays",
+			body: `{"cards":[{"number":"5555555555554444","cvv":"999"}],"amount":1000}`,
+			want: `{"amount":1000,"cards":[{"cvv":"***","number":"************4444"}]}`,
+		},
+		{
+			name: "unrelated fields untouched",
+			body: `{"transaction_id":"txn_a_1234","status":"success"}`,
+			want: `{"status":"success","transaction_id":"txn_a_1234"}`,
+		},
+		{
+			name: "text body",
+			body: "card=4111111111111111 token=ntk_abcdef123456",
+			want: `"card=************1111 token=************3456"`,
+		},
+		{
+			name: "empty body",
+			body: "  ",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(MaskBody([]byte(tt.body))); got != tt.want {
+				t.Errorf("MaskBody(%s)\n got %s\nwant %s", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/network-tokens/ntk_abcdef123456/cryptograms", "/network-tokens/************3456/cryptograms"},
+		{"/tokens/tok_a_12345678", "/tokens/**********5678"},
+		{"/cards/4111111111111111", "/cards/************1111"},
+		{"/charges/0b7d4c1e-8f1a-4c55-9d3e-2a6f0c9b1e42", "/charges/0b7d4c1e-8f1a-4c55-9d3e-2a6f0c9b1e42"},
+		{"/settlements/2026-10-15", "/settlements/2026-10-15"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := MaskPath(tt.path); got != tt.want {
+				t.Errorf("MaskPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Package audit records outbound calls to processors and internal services
+// with their card data and tokens masked, for PCI and dispute investigations.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/models"
+)
+
+// Kinds of service an audited call goes to, stored as the entry's event type
+const (
+	KindProcessor    = "processor"
+	KindBPAS         = "bpas"
+	KindNetworkToken = "network_token"
+	KindSubscription = "subscription"
+)
+
+// MaxBodyBytes is how much of each body is stored; the rest is dropped
+const MaxBodyBytes = 16 << 10
+
+// Recorder stores audit entries. Record must not block the call for long.
+type Recorder interface {
+	Record(entry *models.AuditLog)
+}
+
+type transactionKey struct{}
+
+// WithTransactionID links calls made with ctx to a transaction
+func WithTransactionID(ctx context.Context, transactionID string) context.Context {
+	return context.WithValue(ctx, transactionKey{}, transactionID)
+}
+
+// TransactionID returns the transaction calls made with ctx are linked to
+func TransactionID(ctx context.Context) string {
+	id, _ := ctx.Value(transactionKey{}).(string)
+	return id
+}
+
+// Transport is an http.RoundTripper that records every request it sends
+// to one service. Health checks are not recorded.
+type Transport struct {
+	Base     http.RoundTripper // Defaults to http.DefaultTransport
+	Recorder Recorder
+	Kind     string // One of the Kind constants
+	Service  string // Name of the service called, e.g. processor_a
+}
+
+// NewTransport creates a transport recording calls to a service
+func NewTransport(recorder Recorder, kind, service string) *Transport {
+	return &Transport{Recorder: recorder, Kind: kind, Service: service}
+}
+
+// RoundTrip sends the request and records it with its response
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Recorder == nil || req.URL.Path == "/health" {
+		return base.RoundTrip(req)
+	}
+
+	var requestBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		requestBody = data
+		req.Body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	entry := &models.AuditLog{
+		TransactionID:  TransactionID(req.Context()),
+		EventType:      t.Kind,
+		Processor:      t.Service,
+		Method:         req.Method,
+		Endpoint:       MaskPath(req.URL.Path),
+		RequestPayload: MaskBody(truncate(requestBody)),
+		Timestamp:      time.Now().UTC(),
+	}
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		entry.LatencyMs = time.Since(start).Milliseconds()
+		entry.Error = err.Error()
+		t.Recorder.Record(entry)
+		return nil, err
+	}
+
+	// Buffer the response so it can be both stored and read by the caller
+	responseBody, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	entry.LatencyMs = time.Since(start).Milliseconds()
+	entry.StatusCode = resp.StatusCode
+	entry.ResponsePayload = MaskBody(truncate(responseBody))
+	if readErr != nil {
+		entry.Error = "reading response: " + readErr.Error()
+	}
+	t.Recorder.Record(entry)
+
+	if readErr != nil {
+		return nil, readErr
+	}
+	return resp, nil
+}
+
+func truncate(body []byte) []byte {
+	if len(body) > MaxBodyBytes {
+		return body[:MaxBodyBytes]
+	}
+	return body
+}
@@ -0,0 +1,86 @@
+// Package events defines the events services publish and the transactional
+// outbox they are published through
+package events
+
+// Event type constants
+const (
+	TypeTransaction   = "transaction"
+	TypeSubscription  = "subscription"
+	TypeScheduler     = "scheduler"
+	TypePaymentMethod = "payment_method"
+	TypeHealth        = "health"
+)
+
+// Subscription event constants
+const (
+	SubscriptionCreated    = "created"
+	SubscriptionUpgraded   = "upgraded"
+	SubscriptionDowngraded = "downgraded"
+	SubscriptionCanceled   = "canceled"
+	SubscriptionPastDue    = "past_due"
+	SubscriptionCharged    = "charged"
+
+	SubscriptionPaymentMethodRequired = "payment_method_required" // The customer must provide a new payment method
+	SubscriptionPaymentMethodUpdated  = "payment_method_updated"
+)
+
+// Scheduler event constants
+const (
+	SchedulerJobStarted     = "job_started"
+	SchedulerJobCompleted   = "job_completed"
+	SchedulerRetryScheduled = "retry_scheduled"
+	SchedulerRetryFailed    = "retry_failed"
+	SchedulerRetrySucceeded = "retry_succeeded"
+)
+
+// Payment method event constants
+const (
+	PaymentMethodRefreshed      = "refreshed"       // The card's expiry was updated before it lapsed
+	PaymentMethodUpdateRequired = "update_required" // The customer must provide a new card
+	PaymentMethodSuspended      = "suspended"       // The card network suspended the token
+	PaymentMethodResumed        = "resumed"         // A suspended token can be charged again
+	PaymentMethodDeleted        = "deleted"         // The card network deleted the token
+	PaymentMethodCardUpdated    = "card_updated"    // The token moved to a reissued card
+)
+
+// SubscriptionEventData represents subscription event payload
+type SubscriptionEventData struct {
+	SubscriptionID string  `json:"subscription_id"`
+	UserID         string  `json:"user_id"`
+	PlanID         string  `json:"plan_id"`
+	PlanName       string  `json:"plan_name,omitempty"`
+	Amount         float64 `json:"amount"` // Deprecated: use amount_minor
+	AmountMinor    int64   `json:"amount_minor"`
+	Currency       string  `json:"currency"`
+	Status         string  `json:"status"`
+	PreviousPlanID string  `json:"previous_plan_id,omitempty"`
+
+	PaymentMethodID string `json:"payment_method_id,omitempty"`
+	Reason          string `json:"reason,omitempty"` // Why a new payment method is required
+}
+
+// SchedulerEventData represents scheduler event payload
+type SchedulerEventData struct {
+	JobID          string `json:"job_id"`
+	SubscriptionID string `json:"subscription_id"`
+	Type           string `json:"type"`
+	Status         string `json:"status"`
+	Attempt        int    `json:"attempt,omitempty"`
+	MaxAttempts    int    `json:"max_attempts,omitempty"`
+	NextRetryAt    string `json:"next_retry_at,omitempty"`
+	TransactionID  string `json:"transaction_id,omitempty"`
+	ProcessorUsed  string `json:"processor_used,omitempty"`
+	ErrorCode      string `json:"error_code,omitempty"`
+	ErrorMessage   string `json:"error_message,omitempty"`
+}
+
+// PaymentMethodEventData represents payment method event payload
+type PaymentMethodEventData struct {
+	PaymentMethodID string `json:"payment_method_id"`
+	UserID          string `json:"user_id"`
+	SubscriptionID  string `json:"subscription_id,omitempty"` // Subscription that would have charged the card
+	LastFour        string `json:"last_four"`
+	ExpMonth        int    `json:"exp_month"`
+	ExpYear         int    `json:"exp_year"`
+	Reason          string `json:"reason,omitempty"` // Why the customer must update the card
+}
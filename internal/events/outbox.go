@@ -0,0 +1,301 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// outboxChannel is notified when a transaction that wrote to the outbox commits
+const outboxChannel = "event_outbox"
+
+// relayLockID is the advisory lock that lets only one relay sequence and
+// publish at a time, so sequence numbers follow commit order
+const relayLockID = 74011
+
+// Execer is satisfied by *sql.DB and *sql.Tx. Pass the *sql.Tx that makes
+// the state change so the event commits or rolls back with it.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Queryer is satisfied by *sql.DB and *sql.Tx
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// OutboxEvent is an event recorded in the outbox
+type OutboxEvent struct {
+	ID          string          `json:"id"`
+	Sequence    int64           `json:"sequence"`
+	Source      string          `json:"source"`
+	Type        string          `json:"type"`
+	Event       string          `json:"event"`
+	Data        json.RawMessage `json:"data"`
+	CreatedAt   time.Time       `json:"created_at"`
+	PublishedAt *time.Time      `json:"published_at,omitempty"`
+}
+
+// Outbox records events on behalf of one service
+type Outbox struct {
+	source string
+}
+
+// NewOutbox creates an outbox writer for the named service
+func NewOutbox(source string) *Outbox {
+	return &Outbox{source: source}
+}
+
+// Write records an event as part of ex's transaction. The relay picks it up
+// once that transaction commits.
+func (o *Outbox) Write(ctx context.Context, ex Execer, eventType, eventName string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	query := `
+		WITH inserted AS (
+			INSERT INTO event_outbox (source, event_type, event_name, payload)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		)
+		SELECT pg_notify('` + outboxChannel + `', '') FROM inserted`
+
+	if _, err := ex.ExecContext(ctx, query, o.source, eventType, eventName, payload); err != nil {
+		return fmt.Errorf("failed to write %s.%s to outbox: %w", eventType, eventName, err)
+	}
+	return nil
+}
+
+const outboxColumns = `event_id, sequence, source, event_type, event_name, payload, created_at, published_at`
+
+func scanOutboxEvents(rows *sql.Rows) ([]*OutboxEvent, error) {
+	defer rows.Close()
+
+	var events []*OutboxEvent
+	for rows.Next() {
+		var e OutboxEvent
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Sequence, &e.Source, &e.Type, &e.Event,
+			&payload, &e.CreatedAt, &e.PublishedAt); err != nil {
+			return nil, err
+		}
+		e.Data = payload
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// ReadOutbox returns published events with a sequence number above after,
+// in order, for consumers replaying from an offset
+func ReadOutbox(ctx context.Context, q Queryer, after int64, limit int) ([]*OutboxEvent, error) {
+	query := `SELECT ` + outboxColumns + `
+		FROM event_outbox
+		WHERE sequence > $1 AND published_at IS NOT NULL
+		ORDER BY sequence
+		LIMIT $2`
+
+	rows, err := q.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxEvents(rows)
+}
+
+// PruneOutbox deletes published events older than before and returns how many went
+func PruneOutbox(ctx context.Context, ex Execer, before time.Time) (int64, error) {
+	result, err := ex.ExecContext(ctx,
+		`DELETE FROM event_outbox WHERE published_at IS NOT NULL AND created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PublishFunc delivers one event. Returning an error stops the relay at
+// that event; it is retried, with everything after it, on the next pass.
+type PublishFunc func(ctx context.Context, e *OutboxEvent) error
+
+// Relay moves events from the outbox to their consumers at least once, in
+// sequence order. Sequence numbers are assigned by the relay as committed
+// events become visible, so they have no gaps and never go backwards.
+type Relay struct {
+	db        *sql.DB
+	publish   PublishFunc
+	batchSize int
+	wake      chan struct{}
+}
+
+// NewRelay creates a relay; call Run to start it
+func NewRelay(db *sql.DB, publish PublishFunc) *Relay {
+	return &Relay{
+		db:        db,
+		publish:   publish,
+		batchSize: 100,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay without waiting for the next poll
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Listen wakes the relay whenever a transaction that wrote to the outbox
+// commits, from any service. Without it the relay only polls.
+func (r *Relay) Listen(databaseURL string) error {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Outbox listener: %v", err)
+		}
+	})
+	if err := listener.Listen(outboxChannel); err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		// A nil notification follows a reconnect, when events may have been missed
+		for range listener.Notify {
+			r.Notify()
+		}
+	}()
+	return nil
+}
+
+// Run relays events until the process exits
+func (r *Relay) Run(pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := r.Drain(ctx); err != nil {
+			log.Printf("Outbox relay: %v", err)
+		}
+		cancel()
+
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// Drain sequences and publishes until the outbox is empty or a publish fails
+func (r *Relay) Drain(ctx context.Context) error {
+	for {
+		sequenced, err := r.sequence(ctx)
+		if err != nil {
+			return fmt.Errorf("sequence events: %w", err)
+		}
+		published, err := r.publishBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if sequenced < r.batchSize && published < r.batchSize {
+			return nil
+		}
+	}
+}
+
+// withRelayLock runs fn in a transaction holding the relay lock. It does
+// nothing if another relay holds the lock.
+func (r *Relay) withRelayLock(ctx context.Context, fn func(tx *sql.Tx) (int, error)) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, relayLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	n, fnErr := fn(tx)
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, fnErr
+}
+
+// sequence numbers the next batch of committed, unsequenced events
+func (r *Relay) sequence(ctx context.Context) (int, error) {
+	return r.withRelayLock(ctx, func(tx *sql.Tx) (int, error) {
+		query := `
+			UPDATE event_outbox o
+			SET sequence = next.seq, sequenced_at = NOW()
+			FROM (
+				SELECT id, (SELECT COALESCE(MAX(sequence), 0) FROM event_outbox) + ROW_NUMBER() OVER (ORDER BY id) AS seq
+				FROM event_outbox
+				WHERE sequence IS NULL
+				ORDER BY id
+				LIMIT $1
+			) next
+			WHERE o.id = next.id`
+
+		result, err := tx.ExecContext(ctx, query, r.batchSize)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		return int(n), err
+	})
+}
+
+// publishBatch publishes the next sequenced events in order and marks those
+// that went out. A crash before the mark means they are published again.
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	return r.withRelayLock(ctx, func(tx *sql.Tx) (int, error) {
+		query := `SELECT ` + outboxColumns + `
+			FROM event_outbox
+			WHERE sequence IS NOT NULL AND published_at IS NULL
+			ORDER BY sequence
+			LIMIT $1`
+
+		rows, err := tx.QueryContext(ctx, query, r.batchSize)
+		if err != nil {
+			return 0, err
+		}
+		events, err := scanOutboxEvents(rows)
+		if err != nil {
+			return 0, err
+		}
+
+		var last int64
+		published := 0
+		var publishErr error
+		for _, e := range events {
+			if err := r.publish(ctx, e); err != nil {
+				publishErr = fmt.Errorf("publish event %d (%s.%s): %w", e.Sequence, e.Type, e.Event, err)
+				break
+			}
+			last = e.Sequence
+			published++
+		}
+
+		if published > 0 {
+			_, err := tx.ExecContext(ctx, `
+				UPDATE event_outbox
+				SET published_at = NOW()
+				WHERE sequence <= $1 AND published_at IS NULL`, last)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return published, publishErr
+	})
+}
@@ -0,0 +1,228 @@
+// Package fees estimates what a processor charges for a payment, using
+// per-processor cost schedules loaded from a file.
+package fees
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+var (
+	ErrNoSchedule      = errors.New("no fee schedule for processor")
+	ErrInvalidSchedule = errors.New("invalid fee schedule")
+)
+
+// Override replaces part of a schedule's pricing. Unset fields keep the
+// value they had before the override was applied.
+type Override struct {
+	BasisPoints *int   `yaml:"basis_points,omitempty" json:"basis_points,omitempty"`
+	FixedMinor  *int64 `yaml:"fixed_minor,omitempty" json:"fixed_minor,omitempty"`
+}
+
+// Schedule is one processor's pricing. The fixed fee is in minor units of
+// Currency, except in currency overrides where it is in that currency.
+// Card brand overrides are applied after currency overrides, and the
+// cross-border surcharge is added on top when the card was issued outside
+// the merchant's country.
+type Schedule struct {
+	Processor      string              `yaml:"processor" json:"processor"`
+	Currency       string              `yaml:"currency" json:"currency"`
+	BasisPoints    int                 `yaml:"basis_points" json:"basis_points"`
+	FixedMinor     int64               `yaml:"fixed_minor" json:"fixed_minor"`
+	CrossBorderBps int                 `yaml:"cross_border_bps" json:"cross_border_bps"`
+	Currencies     map[string]Override `yaml:"currencies,omitempty" json:"currencies,omitempty"`
+	CardBrands     map[string]Override `yaml:"card_brands,omitempty" json:"card_brands,omitempty"`
+}
+
+// ScheduleFile is the layout of configs/fee-schedules.yaml
+type ScheduleFile struct {
+	Version         string     `yaml:"version"`
+	MerchantCountry string     `yaml:"merchant_country"`
+	Schedules       []Schedule `yaml:"schedules"`
+}
+
+// Payment describes what a fee depends on. Card fields may be empty when
+// the payment method doesn't record them; no override or surcharge then applies.
+type Payment struct {
+	Amount      money.Money
+	CardBrand   string
+	CardCountry string
+}
+
+// Estimate is the expected fee for a payment on one processor
+type Estimate struct {
+	Processor   string      `json:"processor"`
+	Fee         money.Money `json:"fee"` // In the payment currency
+	BasisPoints int         `json:"basis_points"`
+	FixedMinor  int64       `json:"fixed_minor"` // In the payment currency
+	CrossBorder bool        `json:"cross_border"`
+}
+
+// Converter converts an amount to another currency, e.g. fx.Service.ConvertMid
+type Converter func(amount money.Money, to string) (money.Money, error)
+
+// Table holds the fee schedules of every processor
+type Table struct {
+	merchantCountry string
+	schedules       map[string]*Schedule
+	convert         Converter
+}
+
+// LoadFile reads and validates fee schedules from a YAML file. convert is
+// used for fixed fees in a currency other than the payment's; it may be nil,
+// in which case such payments can't be estimated.
+func LoadFile(path string, convert Converter) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee schedules: %w", err)
+	}
+
+	var file ScheduleFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse fee schedules: %w", err)
+	}
+	return NewTable(&file, convert)
+}
+
+// NewTable validates the schedules in file, normalizing codes to upper
+// case and card brands to lower case
+func NewTable(file *ScheduleFile, convert Converter) (*Table, error) {
+	table := &Table{
+		merchantCountry: strings.ToUpper(file.MerchantCountry),
+		schedules:       make(map[string]*Schedule, len(file.Schedules)),
+		convert:         convert,
+	}
+
+	for i := range file.Schedules {
+		s := file.Schedules[i]
+		if s.Processor == "" {
+			return nil, fmt.Errorf("%w: schedule %d has no processor", ErrInvalidSchedule, i)
+		}
+		if _, exists := table.schedules[s.Processor]; exists {
+			return nil, fmt.Errorf("%w: %s is listed twice", ErrInvalidSchedule, s.Processor)
+		}
+
+		s.Currency = strings.ToUpper(s.Currency)
+		if s.Currency == "" {
+			s.Currency = "USD"
+		}
+		if !money.IsSupported(s.Currency) {
+			return nil, fmt.Errorf("%w: %s uses unsupported currency %s", ErrInvalidSchedule, s.Processor, s.Currency)
+		}
+		if err := checkPricing(s.Processor, &s.BasisPoints, &s.FixedMinor); err != nil {
+			return nil, err
+		}
+		if s.CrossBorderBps < 0 || s.CrossBorderBps >= 10000 {
+			return nil, fmt.Errorf("%w: %s cross-border surcharge must be between 0 and 9999 basis points", ErrInvalidSchedule, s.Processor)
+		}
+
+		currencies := make(map[string]Override, len(s.Currencies))
+		for currency, o := range s.Currencies {
+			currency = strings.ToUpper(currency)
+			if !money.IsSupported(currency) {
+				return nil, fmt.Errorf("%w: %s overrides unsupported currency %s", ErrInvalidSchedule, s.Processor, currency)
+			}
+			if err := checkPricing(s.Processor, o.BasisPoints, o.FixedMinor); err != nil {
+				return nil, err
+			}
+			currencies[currency] = o
+		}
+		s.Currencies = currencies
+
+		brands := make(map[string]Override, len(s.CardBrands))
+		for brand, o := range s.CardBrands {
+			if err := checkPricing(s.Processor, o.BasisPoints, o.FixedMinor); err != nil {
+				return nil, err
+			}
+			brands[strings.ToLower(brand)] = o
+		}
+		s.CardBrands = brands
+
+		table.schedules[s.Processor] = &s
+	}
+	return table, nil
+}
+
+func checkPricing(processor string, bps *int, fixed *int64) error {
+	if bps != nil && (*bps < 0 || *bps >= 10000) {
+		return fmt.Errorf("%w: %s fee must be between 0 and 9999 basis points", ErrInvalidSchedule, processor)
+	}
+	if fixed != nil && *fixed < 0 {
+		return fmt.Errorf("%w: %s fixed fee can't be negative", ErrInvalidSchedule, processor)
+	}
+	return nil
+}
+
+// MerchantCountry is the country cards are compared against for cross-border surcharges
+func (t *Table) MerchantCountry() string {
+	return t.merchantCountry
+}
+
+// Schedules returns every schedule, keyed by processor
+func (t *Table) Schedules() map[string]Schedule {
+	schedules := make(map[string]Schedule, len(t.schedules))
+	for name, s := range t.schedules {
+		schedules[name] = *s
+	}
+	return schedules
+}
+
+// Estimate computes the expected fee for a payment on a processor. The
+// percentage part is rounded half up to the payment currency's minor unit.
+func (t *Table) Estimate(processor string, p Payment) (Estimate, error) {
+	s, ok := t.schedules[processor]
+	if !ok {
+		return Estimate{}, fmt.Errorf("%w: %s", ErrNoSchedule, processor)
+	}
+
+	bps := s.BasisPoints
+	fixed := money.Money{Amount: s.FixedMinor, Currency: s.Currency}
+	if o, ok := s.Currencies[p.Amount.Currency]; ok {
+		if o.BasisPoints != nil {
+			bps = *o.BasisPoints
+		}
+		if o.FixedMinor != nil {
+			fixed = money.Money{Amount: *o.FixedMinor, Currency: p.Amount.Currency}
+		}
+	}
+	if o, ok := s.CardBrands[strings.ToLower(p.CardBrand)]; ok {
+		if o.BasisPoints != nil {
+			bps = *o.BasisPoints
+		}
+		if o.FixedMinor != nil {
+			fixed = money.Money{Amount: *o.FixedMinor, Currency: s.Currency}
+		}
+	}
+
+	estimate := Estimate{Processor: processor}
+	country := strings.ToUpper(p.CardCountry)
+	if country != "" && t.merchantCountry != "" && country != t.merchantCountry {
+		estimate.CrossBorder = true
+		bps += s.CrossBorderBps
+	}
+
+	if fixed.Currency != p.Amount.Currency && fixed.Amount != 0 {
+		if t.convert == nil {
+			return Estimate{}, fmt.Errorf("%s fixed fee is in %s and no converter is set", processor, fixed.Currency)
+		}
+		converted, err := t.convert(fixed, p.Amount.Currency)
+		if err != nil {
+			return Estimate{}, fmt.Errorf("convert %s fixed fee: %w", processor, err)
+		}
+		fixed = converted
+	}
+
+	estimate.BasisPoints = bps
+	estimate.FixedMinor = fixed.Amount
+	estimate.Fee = money.Money{
+		Amount:   (p.Amount.Amount*int64(bps)+5000)/10000 + fixed.Amount,
+		Currency: p.Amount.Currency,
+	}
+	return estimate, nil
+}
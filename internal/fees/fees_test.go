@@ -0,0 +1,180 @@
+package fees
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+func intPtr(v int) *int       { return &v }
+func int64Ptr(v int64) *int64 { return &v }
+
+// testRates converts at fixed mid-market rates from USD
+func testRates(amount money.Money, to string) (money.Money, error) {
+	rates := map[string]float64{"USD/EUR": 0.9, "USD/JPY": 150}
+	rate, ok := rates[amount.Currency+"/"+to]
+	if !ok {
+		return money.Money{}, fmt.Errorf("no rate for %s/%s", amount.Currency, to)
+	}
+	return money.FromMajor(amount.Major()*rate, to)
+}
+
+func testScheduleFile() *ScheduleFile {
+	return &ScheduleFile{
+		MerchantCountry: "us",
+		Schedules: []Schedule{
+			{
+				Processor:      "processor_a",
+				Currency:       "USD",
+				BasisPoints:    290,
+				FixedMinor:     30,
+				CrossBorderBps: 100,
+				Currencies: map[string]Override{
+					"eur": {FixedMinor: int64Ptr(25)},
+					"JPY": {BasisPoints: intPtr(300)},
+				},
+				CardBrands: map[string]Override{
+					"Amex": {BasisPoints: intPtr(350)},
+					"visa": {FixedMinor: int64Ptr(10)},
+				},
+			},
+			{Processor: "processor_b", BasisPoints: 250},
+		},
+	}
+}
+
+func testTable(t *testing.T, convert Converter) *Table {
+	t.Helper()
+	table, err := NewTable(testScheduleFile(), convert)
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	return table
+}
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name            string
+		processor       string
+		amount          int64
+		currency        string
+		brand           string
+		country         string
+		wantFee         int64
+		wantBps         int
+		wantFixed       int64
+		wantCrossBorder bool
+	}{
+		{"base pricing", "processor_a", 10000, "USD", "mastercard", "US", 320, 290, 30, false},
+		{"currency override of the fixed fee", "processor_a", 10000, "EUR", "", "", 315, 290, 25, false},
+		{"currency override of the rate, fixed fee converted", "processor_a", 10000, "JPY", "", "", 345, 300, 45, false},
+		{"card brand override, any case", "processor_a", 10000, "USD", "AMEX", "US", 380, 350, 30, false},
+		{"card brand applied after currency", "processor_a", 10000, "EUR", "amex", "", 375, 350, 25, false},
+		{"card brand fixed fee converted from the schedule currency", "processor_a", 10000, "EUR", "visa", "", 299, 290, 9, false},
+		{"cross-border surcharge", "processor_a", 10000, "USD", "", "gb", 420, 390, 30, true},
+		{"surcharge on top of the brand rate", "processor_a", 10000, "USD", "amex", "DE", 480, 450, 30, true},
+		{"domestic card in lower case", "processor_a", 10000, "USD", "", "us", 320, 290, 30, false},
+		{"default schedule currency", "processor_b", 10000, "USD", "", "", 250, 250, 0, false},
+		{"rounds half up", "processor_b", 1020, "USD", "", "", 26, 250, 0, false},
+		{"rounds down below half", "processor_b", 1019, "USD", "", "", 25, 250, 0, false},
+		{"zero-decimal currency", "processor_b", 999, "JPY", "", "", 25, 250, 0, false},
+		{"three-decimal currency", "processor_b", 1234, "KWD", "", "", 31, 250, 0, false},
+	}
+
+	table := testTable(t, testRates)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := table.Estimate(tt.processor, Payment{
+				Amount:      money.Money{Amount: tt.amount, Currency: tt.currency},
+				CardBrand:   tt.brand,
+				CardCountry: tt.country,
+			})
+			if err != nil {
+				t.Fatalf("Estimate: %v", err)
+			}
+			if got.Fee.Amount != tt.wantFee || got.Fee.Currency != tt.currency {
+				t.Errorf("Fee = %s, want %d %s", got.Fee, tt.wantFee, tt.currency)
+			}
+			if got.BasisPoints != tt.wantBps || got.FixedMinor != tt.wantFixed || got.CrossBorder != tt.wantCrossBorder {
+				t.Errorf("Estimate = %d bps + %d, cross-border %v; want %d bps + %d, cross-border %v",
+					got.BasisPoints, got.FixedMinor, got.CrossBorder, tt.wantBps, tt.wantFixed, tt.wantCrossBorder)
+			}
+		})
+	}
+}
+
+func TestEstimateFailures(t *testing.T) {
+	jpy := Payment{Amount: money.Money{Amount: 10000, Currency: "JPY"}}
+
+	if _, err := testTable(t, testRates).Estimate("processor_c", jpy); !errors.Is(err, ErrNoSchedule) {
+		t.Errorf("Estimate for an unknown processor error = %v, want ErrNoSchedule", err)
+	}
+
+	noRates := testTable(t, nil)
+	if _, err := noRates.Estimate("processor_a", jpy); err == nil {
+		t.Error("Estimate converted a USD fixed fee without a converter")
+	}
+	// Nothing to convert without a fixed fee
+	if got, err := noRates.Estimate("processor_b", jpy); err != nil || got.Fee.Amount != 250 {
+		t.Errorf("Estimate without a fixed fee = %v, %v, want 250 JPY", got.Fee, err)
+	}
+
+	gbp := Payment{Amount: money.Money{Amount: 10000, Currency: "GBP"}}
+	if _, err := testTable(t, testRates).Estimate("processor_a", gbp); err == nil {
+		t.Error("Estimate succeeded without a USD/GBP rate")
+	}
+}
+
+func TestNewTableRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(f *ScheduleFile)
+	}{
+		{"no processor", func(f *ScheduleFile) { f.Schedules[1].Processor = "" }},
+		{"processor listed twice", func(f *ScheduleFile) { f.Schedules[1].Processor = "processor_a" }},
+		{"unsupported currency", func(f *ScheduleFile) { f.Schedules[1].Currency = "XYZ" }},
+		{"rate of 100%", func(f *ScheduleFile) { f.Schedules[1].BasisPoints = 10000 }},
+		{"negative rate", func(f *ScheduleFile) { f.Schedules[1].BasisPoints = -1 }},
+		{"negative fixed fee", func(f *ScheduleFile) { f.Schedules[1].FixedMinor = -1 }},
+		{"cross-border surcharge of 100%", func(f *ScheduleFile) { f.Schedules[1].CrossBorderBps = 10000 }},
+		{"override of an unsupported currency", func(f *ScheduleFile) {
+			f.Schedules[0].Currencies["XYZ"] = Override{FixedMinor: int64Ptr(1)}
+		}},
+		{"negative currency override", func(f *ScheduleFile) {
+			f.Schedules[0].Currencies["EUR"] = Override{FixedMinor: int64Ptr(-1)}
+		}},
+		{"card brand override of 100%", func(f *ScheduleFile) {
+			f.Schedules[0].CardBrands["visa"] = Override{BasisPoints: intPtr(10000)}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := testScheduleFile()
+			tt.modify(file)
+			if _, err := NewTable(file, testRates); !errors.Is(err, ErrInvalidSchedule) {
+				t.Errorf("NewTable error = %v, want ErrInvalidSchedule", err)
+			}
+		})
+	}
+}
+
+func TestNewTableNormalizes(t *testing.T) {
+	table := testTable(t, testRates)
+	if table.MerchantCountry() != "US" {
+		t.Errorf("MerchantCountry() = %q, want US", table.MerchantCountry())
+	}
+
+	schedules := table.Schedules()
+	if got := schedules["processor_b"].Currency; got != "USD" {
+		t.Errorf("processor_b currency = %q, want USD by default", got)
+	}
+	if _, ok := schedules["processor_a"].Currencies["EUR"]; !ok {
+		t.Errorf("currency overrides = %v, want EUR upper-cased", schedules["processor_a"].Currencies)
+	}
+	if _, ok := schedules["processor_a"].CardBrands["amex"]; !ok {
+		t.Errorf("card brand overrides = %v, want amex lower-cased", schedules["processor_a"].CardBrands)
+	}
+}
@@ -0,0 +1,252 @@
+// Package fx converts money between currencies using a rate table loaded
+// from a file or replaced through an admin API.
+package fx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+var (
+	ErrRateNotFound = errors.New("no exchange rate for currency pair")
+	ErrRateStale    = errors.New("exchange rate is too old")
+	ErrInvalidRate  = errors.New("invalid exchange rate")
+)
+
+// Rate is the mid-market rate between two currencies: 1 From buys Mid To
+type Rate struct {
+	From      string    `yaml:"from" json:"from"`
+	To        string    `yaml:"to" json:"to"`
+	Mid       float64   `yaml:"rate" json:"rate"`
+	MarkupBps *int      `yaml:"markup_bps,omitempty" json:"markup_bps,omitempty"` // Overrides the table default
+	AsOf      time.Time `yaml:"as_of,omitempty" json:"as_of,omitempty"`           // Defaults to the table timestamp
+}
+
+// RateTable is a complete set of rates, as loaded from a file or the admin API
+type RateTable struct {
+	AsOf             time.Time `yaml:"as_of" json:"as_of"`
+	DefaultMarkupBps int       `yaml:"default_markup_bps" json:"default_markup_bps"`
+	Rates            []Rate    `yaml:"rates" json:"rates"`
+}
+
+// LoadRateFile reads a rate table from a YAML file
+func LoadRateFile(path string) (*RateTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate table: %w", err)
+	}
+
+	var table RateTable
+	if err := yaml.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse rate table: %w", err)
+	}
+	return &table, nil
+}
+
+// Validate normalizes currency codes, fills in defaults and checks every rate
+func (t *RateTable) Validate() error {
+	if t.AsOf.IsZero() {
+		return fmt.Errorf("%w: rate table needs an as_of timestamp", ErrInvalidRate)
+	}
+	if err := checkMarkup(t.DefaultMarkupBps); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i := range t.Rates {
+		r := &t.Rates[i]
+		r.From = strings.ToUpper(r.From)
+		r.To = strings.ToUpper(r.To)
+
+		if !money.IsSupported(r.From) || !money.IsSupported(r.To) || r.From == r.To {
+			return fmt.Errorf("%w: %s/%s is not a supported currency pair", ErrInvalidRate, r.From, r.To)
+		}
+		if r.Mid <= 0 || math.IsInf(r.Mid, 0) || math.IsNaN(r.Mid) {
+			return fmt.Errorf("%w: %s/%s rate must be positive", ErrInvalidRate, r.From, r.To)
+		}
+		if r.MarkupBps != nil {
+			if err := checkMarkup(*r.MarkupBps); err != nil {
+				return err
+			}
+		}
+		if r.AsOf.IsZero() {
+			r.AsOf = t.AsOf
+		}
+		if seen[pairKey(r.From, r.To)] {
+			return fmt.Errorf("%w: %s/%s is listed twice", ErrInvalidRate, r.From, r.To)
+		}
+		seen[pairKey(r.From, r.To)] = true
+	}
+	return nil
+}
+
+func checkMarkup(bps int) error {
+	if bps < 0 || bps >= 10000 {
+		return fmt.Errorf("%w: markup must be between 0 and 9999 basis points", ErrInvalidRate)
+	}
+	return nil
+}
+
+// Quote is the rate applied to one conversion, recorded with the transaction
+type Quote struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`     // Effective rate after markup
+	MidRate   float64   `json:"mid_rate"` // Mid-market rate before markup
+	MarkupBps int       `json:"markup_bps"`
+	AsOf      time.Time `json:"as_of"`
+}
+
+// Identity returns the quote for a same-currency "conversion"
+func Identity(currency string) Quote {
+	return Quote{From: currency, To: currency, Rate: 1, MidRate: 1}
+}
+
+// IsIdentity reports whether the quote leaves amounts unchanged
+func (q Quote) IsIdentity() bool {
+	return q.From == q.To
+}
+
+// Convert applies the quote to an amount in its From currency, rounding to
+// the precision of the To currency
+func (q Quote) Convert(amount money.Money) (money.Money, error) {
+	if amount.Currency != q.From {
+		return money.Money{}, fmt.Errorf("%w: quote is for %s, amount is in %s", money.ErrCurrencyMismatch, q.From, amount.Currency)
+	}
+	if q.IsIdentity() {
+		return amount, nil
+	}
+	return money.FromMajor(amount.Major()*q.Rate, q.To)
+}
+
+// Service holds the current rate table
+type Service struct {
+	mu       sync.RWMutex
+	table    RateTable
+	rates    map[string]Rate
+	source   string
+	loadedAt time.Time
+	maxAge   time.Duration // Rates older than this are refused; zero disables the check
+}
+
+// NewService creates a service with no rates loaded
+func NewService(maxAge time.Duration) *Service {
+	return &Service{
+		rates:  make(map[string]Rate),
+		maxAge: maxAge,
+	}
+}
+
+// LoadFile replaces the rate table with the contents of a file
+func (s *Service) LoadFile(path string) error {
+	table, err := LoadRateFile(path)
+	if err != nil {
+		return err
+	}
+	return s.SetRates(table, path)
+}
+
+// SetRates validates and replaces the whole rate table
+func (s *Service) SetRates(table *RateTable, source string) error {
+	if err := table.Validate(); err != nil {
+		return err
+	}
+
+	rates := make(map[string]Rate, len(table.Rates))
+	for _, r := range table.Rates {
+		rates[pairKey(r.From, r.To)] = r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.table = *table
+	s.rates = rates
+	s.source = source
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// Snapshot returns the current table, where it came from and when it was loaded
+func (s *Service) Snapshot() (RateTable, string, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	table := s.table
+	table.Rates = append([]Rate(nil), s.table.Rates...)
+	return table, s.source, s.loadedAt
+}
+
+// Quote returns the rate to convert from one currency to another. A pair
+// missing from the table is derived from its inverse.
+func (s *Service) Quote(from, to string) (Quote, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	if from == to {
+		return Identity(from), nil
+	}
+
+	s.mu.RLock()
+	defaultMarkup := s.table.DefaultMarkupBps
+	rate, ok := s.rates[pairKey(from, to)]
+	if !ok {
+		if inverse, found := s.rates[pairKey(to, from)]; found {
+			rate, ok = inverse, true
+			rate.Mid = 1 / inverse.Mid
+		}
+	}
+	s.mu.RUnlock()
+
+	if !ok {
+		return Quote{}, fmt.Errorf("%w: %s/%s", ErrRateNotFound, from, to)
+	}
+
+	if s.maxAge > 0 && time.Since(rate.AsOf) > s.maxAge {
+		return Quote{}, fmt.Errorf("%w: %s/%s as of %s", ErrRateStale, from, to, rate.AsOf.Format(time.RFC3339))
+	}
+
+	markup := defaultMarkup
+	if rate.MarkupBps != nil {
+		markup = *rate.MarkupBps
+	}
+
+	// The markup is taken out of the converted amount
+	return Quote{
+		From:      from,
+		To:        to,
+		Rate:      rate.Mid * (1 - float64(markup)/10000),
+		MidRate:   rate.Mid,
+		MarkupBps: markup,
+		AsOf:      rate.AsOf,
+	}, nil
+}
+
+// Convert converts an amount at the current rate
+func (s *Service) Convert(amount money.Money, to string) (money.Money, Quote, error) {
+	quote, err := s.Quote(amount.Currency, to)
+	if err != nil {
+		return money.Money{}, Quote{}, err
+	}
+	converted, err := quote.Convert(amount)
+	return converted, quote, err
+}
+
+// ConvertMid converts an amount at the mid-market rate, for reporting
+func (s *Service) ConvertMid(amount money.Money, to string) (money.Money, error) {
+	quote, err := s.Quote(amount.Currency, to)
+	if err != nil {
+		return money.Money{}, err
+	}
+	quote.Rate = quote.MidRate
+	return quote.Convert(amount)
+}
+
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
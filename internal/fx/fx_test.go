@@ -0,0 +1,176 @@
+package fx
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/AnuragDani/subscription-platform/internal/money"
+)
+
+func intPtr(v int) *int { return &v }
+
+// testService loads a table as of asOf with a 100 bps default markup
+func testService(t *testing.T, maxAge time.Duration, asOf time.Time) *Service {
+	t.Helper()
+	s := NewService(maxAge)
+	err := s.SetRates(&RateTable{
+		AsOf:             asOf,
+		DefaultMarkupBps: 100,
+		Rates: []Rate{
+			{From: "eur", To: "usd", Mid: 1.10},
+			{From: "USD", To: "JPY", Mid: 150, MarkupBps: intPtr(0)},
+			{From: "USD", To: "KWD", Mid: 0.3075, MarkupBps: intPtr(0), AsOf: asOf.Add(-48 * time.Hour)},
+		},
+	}, "test")
+	if err != nil {
+		t.Fatalf("SetRates: %v", err)
+	}
+	return s
+}
+
+func TestValidate(t *testing.T) {
+	asOf := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		table   RateTable
+		wantErr bool
+	}{
+		{"valid", RateTable{AsOf: asOf, Rates: []Rate{{From: "EUR", To: "USD", Mid: 1.1}}}, false},
+		{"missing as_of", RateTable{Rates: []Rate{{From: "EUR", To: "USD", Mid: 1.1}}}, true},
+		{"unsupported currency", RateTable{AsOf: asOf, Rates: []Rate{{From: "XYZ", To: "USD", Mid: 1.1}}}, true},
+		{"same currency", RateTable{AsOf: asOf, Rates: []Rate{{From: "USD", To: "usd", Mid: 1}}}, true},
+		{"zero rate", RateTable{AsOf: asOf, Rates: []Rate{{From: "EUR", To: "USD"}}}, true},
+		{"NaN rate", RateTable{AsOf: asOf, Rates: []Rate{{From: "EUR", To: "USD", Mid: math.NaN()}}}, true},
+		{"negative default markup", RateTable{AsOf: asOf, DefaultMarkupBps: -1}, true},
+		{"markup of the whole amount", RateTable{AsOf: asOf, Rates: []Rate{{From: "EUR", To: "USD", Mid: 1.1, MarkupBps: intPtr(10000)}}}, true},
+		{"duplicate pair", RateTable{AsOf: asOf, Rates: []Rate{{From: "EUR", To: "USD", Mid: 1.1}, {From: "eur", To: "usd", Mid: 1.2}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.table.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidRate) {
+				t.Errorf("Validate() error = %v, want ErrInvalidRate", err)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	s := testService(t, 0, time.Now())
+
+	tests := []struct {
+		name       string
+		from, to   string
+		wantRate   float64
+		wantMid    float64
+		wantMarkup int
+		wantErr    error
+	}{
+		{"same currency", "usd", "USD", 1, 1, 0, nil},
+		{"direct pair with default markup", "EUR", "USD", 1.10 * 0.99, 1.10, 100, nil},
+		{"inverse pair", "USD", "EUR", 0.99 / 1.10, 1 / 1.10, 100, nil},
+		{"per-rate markup override", "usd", "jpy", 150, 150, 0, nil},
+		{"missing pair", "EUR", "JPY", 0, 0, 0, ErrRateNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := s.Quote(tt.from, tt.to)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Quote(%s, %s) error = %v, want %v", tt.from, tt.to, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if math.Abs(q.Rate-tt.wantRate) > 1e-12 || math.Abs(q.MidRate-tt.wantMid) > 1e-12 {
+				t.Errorf("Quote rate = %v (mid %v), want %v (mid %v)", q.Rate, q.MidRate, tt.wantRate, tt.wantMid)
+			}
+			if q.MarkupBps != tt.wantMarkup {
+				t.Errorf("Quote markup = %d, want %d", q.MarkupBps, tt.wantMarkup)
+			}
+		})
+	}
+}
+
+func TestQuoteStaleness(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		asOf     time.Time
+		from, to string
+		wantErr  error
+	}{
+		{"fresh table", 24 * time.Hour, now.Add(-time.Hour), "EUR", "USD", nil},
+		{"stale table", 24 * time.Hour, now.Add(-25 * time.Hour), "EUR", "USD", ErrRateStale},
+		{"stale inverse pair", 24 * time.Hour, now.Add(-25 * time.Hour), "USD", "EUR", ErrRateStale},
+		{"stale rate in a fresh table", 24 * time.Hour, now, "USD", "KWD", ErrRateStale},
+		{"zero max age disables the check", 0, now.Add(-365 * 24 * time.Hour), "EUR", "USD", nil},
+		{"same currency is never stale", 24 * time.Hour, now.Add(-25 * time.Hour), "USD", "USD", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testService(t, tt.maxAge, tt.asOf)
+			if _, err := s.Quote(tt.from, tt.to); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Quote(%s, %s) error = %v, want %v", tt.from, tt.to, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	s := testService(t, 0, time.Now())
+
+	tests := []struct {
+		name    string
+		amount  money.Money
+		to      string
+		want    money.Money
+		wantMid money.Money
+	}{
+		{"two to two decimals", money.Money{Amount: 1000, Currency: "EUR"}, "USD",
+			money.Money{Amount: 1089, Currency: "USD"}, money.Money{Amount: 1100, Currency: "USD"}},
+		{"two to zero decimals", money.Money{Amount: 1234, Currency: "USD"}, "JPY",
+			money.Money{Amount: 1851, Currency: "JPY"}, money.Money{Amount: 1851, Currency: "JPY"}},
+		{"zero to two decimals", money.Money{Amount: 1851, Currency: "JPY"}, "USD",
+			money.Money{Amount: 1234, Currency: "USD"}, money.Money{Amount: 1234, Currency: "USD"}},
+		{"two to three decimals", money.Money{Amount: 1000, Currency: "USD"}, "KWD",
+			money.Money{Amount: 3075, Currency: "KWD"}, money.Money{Amount: 3075, Currency: "KWD"}},
+		{"same currency", money.Money{Amount: 999, Currency: "USD"}, "USD",
+			money.Money{Amount: 999, Currency: "USD"}, money.Money{Amount: 999, Currency: "USD"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := s.Convert(tt.amount, tt.to)
+			if err != nil {
+				t.Fatalf("Convert: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Convert(%s) = %s, want %s", tt.amount, got, tt.want)
+			}
+
+			mid, err := s.ConvertMid(tt.amount, tt.to)
+			if err != nil {
+				t.Fatalf("ConvertMid: %v", err)
+			}
+			if mid != tt.wantMid {
+				t.Errorf("ConvertMid(%s) = %s, want %s", tt.amount, mid, tt.wantMid)
+			}
+		})
+	}
+}
+
+func TestQuoteConvertRequiresFromCurrency(t *testing.T) {
+	q := Quote{From: "EUR", To: "USD", Rate: 1.1, MidRate: 1.1}
+	if _, err := q.Convert(money.Money{Amount: 100, Currency: "GBP"}); !errors.Is(err, money.ErrCurrencyMismatch) {
+		t.Errorf("Convert error = %v, want ErrCurrencyMismatch", err)
+	}
+}
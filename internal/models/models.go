@@ -2,6 +2,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -98,16 +99,21 @@ type RetryPolicy struct {
 	Segment          string                 `json:"segment" db:"segment"`
 }
 
-// AuditLog represents compliance and debugging logs
+// AuditLog represents one outbound call to a processor or internal service,
+// kept for compliance and dispute investigations. Payloads are masked.
 type AuditLog struct {
-	ID              string                 `json:"id" db:"id"`
-	LogID           string                 `json:"log_id" db:"log_id"`
-	TransactionID   string                 `json:"transaction_id" db:"transaction_id"`
-	EventType       string                 `json:"event_type" db:"event_type"`
-	Processor       string                 `json:"processor" db:"processor"`
-	RequestPayload  map[string]interface{} `json:"request_payload" db:"request_payload"`
-	ResponsePayload map[string]interface{} `json:"response_payload" db:"response_payload"`
-	Timestamp       time.Time              `json:"timestamp" db:"timestamp"`
+	ID              string          `json:"id" db:"id"`
+	TransactionID   string          `json:"transaction_id,omitempty" db:"transaction_id"`
+	EventType       string          `json:"event_type" db:"event_type"` // Kind of service: processor, bpas, network_token, subscription
+	Processor       string          `json:"processor" db:"processor"`   // Service called, e.g. processor_a
+	Method          string          `json:"method" db:"method"`
+	Endpoint        string          `json:"endpoint" db:"endpoint"`
+	StatusCode      int             `json:"status_code,omitempty" db:"status_code"` // Zero when no response arrived
+	LatencyMs       int64           `json:"latency_ms" db:"latency_ms"`
+	Error           string          `json:"error,omitempty" db:"error"`
+	RequestPayload  json.RawMessage `json:"request_payload,omitempty" db:"request_payload"`
+	ResponsePayload json.RawMessage `json:"response_payload,omitempty" db:"response_payload"`
+	Timestamp       time.Time       `json:"timestamp" db:"created_at"`
 }
 
 // ProcessorHealth represents processor health tracking
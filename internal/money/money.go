@@ -0,0 +1,130 @@
+// Package money represents amounts as integer minor units of an ISO 4217
+// currency, so no service has to do float arithmetic on money.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrUnknownCurrency  = errors.New("unknown currency")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+	ErrInvalidAmount    = errors.New("invalid amount")
+)
+
+// exponents holds the number of minor-unit digits of each supported ISO 4217 currency
+var exponents = map[string]int{
+	// Zero-decimal currencies
+	"JPY": 0, "KRW": 0, "VND": 0, "CLP": 0, "ISK": 0, "HUF": 0, "UGX": 0, "XAF": 0, "XOF": 0,
+
+	// Two-decimal currencies
+	"USD": 2, "EUR": 2, "GBP": 2, "AUD": 2, "CAD": 2, "CHF": 2, "SEK": 2, "NOK": 2,
+	"DKK": 2, "NZD": 2, "SGD": 2, "HKD": 2, "CNY": 2, "INR": 2, "BRL": 2, "MXN": 2,
+	"PLN": 2, "CZK": 2, "ZAR": 2, "AED": 2, "SAR": 2, "ILS": 2, "TRY": 2, "THB": 2,
+
+	// Three-decimal currencies
+	"KWD": 3, "BHD": 3, "OMR": 3, "JOD": 3, "TND": 3, "LYD": 3, "IQD": 3,
+}
+
+// Exponent returns the number of minor-unit digits for a currency code
+func Exponent(currency string) (int, error) {
+	exp, ok := exponents[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownCurrency, currency)
+	}
+	return exp, nil
+}
+
+// IsSupported reports whether a currency code is known
+func IsSupported(currency string) bool {
+	_, err := Exponent(currency)
+	return err == nil
+}
+
+// Money is an amount in minor units of a currency (cents for USD, yen for
+// JPY, fils for KWD)
+type Money struct {
+	Amount   int64  `json:"amount_minor"`
+	Currency string `json:"currency"`
+}
+
+// New creates a Money from minor units
+func New(amount int64, currency string) (Money, error) {
+	if _, err := Exponent(currency); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}, nil
+}
+
+// FromMajor converts a decimal amount (e.g. 12.34 USD) to minor units,
+// rounding to the currency's precision. Only for accepting legacy float fields.
+func FromMajor(amount float64, currency string) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return Money{}, ErrInvalidAmount
+	}
+	minor := math.Round(amount * math.Pow10(exp))
+	if math.Abs(minor) > math.MaxInt64/2 {
+		return Money{}, fmt.Errorf("%w: %v out of range", ErrInvalidAmount, amount)
+	}
+	return Money{Amount: int64(minor), Currency: strings.ToUpper(currency)}, nil
+}
+
+// Resolve picks the amount from a request that may carry minor units, a
+// legacy decimal amount, or both. Minor units win when both are set.
+func Resolve(minor int64, legacy float64, currency string) (Money, error) {
+	if minor != 0 {
+		return New(minor, currency)
+	}
+	return FromMajor(legacy, currency)
+}
+
+// Major returns the amount in major units. Only for display and legacy fields.
+func (m Money) Major() float64 {
+	exp, err := Exponent(m.Currency)
+	if err != nil {
+		exp = 2
+	}
+	return float64(m.Amount) / math.Pow10(exp)
+}
+
+// ToMajor converts minor units of a currency to major units
+func ToMajor(amount int64, currency string) float64 {
+	return Money{Amount: amount, Currency: currency}.Major()
+}
+
+// IsPositive reports whether the amount is greater than zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// Add returns m + other; both must be in the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m - other; both must be in the same currency
+func (m Money) Sub(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}, nil
+}
+
+// String formats the amount with the currency's precision, e.g. "12.34 USD"
+func (m Money) String() string {
+	exp, err := Exponent(m.Currency)
+	if err != nil {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	return fmt.Sprintf("%.*f %s", exp, m.Major(), m.Currency)
+}
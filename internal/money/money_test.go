@@ -0,0 +1,144 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestFromMajor(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+		want     int64
+		wantErr  error
+	}{
+		{"two decimals", 12.34, "USD", 1234, nil},
+		{"two decimals float noise", 0.1 + 0.2, "USD", 30, nil},
+		{"two decimals rounds half up", 10.005, "EUR", 1001, nil},
+		{"zero decimals whole", 1500, "JPY", 1500, nil},
+		{"zero decimals rounds fraction", 1499.6, "JPY", 1500, nil},
+		{"zero decimals rounds half away from zero", 1234.5, "KRW", 1235, nil},
+		{"zero decimals drops small fraction", 99.4, "JPY", 99, nil},
+		{"three decimals", 1.234, "KWD", 1234, nil},
+		{"three decimals rounds fourth digit", 1.2346, "BHD", 1235, nil},
+		{"three decimals keeps trailing zero", 0.5, "OMR", 500, nil},
+		{"lower-case code", 5, "kwd", 5000, nil},
+		{"negative", -2.5, "USD", -250, nil},
+		{"unknown currency", 1, "XYZ", 0, ErrUnknownCurrency},
+		{"NaN", math.NaN(), "USD", 0, ErrInvalidAmount},
+		{"infinity", math.Inf(1), "JPY", 0, ErrInvalidAmount},
+		{"out of range", 1e18, "KWD", 0, ErrInvalidAmount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromMajor(tt.amount, tt.currency)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FromMajor(%v, %s) error = %v, want %v", tt.amount, tt.currency, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Amount != tt.want {
+				t.Errorf("FromMajor(%v, %s) = %d, want %d", tt.amount, tt.currency, got.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestMajorAndString(t *testing.T) {
+	tests := []struct {
+		money      Money
+		wantMajor  float64
+		wantString string
+	}{
+		{Money{Amount: 1234, Currency: "USD"}, 12.34, "12.34 USD"},
+		{Money{Amount: 5, Currency: "USD"}, 0.05, "0.05 USD"},
+		{Money{Amount: 1500, Currency: "JPY"}, 1500, "1500 JPY"},
+		{Money{Amount: 0, Currency: "KRW"}, 0, "0 KRW"},
+		{Money{Amount: 1234, Currency: "KWD"}, 1.234, "1.234 KWD"},
+		{Money{Amount: 5, Currency: "BHD"}, 0.005, "0.005 BHD"},
+		{Money{Amount: 250, Currency: "XYZ"}, 2.5, "250 XYZ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantString, func(t *testing.T) {
+			if got := tt.money.Major(); got != tt.wantMajor {
+				t.Errorf("Major() = %v, want %v", got, tt.wantMajor)
+			}
+			if got := tt.money.String(); got != tt.wantString {
+				t.Errorf("String() = %q, want %q", got, tt.wantString)
+			}
+		})
+	}
+}
+
+func TestRoundTripThroughMajor(t *testing.T) {
+	tests := []struct {
+		currency string
+		amounts  []int64
+	}{
+		{"JPY", []int64{1, 99, 1500, 123456789}},
+		{"USD", []int64{1, 99, 1234, 123456789}},
+		{"KWD", []int64{1, 999, 1234, 123456789}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.currency, func(t *testing.T) {
+			for _, amount := range tt.amounts {
+				got, err := FromMajor(ToMajor(amount, tt.currency), tt.currency)
+				if err != nil {
+					t.Fatalf("FromMajor: %v", err)
+				}
+				if got.Amount != amount {
+					t.Errorf("%d %s round-tripped to %d", amount, tt.currency, got.Amount)
+				}
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		minor    int64
+		legacy   float64
+		currency string
+		want     int64
+	}{
+		{"minor units only", 1234, 0, "USD", 1234},
+		{"legacy only", 0, 12.34, "USD", 1234},
+		{"minor units win", 1000, 12.34, "USD", 1000},
+		{"legacy zero decimals", 0, 1500, "JPY", 1500},
+		{"legacy three decimals", 0, 1.5, "KWD", 1500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Resolve(tt.minor, tt.legacy, tt.currency)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if got.Amount != tt.want || got.Currency != tt.currency {
+				t.Errorf("Resolve = %v, want %d %s", got, tt.want, tt.currency)
+			}
+		})
+	}
+}
+
+func TestArithmeticRequiresSameCurrency(t *testing.T) {
+	usd := Money{Amount: 100, Currency: "USD"}
+	jpy := Money{Amount: 100, Currency: "JPY"}
+
+	if _, err := usd.Add(jpy); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add across currencies error = %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := usd.Sub(jpy); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Sub across currencies error = %v, want ErrCurrencyMismatch", err)
+	}
+	if got, err := usd.Sub(Money{Amount: 30, Currency: "USD"}); err != nil || got.Amount != 70 {
+		t.Errorf("Sub = %v, %v, want 70", got, err)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -17,13 +19,19 @@ type Client struct {
 }
 
 type ChargeRequest struct {
-	Amount         int    `json:"amount"`
+	Amount         int64  `json:"amount"`
 	Currency       string `json:"currency"`
 	Token          string `json:"token,omitempty"`
 	IdempotencyKey string `json:"idempotency_key"`
 	NetworkToken   string `json:"network_token,omitempty"`
 	ProcessorToken string `json:"processor_token,omitempty"`
 	Marketplace    string `json:"marketplace,omitempty"`
+
+	// Single-use cryptogram binding NetworkToken to this charge; MITs may omit it
+	TokenCryptogram string `json:"token_cryptogram,omitempty"`
+
+	StoredCredential *StoredCredential `json:"stored_credential,omitempty"`
+	ThreeDS          *ThreeDSRequest   `json:"three_ds,omitempty"`
 }
 
 type ChargeResponse struct {
@@ -35,12 +43,24 @@ type ChargeResponse struct {
 	ProcessorUsed   string `json:"processor_used"`
 	TokenType       string `json:"token_type,omitempty"`
 	ExchangeRate    string `json:"exchange_rate,omitempty"`
-	ProcessedAmount int    `json:"processed_amount,omitempty"`
+	ProcessedAmount int64  `json:"processed_amount,omitempty"`
+
+	// Network's ID for the charge; an initial CIT's is referenced by later MITs
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+
+	// Set to requires_action, with a challenge, while the cardholder authenticates
+	Status  string            `json:"status,omitempty"`
+	ThreeDS *ThreeDSChallenge `json:"three_ds,omitempty"`
+}
+
+// RequiresAction reports whether the charge waits on a 3-D Secure challenge
+func (r *ChargeResponse) RequiresAction() bool {
+	return r.Status == ChargeStatusRequiresAction && r.ThreeDS != nil
 }
 
 type RefundRequest struct {
 	OriginalTransactionID string `json:"original_transaction_id"`
-	Amount                int    `json:"amount"`
+	Amount                int64  `json:"amount"`
 	Currency              string `json:"currency"`
 	Reason                string `json:"reason"`
 	IdempotencyKey        string `json:"idempotency_key"`
@@ -54,6 +74,120 @@ type RefundResponse struct {
 	ProcessedCurrency string `json:"processed_currency,omitempty"`
 }
 
+type AuthorizeRequest struct {
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	Token          string `json:"token,omitempty"`
+	IdempotencyKey string `json:"idempotency_key"`
+	NetworkToken   string `json:"network_token,omitempty"`
+	ProcessorToken string `json:"processor_token,omitempty"`
+	Marketplace    string `json:"marketplace,omitempty"`
+
+	// Single-use cryptogram binding NetworkToken to this hold; MITs may omit it
+	TokenCryptogram string `json:"token_cryptogram,omitempty"`
+
+	StoredCredential *StoredCredential `json:"stored_credential,omitempty"`
+	ThreeDS          *ThreeDSRequest   `json:"three_ds,omitempty"`
+}
+
+type AuthorizeResponse struct {
+	Success         bool      `json:"success"`
+	AuthorizationID string    `json:"authorization_id,omitempty"`
+	AuthCode        string    `json:"auth_code,omitempty"`
+	Amount          int64     `json:"amount,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at,omitempty"`
+	ErrorCode       string    `json:"error_code,omitempty"`
+	ErrorMessage    string    `json:"error_message,omitempty"`
+	ProcessorUsed   string    `json:"processor_used"`
+}
+
+// VerifyRequest checks a card can be charged without moving money, as a
+// zero-amount authorization
+type VerifyRequest struct {
+	Currency       string `json:"currency"`
+	IdempotencyKey string `json:"idempotency_key"`
+	NetworkToken   string `json:"network_token,omitempty"`
+	ProcessorToken string `json:"processor_token,omitempty"`
+}
+
+type VerifyResponse struct {
+	Success        bool   `json:"success"`
+	VerificationID string `json:"verification_id,omitempty"`
+	ErrorCode      string `json:"error_code,omitempty"`
+	ErrorMessage   string `json:"error_message,omitempty"`
+	ProcessorUsed  string `json:"processor_used"`
+}
+
+type CaptureRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	Amount          int64  `json:"amount"`
+	FinalCapture    bool   `json:"final_capture"`
+	IdempotencyKey  string `json:"idempotency_key"`
+}
+
+type CaptureResponse struct {
+	Success         bool   `json:"success"`
+	TransactionID   string `json:"transaction_id,omitempty"`
+	AuthorizationID string `json:"authorization_id"`
+	CapturedAmount  int64  `json:"captured_amount"`
+	RemainingAmount int64  `json:"remaining_amount"`
+	Status          string `json:"status,omitempty"`
+	ErrorCode       string `json:"error_code,omitempty"`
+	ErrorMessage    string `json:"error_message,omitempty"`
+}
+
+type VoidRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	Reason          string `json:"reason"`
+	IdempotencyKey  string `json:"idempotency_key"`
+}
+
+type VoidResponse struct {
+	Success         bool   `json:"success"`
+	AuthorizationID string `json:"authorization_id"`
+	ReleasedAmount  int64  `json:"released_amount"`
+	Status          string `json:"status,omitempty"`
+	ErrorCode       string `json:"error_code,omitempty"`
+	ErrorMessage    string `json:"error_message,omitempty"`
+}
+
+// DisputeEvidence is what a merchant submits to contest a dispute
+type DisputeEvidence struct {
+	ProductDescription    string   `json:"product_description,omitempty"`
+	CustomerName          string   `json:"customer_name,omitempty"`
+	CustomerEmail         string   `json:"customer_email,omitempty"`
+	ServiceDate           string   `json:"service_date,omitempty"`
+	CancellationPolicy    string   `json:"cancellation_policy,omitempty"`
+	CustomerCommunication string   `json:"customer_communication,omitempty"`
+	UncategorizedText     string   `json:"uncategorized_text,omitempty"`
+	DocumentURLs          []string `json:"document_urls,omitempty"`
+}
+
+type DisputeEvidenceRequest struct {
+	DisputeID string          `json:"dispute_id"`
+	Evidence  DisputeEvidence `json:"evidence"`
+}
+
+type DisputeEvidenceResponse struct {
+	Success      bool   `json:"success"`
+	DisputeID    string `json:"dispute_id"`
+	Status       string `json:"status,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// DisputeNotification is what a processor posts when a dispute is raised or changes state
+type DisputeNotification struct {
+	DisputeID     string    `json:"dispute_id"`
+	TransactionID string    `json:"transaction_id"` // The processor's transaction ID
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	ReasonCode    string    `json:"reason_code"`
+	Reason        string    `json:"reason"`
+	Status        string    `json:"status"`
+	EvidenceDueBy time.Time `json:"evidence_due_by"`
+}
+
 type TokenizeRequest struct {
 	CardNumber string `json:"card_number"`
 	ExpMonth   int    `json:"exp_month"`
@@ -105,6 +239,21 @@ func (e *ProcessorError) Error() string {
 	return fmt.Sprintf("%s (%s): %s", e.Processor, e.Code, e.Message)
 }
 
+// ErrChargeNotFound means the processor has no record of a charge
+var ErrChargeNotFound = errors.New("charge not found")
+
+// ErrAuthorizationNotFound means the processor has no record of an authorization
+var ErrAuthorizationNotFound = errors.New("authorization not found")
+
+// ErrRefundNotFound means the processor has no record of a refund
+var ErrRefundNotFound = errors.New("refund not found")
+
+// ErrCaptureNotFound means the processor has no record of a capture
+var ErrCaptureNotFound = errors.New("capture not found")
+
+// ErrDisputeNotFound means the processor has no record of a dispute
+var ErrDisputeNotFound = errors.New("dispute not found")
+
 // NewClient creates a new processor client
 func NewClient(name, baseURL string, timeout time.Duration) *Client {
 	return &Client{
@@ -116,14 +265,28 @@ func NewClient(name, baseURL string, timeout time.Duration) *Client {
 	}
 }
 
+// SetTransport replaces the transport requests are sent through, e.g. to audit them
+func (c *Client) SetTransport(transport http.RoundTripper) {
+	c.httpClient.Transport = transport
+}
+
 // Charge processes a payment charge
 func (c *Client) Charge(ctx context.Context, req *ChargeRequest) (*ChargeResponse, error) {
 	var response ChargeResponse
 	err := c.makeRequest(ctx, "POST", "/charge", req, &response)
 	if err != nil {
+		// Keep the processor's response body when it sent one (e.g. a 402 decline)
+		if response.ErrorCode != "" {
+			return &response, err
+		}
 		return nil, err
 	}
 
+	// Waiting on the cardholder is not a decline
+	if response.RequiresAction() {
+		return &response, nil
+	}
+
 	// Convert error response to ProcessorError for better handling
 	if !response.Success {
 		return &response, &ProcessorError{
@@ -143,6 +306,9 @@ func (c *Client) Refund(ctx context.Context, req *RefundRequest) (*RefundRespons
 	var response RefundResponse
 	err := c.makeRequest(ctx, "POST", "/refund", req, &response)
 	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
 		return nil, err
 	}
 
@@ -158,6 +324,133 @@ func (c *Client) Refund(ctx context.Context, req *RefundRequest) (*RefundRespons
 	return &response, nil
 }
 
+// Authorize places a hold on the card without capturing funds
+func (c *Client) Authorize(ctx context.Context, req *AuthorizeRequest) (*AuthorizeResponse, error) {
+	var response AuthorizeResponse
+	err := c.makeRequest(ctx, "POST", "/authorize", req, &response)
+	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
+		return nil, err
+	}
+
+	if !response.Success {
+		return &response, &ProcessorError{
+			Code:        response.ErrorCode,
+			Message:     response.ErrorMessage,
+			Processor:   c.name,
+			IsRetryable: c.isRetryableError(response.ErrorCode),
+		}
+	}
+
+	return &response, nil
+}
+
+// Verify runs a zero-amount authorization to check a card is valid
+func (c *Client) Verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error) {
+	var response VerifyResponse
+	err := c.makeRequest(ctx, "POST", "/verify", req, &response)
+	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
+		return nil, err
+	}
+
+	if !response.Success {
+		return &response, &ProcessorError{
+			Code:      response.ErrorCode,
+			Message:   response.ErrorMessage,
+			Processor: c.name,
+		}
+	}
+
+	return &response, nil
+}
+
+// Capture collects all or part of an authorization
+func (c *Client) Capture(ctx context.Context, req *CaptureRequest) (*CaptureResponse, error) {
+	var response CaptureResponse
+	err := c.makeRequest(ctx, "POST", "/capture", req, &response)
+	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
+		return nil, err
+	}
+
+	if !response.Success {
+		return &response, &ProcessorError{
+			Code:      response.ErrorCode,
+			Message:   response.ErrorMessage,
+			Processor: c.name,
+		}
+	}
+
+	return &response, nil
+}
+
+// Void releases the uncaptured part of an authorization
+func (c *Client) Void(ctx context.Context, req *VoidRequest) (*VoidResponse, error) {
+	var response VoidResponse
+	err := c.makeRequest(ctx, "POST", "/void", req, &response)
+	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
+		return nil, err
+	}
+
+	if !response.Success {
+		return &response, &ProcessorError{
+			Code:      response.ErrorCode,
+			Message:   response.ErrorMessage,
+			Processor: c.name,
+		}
+	}
+
+	return &response, nil
+}
+
+// GetDispute returns a dispute's current state as the processor has it, or
+// ErrDisputeNotFound if the processor never raised it
+func (c *Client) GetDispute(ctx context.Context, disputeID string) (*DisputeNotification, error) {
+	var response DisputeNotification
+	err := c.makeRequest(ctx, "GET", "/disputes/"+url.PathEscape(disputeID), nil, &response)
+	if err != nil {
+		var procErr *ProcessorError
+		if errors.As(err, &procErr) && procErr.StatusCode == http.StatusNotFound {
+			return nil, ErrDisputeNotFound
+		}
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// SubmitDisputeEvidence contests a dispute with the processor
+func (c *Client) SubmitDisputeEvidence(ctx context.Context, req *DisputeEvidenceRequest) (*DisputeEvidenceResponse, error) {
+	var response DisputeEvidenceResponse
+	err := c.makeRequest(ctx, "POST", "/disputes/"+url.PathEscape(req.DisputeID)+"/evidence", req, &response)
+	if err != nil {
+		if response.ErrorCode != "" {
+			return &response, err
+		}
+		return nil, err
+	}
+
+	if !response.Success {
+		return &response, &ProcessorError{
+			Code:      response.ErrorCode,
+			Message:   response.ErrorMessage,
+			Processor: c.name,
+		}
+	}
+
+	return &response, nil
+}
+
 // Tokenize creates a payment token
 func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
 	var response TokenizeResponse
@@ -178,6 +471,70 @@ func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeR
 	return &response, nil
 }
 
+// LookupCharge returns the outcome of the charge sent with an idempotency key,
+// or ErrChargeNotFound if the processor never received it
+func (c *Client) LookupCharge(ctx context.Context, idempotencyKey string) (*ChargeResponse, error) {
+	var response ChargeResponse
+	err := c.makeRequest(ctx, "GET", "/charges/"+url.PathEscape(idempotencyKey), nil, &response)
+	if err != nil {
+		var procErr *ProcessorError
+		if errors.As(err, &procErr) && procErr.StatusCode == http.StatusNotFound {
+			return nil, ErrChargeNotFound
+		}
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// LookupAuthorization returns the outcome of the authorization sent with an
+// idempotency key, or ErrAuthorizationNotFound if the processor never received it
+func (c *Client) LookupAuthorization(ctx context.Context, idempotencyKey string) (*AuthorizeResponse, error) {
+	var response AuthorizeResponse
+	err := c.makeRequest(ctx, "GET", "/authorizations?idempotency_key="+url.QueryEscape(idempotencyKey), nil, &response)
+	if err != nil {
+		var procErr *ProcessorError
+		if errors.As(err, &procErr) && procErr.StatusCode == http.StatusNotFound {
+			return nil, ErrAuthorizationNotFound
+		}
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// LookupRefund returns the outcome of the refund sent with an idempotency key,
+// or ErrRefundNotFound if the processor never received it
+func (c *Client) LookupRefund(ctx context.Context, idempotencyKey string) (*RefundResponse, error) {
+	var response RefundResponse
+	err := c.makeRequest(ctx, "GET", "/refunds/"+url.PathEscape(idempotencyKey), nil, &response)
+	if err != nil {
+		var procErr *ProcessorError
+		if errors.As(err, &procErr) && procErr.StatusCode == http.StatusNotFound {
+			return nil, ErrRefundNotFound
+		}
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// LookupCapture returns the outcome of the capture sent with an idempotency
+// key, or ErrCaptureNotFound if the processor never received it
+func (c *Client) LookupCapture(ctx context.Context, idempotencyKey string) (*CaptureResponse, error) {
+	var response CaptureResponse
+	err := c.makeRequest(ctx, "GET", "/captures/"+url.PathEscape(idempotencyKey), nil, &response)
+	if err != nil {
+		var procErr *ProcessorError
+		if errors.As(err, &procErr) && procErr.StatusCode == http.StatusNotFound {
+			return nil, ErrCaptureNotFound
+		}
+		return nil, err
+	}
+
+	return &response, nil
+}
+
 // Health checks processor health
 func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
 	var response HealthResponse
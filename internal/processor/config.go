@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ProcessorsFile is the layout of configs/processors.yaml
+type ProcessorsFile struct {
+	Version    string            `yaml:"version"`
+	Processors []ProcessorConfig `yaml:"processors"`
+}
+
+// LoadProcessorConfigs reads processor definitions from a YAML file, sorted by priority
+func LoadProcessorConfigs(path string) ([]*ProcessorConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read processor config: %w", err)
+	}
+
+	var file ProcessorsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse processor config: %w", err)
+	}
+
+	if len(file.Processors) == 0 {
+		return nil, fmt.Errorf("no processors defined in %s", path)
+	}
+
+	seen := make(map[string]bool)
+	configs := make([]*ProcessorConfig, 0, len(file.Processors))
+	for i := range file.Processors {
+		config := &file.Processors[i]
+		if config.Name == "" || config.BaseURL == "" {
+			return nil, fmt.Errorf("processor %d: name and base_url are required", i)
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("processor %s defined more than once", config.Name)
+		}
+		seen[config.Name] = true
+
+		// Apply defaults
+		if config.Timeout == 0 {
+			config.Timeout = 5 * time.Second
+		}
+		if config.MaxRetries == 0 {
+			config.MaxRetries = 2
+		}
+
+		configs = append(configs, config)
+	}
+
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Priority < configs[j].Priority
+	})
+
+	return configs, nil
+}
+
+// ProcessorFactoryFromFile creates a processor factory from a YAML config file
+func ProcessorFactoryFromFile(path string) (*ProcessorFactory, error) {
+	configs, err := LoadProcessorConfigs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	factory := NewProcessorFactory()
+	for _, config := range configs {
+		factory.RegisterProcessor(config)
+	}
+
+	return factory, nil
+}
@@ -0,0 +1,58 @@
+package processor
+
+import "errors"
+
+// Stored credential initiators
+const (
+	InitiatorCustomer = "customer" // Customer-initiated (CIT): the cardholder is present
+	InitiatorMerchant = "merchant" // Merchant-initiated (MIT): charged without the cardholder
+)
+
+// Stored credential sequences
+const (
+	SequenceInitial    = "initial"    // Stores the card for later use
+	SequenceSubsequent = "subsequent" // Uses a card stored by an earlier initial charge
+)
+
+// Reasons a stored credential is used
+const (
+	ReasonRecurring   = "recurring"   // Fixed schedule, e.g. a subscription renewal
+	ReasonUnscheduled = "unscheduled" // Variable timing, e.g. usage top-ups
+)
+
+// StoredCredential flags a charge made with card details kept on file.
+// Card networks require the initial CIT to be flagged and every later MIT
+// to reference the network transaction ID of that initial charge.
+type StoredCredential struct {
+	Initiator            string `json:"initiator"`
+	Sequence             string `json:"sequence"`
+	Reason               string `json:"reason"`
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"` // Initial charge's network transaction ID; required for MITs
+}
+
+// IsMIT reports whether the charge is merchant-initiated
+func (s *StoredCredential) IsMIT() bool {
+	return s != nil && s.Initiator == InitiatorMerchant
+}
+
+// EstablishesCredential reports whether the charge stores the card, so its
+// network transaction ID should be kept for later MITs
+func (s *StoredCredential) EstablishesCredential() bool {
+	return s != nil && s.Initiator == InitiatorCustomer && s.Sequence == SequenceInitial
+}
+
+// Validate checks the indicator is one the networks accept. A MIT can only
+// follow an initial CIT, so it is always subsequent.
+func (s *StoredCredential) Validate() error {
+	switch {
+	case s.Initiator != InitiatorCustomer && s.Initiator != InitiatorMerchant:
+		return errors.New("initiator must be customer or merchant")
+	case s.Sequence != SequenceInitial && s.Sequence != SequenceSubsequent:
+		return errors.New("sequence must be initial or subsequent")
+	case s.Reason != ReasonRecurring && s.Reason != ReasonUnscheduled:
+		return errors.New("reason must be recurring or unscheduled")
+	case s.Initiator == InitiatorMerchant && s.Sequence == SequenceInitial:
+		return errors.New("merchant-initiated charges must be subsequent to an initial customer-initiated charge")
+	}
+	return nil
+}
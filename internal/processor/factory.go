@@ -3,13 +3,26 @@ package processor
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 // ProcessorInterface defines the interface all processors must implement
 type ProcessorInterface interface {
 	Charge(ctx context.Context, req *ChargeRequest) (*ChargeResponse, error)
+	LookupCharge(ctx context.Context, idempotencyKey string) (*ChargeResponse, error)
+	LookupAuthorization(ctx context.Context, idempotencyKey string) (*AuthorizeResponse, error)
+	LookupRefund(ctx context.Context, idempotencyKey string) (*RefundResponse, error)
+	LookupCapture(ctx context.Context, idempotencyKey string) (*CaptureResponse, error)
 	Refund(ctx context.Context, req *RefundRequest) (*RefundResponse, error)
+	Authorize(ctx context.Context, req *AuthorizeRequest) (*AuthorizeResponse, error)
+	Verify(ctx context.Context, req *VerifyRequest) (*VerifyResponse, error)
+	Capture(ctx context.Context, req *CaptureRequest) (*CaptureResponse, error)
+	Void(ctx context.Context, req *VoidRequest) (*VoidResponse, error)
+	GetDispute(ctx context.Context, disputeID string) (*DisputeNotification, error)
+	SubmitDisputeEvidence(ctx context.Context, req *DisputeEvidenceRequest) (*DisputeEvidenceResponse, error)
+	GetSettlementReport(ctx context.Context, date time.Time) ([]SettlementRecord, error)
 	Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error)
 	Health(ctx context.Context) (*HealthResponse, error)
 	GetStats(ctx context.Context) (*StatsResponse, error)
@@ -20,16 +33,24 @@ type ProcessorInterface interface {
 
 // ProcessorConfig holds configuration for a processor
 type ProcessorConfig struct {
-	Name       string
-	BaseURL    string
-	Timeout    time.Duration
-	MaxRetries int
+	Name        string        `yaml:"name" json:"name"`
+	BaseURL     string        `yaml:"base_url" json:"base_url"`
+	Timeout     time.Duration `yaml:"timeout" json:"timeout"`
+	MaxRetries  int           `yaml:"max_retries" json:"max_retries"`
+	Priority    int           `yaml:"priority" json:"priority"` // Lower number = earlier in the default fallback chain
+	Weight      float64       `yaml:"weight" json:"weight"`
+	Description string        `yaml:"description,omitempty" json:"description,omitempty"`
 }
 
+// ProcessorBuilder creates a processor instance from its configuration
+type ProcessorBuilder func(config *ProcessorConfig) ProcessorInterface
+
 // ProcessorFactory manages processor instances
 type ProcessorFactory struct {
+	mu         sync.Mutex
 	processors map[string]ProcessorInterface
 	configs    map[string]*ProcessorConfig
+	builder    ProcessorBuilder
 }
 
 // NewProcessorFactory creates a new processor factory
@@ -37,16 +58,34 @@ func NewProcessorFactory() *ProcessorFactory {
 	return &ProcessorFactory{
 		processors: make(map[string]ProcessorInterface),
 		configs:    make(map[string]*ProcessorConfig),
+		builder:    defaultBuilder,
 	}
 }
 
+func defaultBuilder(config *ProcessorConfig) ProcessorInterface {
+	return NewClient(config.Name, config.BaseURL, config.Timeout)
+}
+
+// SetBuilder replaces how processor instances are created, e.g. to wrap
+// clients with service-specific behaviour. Processors already created are kept.
+func (f *ProcessorFactory) SetBuilder(builder ProcessorBuilder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.builder = builder
+}
+
 // RegisterProcessor adds a processor configuration
 func (f *ProcessorFactory) RegisterProcessor(config *ProcessorConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.configs[config.Name] = config
 }
 
 // GetProcessor returns a processor client by name, creating it if necessary
 func (f *ProcessorFactory) GetProcessor(name string) (ProcessorInterface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	// Return existing processor if already created
 	if processor, exists := f.processors[name]; exists {
 		return processor, nil
@@ -59,17 +98,17 @@ func (f *ProcessorFactory) GetProcessor(name string) (ProcessorInterface, error)
 	}
 
 	// Create new processor client
-	client := NewClient(config.Name, config.BaseURL, config.Timeout)
+	client := f.builder(config)
 	f.processors[name] = client
 
 	return client, nil
 }
 
-// GetAllProcessors returns all configured processors
+// GetAllProcessors returns all configured processors in priority order
 func (f *ProcessorFactory) GetAllProcessors() ([]ProcessorInterface, error) {
 	var processors []ProcessorInterface
 
-	for name := range f.configs {
+	for _, name := range f.GetProcessorNames() {
 		processor, err := f.GetProcessor(name)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get processor %s: %w", name, err)
@@ -80,15 +119,35 @@ func (f *ProcessorFactory) GetAllProcessors() ([]ProcessorInterface, error) {
 	return processors, nil
 }
 
-// GetProcessorNames returns a list of all configured processor names
+// GetProcessorNames returns all configured processor names in priority order
 func (f *ProcessorFactory) GetProcessorNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	var names []string
 	for name := range f.configs {
 		names = append(names, name)
 	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := f.configs[names[i]].Priority, f.configs[names[j]].Priority
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+
 	return names
 }
 
+// GetProcessorConfig returns the configuration of a registered processor
+func (f *ProcessorFactory) GetProcessorConfig(name string) (*ProcessorConfig, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config, exists := f.configs[name]
+	return config, exists
+}
+
 // GetHealthyProcessors returns only the processors that are currently healthy
 func (f *ProcessorFactory) GetHealthyProcessors(ctx context.Context) ([]ProcessorInterface, error) {
 	allProcessors, err := f.GetAllProcessors()
@@ -110,7 +169,7 @@ func (f *ProcessorFactory) GetHealthyProcessors(ctx context.Context) ([]Processo
 func (f *ProcessorFactory) CheckAllHealth(ctx context.Context) (map[string]bool, error) {
 	healthStatus := make(map[string]bool)
 
-	for name := range f.configs {
+	for _, name := range f.GetProcessorNames() {
 		processor, err := f.GetProcessor(name)
 		if err != nil {
 			healthStatus[name] = false
@@ -127,7 +186,7 @@ func (f *ProcessorFactory) CheckAllHealth(ctx context.Context) (map[string]bool,
 func (f *ProcessorFactory) GetProcessorStats(ctx context.Context) (map[string]*StatsResponse, error) {
 	stats := make(map[string]*StatsResponse)
 
-	for name := range f.configs {
+	for _, name := range f.GetProcessorNames() {
 		processor, err := f.GetProcessor(name)
 		if err != nil {
 			continue
@@ -154,6 +213,7 @@ func DefaultProcessorFactory() *ProcessorFactory {
 		BaseURL:    "http://mock-processor-a:8101",
 		Timeout:    5 * time.Second,
 		MaxRetries: 2,
+		Priority:   1,
 	})
 
 	// Register Processor B (Secondary/Backup)
@@ -162,6 +222,7 @@ func DefaultProcessorFactory() *ProcessorFactory {
 		BaseURL:    "http://mock-processor-b:8102",
 		Timeout:    5 * time.Second,
 		MaxRetries: 2,
+		Priority:   2,
 	})
 
 	return factory
@@ -177,6 +238,7 @@ func ProcessorFromConfig(processorAURL, processorBURL string) *ProcessorFactory
 			BaseURL:    processorAURL,
 			Timeout:    5 * time.Second,
 			MaxRetries: 2,
+			Priority:   1,
 		})
 	}
 
@@ -186,6 +248,7 @@ func ProcessorFromConfig(processorAURL, processorBURL string) *ProcessorFactory
 			BaseURL:    processorBURL,
 			Timeout:    5 * time.Second,
 			MaxRetries: 2,
+			Priority:   2,
 		})
 	}
 
@@ -0,0 +1,122 @@
+package processor
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SettlementRecord is one line of a processor's daily settlement file.
+// Amounts are in minor units of Currency; Net is negative for refunds.
+type SettlementRecord struct {
+	SettlementDate        string    `json:"settlement_date"`
+	TransactionID         string    `json:"transaction_id"`
+	OriginalTransactionID string    `json:"original_transaction_id,omitempty"`
+	Type                  string    `json:"type"`
+	Status                string    `json:"status"`
+	Amount                int64     `json:"amount"`
+	Currency              string    `json:"currency"`
+	Fee                   int64     `json:"fee"`
+	Net                   int64     `json:"net"`
+	ProcessedAt           time.Time `json:"processed_at"`
+}
+
+// settlementColumns are the columns a settlement file must have, in any order
+var settlementColumns = []string{
+	"settlement_date", "transaction_id", "original_transaction_id", "type", "status",
+	"amount", "currency", "fee", "net", "processed_at",
+}
+
+// ParseSettlementReport reads a settlement CSV with a header row
+func ParseSettlementReport(r io.Reader) ([]SettlementRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("settlement file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read settlement header: %w", err)
+	}
+
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		index[strings.TrimSpace(column)] = i
+	}
+	for _, column := range settlementColumns {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("settlement file is missing column %s", column)
+		}
+	}
+
+	records := []SettlementRecord{}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("settlement line %d: %w", line, err)
+		}
+
+		field := func(column string) string { return strings.TrimSpace(row[index[column]]) }
+		record := SettlementRecord{
+			SettlementDate:        field("settlement_date"),
+			TransactionID:         field("transaction_id"),
+			OriginalTransactionID: field("original_transaction_id"),
+			Type:                  field("type"),
+			Status:                field("status"),
+			Currency:              strings.ToUpper(field("currency")),
+		}
+		if record.TransactionID == "" {
+			return nil, fmt.Errorf("settlement line %d: transaction_id is empty", line)
+		}
+		for column, dest := range map[string]*int64{"amount": &record.Amount, "fee": &record.Fee, "net": &record.Net} {
+			if *dest, err = strconv.ParseInt(field(column), 10, 64); err != nil {
+				return nil, fmt.Errorf("settlement line %d: %s is not an integer", line, column)
+			}
+		}
+		if record.ProcessedAt, err = time.Parse(time.RFC3339, field("processed_at")); err != nil {
+			return nil, fmt.Errorf("settlement line %d: processed_at is not an RFC 3339 timestamp", line)
+		}
+		records = append(records, record)
+	}
+}
+
+// GetSettlementReport downloads and parses the settlement file for a UTC day
+func (c *Client) GetSettlementReport(ctx context.Context, date time.Time) ([]SettlementRecord, error) {
+	url := c.baseURL + "/settlements/" + date.UTC().Format("2006-01-02")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, &ProcessorError{
+			Code:        "NETWORK_ERROR",
+			Message:     fmt.Sprintf("Network error: %v", err),
+			Processor:   c.name,
+			IsRetryable: true,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, &ProcessorError{
+			Code:        c.getErrorCodeFromStatus(resp.StatusCode),
+			Message:     string(body),
+			StatusCode:  resp.StatusCode,
+			Processor:   c.name,
+			IsRetryable: c.isRetryableStatusCode(resp.StatusCode),
+		}
+	}
+
+	return ParseSettlementReport(resp.Body)
+}
@@ -0,0 +1,45 @@
+package processor
+
+import "time"
+
+// ChargeStatusRequiresAction means the cardholder must complete a 3-D Secure
+// challenge before the charge is authorized
+const ChargeStatusRequiresAction = "requires_action"
+
+// 3-D Secure exemptions a charge can ask the issuer for. The issuer decides;
+// a refused exemption is answered with a challenge.
+const (
+	ExemptionLowValue = "low_value" // Small amounts, e.g. under EUR 30
+	ExemptionMIT      = "mit"       // Merchant-initiated charges are out of SCA scope
+	ExemptionTRA      = "tra"       // Transaction risk analysis by the acquirer
+)
+
+// ValidExemption reports whether exemption is one a charge can request
+func ValidExemption(exemption string) bool {
+	switch exemption {
+	case ExemptionLowValue, ExemptionMIT, ExemptionTRA:
+		return true
+	}
+	return false
+}
+
+// ThreeDSRequest asks for strong customer authentication on a charge
+type ThreeDSRequest struct {
+	Required  bool   `json:"required,omitempty"`  // Authenticate unless an exemption is granted
+	Exemption string `json:"exemption,omitempty"` // Exemption to request, if any
+}
+
+// ThreeDSChallenge is where the cardholder authenticates a charge
+type ThreeDSChallenge struct {
+	ID          string    `json:"id"`
+	RedirectURL string    `json:"redirect_url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// ThreeDSNotification is sent by a processor when a challenge is completed,
+// failed or expired. The charge outcome is read back with LookupCharge.
+type ThreeDSNotification struct {
+	ChallengeID    string `json:"challenge_id"`
+	IdempotencyKey string `json:"idempotency_key"`
+	Status         string `json:"status"` // authenticated, failed or expired
+}
@@ -89,10 +89,64 @@ type RefreshTokenResponse struct {
 	Success         bool   `json:"success"`
 	NewNetworkToken string `json:"new_network_token,omitempty"`
 	ExpiresAt       string `json:"expires_at,omitempty"`
+	ExpMonth        int    `json:"exp_month,omitempty"`
+	ExpYear         int    `json:"exp_year,omitempty"`
 	ErrorCode       string `json:"error_code,omitempty"`
 	ErrorMessage    string `json:"error_message,omitempty"`
 }
 
+// UpgradeTokenRequest asks for a network token for a dual-vault card, named
+// by one of its processor tokens
+type UpgradeTokenRequest struct {
+	ProcessorToken string `json:"processor_token"`
+}
+
+// UpgradeTokenResponse carries the network token a dual-vault card now has
+type UpgradeTokenResponse struct {
+	Success      bool          `json:"success"`
+	NetworkToken *NetworkToken `json:"network_token,omitempty"`
+	ErrorCode    string        `json:"error_code,omitempty"`
+	ErrorMessage string        `json:"error_message,omitempty"`
+}
+
+// CryptogramRequest asks for a cryptogram binding a network token to one charge
+type CryptogramRequest struct {
+	NetworkToken string `json:"network_token"`
+	Amount       int64  `json:"amount"` // In minor units of Currency
+	Currency     string `json:"currency"`
+	MerchantID   string `json:"merchant_id"`
+}
+
+// CryptogramResponse represents a cryptogram issued for a charge
+type CryptogramResponse struct {
+	Success      bool   `json:"success"`
+	Cryptogram   string `json:"cryptogram,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// Network token states
+const (
+	TokenStatusActive    = "active"
+	TokenStatusSuspended = "suspended" // Unusable until resumed, e.g. the card was reported lost
+	TokenStatusDeleted   = "deleted"   // Permanently unusable, e.g. the account was closed
+)
+
+// LifecycleNotification is what the network token service posts when a
+// token is suspended, resumed, deleted or moved to a reissued card. It
+// carries the token's whole state as of OccurredAt.
+type LifecycleNotification struct {
+	EventID      string    `json:"event_id"`
+	NetworkToken string    `json:"network_token"`
+	Event        string    `json:"event"` // suspended, resumed, deleted or pan_updated
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason,omitempty"`
+	LastFour     string    `json:"last_four"`
+	ExpMonth     int       `json:"exp_month"`
+	ExpYear      int       `json:"exp_year"`
+	OccurredAt   time.Time `json:"occurred_at"`
+}
+
 // TokenInfo contains detailed token information
 type TokenInfo struct {
 	NetworkToken     string    `json:"network_token"`
@@ -105,6 +159,8 @@ type TokenInfo struct {
 	CreatedAt        time.Time `json:"created_at"`
 	ExpiresAt        time.Time `json:"expires_at"`
 	SupportedMarkets []string  `json:"supported_markets"`
+	Status           string    `json:"status"`
+	StatusReason     string    `json:"status_reason,omitempty"`
 }
 
 // ProcessorTokens contains processor-specific tokens for a payment method
@@ -118,15 +174,23 @@ type ProcessorTokens struct {
 
 // TokenError represents token-related errors
 type TokenError struct {
-	Code    string
-	Message string
-	Type    string // "network", "dual_vault", "validation", "refresh"
+	Code       string
+	Message    string
+	Type       string // "network", "dual_vault", "validation", "refresh", "upgrade", "lifecycle"
+	StatusCode int    // HTTP status from the token service; zero when it wasn't reached
 }
 
 func (e *TokenError) Error() string {
 	return fmt.Sprintf("Token %s error (%s): %s", e.Type, e.Code, e.Message)
 }
 
+// Refused reports whether the token service turned the request down, as
+// opposed to failing to handle it. Only refusals are worth recording
+// against a card; anything else may succeed if tried again.
+func (e *TokenError) Refused() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
 // NewTokenManager creates a new token manager
 func NewTokenManager(networkTokenURL string) *TokenManager {
 	return &TokenManager{
@@ -137,6 +201,11 @@ func NewTokenManager(networkTokenURL string) *TokenManager {
 	}
 }
 
+// SetTransport replaces the transport requests are sent through, e.g. to audit them
+func (tm *TokenManager) SetTransport(transport http.RoundTripper) {
+	tm.httpClient.Transport = transport
+}
+
 // CreateToken attempts to create a network token, falling back to dual vault if needed
 func (tm *TokenManager) CreateToken(ctx context.Context, req *TokenRequest) (*TokenResponse, error) {
 	jsonData, err := json.Marshal(req)
@@ -173,9 +242,10 @@ func (tm *TokenManager) CreateToken(ctx context.Context, req *TokenRequest) (*To
 
 	if resp.StatusCode >= 400 {
 		return &response, &TokenError{
-			Code:    response.ErrorCode,
-			Message: response.ErrorMessage,
-			Type:    "network",
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "network",
+			StatusCode: resp.StatusCode,
 		}
 	}
 
@@ -201,9 +271,10 @@ func (tm *TokenManager) GetTokenInfo(ctx context.Context, networkToken string) (
 
 	if resp.StatusCode == http.StatusNotFound {
 		return nil, &TokenError{
-			Code:    "TOKEN_NOT_FOUND",
-			Message: "Network token not found",
-			Type:    "validation",
+			Code:       "TOKEN_NOT_FOUND",
+			Message:    "Network token not found",
+			Type:       "validation",
+			StatusCode: resp.StatusCode,
 		}
 	}
 
@@ -212,6 +283,15 @@ func (tm *TokenManager) GetTokenInfo(ctx context.Context, networkToken string) (
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
+	if resp.StatusCode >= 400 {
+		return nil, &TokenError{
+			Code:       "SERVICE_ERROR",
+			Message:    fmt.Sprintf("Token service returned status %d: %s", resp.StatusCode, body),
+			Type:       "validation",
+			StatusCode: resp.StatusCode,
+		}
+	}
+
 	var tokenInfo TokenInfo
 	if err := json.Unmarshal(body, &tokenInfo); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
@@ -446,16 +526,18 @@ func (tm *TokenManager) ValidateToken(ctx context.Context, networkToken, process
 
 	if resp.StatusCode >= 400 {
 		return &response, &TokenError{
-			Code:    response.ErrorCode,
-			Message: response.ErrorMessage,
-			Type:    "validation",
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "validation",
+			StatusCode: resp.StatusCode,
 		}
 	}
 
 	return &response, nil
 }
 
-// RefreshToken refreshes an existing network token
+// RefreshToken refreshes an existing network token. With a zero expiry the
+// service asks the issuer for the card's current expiry (account updater).
 func (tm *TokenManager) RefreshToken(ctx context.Context, networkToken string, expMonth, expYear int) (*RefreshTokenResponse, error) {
 	req := RefreshTokenRequest{
 		NetworkToken: networkToken,
@@ -497,11 +579,155 @@ func (tm *TokenManager) RefreshToken(ctx context.Context, networkToken string, e
 
 	if resp.StatusCode >= 400 {
 		return &response, &TokenError{
-			Code:    response.ErrorCode,
-			Message: response.ErrorMessage,
-			Type:    "refresh",
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "refresh",
+			StatusCode: resp.StatusCode,
 		}
 	}
 
 	return &response, nil
-}
\ No newline at end of file
+}
+
+// UpgradeToken retries network tokenization for a card that fell back to
+// the dual vault. The card number never leaves the network token service.
+// A refusal, e.g. the issuer still doesn't participate, comes back as a
+// *TokenError with the response.
+func (tm *TokenManager) UpgradeToken(ctx context.Context, processorToken string) (*UpgradeTokenResponse, error) {
+	jsonData, err := json.Marshal(UpgradeTokenRequest{ProcessorToken: processorToken})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", tm.networkTokenURL+"/network-tokens/upgrade", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := tm.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &TokenError{
+			Code:    "NETWORK_ERROR",
+			Message: fmt.Sprintf("Network error: %v", err),
+			Type:    "upgrade",
+		}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response UpgradeTokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return &response, &TokenError{
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "upgrade",
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return &response, nil
+}
+
+// DeleteToken retires a network token for good, e.g. one provisioned for a
+// payment method that was detached before it could be stored. A token the
+// service doesn't know comes back as a TOKEN_NOT_FOUND *TokenError.
+func (tm *TokenManager) DeleteToken(ctx context.Context, networkToken, reason string) error {
+	jsonData, err := json.Marshal(map[string]string{"reason": reason})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "DELETE", tm.networkTokenURL+"/network-tokens/"+networkToken, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := tm.httpClient.Do(httpReq)
+	if err != nil {
+		return &TokenError{
+			Code:    "NETWORK_ERROR",
+			Message: fmt.Sprintf("Network error: %v", err),
+			Type:    "lifecycle",
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var response struct {
+			ErrorCode    string `json:"error_code"`
+			ErrorMessage string `json:"error_message"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(body, &response); err != nil || response.ErrorCode == "" {
+			response.ErrorCode = "SERVICE_ERROR"
+			response.ErrorMessage = fmt.Sprintf("Token service returned status %d: %s", resp.StatusCode, body)
+		}
+		return &TokenError{
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "lifecycle",
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return nil
+}
+
+// RequestCryptogram gets a single-use cryptogram for charging a network
+// token. A refusal comes back as a *TokenError with the response.
+func (tm *TokenManager) RequestCryptogram(ctx context.Context, req *CryptogramRequest) (*CryptogramResponse, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", tm.networkTokenURL+"/network-tokens/cryptogram", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := tm.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &TokenError{
+			Code:    "NETWORK_ERROR",
+			Message: fmt.Sprintf("Network error: %v", err),
+			Type:    "network",
+		}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var response CryptogramResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return &response, &TokenError{
+			Code:       response.ErrorCode,
+			Message:    response.ErrorMessage,
+			Type:       "network",
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return &response, nil
+}
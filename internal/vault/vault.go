@@ -0,0 +1,296 @@
+// Package vault encrypts the payment tokens stored in payment_methods. Each
+// row has its own data key, stored wrapped by a versioned master key, so
+// master keys can be rotated by re-encrypting rows while services keep running.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrUnknownKeyVersion = errors.New("unknown master key version")
+	ErrInvalidKeyFile    = errors.New("invalid key file")
+	ErrNoKeyFile         = errors.New("TOKEN_KEYS_FILE is required (set TOKEN_KEYS_DEMO=1 to use the demo key)")
+)
+
+// Keyring holds the master keys. It stands in for a KMS: master keys never
+// leave it, callers only ask it to wrap and unwrap data keys.
+type Keyring interface {
+	// ActiveVersion is the master key new data keys are wrapped with
+	ActiveVersion() int
+	Wrap(version int, dataKey []byte) ([]byte, error)
+	Unwrap(version int, wrapped []byte) ([]byte, error)
+}
+
+// KeyFile is the layout of the file TOKEN_KEYS_FILE points at. Keys are
+// base64-encoded 32-byte AES keys. Older versions stay listed until no row
+// uses them.
+type KeyFile struct {
+	ActiveVersion int            `json:"active_version"`
+	IndexKey      string         `json:"index_key"`
+	Keys          map[int]string `json:"keys"`
+}
+
+// LocalKeyring is a Keyring holding its master keys in memory
+type LocalKeyring struct {
+	active int
+	keys   map[int]cipher.AEAD
+}
+
+// NewLocalKeyring builds a keyring from 32-byte master keys by version
+func NewLocalKeyring(active int, keys map[int][]byte) (*LocalKeyring, error) {
+	k := &LocalKeyring{active: active, keys: make(map[int]cipher.AEAD, len(keys))}
+	for version, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%w: master key %d must be 32 bytes", ErrInvalidKeyFile, version)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[version] = aead
+	}
+	if _, exists := k.keys[active]; !exists {
+		return nil, fmt.Errorf("%w: active version %d has no key", ErrInvalidKeyFile, active)
+	}
+	return k, nil
+}
+
+func (k *LocalKeyring) ActiveVersion() int {
+	return k.active
+}
+
+// Wrap encrypts a data key, binding it to the master key version
+func (k *LocalKeyring) Wrap(version int, dataKey []byte) ([]byte, error) {
+	aead, exists := k.keys[version]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	return seal(aead, dataKey, []byte(strconv.Itoa(version)))
+}
+
+func (k *LocalKeyring) Unwrap(version int, wrapped []byte) ([]byte, error) {
+	aead, exists := k.keys[version]
+	if !exists {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	return open(aead, wrapped, []byte(strconv.Itoa(version)))
+}
+
+// Vault encrypts token columns and computes their lookup hashes
+type Vault struct {
+	keys     Keyring
+	indexKey []byte
+}
+
+// New creates a Vault. The index key is separate from the master keys so
+// lookup hashes don't change when master keys rotate.
+func New(keys Keyring, indexKey []byte) *Vault {
+	return &Vault{keys: keys, indexKey: indexKey}
+}
+
+// Load opens the key file at TOKEN_KEYS_FILE. Without one it uses the
+// published demo key, but only when TOKEN_KEYS_DEMO=1 asks for it.
+func Load() (*Vault, error) {
+	path := os.Getenv("TOKEN_KEYS_FILE")
+	if path == "" {
+		if os.Getenv("TOKEN_KEYS_DEMO") != "1" {
+			return nil, ErrNoKeyFile
+		}
+		log.Println("⚠️  TOKEN_KEYS_DEMO set, using the demo token key")
+		demo := sha256.Sum256([]byte("demo-payment-token-key"))
+		keys, err := NewLocalKeyring(1, map[int][]byte{1: demo[:]})
+		if err != nil {
+			return nil, err
+		}
+		return New(keys, []byte("demo-payment-token-index")), nil
+	}
+	return LoadFile(path)
+}
+
+// LoadFile opens a key file
+func LoadFile(path string) (*Vault, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var file KeyFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyFile, err)
+	}
+
+	indexKey, err := base64.StdEncoding.DecodeString(file.IndexKey)
+	if err != nil || len(indexKey) < 16 {
+		return nil, fmt.Errorf("%w: index_key must be at least 16 base64-encoded bytes", ErrInvalidKeyFile)
+	}
+	keys := make(map[int][]byte, len(file.Keys))
+	for version, encoded := range file.Keys {
+		if keys[version], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("%w: master key %d: %v", ErrInvalidKeyFile, version, err)
+		}
+	}
+	keyring, err := NewLocalKeyring(file.ActiveVersion, keys)
+	if err != nil {
+		return nil, err
+	}
+	return New(keyring, indexKey), nil
+}
+
+// ActiveVersion is the master key version new rows are encrypted under
+func (v *Vault) ActiveVersion() int {
+	return v.keys.ActiveVersion()
+}
+
+// Index hashes a token for equality lookups on an encrypted column.
+// Empty tokens have no index.
+func (v *Vault) Index(token string) string {
+	if token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, v.indexKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Envelope is one row's data key, with the form it is stored in
+type Envelope struct {
+	KeyVersion int
+	WrappedKey []byte
+	aead       cipher.AEAD
+}
+
+// NewEnvelope creates a data key wrapped by the active master key
+func (v *Vault) NewEnvelope() (*Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	version := v.keys.ActiveVersion()
+	wrapped, err := v.keys.Wrap(version, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyVersion: version, WrappedKey: wrapped, aead: aead}, nil
+}
+
+// OpenEnvelope unwraps a row's data key
+func (v *Vault) OpenEnvelope(version int, wrapped []byte) (*Envelope, error) {
+	dataKey, err := v.keys.Unwrap(version, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{KeyVersion: version, WrappedKey: wrapped, aead: aead}, nil
+}
+
+// Encrypt seals a column value. The column name is bound to the ciphertext
+// so values can't be swapped between columns. Empty values stay empty.
+func (e *Envelope) Encrypt(column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	sealed, err := seal(e.aead, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt for the same column
+func (e *Envelope) Decrypt(column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted %s: %w", column, err)
+	}
+	plaintext, err := open(e.aead, sealed, []byte(column))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// Tokens are the encrypted columns of a payment_methods row
+type Tokens struct {
+	NetworkToken    string
+	ProcessorAToken string
+	ProcessorBToken string
+	ProcessorTokens map[string]string // processor_tokens, keyed by processor
+}
+
+// Seal encrypts every token of a row
+func (e *Envelope) Seal(t Tokens) (Tokens, error) {
+	return t.apply(e.Encrypt)
+}
+
+// Open decrypts every token of a row
+func (e *Envelope) Open(t Tokens) (Tokens, error) {
+	return t.apply(e.Decrypt)
+}
+
+func (t Tokens) apply(fn func(column, value string) (string, error)) (Tokens, error) {
+	var out Tokens
+	var err error
+	if out.NetworkToken, err = fn("network_token", t.NetworkToken); err != nil {
+		return Tokens{}, err
+	}
+	if out.ProcessorAToken, err = fn("processor_a_token", t.ProcessorAToken); err != nil {
+		return Tokens{}, err
+	}
+	if out.ProcessorBToken, err = fn("processor_b_token", t.ProcessorBToken); err != nil {
+		return Tokens{}, err
+	}
+	out.ProcessorTokens = make(map[string]string, len(t.ProcessorTokens))
+	for processor, token := range t.ProcessorTokens {
+		if out.ProcessorTokens[processor], err = fn("processor_tokens."+processor, token); err != nil {
+			return Tokens{}, err
+		}
+	}
+	return out, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce, which prefixes the result
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
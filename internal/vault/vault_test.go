@@ -0,0 +1,261 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testVault has master keys 1 and 2, with 2 active
+func testVault(t *testing.T) *Vault {
+	t.Helper()
+	keys, err := NewLocalKeyring(2, map[int][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatalf("NewLocalKeyring: %v", err)
+	}
+	return New(keys, []byte("test-index-key-0123456789"))
+}
+
+func testEnvelope(t *testing.T, v *Vault) *Envelope {
+	t.Helper()
+	env, err := v.NewEnvelope()
+	if err != nil {
+		t.Fatalf("NewEnvelope: %v", err)
+	}
+	return env
+}
+
+func TestSealOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens Tokens
+	}{
+		{"network token only", Tokens{NetworkToken: "ntk_4111abcd1111"}},
+		{"dual vault", Tokens{ProcessorAToken: "tok_a_12345678", ProcessorBToken: "tok_b_87654321"}},
+		{"processor tokens", Tokens{
+			NetworkToken:    "ntk_4111abcd1111",
+			ProcessorTokens: map[string]string{"processor_a": "pa_1", "processor_c": "pc_3"},
+		}},
+		{"empty row", Tokens{}},
+	}
+
+	v := testVault(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testEnvelope(t, v)
+			sealed, err := env.Seal(tt.tokens)
+			if err != nil {
+				t.Fatalf("Seal: %v", err)
+			}
+			if tt.tokens.NetworkToken != "" && sealed.NetworkToken == tt.tokens.NetworkToken {
+				t.Error("network token stored in the clear")
+			}
+			for processor, token := range tt.tokens.ProcessorTokens {
+				if sealed.ProcessorTokens[processor] == token {
+					t.Errorf("%s token stored in the clear", processor)
+				}
+			}
+
+			// Open as a later read would: from the stored key version and wrapped key
+			stored, err := v.OpenEnvelope(env.KeyVersion, env.WrappedKey)
+			if err != nil {
+				t.Fatalf("OpenEnvelope: %v", err)
+			}
+			opened, err := stored.Open(sealed)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+
+			want := tt.tokens
+			if want.ProcessorTokens == nil {
+				want.ProcessorTokens = map[string]string{}
+			}
+			if !reflect.DeepEqual(opened, want) {
+				t.Errorf("Open = %+v, want %+v", opened, want)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsSwappedColumns(t *testing.T) {
+	v := testVault(t)
+	env := testEnvelope(t, v)
+
+	tests := []struct {
+		name       string
+		sealedFor  string
+		openedAs   string
+		wantOpened bool
+	}{
+		{"same column", "network_token", "network_token", true},
+		{"network token read as processor A token", "network_token", "processor_a_token", false},
+		{"processor A token read as processor B token", "processor_a_token", "processor_b_token", false},
+		{"processor token read as another processor's", "processor_tokens.processor_a", "processor_tokens.processor_b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ciphertext, err := env.Encrypt(tt.sealedFor, "ntk_4111abcd1111")
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			plaintext, err := env.Decrypt(tt.openedAs, ciphertext)
+			if opened := err == nil; opened != tt.wantOpened {
+				t.Fatalf("Decrypt(%s) of a %s value: %q, %v", tt.openedAs, tt.sealedFor, plaintext, err)
+			}
+		})
+	}
+}
+
+func TestOpenRejectsSwappedRowColumns(t *testing.T) {
+	v := testVault(t)
+	env := testEnvelope(t, v)
+
+	sealed, err := env.Seal(Tokens{ProcessorAToken: "tok_a_12345678", ProcessorBToken: "tok_b_87654321"})
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	sealed.ProcessorAToken, sealed.ProcessorBToken = sealed.ProcessorBToken, sealed.ProcessorAToken
+
+	if opened, err := env.Open(sealed); err == nil {
+		t.Errorf("Open of swapped columns = %+v, want error", opened)
+	}
+}
+
+func TestDecryptRejectsAnotherRowsKey(t *testing.T) {
+	v := testVault(t)
+	ciphertext, err := testEnvelope(t, v).Encrypt("network_token", "ntk_4111abcd1111")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if _, err := testEnvelope(t, v).Decrypt("network_token", ciphertext); err == nil {
+		t.Error("another row's data key opened the value")
+	}
+}
+
+func TestOpenEnvelopeKeyVersions(t *testing.T) {
+	v := testVault(t)
+	env := testEnvelope(t, v)
+	if env.KeyVersion != 2 {
+		t.Fatalf("new envelope under key %d, want active key 2", env.KeyVersion)
+	}
+
+	tests := []struct {
+		name    string
+		version int
+		wantErr error
+	}{
+		{"wrapping version", 2, nil},
+		{"unknown version", 3, ErrUnknownKeyVersion},
+		{"no version", 0, ErrUnknownKeyVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.OpenEnvelope(tt.version, env.WrappedKey)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("OpenEnvelope(%d) error = %v, want %v", tt.version, err, tt.wantErr)
+			}
+		})
+	}
+
+	// A key wrapped under 2 doesn't unwrap under 1 even though 1 is known
+	if _, err := v.OpenEnvelope(1, env.WrappedKey); err == nil || errors.Is(err, ErrUnknownKeyVersion) {
+		t.Errorf("OpenEnvelope(1) of a version 2 key error = %v, want an unwrap failure", err)
+	}
+}
+
+func TestNewLocalKeyring(t *testing.T) {
+	tests := []struct {
+		name   string
+		active int
+		keys   map[int][]byte
+	}{
+		{"short key", 1, map[int][]byte{1: bytes.Repeat([]byte{1}, 16)}},
+		{"active version without a key", 2, map[int][]byte{1: bytes.Repeat([]byte{1}, 32)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLocalKeyring(tt.active, tt.keys); !errors.Is(err, ErrInvalidKeyFile) {
+				t.Errorf("NewLocalKeyring error = %v, want ErrInvalidKeyFile", err)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	v := testVault(t)
+	if v.Index("") != "" {
+		t.Error("empty token has an index")
+	}
+	if v.Index("ntk_4111abcd1111") != v.Index("ntk_4111abcd1111") {
+		t.Error("index is not stable")
+	}
+	if v.Index("ntk_4111abcd1111") == v.Index("ntk_4111abcd1112") {
+		t.Error("different tokens share an index")
+	}
+
+	// Rotating master keys leaves lookup hashes alone
+	rotated, err := NewLocalKeyring(3, map[int][]byte{3: bytes.Repeat([]byte{3}, 32)})
+	if err != nil {
+		t.Fatalf("NewLocalKeyring: %v", err)
+	}
+	if New(rotated, v.indexKey).Index("ntk_4111abcd1111") != v.Index("ntk_4111abcd1111") {
+		t.Error("index changed with the master key")
+	}
+}
+
+func TestLoadDemoKeyIsOptIn(t *testing.T) {
+	t.Setenv("TOKEN_KEYS_FILE", "")
+
+	t.Setenv("TOKEN_KEYS_DEMO", "")
+	if _, err := Load(); !errors.Is(err, ErrNoKeyFile) {
+		t.Errorf("Load without a key file error = %v, want ErrNoKeyFile", err)
+	}
+
+	t.Setenv("TOKEN_KEYS_DEMO", "true")
+	if _, err := Load(); !errors.Is(err, ErrNoKeyFile) {
+		t.Errorf("Load with TOKEN_KEYS_DEMO=true error = %v, want ErrNoKeyFile", err)
+	}
+
+	t.Setenv("TOKEN_KEYS_DEMO", "1")
+	v, err := Load()
+	if err != nil {
+		t.Fatalf("Load with TOKEN_KEYS_DEMO=1: %v", err)
+	}
+	if _, err := v.NewEnvelope(); err != nil {
+		t.Errorf("demo vault can't create envelopes: %v", err)
+	}
+}
+
+func TestLoadKeyFileWinsOverDemo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token-keys.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	index := base64.StdEncoding.EncodeToString([]byte("test-index-key-0123456789"))
+	file := `{"active_version": 3, "index_key": "` + index + `", "keys": {"3": "` + key + `"}}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("TOKEN_KEYS_FILE", path)
+	t.Setenv("TOKEN_KEYS_DEMO", "1")
+
+	v, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	env, err := v.NewEnvelope()
+	if err != nil {
+		t.Fatalf("NewEnvelope: %v", err)
+	}
+	if env.KeyVersion != 3 {
+		t.Errorf("envelope under key %d, want the key file's active key 3", env.KeyVersion)
+	}
+}
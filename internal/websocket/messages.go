@@ -10,6 +10,7 @@ const (
 	TypeTransaction  = "transaction"
 	TypeSubscription = "subscription"
 	TypeScheduler    = "scheduler"
+	TypePaymentMethod = "payment_method"
 	TypeHealth       = "health"
 	TypeRouting      = "routing"
 	TypeHeartbeat    = "heartbeat"
@@ -20,8 +21,13 @@ const (
 	EventChargeInitiated = "charge_initiated"
 	EventChargeSucceeded = "charge_succeeded"
 	EventChargeFailed    = "charge_failed"
+	EventChargeRequiresAction = "charge_requires_action"
 	EventFailoverTriggered = "failover_triggered"
 	EventRefundProcessed = "refund_processed"
+	EventDisputeOpened      = "dispute_opened"
+	EventDisputeUnderReview = "dispute_under_review"
+	EventDisputeWon         = "dispute_won"
+	EventDisputeLost        = "dispute_lost"
 )
 
 // Subscription events
@@ -31,6 +37,8 @@ const (
 	EventSubscriptionDowngraded = "downgraded"
 	EventSubscriptionCanceled   = "canceled"
 	EventSubscriptionPastDue    = "past_due"
+	EventSubscriptionPaymentMethodRequired = "payment_method_required"
+	EventSubscriptionPaymentMethodUpdated  = "payment_method_updated"
 )
 
 // Scheduler events
@@ -42,14 +50,28 @@ const (
 	EventRetrySucceeded  = "retry_succeeded"
 )
 
+// Payment method events
+const (
+	EventPaymentMethodRefreshed      = "refreshed"
+	EventPaymentMethodUpdateRequired = "update_required"
+	EventPaymentMethodSuspended      = "suspended"
+	EventPaymentMethodResumed        = "resumed"
+	EventPaymentMethodDeleted        = "deleted"
+	EventPaymentMethodCardUpdated    = "card_updated"
+)
+
 // Health events
 const (
 	EventProcessorHealthy   = "processor_healthy"
 	EventProcessorUnhealthy = "processor_unhealthy"
+	EventProcessorProbing   = "processor_probing"
 )
 
-// Message represents a WebSocket message
+// Message represents a WebSocket message. Events relayed from the outbox
+// carry their event ID and sequence number; heartbeats and health do not.
 type Message struct {
+	ID        string      `json:"id,omitempty"`
+	Sequence  int64       `json:"sequence,omitempty"`
 	Type      string      `json:"type"`
 	Event     string      `json:"event"`
 	Data      interface{} `json:"data,omitempty"`
@@ -76,6 +98,7 @@ type TransactionData struct {
 	TransactionID   string  `json:"transaction_id"`
 	SubscriptionID  string  `json:"subscription_id,omitempty"`
 	Amount          float64 `json:"amount"`
+	AmountMinor     int64   `json:"amount_minor"`
 	Currency        string  `json:"currency"`
 	ProcessorUsed   string  `json:"processor_used,omitempty"`
 	PreviousProcessor string `json:"previous_processor,omitempty"`
@@ -85,6 +108,22 @@ type TransactionData struct {
 	Duration        string  `json:"duration,omitempty"`
 }
 
+// DisputeData represents dispute event data
+type DisputeData struct {
+	DisputeID          string  `json:"dispute_id"`
+	TransactionID      string  `json:"transaction_id"`
+	SubscriptionID     string  `json:"subscription_id,omitempty"`
+	Processor          string  `json:"processor"`
+	ProcessorDisputeID string  `json:"processor_dispute_id"`
+	ReasonCode         string  `json:"reason_code"`
+	Reason             string  `json:"reason,omitempty"`
+	Amount             float64 `json:"amount"`
+	AmountMinor        int64   `json:"amount_minor"`
+	Currency           string  `json:"currency"`
+	Status             string  `json:"status"`
+	EvidenceDueBy      string  `json:"evidence_due_by,omitempty"`
+}
+
 // SubscriptionData represents subscription event data
 type SubscriptionData struct {
 	SubscriptionID string  `json:"subscription_id"`
@@ -92,6 +131,7 @@ type SubscriptionData struct {
 	PlanID         string  `json:"plan_id"`
 	PlanName       string  `json:"plan_name,omitempty"`
 	Amount         float64 `json:"amount"`
+	AmountMinor    int64   `json:"amount_minor"`
 	Currency       string  `json:"currency"`
 	Status         string  `json:"status"`
 	PreviousPlanID string  `json:"previous_plan_id,omitempty"`
@@ -118,6 +158,8 @@ type HealthData struct {
 	Status      string `json:"status"`
 	SuccessRate float64 `json:"success_rate,omitempty"`
 	Latency     string `json:"latency,omitempty"`
+	CircuitState string `json:"circuit_state,omitempty"`
+	Reason      string `json:"reason,omitempty"`
 }
 
 // HeartbeatData represents heartbeat data
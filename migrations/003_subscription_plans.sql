@@ -6,7 +6,7 @@ CREATE TABLE IF NOT EXISTS plans (
     id VARCHAR(50) PRIMARY KEY,
     name VARCHAR(100) NOT NULL,
     display_name VARCHAR(100) NOT NULL,
-    amount BIGINT NOT NULL, -- Amount in cents
+    amount BIGINT NOT NULL, -- Amount in minor units of currency
     currency VARCHAR(3) NOT NULL DEFAULT 'USD',
     interval VARCHAR(20) NOT NULL, -- monthly, yearly
     trial_days INTEGER NOT NULL DEFAULT 0,
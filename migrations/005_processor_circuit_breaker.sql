@@ -0,0 +1,13 @@
+-- Migration 005: Circuit breaker state on processor_health
+-- Records the breaker state of each processor and why it last changed
+
+ALTER TABLE processor_health ADD COLUMN IF NOT EXISTS circuit_state VARCHAR(20) NOT NULL DEFAULT 'closed';
+ALTER TABLE processor_health ADD COLUMN IF NOT EXISTS state_reason TEXT;
+ALTER TABLE processor_health ADD COLUMN IF NOT EXISTS state_changed_at TIMESTAMP DEFAULT NOW();
+
+ALTER TABLE processor_health DROP CONSTRAINT IF EXISTS chk_circuit_state;
+ALTER TABLE processor_health ADD CONSTRAINT chk_circuit_state
+    CHECK (circuit_state IN ('closed', 'open', 'half_open'));
+
+COMMENT ON COLUMN processor_health.circuit_state IS 'Circuit breaker state: closed, open or half_open';
+COMMENT ON COLUMN processor_health.state_reason IS 'Why the breaker last changed state (error rate, latency, probe result)';
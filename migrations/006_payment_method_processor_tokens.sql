@@ -0,0 +1,16 @@
+-- Migration 006: Processor tokens keyed by processor name
+-- Lets a payment method hold vaulted tokens for any configured processor,
+-- not just the processor_a_token/processor_b_token columns
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS processor_tokens JSONB NOT NULL DEFAULT '{}';
+
+-- Backfill from the legacy per-processor columns
+UPDATE payment_methods
+SET processor_tokens = jsonb_strip_nulls(jsonb_build_object(
+    'processor_a', processor_a_token,
+    'processor_b', processor_b_token
+))
+WHERE processor_tokens = '{}'
+  AND (processor_a_token IS NOT NULL OR processor_b_token IS NOT NULL);
+
+COMMENT ON COLUMN payment_methods.processor_tokens IS 'Vaulted processor tokens keyed by processor name, e.g. {"processor_c": "tok_..."}';
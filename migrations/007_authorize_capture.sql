@@ -0,0 +1,21 @@
+-- Migration 007: Authorize / capture / void
+-- Authorizations are stored as transactions of type 'authorization'; captures
+-- and voids reference them through original_transaction_id
+
+-- Running total of captures against an authorization
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS captured_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+-- When the processor releases the hold
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS auth_expires_at TIMESTAMP;
+
+-- Open authorizations, for the expiry sweep
+CREATE INDEX IF NOT EXISTS idx_transactions_open_authorizations
+    ON transactions(auth_expires_at)
+    WHERE transaction_type = 'authorization' AND status IN ('authorized', 'partially_captured');
+
+-- Captures, voids and refunds looked up by their parent transaction
+CREATE INDEX IF NOT EXISTS idx_transactions_original ON transactions(original_transaction_id);
+
+COMMENT ON COLUMN transactions.transaction_type IS 'charge, refund, authorization, capture or void';
+COMMENT ON COLUMN transactions.captured_amount IS 'Total captured so far (authorizations only)';
+COMMENT ON COLUMN transactions.auth_expires_at IS 'When the authorization hold expires (authorizations only)';
@@ -0,0 +1,23 @@
+-- Migration 008: Idempotency keys
+-- Holds the in-flight lock and stored response for each idempotency key,
+-- plus a hash of the request so a reused key with a different payload can be
+-- rejected. The row alone decides who holds a key; Redis only caches
+-- completed responses for replay
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key VARCHAR(255) PRIMARY KEY,
+    scope VARCHAR(50) NOT NULL, -- charge, authorize, capture, void
+    request_hash CHAR(64) NOT NULL, -- SHA-256 of the request body
+    status VARCHAR(20) NOT NULL DEFAULT 'in_flight'
+        CHECK (status IN ('in_flight', 'completed')),
+    response_code INTEGER,
+    response_body JSONB,
+    locked_until TIMESTAMP, -- An in-flight lock past this time can be taken over
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at);
+
+COMMENT ON TABLE idempotency_keys IS 'Idempotency locks and stored responses; the row decides who holds a key, Redis only caches completed responses';
+COMMENT ON COLUMN idempotency_keys.expires_at IS 'When the key can be reused; set from IDEMPOTENCY_RETENTION';
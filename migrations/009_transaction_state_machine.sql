@@ -0,0 +1,21 @@
+-- Migration 009: Transaction state machine
+-- Charges are written as 'pending' before they are sent to a processor and
+-- move to success, failed or unknown. A background recoverer settles
+-- transactions left pending or unknown by asking the processors.
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW();
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS recovery_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS last_recovery_at TIMESTAMP;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_transaction_status;
+ALTER TABLE transactions ADD CONSTRAINT chk_transaction_status
+    CHECK (status IN ('pending', 'success', 'failed', 'unknown', 'refunded',
+                      'authorized', 'partially_captured', 'captured', 'voided', 'expired'));
+
+-- Transactions the recoverer needs to look at
+CREATE INDEX IF NOT EXISTS idx_transactions_unsettled
+    ON transactions(created_at)
+    WHERE status IN ('pending', 'unknown');
+
+COMMENT ON COLUMN transactions.status IS 'pending, success, failed or unknown; authorizations use authorized, partially_captured, captured, voided or expired';
+COMMENT ON COLUMN transactions.recovery_attempts IS 'Times the recoverer has asked processors for the outcome of a stuck transaction';
@@ -0,0 +1,28 @@
+-- Migration 010: Refund ledger
+-- Refunds are transactions of type 'refund' with a positive amount that
+-- reference the charge (or capture) through original_transaction_id. The
+-- original keeps a running total so the refundable balance can be checked
+-- under a row lock.
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS refunded_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_refunded_amount;
+ALTER TABLE transactions ADD CONSTRAINT chk_refunded_amount
+    CHECK (refunded_amount >= 0 AND refunded_amount <= amount);
+
+-- Refunds were previously stored with status 'refunded'
+UPDATE transactions SET status = 'success'
+WHERE transaction_type = 'refund' AND status = 'refunded';
+
+-- Backfill totals from refunds already recorded
+UPDATE transactions t
+SET refunded_amount = LEAST(t.amount, r.total)
+FROM (
+    SELECT original_transaction_id, SUM(ABS(amount)) AS total
+    FROM transactions
+    WHERE transaction_type = 'refund' AND status = 'success'
+    GROUP BY original_transaction_id
+) r
+WHERE t.id = r.original_transaction_id;
+
+COMMENT ON COLUMN transactions.refunded_amount IS 'Total successfully refunded against this charge or capture';
@@ -0,0 +1,59 @@
+-- Migration 011: Integer minor-unit amounts
+-- Amounts are stored as BIGINT minor units of the row's currency (cents for
+-- USD, yen for JPY, fils for KWD). The DECIMAL columns are still written for
+-- one release so older readers keep working, then will be dropped.
+
+-- Minor-unit digits per ISO 4217 currency; keep in sync with internal/money
+CREATE OR REPLACE FUNCTION currency_exponent(code TEXT) RETURNS INTEGER AS $$
+    SELECT CASE upper(code)
+        WHEN 'JPY' THEN 0 WHEN 'KRW' THEN 0 WHEN 'VND' THEN 0 WHEN 'CLP' THEN 0
+        WHEN 'ISK' THEN 0 WHEN 'HUF' THEN 0 WHEN 'UGX' THEN 0 WHEN 'XAF' THEN 0
+        WHEN 'XOF' THEN 0
+        WHEN 'KWD' THEN 3 WHEN 'BHD' THEN 3 WHEN 'OMR' THEN 3 WHEN 'JOD' THEN 3
+        WHEN 'TND' THEN 3 WHEN 'LYD' THEN 3 WHEN 'IQD' THEN 3
+        ELSE 2
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Legacy columns need a third decimal for KWD-style currencies
+ALTER TABLE transactions ALTER COLUMN amount TYPE DECIMAL(15,3);
+ALTER TABLE transactions ALTER COLUMN captured_amount TYPE DECIMAL(15,3);
+ALTER TABLE transactions ALTER COLUMN refunded_amount TYPE DECIMAL(15,3);
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS amount_minor BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS captured_amount_minor BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS refunded_amount_minor BIGINT NOT NULL DEFAULT 0;
+
+UPDATE transactions
+SET amount_minor = ROUND(amount * power(10, currency_exponent(currency))),
+    captured_amount_minor = ROUND(captured_amount * power(10, currency_exponent(currency))),
+    refunded_amount_minor = ROUND(refunded_amount * power(10, currency_exponent(currency)))
+WHERE amount_minor IS NULL;
+
+ALTER TABLE transactions ALTER COLUMN amount_minor SET NOT NULL;
+
+-- The refund ceiling is enforced on the exact values
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_refunded_amount;
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_refunded_amount_minor;
+ALTER TABLE transactions ADD CONSTRAINT chk_refunded_amount_minor
+    CHECK (refunded_amount_minor >= 0 AND refunded_amount_minor <= amount_minor);
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_amount_minor_positive;
+ALTER TABLE transactions ADD CONSTRAINT chk_amount_minor_positive CHECK (amount_minor > 0);
+
+-- subscriptions.amount is used by the active_retries view, so it keeps its type
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS amount_minor BIGINT;
+
+UPDATE subscriptions
+SET amount_minor = ROUND(amount * power(10, currency_exponent(currency)))
+WHERE amount_minor IS NULL;
+
+ALTER TABLE subscriptions ALTER COLUMN amount_minor SET NOT NULL;
+
+COMMENT ON COLUMN transactions.amount_minor IS 'Amount in minor units of currency';
+COMMENT ON COLUMN transactions.captured_amount_minor IS 'Total captured so far in minor units (authorizations only)';
+COMMENT ON COLUMN transactions.refunded_amount_minor IS 'Total successfully refunded in minor units';
+COMMENT ON COLUMN subscriptions.amount_minor IS 'Recurring amount in minor units of currency';
+COMMENT ON COLUMN plans.amount IS 'Price in minor units of currency (2900 = 29.00 USD, 2900 = 2900 JPY)';
+COMMENT ON COLUMN transactions.amount IS 'Deprecated: use amount_minor';
+COMMENT ON COLUMN subscriptions.amount IS 'Deprecated: use amount_minor';
@@ -0,0 +1,36 @@
+-- Migration 012: Presentment vs settlement currency
+-- amount_minor/currency stay the presentment amount the customer is charged.
+-- The settlement columns hold what the merchant receives and the exchange
+-- rate used to get there. Refunds, captures and voids copy the rate of the
+-- transaction they reference.
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS settlement_currency VARCHAR(3);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS settlement_amount_minor BIGINT;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate NUMERIC(20,10);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_mid_rate NUMERIC(20,10);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_markup_bps INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate_as_of TIMESTAMP;
+
+-- Everything before this settled in the presentment currency
+UPDATE transactions
+SET settlement_currency = currency,
+    settlement_amount_minor = amount_minor,
+    fx_rate = 1,
+    fx_mid_rate = 1
+WHERE settlement_currency IS NULL;
+
+ALTER TABLE transactions ALTER COLUMN settlement_currency SET NOT NULL;
+ALTER TABLE transactions ALTER COLUMN settlement_amount_minor SET NOT NULL;
+ALTER TABLE transactions ALTER COLUMN fx_rate SET NOT NULL;
+ALTER TABLE transactions ALTER COLUMN fx_mid_rate SET NOT NULL;
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_fx_rate_positive;
+ALTER TABLE transactions ADD CONSTRAINT chk_fx_rate_positive CHECK (fx_rate > 0 AND fx_mid_rate > 0);
+
+CREATE INDEX IF NOT EXISTS idx_transactions_created_currency ON transactions(created_at, currency);
+
+COMMENT ON COLUMN transactions.settlement_currency IS 'Currency the merchant is paid in';
+COMMENT ON COLUMN transactions.settlement_amount_minor IS 'Amount the merchant receives, in minor units of settlement_currency';
+COMMENT ON COLUMN transactions.fx_rate IS 'Effective presentment-to-settlement rate after markup; 1 when no conversion';
+COMMENT ON COLUMN transactions.fx_mid_rate IS 'Mid-market rate before markup';
+COMMENT ON COLUMN transactions.fx_rate_as_of IS 'Timestamp of the rate table entry used';
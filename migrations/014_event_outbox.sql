@@ -0,0 +1,24 @@
+-- Migration 014: Transactional event outbox
+-- Services write events here in the same transaction as the change they
+-- describe. The orchestrator's relay numbers committed events in order and
+-- publishes them to WebSocket clients and webhooks, at least once.
+
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id BIGSERIAL PRIMARY KEY,                   -- Insert order, which may differ from commit order
+    event_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    sequence BIGINT UNIQUE,                     -- Assigned by the relay once the event is committed
+    source VARCHAR(50) NOT NULL,                -- Service that wrote the event
+    event_type VARCHAR(50) NOT NULL,            -- transaction, subscription, scheduler
+    event_name VARCHAR(50) NOT NULL,            -- charge_succeeded, created, retry_failed, ...
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    sequenced_at TIMESTAMP,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_outbox_unsequenced ON event_outbox(id) WHERE sequence IS NULL;
+CREATE INDEX IF NOT EXISTS idx_event_outbox_unpublished ON event_outbox(sequence) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_event_outbox_created ON event_outbox(created_at) WHERE published_at IS NOT NULL;
+
+COMMENT ON TABLE event_outbox IS 'Events written with their state change and relayed in sequence order';
+COMMENT ON COLUMN event_outbox.sequence IS 'Gapless publication order; consumers replay with GET /events?after=<sequence>';
@@ -0,0 +1,7 @@
+-- Migration 015: Indexes for transaction search
+-- GET /transactions pages with keyset cursors on (created_at, id) or
+-- (amount_minor, id), and filters by payment method.
+
+CREATE INDEX IF NOT EXISTS idx_transactions_created_id ON transactions(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_amount_id ON transactions(amount_minor, id);
+CREATE INDEX IF NOT EXISTS idx_transactions_payment_method ON transactions(payment_method_id, created_at);
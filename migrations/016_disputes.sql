@@ -0,0 +1,35 @@
+-- Migration 016: Chargebacks and disputes
+-- Processors notify the orchestrator when a cardholder disputes a payment.
+-- A dispute moves needs_response -> under_review once evidence is submitted,
+-- then to won or lost; a dispute left unanswered past its deadline is lost.
+
+CREATE TABLE IF NOT EXISTS disputes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    subscription_id UUID, -- Copied from the transaction; put past_due when the dispute is lost
+    processor VARCHAR(50) NOT NULL,
+    processor_dispute_id VARCHAR(255) NOT NULL,
+    reason_code VARCHAR(20) NOT NULL,
+    reason TEXT,
+    amount_minor BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'needs_response',
+    evidence_due_by TIMESTAMP NOT NULL,
+    evidence JSONB,
+    evidence_submitted_at TIMESTAMP,
+    resolved_at TIMESTAMP,
+    subscription_synced_at TIMESTAMP, -- When the subscription service put the subscription past due, or refused for good
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT chk_dispute_status CHECK (status IN ('needs_response', 'under_review', 'won', 'lost')),
+    CONSTRAINT chk_dispute_amount CHECK (amount_minor > 0),
+    CONSTRAINT uq_dispute_processor UNIQUE (processor, processor_dispute_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_disputes_transaction ON disputes(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_disputes_status ON disputes(status, evidence_due_by);
+CREATE INDEX IF NOT EXISTS idx_disputes_subscription_sync ON disputes(updated_at)
+    WHERE status = 'lost' AND subscription_id IS NOT NULL AND subscription_synced_at IS NULL;
+
+-- Disputes are found by the processor's transaction ID
+CREATE INDEX IF NOT EXISTS idx_transactions_processor_tx ON transactions(processor_used, processor_transaction_id);
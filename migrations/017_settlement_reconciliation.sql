@@ -0,0 +1,66 @@
+-- Migration 017: Settlement reconciliation
+-- Each run ingests one processor's daily settlement file, keeps its lines,
+-- and matches them against transactions.processor_transaction_id. Anything
+-- that doesn't line up is recorded as a discrepancy:
+--   missing          we recorded a successful transaction the processor did not settle
+--   extra            the processor settled a transaction we have no record of
+--   amount_mismatch  amount or currency differ
+--   status_mismatch  the processor settled it but our record is not successful,
+--                    or the transaction types differ
+
+CREATE TABLE IF NOT EXISTS reconciliation_runs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    processor VARCHAR(50) NOT NULL,
+    settlement_date DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'running',
+    record_count INTEGER NOT NULL DEFAULT 0,
+    matched_count INTEGER NOT NULL DEFAULT 0,
+    missing_count INTEGER NOT NULL DEFAULT 0,
+    extra_count INTEGER NOT NULL DEFAULT 0,
+    amount_mismatch_count INTEGER NOT NULL DEFAULT 0,
+    status_mismatch_count INTEGER NOT NULL DEFAULT 0,
+    totals JSONB NOT NULL DEFAULT '{}', -- Gross, fees and net settled per currency
+    error TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP,
+    CONSTRAINT chk_reconciliation_status CHECK (status IN ('running', 'completed', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_reconciliation_runs_day ON reconciliation_runs(processor, settlement_date, started_at DESC);
+
+CREATE TABLE IF NOT EXISTS settlement_records (
+    id BIGSERIAL PRIMARY KEY,
+    run_id UUID NOT NULL REFERENCES reconciliation_runs(id) ON DELETE CASCADE,
+    processor_transaction_id VARCHAR(255) NOT NULL,
+    original_processor_transaction_id VARCHAR(255),
+    record_type VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    fee_minor BIGINT NOT NULL,
+    net_minor BIGINT NOT NULL,
+    processed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_settlement_records_run ON settlement_records(run_id);
+CREATE INDEX IF NOT EXISTS idx_settlement_records_processor_tx ON settlement_records(processor_transaction_id);
+
+CREATE TABLE IF NOT EXISTS reconciliation_discrepancies (
+    id BIGSERIAL PRIMARY KEY,
+    run_id UUID NOT NULL REFERENCES reconciliation_runs(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    processor_transaction_id VARCHAR(255) NOT NULL,
+    transaction_id UUID REFERENCES transactions(id),
+    recorded_type VARCHAR(20),
+    recorded_status VARCHAR(20),
+    recorded_amount_minor BIGINT,
+    recorded_currency VARCHAR(3),
+    settled_type VARCHAR(20),
+    settled_status VARCHAR(20),
+    settled_amount_minor BIGINT,
+    settled_currency VARCHAR(3),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT chk_discrepancy_kind CHECK (kind IN ('missing', 'extra', 'amount_mismatch', 'status_mismatch'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_reconciliation_discrepancies_run ON reconciliation_discrepancies(run_id, kind);
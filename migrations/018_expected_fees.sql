@@ -0,0 +1,19 @@
+-- Migration 018: Expected processor fees
+-- Every transaction records the fee its processor is expected to charge,
+-- estimated from configs/fee-schedules.yaml, in minor units of the
+-- transaction currency. Processors only charge for charges and captures;
+-- authorizations, voids and refunds record zero. The estimate follows the
+-- charge when it fails over to another processor.
+--
+-- Payment methods gain the card brand and issuing country, which fee
+-- schedules price differently (brand overrides, cross-border surcharges).
+-- Both are optional; without them the base rate applies.
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS expected_fee_minor BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS card_brand VARCHAR(20);
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS card_country VARCHAR(2);
+
+-- Approval rates per processor are computed over recent charges for routing
+CREATE INDEX IF NOT EXISTS idx_transactions_processor_recent ON transactions(processor_used, created_at)
+    WHERE transaction_type IN ('charge', 'authorization');
@@ -0,0 +1,26 @@
+-- Migration 019: Audit log of outbound calls
+-- Every call the orchestrator makes to a processor, BPAS, the network token
+-- service or the subscription service, with its latency and outcome.
+-- Payloads are stored with card numbers, security codes and token values
+-- masked, and cut at 16 KiB. Entries are kept for AUDIT_RETENTION and then
+-- purged. transaction_id has no foreign key: entries are written
+-- asynchronously and may land before the transaction they belong to.
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    transaction_id UUID,
+    event_type VARCHAR(30) NOT NULL, -- processor, bpas, network_token, subscription
+    processor VARCHAR(50) NOT NULL,  -- Service called, e.g. processor_a
+    method VARCHAR(10) NOT NULL,
+    endpoint TEXT NOT NULL,
+    status_code INTEGER,             -- NULL when no response arrived
+    latency_ms INTEGER NOT NULL,
+    error TEXT,
+    request_payload JSONB,
+    response_payload JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_transaction ON audit_logs(transaction_id, created_at)
+    WHERE transaction_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_audit_logs_created ON audit_logs(created_at DESC, id DESC);
@@ -0,0 +1,8 @@
+-- Migration 020: Stored credentials
+-- Card networks require merchant-initiated charges (MITs) to reference the
+-- network transaction ID of the customer-initiated charge (CIT) that first
+-- stored the card. It is recorded on the payment method when that initial
+-- charge succeeds.
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_transaction_id VARCHAR(50);
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_transaction_id_at TIMESTAMP;
@@ -0,0 +1,26 @@
+-- Migration 021: 3-D Secure challenges
+-- A charge the issuer wants authenticated waits in requires_action until
+-- the processor reports the cardholder's challenge is over, or until
+-- THREE_DS_TIMEOUT passes. The stored credential flags are kept so a CIT
+-- that stores the card can record its network transaction ID once it settles.
+
+ALTER TABLE transactions DROP CONSTRAINT IF EXISTS chk_transaction_status;
+ALTER TABLE transactions ADD CONSTRAINT chk_transaction_status
+    CHECK (status IN ('pending', 'success', 'failed', 'unknown', 'refunded',
+                      'authorized', 'partially_captured', 'captured', 'voided', 'expired',
+                      'requires_action'));
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS stored_credential JSONB;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS three_ds_exemption VARCHAR(20);   -- low_value, mit or tra
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS three_ds_challenge_id VARCHAR(64);
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS three_ds_redirect_url TEXT;
+
+-- Processor notifications find the charge by challenge
+CREATE INDEX IF NOT EXISTS idx_transactions_three_ds_challenge
+    ON transactions(processor_used, three_ds_challenge_id)
+    WHERE three_ds_challenge_id IS NOT NULL;
+
+-- Charges the expiry job looks at
+CREATE INDEX IF NOT EXISTS idx_transactions_requires_action
+    ON transactions(updated_at)
+    WHERE status = 'requires_action';
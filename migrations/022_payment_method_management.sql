@@ -0,0 +1,13 @@
+-- Migration 022: Payment method management
+-- Cards are attached through the orchestrator's /payment-methods API, which
+-- tokenizes them with the network token service. A detached method is kept
+-- for the transactions that reference it but can no longer be charged.
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;  -- Passed a zero-amount verification
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS detached_at TIMESTAMP;
+
+-- New methods are only the default when asked for, or when they're the user's first
+ALTER TABLE payment_methods ALTER COLUMN is_default SET DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_user_active
+    ON payment_methods(user_id, created_at DESC) WHERE detached_at IS NULL;
@@ -0,0 +1,18 @@
+-- Migration 023: Proactive card refresh
+-- The MIT scheduler asks the network token service (an account updater
+-- stand-in) for new expiries of cards that lapse before their
+-- subscription's next billing date. Cards it can't refresh are flagged so
+-- the customer can be asked for a new one.
+
+-- The expiry check compared against the current year, which rejected any
+-- update to a row once its card had expired, including the refresh itself
+ALTER TABLE payment_methods DROP CONSTRAINT IF EXISTS chk_exp_year_valid;
+ALTER TABLE payment_methods ADD CONSTRAINT chk_exp_year_valid CHECK (exp_year BETWEEN 2000 AND 2100);
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS refresh_attempted_at TIMESTAMP;
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS refreshed_at TIMESTAMP;
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS update_required_at TIMESTAMP;    -- Flagged for customer outreach
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS update_required_reason VARCHAR(50); -- ACCOUNT_CLOSED, NO_UPDATE_AVAILABLE, ...
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_update_required
+    ON payment_methods(update_required_at) WHERE update_required_at IS NOT NULL;
@@ -0,0 +1,23 @@
+-- Migration 024: Network token lifecycle
+-- The network token service notifies the orchestrator when a card network
+-- suspends, resumes or deletes a token, or moves it to a reissued card.
+-- Suspended and deleted tokens are no longer charged, and subscriptions
+-- billed through them are flagged so the customer can provide a new
+-- payment method.
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS token_status VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS token_status_reason VARCHAR(50); -- lost_card, account_closed, ...
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS token_updated_at TIMESTAMP;       -- When the last applied notification happened
+
+ALTER TABLE payment_methods DROP CONSTRAINT IF EXISTS chk_token_status_valid;
+ALTER TABLE payment_methods ADD CONSTRAINT chk_token_status_valid
+    CHECK (token_status IN ('active', 'suspended', 'deleted'));
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_network_token
+    ON payment_methods(network_token) WHERE network_token IS NOT NULL;
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_method_required_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS payment_method_required_reason VARCHAR(50); -- token_suspended, token_deleted
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_payment_method_required
+    ON subscriptions(payment_method_required_at) WHERE payment_method_required_at IS NOT NULL;
@@ -0,0 +1,29 @@
+-- Migration 025: Network token vault
+-- The network token service kept its tokens in memory and lost them on
+-- restart. With TOKEN_STORE=postgres it keeps them here, shared by every
+-- replica. Each record is encrypted (AES-256-GCM) with a key derived from
+-- TOKEN_STORE_KEY; tokens, processor tokens and card fingerprints are only
+-- stored as keyed hashes for lookups.
+
+CREATE TABLE IF NOT EXISTS network_token_vault (
+    token_index VARCHAR(64) PRIMARY KEY,   -- HMAC of the network token
+    processor_a_index VARCHAR(64),         -- HMAC of the dual-vault processor tokens
+    processor_b_index VARCHAR(64),
+    fingerprint VARCHAR(64),               -- Same for every token of a card
+    record BYTEA NOT NULL,                 -- Nonce followed by the sealed token
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_network_token_vault_processor_a
+    ON network_token_vault(processor_a_index) WHERE processor_a_index IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_network_token_vault_processor_b
+    ON network_token_vault(processor_b_index) WHERE processor_b_index IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_network_token_vault_fingerprint
+    ON network_token_vault(fingerprint) WHERE fingerprint IS NOT NULL;
+
+-- Request counters behind GET /admin/stats
+CREATE TABLE IF NOT EXISTS network_token_stats (
+    name VARCHAR(50) PRIMARY KEY,
+    value BIGINT NOT NULL DEFAULT 0
+);
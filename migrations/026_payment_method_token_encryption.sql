@@ -0,0 +1,26 @@
+-- Migration 026: Payment method token encryption
+-- network_token, processor_a_token, processor_b_token and the values of
+-- processor_tokens are encrypted with a data key of their own per row. The
+-- data key is stored wrapped by the master key version in token_key_version.
+-- Rows without a version were written before encryption and are read as is
+-- until cmd/token-rekey encrypts them.
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS token_key_version INTEGER;
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS wrapped_data_key BYTEA;
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_token_hash VARCHAR(64); -- HMAC of the network token, for lookups
+
+-- Ciphertext is longer than the tokens it replaces
+ALTER TABLE payment_methods ALTER COLUMN network_token TYPE TEXT;
+ALTER TABLE payment_methods ALTER COLUMN processor_a_token TYPE TEXT;
+ALTER TABLE payment_methods ALTER COLUMN processor_b_token TYPE TEXT;
+
+ALTER TABLE payment_methods DROP CONSTRAINT IF EXISTS chk_token_key_envelope;
+ALTER TABLE payment_methods ADD CONSTRAINT chk_token_key_envelope
+    CHECK ((token_key_version IS NULL) = (wrapped_data_key IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_network_token_hash
+    ON payment_methods(network_token_hash) WHERE network_token_hash IS NOT NULL;
+
+-- Rows still to be encrypted or re-encrypted under a new master key
+CREATE INDEX IF NOT EXISTS idx_payment_methods_token_key_version
+    ON payment_methods(token_key_version);
@@ -0,0 +1,27 @@
+-- Migration 027: Dual-vault to network token migration
+-- The orchestrator periodically asks the network token service to retry
+-- network tokenization for payment methods that fell back to the dual vault.
+-- Migrated methods keep their processor tokens as a fallback.
+
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_token_attempted_at TIMESTAMP;       -- Last migration attempt
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_token_attempt_result VARCHAR(50);   -- migrated, or why it failed (ISSUER_NOT_PARTICIPATING, ...)
+ALTER TABLE payment_methods ADD COLUMN IF NOT EXISTS network_token_migrated_at TIMESTAMP;        -- When a dual-vault method got a network token
+
+CREATE INDEX IF NOT EXISTS idx_payment_methods_dual_vault
+    ON payment_methods(id) WHERE token_type = 'dual_vault' AND detached_at IS NULL;
+
+-- Where the migration is in its pass through the dual-vault methods, so a
+-- restart resumes there. The lease keeps replicas from running it twice.
+CREATE TABLE IF NOT EXISTS token_migration_checkpoints (
+    name VARCHAR(50) PRIMARY KEY,          -- dual_vault_to_network
+    cursor_id UUID,                        -- Last payment method tried; NULL between passes
+    pass_started_at TIMESTAMP,
+    pass_completed_at TIMESTAMP,
+    pass_attempted INTEGER NOT NULL DEFAULT 0,
+    pass_migrated INTEGER NOT NULL DEFAULT 0,
+    pass_failed INTEGER NOT NULL DEFAULT 0,
+    passes_completed INTEGER NOT NULL DEFAULT 0,
+    lease_owner VARCHAR(64),
+    lease_expires_at TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -8,10 +8,10 @@ VALUES
 ON CONFLICT (id) DO NOTHING;
 
 -- Seed test subscriptions
-INSERT INTO subscriptions (id, user_id, status, plan_id, amount, currency, billing_cycle)
+INSERT INTO subscriptions (id, user_id, status, plan_id, amount, amount_minor, currency, billing_cycle)
 VALUES
-  ('sub_test_123', 'user_test_123', 'active', 'premium_monthly', 999, 'USD', 'monthly'),
-  ('sub_test_456', 'user_test_456', 'active', 'basic_monthly', 499, 'USD', 'monthly'),
-  ('sub_manual_test', 'user_manual_test', 'active', 'premium_monthly', 1999, 'USD', 'monthly'),
-  ('sub_failover_test', 'user_failover_test', 'active', 'premium_monthly', 999, 'EUR', 'monthly')
+  ('sub_test_123', 'user_test_123', 'active', 'premium_monthly', 999, 99900, 'USD', 'monthly'),
+  ('sub_test_456', 'user_test_456', 'active', 'basic_monthly', 499, 49900, 'USD', 'monthly'),
+  ('sub_manual_test', 'user_manual_test', 'active', 'premium_monthly', 1999, 199900, 'USD', 'monthly'),
+  ('sub_failover_test', 'user_failover_test', 'active', 'premium_monthly', 999, 99900, 'EUR', 'monthly')
 ON CONFLICT (id) DO NOTHING;
\ No newline at end of file